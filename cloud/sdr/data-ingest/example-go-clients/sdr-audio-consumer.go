@@ -0,0 +1,370 @@
+// Example for consuming the audio messages that sdr2evtstreams produces to IBM Event Streams (kafka), and
+// storing the audio and its metadata in a directory or in IBM Cloud Object Storage.
+// See README.md for setup requirements.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"             // doc: https://godoc.org/github.com/Shopify/sarama
+	cluster "github.com/bsm/sarama-cluster" // doc: http://godoc.org/github.com/bsm/sarama-cluster
+	"github.com/open-horizon/examples/cloud/sdr/data-ingest/example-go-clients/util"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+func Usage(exitCode int) {
+	fmt.Printf("Usage: %s [-t <topic>] [-g <group>] [-h] [-v]\n\nEnvironment Variables: MSGHUB_API_KEY, MSGHUB_BROKER_URL, MSGHUB_TOPIC, OUTPUT_DIR, COS_ENDPOINT, COS_BUCKET, COS_REGION, COS_ACCESS_KEY_ID, COS_SECRET_ACCESS_KEY, SIGNING_KEYS_DIR, REQUIRE_SIGNATURES, AUDIO_DECRYPTION_KEYS, FRAGMENT_TIMEOUT\n", os.Args[0])
+	os.Exit(exitCode)
+}
+
+// ingester checks, reassembles, decrypts and stores the audio messages.
+type ingester struct {
+	Store util.ObjectStore
+	// SigningKeysDir holds the PEM Ed25519 public key of each node, in a file named by its signatureKeyID with
+	// each "/" replaced by "_", and ".pem" added.
+	SigningKeysDir    string
+	RequireSignatures bool
+	// DecryptionKeys are the AES-GCM ciphers of the audio by keyID.
+	DecryptionKeys  map[string]cipher.AEAD
+	FragmentTimeout time.Duration
+	signingKeys     map[string]ed25519.PublicKey
+	captures        map[string]*partialCapture
+}
+
+// partialCapture holds the fragments of a capture that were received so far, by their Seq.
+type partialCapture struct {
+	Fragments map[int]*audiolib.AudioMsg
+	FirstSeen time.Time
+}
+
+// audioMetadata is what is stored next to each audio file, the message without its audio.
+type audioMetadata struct {
+	audiolib.AudioMsg
+	// Audio hides the audio of AudioMsg, it is always empty.
+	Audio       string `json:"audio,omitempty"`
+	AudioObject string `json:"audioObject"`
+	// SignedBy is the signatureKeyID of the node whose signature was verified, empty if it wasn't signed.
+	SignedBy  string `json:"signedBy,omitempty"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+func main() {
+	// Get all of the input options
+	var topic, group string
+	flag.StringVar(&topic, "t", "", "topic")
+	flag.StringVar(&group, "g", "sdr-audio-ingest", "consumer group")
+	var help bool
+	flag.BoolVar(&help, "h", false, "help")
+	flag.BoolVar(&util.VerboseBool, "v", false, "verbose")
+	flag.Parse()
+	if help {
+		Usage(1)
+	}
+
+	// Event Streams, which sdr2evtstreams publishes to, takes the user name token and the api key as the password.
+	apiKey := util.RequiredEnvVar("MSGHUB_API_KEY", "")
+	brokers := strings.Split(util.RequiredEnvVar("MSGHUB_BROKER_URL", ""), ",")
+	if topic == "" {
+		topic = util.RequiredEnvVar("MSGHUB_TOPIC", "sdr-audio")
+	}
+
+	in := &ingester{
+		SigningKeysDir:    os.Getenv("SIGNING_KEYS_DIR"),
+		RequireSignatures: os.Getenv("REQUIRE_SIGNATURES") == "true",
+		DecryptionKeys:    map[string]cipher.AEAD{},
+		FragmentTimeout:   10 * time.Minute,
+		signingKeys:       map[string]ed25519.PublicKey{},
+		captures:          map[string]*partialCapture{},
+	}
+	if in.RequireSignatures && in.SigningKeysDir == "" {
+		util.ExitOnErr(errors.New("REQUIRE_SIGNATURES=true needs SIGNING_KEYS_DIR"))
+	}
+	if timeout := os.Getenv("FRAGMENT_TIMEOUT"); timeout != "" {
+		var err error
+		in.FragmentTimeout, err = time.ParseDuration(timeout)
+		util.ExitOnErr(err)
+	}
+	// AUDIO_DECRYPTION_KEYS is a comma separated list of keyID:base64key, an entry without a keyID is the key
+	// of the audio encrypted without one.
+	if keys := os.Getenv("AUDIO_DECRYPTION_KEYS"); keys != "" {
+		for _, entry := range strings.Split(keys, ",") {
+			keyID, encoded := "", entry
+			if i := strings.LastIndex(entry, ":"); i >= 0 {
+				keyID, encoded = entry[:i], entry[i+1:]
+			}
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			util.ExitOnErr(err)
+			in.DecryptionKeys[keyID], err = audiolib.NewAudioCipher(key)
+			util.ExitOnErr(err)
+		}
+	}
+	if bucket := os.Getenv("COS_BUCKET"); bucket != "" {
+		in.Store = &util.COSStore{
+			Endpoint:        util.RequiredEnvVar("COS_ENDPOINT", "https://s3.us-south.cloud-object-storage.appdomain.cloud"),
+			Bucket:          bucket,
+			Region:          util.RequiredEnvVar("COS_REGION", "us-south"),
+			AccessKeyID:     util.RequiredEnvVar("COS_ACCESS_KEY_ID", ""),
+			SecretAccessKey: util.RequiredEnvVar("COS_SECRET_ACCESS_KEY", ""),
+		}
+		fmt.Printf("Storing the audio in bucket %s\n", bucket)
+	} else {
+		dir := util.RequiredEnvVar("OUTPUT_DIR", "sdr-audio")
+		in.Store = &util.DirStore{Dir: dir}
+		fmt.Printf("Storing the audio in %s\n", dir)
+	}
+
+	util.Verbose("starting sdr audio ingest example...")
+
+	if util.VerboseBool {
+		sarama.Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
+	}
+
+	// init (custom) config, enable errors and notifications, and start with the oldest messages of a new group
+	config := cluster.NewConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Group.Return.Notifications = true
+	err := util.PopulateConfig(&config.Config, "token", apiKey, apiKey) // add creds and tls info
+	util.ExitOnErr(err)
+
+	// init consumer
+	consumer, err := cluster.NewConsumer(brokers, group, []string{topic}, config)
+	util.ExitOnErr(err)
+	defer consumer.Close()
+
+	// trap SIGINT to trigger a shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	// consume errors
+	go func() {
+		for err := range consumer.Errors() {
+			log.Printf("Error: %s\n", err.Error())
+		}
+	}()
+
+	// consume notifications
+	go func() {
+		for ntf := range consumer.Notifications() {
+			if util.VerboseBool {
+				log.Printf("Rebalanced: %+v\n", ntf)
+			}
+		}
+	}()
+
+	// consume messages, watch signals
+	fmt.Printf("Consuming audio messages produced to %s...\n", topic)
+	for {
+		select {
+		case msg, ok := <-consumer.Messages():
+			if ok {
+				if err := in.ingest(msg); err != nil {
+					// a message that can't be stored now never will be, so it is skipped like the others.
+					log.Printf("Error: skipping message at partition %d, offset %d: %s\n", msg.Partition, msg.Offset, err.Error())
+				}
+				consumer.MarkOffset(msg, "") // mark message as processed
+			}
+		case <-signals:
+			return
+		}
+	}
+}
+
+// ingest handles one Kafka message. The fragments of a capture are held until all of them are in, and only
+// then is the capture stored.
+func (in *ingester) ingest(msg *sarama.ConsumerMessage) error {
+	signedBy, err := in.verify(msg)
+	if err != nil {
+		return err
+	}
+	audioMsg, err := decodeAudioMsg(msg.Value)
+	if err != nil {
+		return err
+	}
+	in.expireCaptures()
+	if audioMsg.SeqTotal > 1 {
+		capture := in.captures[audioMsg.CaptureID]
+		if capture == nil {
+			capture = &partialCapture{Fragments: map[int]*audiolib.AudioMsg{}, FirstSeen: time.Now()}
+			in.captures[audioMsg.CaptureID] = capture
+		}
+		capture.Fragments[audioMsg.Seq] = audioMsg
+		util.Verbose("fragment %d of %d of capture %s", audioMsg.Seq, audioMsg.SeqTotal, audioMsg.CaptureID)
+		if len(capture.Fragments) < audioMsg.SeqTotal {
+			return nil
+		}
+		delete(in.captures, audioMsg.CaptureID)
+		var fragments []*audiolib.AudioMsg
+		for _, fragment := range capture.Fragments {
+			fragments = append(fragments, fragment)
+		}
+		audioMsg, err = audiolib.Reassemble(fragments)
+		if err != nil {
+			return err
+		}
+	}
+	return in.store(audioMsg, signedBy, msg)
+}
+
+// verify checks the signature header of msg, and returns the key that signed it, empty if it isn't signed.
+func (in *ingester) verify(msg *sarama.ConsumerMessage) (keyID string, err error) {
+	var signature string
+	for _, header := range msg.Headers {
+		switch string(header.Key) {
+		case "signature":
+			signature = string(header.Value)
+		case "signatureKeyID":
+			keyID = string(header.Value)
+		}
+	}
+	if signature == "" {
+		if in.RequireSignatures {
+			return "", errors.New("the message isn't signed")
+		}
+		return "", nil
+	}
+	if in.SigningKeysDir == "" {
+		// there are no keys to check it with.
+		return "", nil
+	}
+	key, err := in.signingKey(keyID)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, msg.Value, decoded) {
+		return "", fmt.Errorf("the signature of %s doesn't match the message", keyID)
+	}
+	return keyID, nil
+}
+
+// signingKey reads the public key named keyID from SigningKeysDir, once.
+func (in *ingester) signingKey(keyID string) (ed25519.PublicKey, error) {
+	if key, ok := in.signingKeys[keyID]; ok {
+		return key, nil
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(in.SigningKeysDir, strings.Replace(keyID, "/", "_", -1)+".pem"))
+	if err != nil {
+		return nil, fmt.Errorf("no public key for %q: %v", keyID, err)
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("the public key of %q isn't PEM", keyID)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("bad public key for %q: %v", keyID, err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the public key of %q is a %T, not an Ed25519 key", keyID, parsed)
+	}
+	in.signingKeys[keyID] = key
+	return key, nil
+}
+
+// decodeAudioMsg parses value, which is the JSON that sdr2evtstreams produces, its Avro after the zero byte and
+// schema ID of EVTSTREAMS_MESSAGE_FORMAT=avro, or the protobuf of audiomsg.proto.
+func decodeAudioMsg(value []byte) (*audiolib.AudioMsg, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		audioMsg := &audiolib.AudioMsg{}
+		return audioMsg, json.Unmarshal(value, audioMsg)
+	}
+	// a protobuf message never starts with a zero byte, as there is no field 0.
+	if len(value) >= 5 && value[0] == 0 {
+		return audiolib.DecodeAvro(value[5:])
+	}
+	return audiolib.DecodeProto(value)
+}
+
+// expireCaptures drops the captures whose fragments didn't all come in within FragmentTimeout.
+func (in *ingester) expireCaptures() {
+	for captureID, capture := range in.captures {
+		if time.Since(capture.FirstSeen) > in.FragmentTimeout {
+			log.Printf("Error: dropping capture %s, only %d of its fragments came in\n", captureID, len(capture.Fragments))
+			delete(in.captures, captureID)
+		}
+	}
+}
+
+// store decrypts the audio of audioMsg and writes it, with its metadata next to it in a .json object. Gzipped
+// audio is stored uncompressed, so that it is a plain WAV file.
+func (in *ingester) store(audioMsg *audiolib.AudioMsg, signedBy string, msg *sarama.ConsumerMessage) error {
+	if audioMsg.Encryption != "" {
+		aead, ok := in.DecryptionKeys[audioMsg.KeyID]
+		if !ok {
+			return fmt.Errorf("no key in AUDIO_DECRYPTION_KEYS for keyID %q", audioMsg.KeyID)
+		}
+		if err := audioMsg.DecryptAudio(aead); err != nil {
+			return err
+		}
+	}
+	audio, err := base64.StdEncoding.DecodeString(audioMsg.Audio)
+	if err != nil {
+		return err
+	}
+	if audioMsg.ContentEncoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(audio))
+		if err != nil {
+			return err
+		}
+		audio, err = ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		audioMsg.ContentEncoding = ""
+	}
+
+	devID := strings.Replace(audioMsg.DevID, "/", "_", -1)
+	if devID == "" {
+		devID = "unknown"
+	}
+	name := fmt.Sprintf("%s/%d-%d", devID, audioMsg.Ts, audioMsg.Freq)
+	metadata := audioMetadata{AudioMsg: *audioMsg, AudioObject: name + audioExtension(audioMsg.ContentType), SignedBy: signedBy, Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+	err = in.Store.Put(metadata.AudioObject, audio, audioMsg.ContentType)
+	if err != nil {
+		return err
+	}
+	serialized, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = in.Store.Put(name+".json", serialized, "application/json")
+	if err == nil {
+		fmt.Printf("stored %s (%d bytes, station %s, expected value %.2f)\n", metadata.AudioObject, len(audio), audioMsg.Station(), audioMsg.ExpectedValue)
+	}
+	return err
+}
+
+// audioExtension is the file extension of contentType.
+func audioExtension(contentType string) string {
+	switch contentType {
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/flac":
+		return ".flac"
+	case "audio/wav":
+		return ".wav"
+	}
+	return ".bin"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// startAsync replaces the SyncProducer of conn with an AsyncProducer, which batches up to flushMessages messages,
+// or whatever it has every flushFrequency, into each request to the brokers. Publishing then returns as soon
+// as a message is queued. Whether it was sent is only known later, so a message that fails is logged and
+// counted, but isn't retried, spooled or dead lettered.
+func (conn *evtstreamsConn) startAsync(flushMessages int, flushFrequency time.Duration) (err error) {
+	brokers, config, err := newSaramaConfig()
+	if err != nil {
+		return
+	}
+	config.Producer.Flush.Messages = flushMessages
+	config.Producer.Flush.Frequency = flushFrequency
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.Producer.Close()
+	conn.Producer, conn.Async = nil, producer
+	conn.handled = make(chan struct{})
+	go conn.handleAsync(producer)
+	logInfo("publishing asynchronously, in batches of up to", flushMessages, "messages or every", flushFrequency)
+	return
+}
+
+// sendAsync queues audioMsg, it only blocks while the queue of the producer is full.
+func (conn *evtstreamsConn) sendAsync(audioMsg *audiolib.AudioMsg) error {
+	msg, err := conn.producerMessage(audioMsg)
+	if err != nil {
+		return err
+	}
+	msg.Metadata = asyncSend{AudioMsg: audioMsg, At: time.Now()}
+	conn.Async.Input() <- msg
+	return nil
+}
+
+// asyncSend is the Metadata of each message sent by sendAsync, to log it by once the brokers have it.
+type asyncSend struct {
+	AudioMsg *audiolib.AudioMsg
+	At       time.Time
+}
+
+// handleAsync reads the results of the messages from producer until it is closed, and then closes conn.handled.
+func (conn *evtstreamsConn) handleAsync(producer sarama.AsyncProducer) {
+	defer close(conn.handled)
+	successes, errs := producer.Successes(), producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			send := msg.Metadata.(asyncSend)
+			health.set(&health.PublisherConnected, true)
+			logInfo("> message sent", field("freq", send.AudioMsg.Freq), field("topic", msg.Topic), field("partition", msg.Partition), field("offset", msg.Offset), field("latency", time.Since(send.At)))
+		case msgErr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			send := msgErr.Msg.Metadata.(asyncSend)
+			failed := atomic.AddInt64(&conn.FailedSends, 1)
+			metrics.publishFailedLater()
+			health.set(&health.PublisherConnected, false)
+			logError("FAILED to send message:", msgErr.Err, field("freq", send.AudioMsg.Freq), field("latency", time.Since(send.At)), field("failed", failed))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audioconv"
+)
+
+// audioSampleRate and audioBytesPerSample describe the raw mono audio from the sdr service, 16 bit at 16kHz by default.
+// They are set in main via AUDIO_SAMPLE_RATE and AUDIO_BYTES_PER_SAMPLE.
+var audioSampleRate = 16000
+var audioBytesPerSample = 2
+
+// audioChannels is the number of channels of the raw audio, the sdr service only sends mono.
+const audioChannels = 1
+
+// modelAudioFormat is the format of the audio that the model takes, which the captured audio is converted to
+// before it is scored. It is set in main, to capturedAudioFormat unless MODEL_SAMPLE_RATE, MODEL_SAMPLE_FORMAT
+// or MODEL_CHANNELS say otherwise.
+var modelAudioFormat = capturedAudioFormat()
+
+// capturedAudioFormat is the format of the raw audio from the SDR, going by audioSampleRate and audioBytesPerSample.
+func capturedAudioFormat() audioconv.Format {
+	return audioconv.Format{SampleRate: audioSampleRate, Channels: audioChannels, Encoding: audioconv.Encoding(audioSampleFormat())}
+}
+
+// modelAudio converts captured raw audio to modelAudioFormat, it returns audio itself if they are the same.
+func modelAudio(audio []byte) []byte {
+	return audioconv.Convert(audio, capturedAudioFormat(), modelAudioFormat)
+}
+
+// audioCodec is what the audio of each message is encoded with, set in main via AUDIO_CODEC.
+var audioCodec = "mp3"
+
+// audioCodecs are the codecs that AUDIO_CODEC can name.
+var audioCodecs = []string{"mp3", "flac", "wav", "gzip"}
+
+// encodeAudio encodes raw audio with audioCodec as the base64 Audio of a message, with the content type and
+// content encoding that consumers decode it by. mp3 is lossy, flac is lossless, wav is the raw audio
+// in a WAV header, and gzip is that gzipped.
+func encodeAudio(raw []byte) (audio, contentType, contentEncoding string) {
+	switch audioCodec {
+	case "flac":
+		return base64.StdEncoding.EncodeToString(encodeFLAC(raw)), "audio/flac", ""
+	case "wav":
+		return base64.StdEncoding.EncodeToString(wavFile(raw)), "audio/wav", ""
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(wavFile(raw))
+		zw.Close()
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), "audio/wav", "gzip"
+	}
+	return rawToB64Mp3(raw), "audio/mpeg", ""
+}
+
+// audioSampleFormat names the format of the raw samples the way ffmpeg does, like s16le, going by audioBytesPerSample.
+func audioSampleFormat() string {
+	if audioBytesPerSample == 1 {
+		return "u8"
+	}
+	return fmt.Sprintf("s%dle", audioBytesPerSample*8)
+}
+
+// audioChunkSeconds is the length of the audio chunks that the /audio endpoint of the sdr service sends,
+// and the default length of the captures and of the audio the model expects.
+const audioChunkSeconds = 29.328
+
+// captureSeconds is how long each capture of audio is, CAPTURE_SECONDS.
+var captureSeconds = audioChunkSeconds
+
+// expectedAudioBytes is how many bytes of raw audio last durationSeconds.
+func expectedAudioBytes(durationSeconds float64) int {
+	return int(math.Round(durationSeconds*float64(audioSampleRate))) * audioBytesPerSample
+}
+
+// audioDuration is how many seconds raw audio lasts.
+func audioDuration(raw []byte) float32 {
+	return float32(len(raw)/(audioBytesPerSample*audioChannels)) / float32(audioSampleRate)
+}
+
+// minPowerDBFS is the power level of silence, which would otherwise be minus infinity.
+const minPowerDBFS = -120
+
+// audioPowerDBFS is the RMS level of raw audio in dB relative to full scale, 0 for a full scale square wave.
+func audioPowerDBFS(raw []byte) float32 {
+	samples := decodeSamples(raw)
+	var sum float64
+	for _, sample := range samples {
+		sum += sample * sample
+	}
+	if sum == 0 {
+		return minPowerDBFS
+	}
+	return float32(math.Max(minPowerDBFS, 10*math.Log10(sum/float64(len(samples)))))
+}
+
+// audioBuffers holds buffers of a chunk of raw audio each, so that every capture doesn't allocate a new one.
+var audioBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, expectedAudioBytes(captureSeconds))
+		return &buf
+	},
+}
+
+// getAudioBuffer returns an empty buffer with room for a chunk of raw audio.
+func getAudioBuffer() []byte {
+	return (*audioBuffers.Get().(*[]byte))[:0]
+}
+
+// releaseAudioBuffer gives buf back to be reused, nothing may use it afterwards.
+// Buffers that grew beyond a chunk, or that were never from the pool, are left to the garbage collector.
+func releaseAudioBuffer(buf []byte) {
+	if cap(buf) != expectedAudioBytes(captureSeconds) {
+		return
+	}
+	buf = buf[:0]
+	audioBuffers.Put(&buf)
+}
+
+// decodeSamples turns raw little endian audio into samples between -1 and 1, going by audioBytesPerSample.
+// 1 byte samples are unsigned, wider samples are signed.
+func decodeSamples(audio []byte) (samples []float64) {
+	width := audioBytesPerSample
+	samples = make([]float64, len(audio)/width)
+	for i := range samples {
+		b := audio[i*width : (i+1)*width]
+		switch width {
+		case 1:
+			samples[i] = (float64(b[0]) - 128) / 128
+		case 2:
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(b))) / -math.MinInt16
+		case 4:
+			samples[i] = float64(int32(binary.LittleEndian.Uint32(b))) / -math.MinInt32
+		default:
+			// take the most significant 2 bytes of other widths.
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(b[width-2:]))) / -math.MinInt16
+		}
+	}
+	return
+}
+
+// encodeSamples is the inverse of decodeSamples, it writes samples between -1 and 1 into audio as raw little endian audio.
+// Samples out of that range are clamped rather than wrapped around.
+func encodeSamples(samples []float64, audio []byte) {
+	width := audioBytesPerSample
+	for i, sample := range samples {
+		b := audio[i*width : (i+1)*width]
+		switch width {
+		case 1:
+			b[0] = byte(clampSample(sample*128+128, 0, math.MaxUint8))
+		case 2:
+			binary.LittleEndian.PutUint16(b, uint16(int16(clampSample(sample*-math.MinInt16, math.MinInt16, math.MaxInt16))))
+		case 4:
+			binary.LittleEndian.PutUint32(b, uint32(int32(clampSample(sample*-math.MinInt32, math.MinInt32, math.MaxInt32))))
+		default:
+			for j := range b[:width-2] {
+				b[j] = 0
+			}
+			binary.LittleEndian.PutUint16(b[width-2:], uint16(int16(clampSample(sample*-math.MinInt16, math.MinInt16, math.MaxInt16))))
+		}
+	}
+}
+
+func clampSample(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, math.Round(v)))
+}
+
+// preprocessSamples removes the DC offset from samples, then scales them so that the loudest is at full scale.
+// Silence is left as it is.
+func preprocessSamples(samples []float64) {
+	if len(samples) == 0 {
+		return
+	}
+	var mean float64
+	for _, sample := range samples {
+		mean += sample
+	}
+	mean /= float64(len(samples))
+	var peak float64
+	for i := range samples {
+		samples[i] -= mean
+		peak = math.Max(peak, math.Abs(samples[i]))
+	}
+	if peak == 0 {
+		return
+	}
+	for i := range samples {
+		samples[i] /= peak
+	}
+}
+
+// preprocessAudio returns a copy of raw audio with preprocessSamples applied to it.
+func preprocessAudio(audio []byte) []byte {
+	samples := decodeSamples(audio)
+	preprocessSamples(samples)
+	processed := make([]byte, len(audio))
+	// any trailing partial sample is kept as it is.
+	copy(processed, audio)
+	encodeSamples(samples, processed)
+	return processed
+}
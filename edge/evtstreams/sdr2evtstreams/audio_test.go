@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPreprocessSamplesLeavesSilence(t *testing.T) {
+	samples := []float64{0, 0, 0, 0}
+	preprocessSamples(samples)
+	for i, sample := range samples {
+		if sample != 0 {
+			t.Errorf("sample %d of silence is %v after preprocessing, want 0", i, sample)
+		}
+	}
+	// a constant is only a DC offset, which leaves silence.
+	samples = []float64{0.25, 0.25, 0.25}
+	preprocessSamples(samples)
+	for i, sample := range samples {
+		if sample != 0 {
+			t.Errorf("sample %d of a constant is %v after preprocessing, want 0", i, sample)
+		}
+	}
+	preprocessSamples(nil)
+}
+
+func TestPreprocessSamplesRemovesDCOffsetAndNormalizes(t *testing.T) {
+	// a square wave of 0.1 around an offset of 0.3.
+	samples := []float64{0.4, 0.2, 0.4, 0.2}
+	preprocessSamples(samples)
+	var mean, peak float64
+	for _, sample := range samples {
+		mean += sample / float64(len(samples))
+		peak = math.Max(peak, math.Abs(sample))
+	}
+	if math.Abs(mean) > 1e-9 {
+		t.Errorf("mean after preprocessing is %v, want 0", mean)
+	}
+	if math.Abs(peak-1) > 1e-9 {
+		t.Errorf("peak after preprocessing is %v, want 1", peak)
+	}
+	want := []float64{1, -1, 1, -1}
+	for i := range samples {
+		if math.Abs(samples[i]-want[i]) > 1e-9 {
+			t.Errorf("samples after preprocessing are %v, want %v", samples, want)
+			break
+		}
+	}
+}
+
+func TestPreprocessSamplesPeakIsFullScale(t *testing.T) {
+	samples := []float64{0.01, -0.02, 0.005, -0.01, 0.015}
+	preprocessSamples(samples)
+	var peak float64
+	for _, sample := range samples {
+		peak = math.Max(peak, math.Abs(sample))
+	}
+	if math.Abs(peak-1) > 1e-9 {
+		t.Errorf("peak after preprocessing is %v, want 1", peak)
+	}
+}
+
+func TestEncodeSamplesClampsFullScale(t *testing.T) {
+	defer func(width int) { audioBytesPerSample = width }(audioBytesPerSample)
+	for _, width := range []int{1, 2, 4} {
+		audioBytesPerSample = width
+		samples := []float64{1, -1, 1.5, -1.5, 0}
+		audio := make([]byte, len(samples)*width)
+		encodeSamples(samples, audio)
+		decoded := decodeSamples(audio)
+		// full scale positive is one step short of 1, as there is one more negative value than positive ones.
+		step := 1 / math.Pow(2, float64(width*8-1))
+		want := []float64{1 - step, -1, 1 - step, -1, 0}
+		for i := range want {
+			if math.Abs(decoded[i]-want[i]) > 1e-9 {
+				t.Errorf("width %d: sample %v is %v after encoding, want %v, not wrapped around", width, samples[i], decoded[i], want[i])
+			}
+		}
+	}
+}
+
+func TestPreprocessAudioRoundTrip(t *testing.T) {
+	defer func(width int) { audioBytesPerSample = width }(audioBytesPerSample)
+	audioBytesPerSample = 2
+	audio := make([]byte, 8)
+	encodeSamples([]float64{0.4, 0.2, 0.4, 0.2}, audio)
+	processed := decodeSamples(preprocessAudio(audio))
+	want := []float64{1, -1, 1, -1}
+	for i := range want {
+		if math.Abs(processed[i]-want[i]) > 1e-3 {
+			t.Errorf("preprocessed audio is %v, want %v", processed, want)
+			break
+		}
+	}
+}
+
+// benchmarkAudio keeps the buffers of the benchmarks alive, so that the compiler can't leave out allocating them.
+var benchmarkAudio []byte
+
+// BenchmarkAudioBuffers compares taking the buffer of each capture from audioBuffers with allocating a new one.
+func BenchmarkAudioBuffers(b *testing.B) {
+	n := expectedAudioBytes(captureSeconds)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchmarkAudio = getAudioBuffer()[:n]
+			benchmarkAudio[0] = byte(i)
+			releaseAudioBuffer(benchmarkAudio)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchmarkAudio = make([]byte, n)
+			benchmarkAudio[0] = byte(i)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+// Package audioconv converts raw little endian audio between sample rates, sample formats and channel counts,
+// so that the audio an SDR captures doesn't have to be in the format the model takes.
+package audioconv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Encoding is how each sample of raw audio is stored, named the way ffmpeg names sample formats.
+type Encoding string
+
+const (
+	// U8 is unsigned 8 bit samples, with silence at 128.
+	U8 Encoding = "u8"
+	// S16LE, S24LE and S32LE are signed little endian samples of 16, 24 and 32 bits.
+	S16LE Encoding = "s16le"
+	S24LE Encoding = "s24le"
+	S32LE Encoding = "s32le"
+	// F32LE is little endian 32 bit floats between -1 and 1.
+	F32LE Encoding = "f32le"
+)
+
+// Width is how many bytes each sample of e takes, 0 if e is not known.
+func (e Encoding) Width() int {
+	switch e {
+	case U8:
+		return 1
+	case S16LE:
+		return 2
+	case S24LE:
+		return 3
+	case S32LE, F32LE:
+		return 4
+	}
+	return 0
+}
+
+// Format describes raw audio, whose channels are interleaved.
+type Format struct {
+	SampleRate int
+	Channels   int
+	Encoding   Encoding
+}
+
+// Check returns an error if f can't be converted from or to.
+func (f Format) Check() error {
+	if f.SampleRate <= 0 {
+		return fmt.Errorf("the sample rate must be positive, got %d", f.SampleRate)
+	}
+	if f.Channels != 1 && f.Channels != 2 {
+		return fmt.Errorf("the audio must be mono or stereo, got %d channels", f.Channels)
+	}
+	if f.Encoding.Width() == 0 {
+		return fmt.Errorf("unknown sample format %q, must be u8, s16le, s24le, s32le or f32le", f.Encoding)
+	}
+	return nil
+}
+
+// Bytes is how many bytes of raw audio in f last seconds.
+func (f Format) Bytes(seconds float64) int {
+	return int(math.Round(seconds*float64(f.SampleRate))) * f.Channels * f.Encoding.Width()
+}
+
+// Convert returns raw audio in from converted to to. It returns raw itself if the formats are the same.
+// Stereo is mixed down to mono by averaging its channels, and mono is copied to both channels of stereo.
+// The sample rate is converted by interpolating linearly between the samples, after averaging them over
+// each output sample when the rate goes down, so that high frequencies don't alias.
+// Any trailing partial frame of raw is dropped. Convert panics if either format doesn't pass Check.
+func Convert(raw []byte, from, to Format) []byte {
+	if from == to {
+		return raw
+	}
+	for _, f := range []Format{from, to} {
+		if err := f.Check(); err != nil {
+			panic(err)
+		}
+	}
+	channels := Decode(raw, from)
+	channels = Mix(channels, to.Channels)
+	for i := range channels {
+		channels[i] = Resample(channels[i], from.SampleRate, to.SampleRate)
+	}
+	return Encode(channels, to.Encoding)
+}
+
+// Decode splits raw audio in f into its channels, with samples between -1 and 1.
+func Decode(raw []byte, f Format) (channels [][]float64) {
+	width := f.Encoding.Width()
+	frames := len(raw) / (width * f.Channels)
+	channels = make([][]float64, f.Channels)
+	for c := range channels {
+		channels[c] = make([]float64, frames)
+	}
+	for i := 0; i < frames*f.Channels; i++ {
+		channels[i%f.Channels][i/f.Channels] = decodeSample(raw[i*width:(i+1)*width], f.Encoding)
+	}
+	return
+}
+
+// Encode interleaves channels, with samples between -1 and 1, into raw audio in encoding.
+// Samples out of that range are clamped rather than wrapped around.
+func Encode(channels [][]float64, encoding Encoding) (raw []byte) {
+	if len(channels) == 0 {
+		return nil
+	}
+	width := encoding.Width()
+	frames := len(channels[0])
+	raw = make([]byte, frames*len(channels)*width)
+	for i := 0; i < frames*len(channels); i++ {
+		encodeSample(raw[i*width:(i+1)*width], channels[i%len(channels)][i/len(channels)], encoding)
+	}
+	return
+}
+
+// Mix returns channels as n channels, averaging them into one for mono, or copying a single one into each.
+func Mix(channels [][]float64, n int) [][]float64 {
+	if len(channels) == n || len(channels) == 0 {
+		return channels
+	}
+	mono := channels[0]
+	if len(channels) > 1 {
+		mono = make([]float64, len(channels[0]))
+		for _, channel := range channels {
+			for i, sample := range channel {
+				mono[i] += sample / float64(len(channels))
+			}
+		}
+	}
+	mixed := make([][]float64, n)
+	for c := range mixed {
+		mixed[c] = mono
+	}
+	return mixed
+}
+
+// Resample converts samples at rate from to rate to, keeping their duration.
+func Resample(samples []float64, from, to int) []float64 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	if to < from {
+		samples = boxFilter(samples, int(math.Ceil(float64(from)/float64(to))))
+	}
+	n := int(math.Round(float64(len(samples)) * float64(to) / float64(from)))
+	resampled := make([]float64, n)
+	step := float64(from) / float64(to)
+	for i := range resampled {
+		pos := float64(i) * step
+		j := int(pos)
+		if j >= len(samples)-1 {
+			resampled[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		resampled[i] = samples[j]*(1-frac) + samples[j+1]*frac
+	}
+	return resampled
+}
+
+// boxFilter returns the moving average of samples over size of them, centered on each.
+func boxFilter(samples []float64, size int) []float64 {
+	if size < 2 {
+		return samples
+	}
+	filtered := make([]float64, len(samples))
+	var sum float64
+	count := 0
+	// the window is [i-size/2, i+size-size/2), cut off at either end.
+	lo, hi := 0, 0
+	for i := range samples {
+		for ; hi < len(samples) && hi < i+size-size/2; hi++ {
+			sum += samples[hi]
+			count++
+		}
+		for ; lo < i-size/2; lo++ {
+			sum -= samples[lo]
+			count--
+		}
+		filtered[i] = sum / float64(count)
+	}
+	return filtered
+}
+
+func decodeSample(b []byte, encoding Encoding) float64 {
+	switch encoding {
+	case U8:
+		return (float64(b[0]) - 128) / 128
+	case S16LE:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / -math.MinInt16
+	case S24LE:
+		// shift the 24 bits to the top of an int32 to sign extend them.
+		return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)) / -math.MinInt32
+	case S32LE:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / -math.MinInt32
+	case F32LE:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func encodeSample(b []byte, sample float64, encoding Encoding) {
+	switch encoding {
+	case U8:
+		b[0] = byte(clamp(sample*128+128, 0, math.MaxUint8))
+	case S16LE:
+		binary.LittleEndian.PutUint16(b, uint16(int16(clamp(sample*-math.MinInt16, math.MinInt16, math.MaxInt16))))
+	case S24LE:
+		v := uint32(int32(clamp(sample*-math.MinInt32, math.MinInt32, math.MaxInt32)))
+		b[0], b[1], b[2] = byte(v>>8), byte(v>>16), byte(v>>24)
+	case S32LE:
+		binary.LittleEndian.PutUint32(b, uint32(int32(clamp(sample*-math.MinInt32, math.MinInt32, math.MaxInt32))))
+	case F32LE:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(math.Max(-1, math.Min(1, sample)))))
+	}
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, math.Round(v)))
+}
@@ -0,0 +1,148 @@
+package audioconv
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	samples := []float64{0, 0.5, -0.5, 0.25, -1}
+	for _, encoding := range []Encoding{U8, S16LE, S24LE, S32LE, F32LE} {
+		f := Format{SampleRate: 8000, Channels: 1, Encoding: encoding}
+		raw := Encode([][]float64{samples}, encoding)
+		if len(raw) != len(samples)*encoding.Width() {
+			t.Errorf("%s: encoded %d samples into %d bytes, want %d", encoding, len(samples), len(raw), len(samples)*encoding.Width())
+		}
+		decoded := Decode(raw, f)[0]
+		// u8 is only good to a step of 1/128.
+		tolerance := 1.0 / 128
+		if encoding != U8 {
+			tolerance = 1e-4
+		}
+		for i := range samples {
+			if !near(decoded[i], samples[i], tolerance) {
+				t.Errorf("%s: sample %v decoded as %v", encoding, samples[i], decoded[i])
+			}
+		}
+	}
+}
+
+func TestEncodeClamps(t *testing.T) {
+	for _, encoding := range []Encoding{U8, S16LE, S24LE, S32LE, F32LE} {
+		decoded := Decode(Encode([][]float64{{2, -2}}, encoding), Format{SampleRate: 8000, Channels: 1, Encoding: encoding})[0]
+		// full scale positive is one step short of 1.
+		if decoded[0] < 0.99 || decoded[1] != -1 {
+			t.Errorf("%s: 2 and -2 decoded as %v, want them clamped to full scale rather than wrapped", encoding, decoded)
+		}
+	}
+}
+
+func TestFormatCheck(t *testing.T) {
+	tests := []struct {
+		f  Format
+		ok bool
+	}{
+		{Format{16000, 1, S16LE}, true},
+		{Format{48000, 2, F32LE}, true},
+		{Format{0, 1, S16LE}, false},
+		{Format{16000, 3, S16LE}, false},
+		{Format{16000, 1, "s8"}, false},
+	}
+	for _, test := range tests {
+		if err := test.f.Check(); (err == nil) != test.ok {
+			t.Errorf("%+v.Check() = %v, want ok %v", test.f, err, test.ok)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	if got := (Format{16000, 2, S24LE}).Bytes(0.5); got != 8000*2*3 {
+		t.Errorf("half a second of 16 kHz stereo s24le is %d bytes, want %d", got, 8000*2*3)
+	}
+}
+
+func TestMix(t *testing.T) {
+	stereo := Mix([][]float64{{1, 0.5}, {0, -0.5}}, 1)
+	if len(stereo) != 1 || stereo[0][0] != 0.5 || stereo[0][1] != 0 {
+		t.Errorf("stereo mixed down to %v, want the average of the channels", stereo)
+	}
+	mono := Mix([][]float64{{1, 0.5}}, 2)
+	if len(mono) != 2 || mono[0][1] != 0.5 || mono[1][1] != 0.5 {
+		t.Errorf("mono mixed up to %v, want it in both channels", mono)
+	}
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		from, to int
+		want     int
+	}{
+		{16000, 16000, 1600},
+		{16000, 8000, 800},
+		{8000, 16000, 1600},
+		{44100, 16000, 1600},
+	}
+	for _, test := range tests {
+		samples := make([]float64, test.from/10)
+		for i := range samples {
+			samples[i] = 0.5
+		}
+		resampled := Resample(samples, test.from, test.to)
+		if len(resampled) != test.want {
+			t.Errorf("resampled a tenth of a second from %d to %d Hz into %d samples, want %d", test.from, test.to, len(resampled), test.want)
+		}
+		for _, sample := range resampled {
+			if !near(sample, 0.5, 1e-9) {
+				t.Errorf("resampled a steady 0.5 from %d to %d Hz into %v", test.from, test.to, sample)
+				break
+			}
+		}
+	}
+}
+
+func TestResampleFiltersAliasing(t *testing.T) {
+	// a tone at the Nyquist frequency of 16 kHz can't be represented at 8 kHz, and would alias to a steady level.
+	samples := make([]float64, 1600)
+	for i := range samples {
+		samples[i] = 0.5
+		if i%2 == 1 {
+			samples[i] = -0.5
+		}
+	}
+	for i, sample := range Resample(samples, 16000, 8000) {
+		// the edges are averaged over fewer samples.
+		if i > 0 && i < 799 && !near(sample, 0, 1e-9) {
+			t.Errorf("resampled a tone too high for 8 kHz into %v at %d, want it filtered out", sample, i)
+			break
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	from := Format{SampleRate: 16000, Channels: 2, Encoding: S16LE}
+	to := Format{SampleRate: 8000, Channels: 1, Encoding: F32LE}
+	raw := make([]byte, from.Bytes(1))
+	if converted := Convert(raw, from, from); &converted[0] != &raw[0] {
+		t.Error("converting to the same format copied the audio, want it as it is")
+	}
+	if converted := Convert(raw, from, to); len(converted) != to.Bytes(1) {
+		t.Errorf("converted a second into %d bytes, want %d", len(converted), to.Bytes(1))
+	}
+	// a trailing partial frame is dropped.
+	if converted := Convert(raw[:len(raw)-1], from, to); len(converted) != to.Bytes(1) {
+		t.Errorf("converted a second less a byte into %d bytes, want %d", len(converted), to.Bytes(1))
+	}
+}
+
+func TestConvertPanicsOnBadFormat(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("converting to a bad format didn't panic")
+		}
+	}()
+	Convert(make([]byte, 4), Format{16000, 1, S16LE}, Format{16000, 1, "s8"})
+}
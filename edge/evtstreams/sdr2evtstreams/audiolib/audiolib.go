@@ -1,31 +1,487 @@
 package audiolib
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
 )
 
+// SchemaVersion is the version of the fields of AudioMsg that the messages are sent with. Messages without one
+// are from before version 2, which added duration, powerDBFS, modelName and modelVersion, and the audioSHA256
+// of every message.
+const SchemaVersion = 2
+
+// ModeIQ is the Mode of the messages whose Audio is the raw IQ samples of the SDR instead of audio.
+const ModeIQ = "iq"
+
 // AudioMsg holds the metadata and audio that we send to IBM Message Hub
 type AudioMsg struct {
 	Audio         string  `json:"audio"`
 	Ts            int64   `json:"ts"`
-	Freq          float32 `json:"freq"`
+	Freq          int64   `json:"freq"`
 	ExpectedValue float32 `json:"expectedValue"`
 	DevID         string  `json:"devID"`
 	Lat           float32 `json:"lat"`
 	Lon           float32 `json:"lon"`
 	ContentType   string  `json:"contentType"`
 	Origin        string  `json:"origin"`
+	// Alt is the altitude in meters above mean sea level, 0 if unknown.
+	Alt float32 `json:"alt,omitempty"`
+	// CallSign and StationName are the call sign and the program service name of the station from its RDS,
+	// like WXYZ and "WXYZ FM", empty if they aren't known.
+	CallSign    string `json:"callSign,omitempty"`
+	StationName string `json:"stationName,omitempty"`
+	// Mode is how the audio was demodulated, wfm for broadcast FM, nfm for narrow FM or am, wfm if empty.
+	// It is iq if Audio is the raw IQ samples centered on Freq instead of audio, at SampleRate in SampleFormat cu8.
+	Mode string `json:"mode,omitempty"`
+	// Gain is the gain of the tuner in dB that the IQ samples of Mode iq were captured with, 0 for automatic.
+	Gain float32 `json:"gain,omitempty"`
+	// SNR is the signal to noise ratio of the station in dB, measured when it was captured, 0 if it wasn't.
+	SNR float32 `json:"snr,omitempty"`
+	// Offset is how many seconds into its capture Audio starts, when the capture was scored in sliding windows
+	// and Audio is one of them, 0 if Audio is the whole capture.
+	Offset float32 `json:"offset,omitempty"`
+	// ContentEncoding is how Audio was compressed on top of its ContentType, like gzip, none if empty.
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// Encryption is what Audio is encrypted with, AES-GCM, with the key named KeyID. Audio is in the clear if empty.
+	Encryption string `json:"encryption,omitempty"`
+	KeyID      string `json:"keyID,omitempty"`
+	// Extras holds the values of any extra model outputs, such as a language id, by output name.
+	Extras map[string]float32 `json:"extras,omitempty"`
+	// Logits holds the whole output vector of the model, ExpectedValue is its first value. Only set if INCLUDE_LOGITS=true.
+	Logits []float32 `json:"logits,omitempty"`
+	// Classes holds how likely each class is by its label, for a model that scores several classes, like speech and
+	// music. ExpectedValue is then the sum of the good classes. It may only hold the most likely of them.
+	Classes map[string]float32 `json:"classes,omitempty"`
+	// SampleRate, Channels and SampleFormat describe the raw audio that Audio was encoded from, such as 16000, 1 and s16le.
+	SampleRate   int    `json:"sampleRate,omitempty"`
+	Channels     int    `json:"channels,omitempty"`
+	SampleFormat string `json:"sampleFormat,omitempty"`
+	// Duration is how long the audio lasts in seconds, and PowerDBFS its RMS level in dB below full scale.
+	Duration  float32 `json:"duration,omitempty"`
+	PowerDBFS float32 `json:"powerDBFS,omitempty"`
+	// ModelName and ModelVersion name the model that scored the audio.
+	ModelName    string `json:"modelName,omitempty"`
+	ModelVersion string `json:"modelVersion,omitempty"`
+	// CaptureID, Seq and SeqTotal are only set when the audio of one capture is split over several messages.
+	// Seq counts from 1 to SeqTotal, and the Audio of the fragments is concatenated in order to reassemble it.
+	CaptureID string `json:"captureID,omitempty"`
+	Seq       int    `json:"seq,omitempty"`
+	SeqTotal  int    `json:"seqTotal,omitempty"`
+	// AudioSHA256 is the hex SHA-256 of the decoded audio, of the whole capture in fragments, to check the audio by.
+	AudioSHA256 string `json:"audioSHA256,omitempty"`
+	// SchemaVersion is the SchemaVersion the message was sent with.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+}
+
+// Station names the station of msg for people, by its frequency in MHz and its call sign or else its name,
+// like "101.1 WXYZ".
+func (msg *AudioMsg) Station() string {
+	station := fmt.Sprintf("%.1f", float64(msg.Freq)/1e6)
+	if msg.CallSign != "" {
+		station += " " + msg.CallSign
+	} else if msg.StationName != "" {
+		station += " " + msg.StationName
+	}
+	return station
+}
+
+// SetAudioSHA256 sets the AudioSHA256 of msg to that of its decoded Audio.
+func (msg *AudioMsg) SetAudioSHA256() {
+	audio, _ := base64.StdEncoding.DecodeString(msg.Audio)
+	sum := sha256.Sum256(audio)
+	msg.AudioSHA256 = hex.EncodeToString(sum[:])
+}
+
+// Fragment splits msg into messages whose Audio is at most maxAudioBytes long, all with the given captureID.
+// Every other field is copied from msg. The Audio of each fragment is a multiple of 4 long, but for the last,
+// so that it decodes on its own, as EncodeProto needs.
+func (msg *AudioMsg) Fragment(captureID string, maxAudioBytes int) (fragments []*AudioMsg) {
+	if maxAudioBytes >= 4 {
+		maxAudioBytes -= maxAudioBytes % 4
+	}
+	total := (len(msg.Audio) + maxAudioBytes - 1) / maxAudioBytes
+	whole := *msg
+	whole.SetAudioSHA256()
+	for i := 0; i < total; i++ {
+		end := (i + 1) * maxAudioBytes
+		if end > len(msg.Audio) {
+			end = len(msg.Audio)
+		}
+		fragment := *msg
+		fragment.Audio = msg.Audio[i*maxAudioBytes : end]
+		fragment.CaptureID = captureID
+		fragment.Seq = i + 1
+		fragment.SeqTotal = total
+		fragment.AudioSHA256 = whole.AudioSHA256
+		fragments = append(fragments, &fragment)
+	}
+	return
+}
+
+// Reassemble joins the fragments of one capture, in any order, back into the message they were split from.
+// It fails if any fragment is missing, or if the audio doesn't match the AudioSHA256 of the fragments.
+func Reassemble(fragments []*AudioMsg) (msg *AudioMsg, err error) {
+	if len(fragments) == 0 {
+		return nil, errors.New("no fragments to reassemble")
+	}
+	bySeq := make([]*AudioMsg, fragments[0].SeqTotal)
+	for _, fragment := range fragments {
+		if fragment.CaptureID != fragments[0].CaptureID || fragment.SeqTotal != len(bySeq) || fragment.Seq < 1 || fragment.Seq > len(bySeq) {
+			return nil, fmt.Errorf("fragment %d of %d of capture %s doesn't belong with the others", fragment.Seq, fragment.SeqTotal, fragment.CaptureID)
+		}
+		bySeq[fragment.Seq-1] = fragment
+	}
+	var audio strings.Builder
+	for i, fragment := range bySeq {
+		if fragment == nil {
+			return nil, fmt.Errorf("fragment %d of %d of capture %s is missing", i+1, len(bySeq), fragments[0].CaptureID)
+		}
+		audio.WriteString(fragment.Audio)
+	}
+	whole := *bySeq[0]
+	whole.Audio = audio.String()
+	whole.CaptureID, whole.Seq, whole.SeqTotal = "", 0, 0
+	if bySeq[0].AudioSHA256 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(whole.Audio)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(decoded)
+		if hex.EncodeToString(sum[:]) != bySeq[0].AudioSHA256 {
+			return nil, fmt.Errorf("the audio of capture %s doesn't match its SHA-256", fragments[0].CaptureID)
+		}
+	}
+	return &whole, nil
 }
 
 // Encode implemented for the https://godoc.org/github.com/Shopify/sarama#Encoder interface
+// The JSON also has Ts in RFC 3339 as time, for consumers like Kafka Connect and ksqlDB that parse timestamps that way.
 func (msg *AudioMsg) Encode() (serialized []byte, err error) {
-	serialized, err = json.Marshal(msg)
+	type plain AudioMsg
+	withTime := struct {
+		*plain
+		Time string `json:"time,omitempty"`
+	}{plain: (*plain)(msg)}
+	if msg.Ts != 0 {
+		withTime.Time = time.Unix(msg.Ts, 0).UTC().Format(time.RFC3339)
+	}
+	serialized, err = json.Marshal(withTime)
 	return
 }
 
+// NewAudioCipher makes the AES-GCM cipher that EncryptAudio and DecryptAudio take, of a 16, 24 or 32 byte key.
+func NewAudioCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptAudio encrypts the decoded Audio of msg with the AES-GCM aead, which NewAudioCipher makes, and records
+// keyID as the key it was encrypted with. Audio then holds a random nonce followed by the sealed audio.
+func (msg *AudioMsg) EncryptAudio(aead cipher.AEAD, keyID string) error {
+	audio, err := base64.StdEncoding.DecodeString(msg.Audio)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(audio)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	msg.Audio = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, audio, nil))
+	msg.Encryption, msg.KeyID = "AES-GCM", keyID
+	return nil
+}
+
+// DecryptAudio reverses EncryptAudio with the aead of the key named by msg.KeyID.
+func (msg *AudioMsg) DecryptAudio(aead cipher.AEAD) error {
+	if msg.Encryption != "AES-GCM" {
+		return fmt.Errorf("can't decrypt audio encrypted with %q", msg.Encryption)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(msg.Audio)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("the encrypted audio is too short")
+	}
+	audio, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("can't decrypt the audio with key %q: %v", msg.KeyID, err)
+	}
+	msg.Audio = base64.StdEncoding.EncodeToString(audio)
+	msg.Encryption, msg.KeyID = "", ""
+	return nil
+}
+
+// UnmarshalJSON also reads the freq of messages from before it was whole Hz, which was a float32 that some
+// producers wrote like 1.011e+08.
+func (msg *AudioMsg) UnmarshalJSON(data []byte) error {
+	type plain AudioMsg
+	withFloatFreq := struct {
+		*plain
+		Freq float64 `json:"freq"`
+	}{plain: (*plain)(msg)}
+	err := json.Unmarshal(data, &withFloatFreq)
+	if err != nil {
+		return err
+	}
+	msg.Freq = int64(math.Round(withFloatFreq.Freq))
+	return nil
+}
+
 // Length implemented for the https://godoc.org/github.com/Shopify/sarama#Encoder interface
 // This is an ugly hack becouse I can't easily calculate the length without actualy serializing the object.
 func (msg *AudioMsg) Length() int {
 	serialized, _ := msg.Encode()
 	return len(serialized)
 }
+
+// EncodeProto serializes msg as the AudioMsg of audiomsg.proto, whose audio is the decoded Audio.
+// The fields that audiomsg.proto doesn't have are left out.
+func (msg *AudioMsg) EncodeProto() (serialized []byte, err error) {
+	audio, err := base64.StdEncoding.DecodeString(msg.Audio)
+	if err != nil {
+		return
+	}
+	serialized = appendProtoBytes(serialized, 1, []byte(msg.DevID))
+	serialized = appendProtoFloat(serialized, 2, msg.Lat)
+	serialized = appendProtoFloat(serialized, 3, msg.Lon)
+	serialized = appendProtoFloat(serialized, 6, float32(msg.Freq))
+	serialized = appendProtoInt64(serialized, 29, msg.Freq)
+	serialized = appendProtoFloat(serialized, 7, msg.ExpectedValue)
+	serialized = appendProtoBytes(serialized, 8, audio)
+	serialized = appendProtoBytes(serialized, 10, []byte(msg.ContentType))
+	serialized = appendProtoBytes(serialized, 11, []byte(msg.ContentEncoding))
+	serialized = appendProtoBytes(serialized, 12, []byte(msg.Encryption))
+	serialized = appendProtoBytes(serialized, 13, []byte(msg.KeyID))
+	serialized = appendProtoBytes(serialized, 14, []byte(msg.CaptureID))
+	serialized = appendProtoInt(serialized, 15, msg.Seq)
+	serialized = appendProtoInt(serialized, 16, msg.SeqTotal)
+	serialized = appendProtoBytes(serialized, 17, []byte(msg.AudioSHA256))
+	serialized = appendProtoInt(serialized, 18, msg.SampleRate)
+	serialized = appendProtoInt(serialized, 19, msg.Channels)
+	serialized = appendProtoBytes(serialized, 20, []byte(msg.SampleFormat))
+	serialized = appendProtoFloat(serialized, 21, msg.Duration)
+	serialized = appendProtoFloat(serialized, 22, msg.PowerDBFS)
+	serialized = appendProtoBytes(serialized, 23, []byte(msg.ModelName))
+	serialized = appendProtoBytes(serialized, 24, []byte(msg.ModelVersion))
+	serialized = appendProtoInt(serialized, 25, msg.SchemaVersion)
+	serialized = appendProtoFloat(serialized, 26, msg.Alt)
+	serialized = appendProtoBytes(serialized, 27, []byte(msg.CallSign))
+	serialized = appendProtoBytes(serialized, 28, []byte(msg.StationName))
+	serialized = appendProtoBytes(serialized, 30, []byte(msg.Mode))
+	serialized = appendProtoFloat(serialized, 31, msg.Gain)
+	serialized = appendProtoFloat(serialized, 32, msg.SNR)
+	serialized = appendProtoFloat(serialized, 33, msg.Offset)
+	if msg.Ts != 0 {
+		// a google.protobuf.Timestamp, whose seconds are field 1.
+		ts := appendProtoVarint(nil, 1<<3)
+		ts = appendProtoVarint(ts, uint64(msg.Ts))
+		serialized = appendProtoBytes(serialized, 9, ts)
+	}
+	return
+}
+
+// DecodeProto parses the AudioMsg of audiomsg.proto that EncodeProto serializes, fields it doesn't know are skipped.
+func DecodeProto(serialized []byte) (msg *AudioMsg, err error) {
+	msg = &AudioMsg{}
+	// freqHz is the freq in whole Hz, which messages from before it only have as a float.
+	var freqHz int64
+	for len(serialized) > 0 {
+		var key, n uint64
+		key, serialized, err = readProtoVarint(serialized)
+		if err != nil {
+			return nil, err
+		}
+		var value []byte
+		switch key & 7 {
+		case 0:
+			n, serialized, err = readProtoVarint(serialized)
+			// as an int32 field, negative ones are sign extended.
+			number := int(int32(n))
+			switch key >> 3 {
+			case 15:
+				msg.Seq = number
+			case 16:
+				msg.SeqTotal = number
+			case 18:
+				msg.SampleRate = number
+			case 19:
+				msg.Channels = number
+			case 25:
+				msg.SchemaVersion = number
+			case 29:
+				freqHz = int64(n)
+			}
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(serialized) < size {
+				return nil, errors.New("truncated protobuf field")
+			}
+			value, serialized = serialized[:size], serialized[size:]
+		case 2:
+			n, serialized, err = readProtoVarint(serialized)
+			if err == nil && n > uint64(len(serialized)) {
+				err = errors.New("truncated protobuf field")
+			}
+			if err == nil {
+				value, serialized = serialized[:n], serialized[n:]
+			}
+		default:
+			err = fmt.Errorf("unknown protobuf wire type %d", key&7)
+		}
+		if err != nil {
+			return nil, err
+		}
+		float := func() float32 {
+			if len(value) != 4 {
+				return 0
+			}
+			return math.Float32frombits(binary.LittleEndian.Uint32(value))
+		}
+		switch key >> 3 {
+		case 1:
+			msg.DevID = string(value)
+		case 2:
+			msg.Lat = float()
+		case 3:
+			msg.Lon = float()
+		case 6:
+			msg.Freq = int64(math.Round(float64(float())))
+		case 7:
+			msg.ExpectedValue = float()
+		case 8:
+			msg.Audio = base64.StdEncoding.EncodeToString(value)
+		case 9:
+			// the seconds of the google.protobuf.Timestamp, its nanoseconds are dropped.
+			for len(value) > 0 {
+				var field, x uint64
+				field, value, err = readProtoVarint(value)
+				if err == nil {
+					x, value, err = readProtoVarint(value)
+				}
+				if err != nil || field&7 != 0 {
+					return nil, errors.New("bad protobuf timestamp")
+				}
+				if field>>3 == 1 {
+					msg.Ts = int64(x)
+				}
+			}
+		case 10:
+			msg.ContentType = string(value)
+		case 11:
+			msg.ContentEncoding = string(value)
+		case 12:
+			msg.Encryption = string(value)
+		case 13:
+			msg.KeyID = string(value)
+		case 14:
+			msg.CaptureID = string(value)
+		case 17:
+			msg.AudioSHA256 = string(value)
+		case 20:
+			msg.SampleFormat = string(value)
+		case 21:
+			msg.Duration = float()
+		case 22:
+			msg.PowerDBFS = float()
+		case 23:
+			msg.ModelName = string(value)
+		case 24:
+			msg.ModelVersion = string(value)
+		case 26:
+			msg.Alt = float()
+		case 27:
+			msg.CallSign = string(value)
+		case 28:
+			msg.StationName = string(value)
+		case 30:
+			msg.Mode = string(value)
+		case 31:
+			msg.Gain = float()
+		case 32:
+			msg.SNR = float()
+		case 33:
+			msg.Offset = float()
+		}
+	}
+	if freqHz != 0 {
+		msg.Freq = freqHz
+	}
+	return
+}
+
+// readProtoVarint reads the varint at the start of buf, and returns what follows it.
+func readProtoVarint(buf []byte) (x uint64, rest []byte, err error) {
+	for i, b := range buf {
+		if i == 10 {
+			break
+		}
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, buf[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("bad protobuf varint")
+}
+
+// appendProtoVarint appends x in the 7 bits per byte varint of protobuf.
+func appendProtoVarint(buf []byte, x uint64) []byte {
+	for x >= 0x80 {
+		buf = append(buf, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(buf, byte(x))
+}
+
+// appendProtoBytes appends a length delimited field, unless value is empty as proto3 leaves those out.
+func appendProtoBytes(buf []byte, field uint64, value []byte) []byte {
+	if len(value) == 0 {
+		return buf
+	}
+	buf = appendProtoVarint(buf, field<<3|2)
+	buf = appendProtoVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendProtoInt appends an int32 varint field, unless value is 0.
+func appendProtoInt(buf []byte, field uint64, value int) []byte {
+	return appendProtoInt64(buf, field, int64(value))
+}
+
+// appendProtoInt64 appends an int64 varint field, unless value is 0.
+func appendProtoInt64(buf []byte, field uint64, value int64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendProtoVarint(buf, field<<3)
+	return appendProtoVarint(buf, uint64(value))
+}
+
+// appendProtoFloat appends a fixed 32 bit float field, unless value is 0.
+func appendProtoFloat(buf []byte, field uint64, value float32) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendProtoVarint(buf, field<<3|5)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], math.Float32bits(value))
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,261 @@
+package audiolib
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// AvroSchema is the Avro schema of AudioMsg, whose fields are those of its JSON. audio is the base64 audio, as
+// in the JSON, so that the audio of fragments can be split anywhere. New fields are added at the end with a
+// default, so that the schema stays backwards compatible, which is why freq stays a float and freqHz has it in
+// whole Hz.
+const AvroSchema = `{"type":"record","name":"AudioMsg","namespace":"audiolib","fields":[` +
+	`{"name":"audio","type":"string"},` +
+	`{"name":"ts","type":"long"},` +
+	`{"name":"freq","type":"float"},` +
+	`{"name":"expectedValue","type":"float"},` +
+	`{"name":"devID","type":"string"},` +
+	`{"name":"lat","type":"float"},` +
+	`{"name":"lon","type":"float"},` +
+	`{"name":"contentType","type":"string"},` +
+	`{"name":"origin","type":"string"},` +
+	`{"name":"contentEncoding","type":"string","default":""},` +
+	`{"name":"encryption","type":"string","default":""},` +
+	`{"name":"keyID","type":"string","default":""},` +
+	`{"name":"extras","type":{"type":"map","values":"float"},"default":{}},` +
+	`{"name":"logits","type":{"type":"array","items":"float"},"default":[]},` +
+	`{"name":"sampleRate","type":"int","default":0},` +
+	`{"name":"channels","type":"int","default":0},` +
+	`{"name":"sampleFormat","type":"string","default":""},` +
+	`{"name":"captureID","type":"string","default":""},` +
+	`{"name":"seq","type":"int","default":0},` +
+	`{"name":"seqTotal","type":"int","default":0},` +
+	`{"name":"audioSHA256","type":"string","default":""},` +
+	`{"name":"duration","type":"float","default":0},` +
+	`{"name":"powerDBFS","type":"float","default":0},` +
+	`{"name":"modelName","type":"string","default":""},` +
+	`{"name":"modelVersion","type":"string","default":""},` +
+	`{"name":"schemaVersion","type":"int","default":0},` +
+	`{"name":"alt","type":"float","default":0},` +
+	`{"name":"callSign","type":"string","default":""},` +
+	`{"name":"stationName","type":"string","default":""},` +
+	`{"name":"freqHz","type":"long","default":0},` +
+	`{"name":"mode","type":"string","default":""},` +
+	`{"name":"gain","type":"float","default":0},` +
+	`{"name":"snr","type":"float","default":0},` +
+	`{"name":"offset","type":"float","default":0},` +
+	`{"name":"classes","type":{"type":"map","values":"float"},"default":{}}]}`
+
+// EncodeAvro serializes msg in the Avro binary encoding of AvroSchema, without any framing.
+func (msg *AudioMsg) EncodeAvro() (serialized []byte, err error) {
+	serialized = appendAvroString(serialized, msg.Audio)
+	serialized = appendAvroLong(serialized, msg.Ts)
+	serialized = appendAvroFloat(serialized, float32(msg.Freq))
+	serialized = appendAvroFloat(serialized, msg.ExpectedValue)
+	serialized = appendAvroString(serialized, msg.DevID)
+	serialized = appendAvroFloat(serialized, msg.Lat)
+	serialized = appendAvroFloat(serialized, msg.Lon)
+	serialized = appendAvroString(serialized, msg.ContentType)
+	serialized = appendAvroString(serialized, msg.Origin)
+	serialized = appendAvroString(serialized, msg.ContentEncoding)
+	serialized = appendAvroString(serialized, msg.Encryption)
+	serialized = appendAvroString(serialized, msg.KeyID)
+	serialized = appendAvroFloatMap(serialized, msg.Extras)
+	// an array is a block of its items and an empty block.
+	if len(msg.Logits) > 0 {
+		serialized = appendAvroLong(serialized, int64(len(msg.Logits)))
+		for _, logit := range msg.Logits {
+			serialized = appendAvroFloat(serialized, logit)
+		}
+	}
+	serialized = appendAvroLong(serialized, 0)
+	serialized = appendAvroLong(serialized, int64(msg.SampleRate))
+	serialized = appendAvroLong(serialized, int64(msg.Channels))
+	serialized = appendAvroString(serialized, msg.SampleFormat)
+	serialized = appendAvroString(serialized, msg.CaptureID)
+	serialized = appendAvroLong(serialized, int64(msg.Seq))
+	serialized = appendAvroLong(serialized, int64(msg.SeqTotal))
+	serialized = appendAvroString(serialized, msg.AudioSHA256)
+	serialized = appendAvroFloat(serialized, msg.Duration)
+	serialized = appendAvroFloat(serialized, msg.PowerDBFS)
+	serialized = appendAvroString(serialized, msg.ModelName)
+	serialized = appendAvroString(serialized, msg.ModelVersion)
+	serialized = appendAvroLong(serialized, int64(msg.SchemaVersion))
+	serialized = appendAvroFloat(serialized, msg.Alt)
+	serialized = appendAvroString(serialized, msg.CallSign)
+	serialized = appendAvroString(serialized, msg.StationName)
+	serialized = appendAvroLong(serialized, msg.Freq)
+	serialized = appendAvroString(serialized, msg.Mode)
+	serialized = appendAvroFloat(serialized, msg.Gain)
+	serialized = appendAvroFloat(serialized, msg.SNR)
+	serialized = appendAvroFloat(serialized, msg.Offset)
+	serialized = appendAvroFloatMap(serialized, msg.Classes)
+	return
+}
+
+// DecodeAvro parses the Avro binary encoding of AvroSchema that EncodeAvro serializes.
+func DecodeAvro(serialized []byte) (msg *AudioMsg, err error) {
+	r := &avroReader{buf: serialized}
+	msg = &AudioMsg{}
+	msg.Audio = r.string()
+	msg.Ts = r.long()
+	msg.Freq = int64(math.Round(float64(r.float())))
+	msg.ExpectedValue = r.float()
+	msg.DevID = r.string()
+	msg.Lat = r.float()
+	msg.Lon = r.float()
+	msg.ContentType = r.string()
+	msg.Origin = r.string()
+	msg.ContentEncoding = r.string()
+	msg.Encryption = r.string()
+	msg.KeyID = r.string()
+	msg.Extras = r.floatMap()
+	for n := r.blockLen(); n > 0; n = r.blockLen() {
+		for ; n > 0 && r.err == nil; n-- {
+			msg.Logits = append(msg.Logits, r.float())
+		}
+	}
+	msg.SampleRate = int(r.long())
+	msg.Channels = int(r.long())
+	msg.SampleFormat = r.string()
+	msg.CaptureID = r.string()
+	msg.Seq = int(r.long())
+	msg.SeqTotal = int(r.long())
+	msg.AudioSHA256 = r.string()
+	msg.Duration = r.float()
+	msg.PowerDBFS = r.float()
+	msg.ModelName = r.string()
+	msg.ModelVersion = r.string()
+	msg.SchemaVersion = int(r.long())
+	msg.Alt = r.float()
+	msg.CallSign = r.string()
+	msg.StationName = r.string()
+	if freqHz := r.long(); freqHz != 0 {
+		msg.Freq = freqHz
+	}
+	msg.Mode = r.string()
+	msg.Gain = r.float()
+	msg.SNR = r.float()
+	msg.Offset = r.float()
+	msg.Classes = r.floatMap()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return
+}
+
+// appendAvroLong appends x zig zag coded in a varint, as Avro codes both int and long.
+func appendAvroLong(buf []byte, x int64) []byte {
+	return appendProtoVarint(buf, uint64(x<<1)^uint64(x>>63))
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = appendAvroLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+func appendAvroFloat(buf []byte, value float32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], math.Float32bits(value))
+	return append(buf, b[:]...)
+}
+
+// appendAvroFloatMap appends m as a block of its items and an empty block, the keys are sorted to always encode the same.
+func appendAvroFloatMap(buf []byte, m map[string]float32) []byte {
+	if len(m) > 0 {
+		var keys []string
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf = appendAvroLong(buf, int64(len(keys)))
+		for _, key := range keys {
+			buf = appendAvroString(buf, key)
+			buf = appendAvroFloat(buf, m[key])
+		}
+	}
+	return appendAvroLong(buf, 0)
+}
+
+// avroReader reads the values of an Avro binary encoding from buf, its first error sticks in err.
+type avroReader struct {
+	buf []byte
+	err error
+}
+
+var errAvroTruncated = errors.New("truncated Avro message")
+
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	u, rest, err := readProtoVarint(r.buf)
+	if err != nil {
+		r.err = errAvroTruncated
+		return 0
+	}
+	r.buf = rest
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *avroReader) string() string {
+	n := r.long()
+	if r.err != nil {
+		return ""
+	}
+	if n < 0 || n > int64(len(r.buf)) {
+		r.err = errAvroTruncated
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *avroReader) float() float32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 4 {
+		r.err = errAvroTruncated
+		return 0
+	}
+	value := math.Float32frombits(binary.LittleEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return value
+}
+
+// floatMap reads a map of floats, nil if it is empty.
+func (r *avroReader) floatMap() (m map[string]float32) {
+	for n := r.blockLen(); n > 0; n = r.blockLen() {
+		if m == nil {
+			m = map[string]float32{}
+		}
+		for ; n > 0 && r.err == nil; n-- {
+			key := r.string()
+			m[key] = r.float()
+		}
+	}
+	return
+}
+
+// blockLen is the number of items of the next block of a map or array, 0 at its end or on an error. A negative
+// count is followed by the size of the block in bytes. As each item takes at least a byte, a count over the bytes
+// left is an error, so that a corrupt count can't make the loops over it spin.
+func (r *avroReader) blockLen() int64 {
+	n := r.long()
+	if n < 0 {
+		n = -n
+		r.long()
+	}
+	if r.err != nil {
+		return 0
+	}
+	if n < 0 || n > int64(len(r.buf)) {
+		r.err = errAvroTruncated
+		return 0
+	}
+	return n
+}
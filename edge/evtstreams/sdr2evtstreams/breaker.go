@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses the captures of a loop for Cooldown once its SDR has failed Failures times in a row,
+// after all their retries, instead of the service giving up on it after FAILURE_WINDOW. The service keeps
+// serving /metrics and /healthz meanwhile. Once the cooldown is up the SDR is tried again, and if it fails
+// once more the breaker trips again straight away.
+type circuitBreaker struct {
+	// Device is the SDR of the loop, for its log lines and metrics.
+	Device      string
+	Failures    int
+	Cooldown    time.Duration
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+}
+
+// sdrBreakerFromEnv returns SDR_BREAKER_FAILURES and SDR_BREAKER_COOLDOWN, 0 failures is no breaker.
+func sdrBreakerFromEnv() (failures int, cooldown time.Duration, err error) {
+	failures, cooldown = getEnvInt("SDR_BREAKER_FAILURES", 0), getEnvDuration("SDR_BREAKER_COOLDOWN", 5*time.Minute)
+	if failures < 0 || (failures > 0 && cooldown <= 0) {
+		err = fmt.Errorf("SDR_BREAKER_FAILURES can't be negative, and SDR_BREAKER_COOLDOWN must be over 0 with it")
+	}
+	return
+}
+
+func newCircuitBreaker(device string, failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{Device: device, Failures: failures, Cooldown: cooldown}
+}
+
+// wait is how long captures must still wait until the cooldown is up, 0 if they can go ahead or b is nil.
+func (b *circuitBreaker) wait(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	return 0
+}
+
+// failed counts a call to the SDR that failed at now, and trips the breaker if it is the Failures'th in a row.
+// Calls that were already under way when it tripped don't trip it again.
+func (b *circuitBreaker) failed(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive++
+	if b.consecutive < b.Failures || now.Before(b.openUntil) {
+		return
+	}
+	b.openUntil = now.Add(b.Cooldown)
+	logError("the sdr failed", b.consecutive, "times in a row, pausing captures for", b.Cooldown, deviceField(b.Device))
+	metrics.breakerTripped(b.Device)
+}
+
+// succeeded counts a call to the SDR that succeeded, which closes the breaker.
+func (b *circuitBreaker) succeeded() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive >= b.Failures {
+		logInfo("the sdr is working again, resuming captures", deviceField(b.Device))
+		metrics.breakerClosed(b.Device)
+	}
+	b.consecutive = 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker("", 3, time.Minute)
+	b.failed(start)
+	b.failed(start)
+	if wait := b.wait(start); wait != 0 {
+		t.Fatalf("breaker waits %v after 2 of 3 failures, want 0", wait)
+	}
+	b.failed(start)
+	if wait := b.wait(start); wait != time.Minute {
+		t.Fatalf("breaker waits %v after 3 failures, want the cooldown", wait)
+	}
+	if wait := b.wait(start.Add(40 * time.Second)); wait != 20*time.Second {
+		t.Errorf("breaker waits %v 40s into the cooldown, want 20s", wait)
+	}
+	// calls that were under way when it tripped don't trip it again.
+	b.failed(start.Add(10 * time.Second))
+	if wait := b.wait(start.Add(40 * time.Second)); wait != 20*time.Second {
+		t.Errorf("breaker waits %v after a failure during the cooldown, want the cooldown unchanged", wait)
+	}
+	if wait := b.wait(start.Add(time.Minute)); wait != 0 {
+		t.Fatalf("breaker waits %v once the cooldown is up, want 0", wait)
+	}
+	// once the cooldown is up, one more failure trips it again straight away.
+	b.failed(start.Add(time.Minute))
+	if wait := b.wait(start.Add(time.Minute)); wait != time.Minute {
+		t.Errorf("breaker waits %v after failing again after the cooldown, want the cooldown", wait)
+	}
+}
+
+func TestCircuitBreakerSuccessResets(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker("", 2, time.Minute)
+	b.failed(now)
+	b.succeeded()
+	b.failed(now)
+	if wait := b.wait(now); wait != 0 {
+		t.Errorf("breaker waits %v after failures that a success split up, want 0", wait)
+	}
+	b.failed(now)
+	if wait := b.wait(now); wait != time.Minute {
+		t.Errorf("breaker waits %v after 2 failures in a row, want the cooldown", wait)
+	}
+	b.succeeded()
+	b.failed(now.Add(time.Minute))
+	if wait := b.wait(now.Add(time.Minute)); wait != 0 {
+		t.Errorf("breaker waits %v after one failure after closing, want 0", wait)
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *circuitBreaker
+	b.failed(time.Now())
+	b.succeeded()
+	if wait := b.wait(time.Now()); wait != 0 {
+		t.Errorf("nil breaker waits %v, want 0", wait)
+	}
+}
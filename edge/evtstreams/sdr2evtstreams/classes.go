@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// classLabels names the values of the output of a model that scores several classes, like a softmax over
+// speech, music and noise, so that the scores say how likely each class is.
+type classLabels struct {
+	// Labels are the names of the classes, in the order of the output.
+	Labels []string
+	// Good are the indexes of the classes whose probabilities add up to the goodness, only the first if empty.
+	Good []int
+}
+
+// loadClassLabels reads the labels from the file at path, one per line, and looks up the good labels among them.
+// Blank lines and lines starting with # are skipped.
+func loadClassLabels(path string, good []string) (c *classLabels, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	c = &classLabels{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		label := strings.TrimSpace(scanner.Text())
+		if label == "" || strings.HasPrefix(label, "#") {
+			continue
+		}
+		if c.index(label) >= 0 {
+			return nil, fmt.Errorf("label %s is in %s twice", label, path)
+		}
+		c.Labels = append(c.Labels, label)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(c.Labels) == 0 {
+		return nil, fmt.Errorf("no labels in %s", path)
+	}
+	for _, label := range good {
+		i := c.index(strings.TrimSpace(label))
+		if i < 0 {
+			return nil, fmt.Errorf("good label %s is not in %s", label, path)
+		}
+		c.Good = append(c.Good, i)
+	}
+	return
+}
+
+// index is the index of label, -1 if it isn't one of the labels.
+func (c *classLabels) index(label string) int {
+	for i, l := range c.Labels {
+		if l == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply sets the Classes of s from the values of the output, and its Value to the sum of the good classes.
+func (c *classLabels) apply(values []float32, s *audioScore) error {
+	if len(values) != len(c.Labels) {
+		return fmt.Errorf("the model output has %d values, but there are %d labels", len(values), len(c.Labels))
+	}
+	s.Classes = make(map[string]float32, len(values))
+	for i, value := range values {
+		s.Classes[c.Labels[i]] = value
+	}
+	if len(c.Good) == 0 {
+		s.Value = values[0]
+		return nil
+	}
+	s.Value = 0
+	for _, i := range c.Good {
+		s.Value += values[i]
+	}
+	return nil
+}
+
+// topClasses returns the k most likely of classes, or all of them if k is 0.
+func topClasses(classes map[string]float32, k int) map[string]float32 {
+	if k <= 0 || len(classes) <= k {
+		return classes
+	}
+	labels := make([]string, 0, len(classes))
+	for label := range classes {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if classes[labels[i]] != classes[labels[j]] {
+			return classes[labels[i]] > classes[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	top := make(map[string]float32, k)
+	for _, label := range labels[:k] {
+		top[label] = classes[label]
+	}
+	return top
+}
+
+// classThresholds are the thresholds of the classes that audio is published for, by label. Audio that any
+// of them scores over its threshold in is published, whatever its goodness.
+type classThresholds map[string]float32
+
+// parseClassThresholds parses a comma-separated list of thresholds like speech=0.6,music=0.9.
+func parseClassThresholds(spec string) (t classThresholds, err error) {
+	t = classThresholds{}
+	for _, thresholdSpec := range strings.Split(spec, ",") {
+		thresholdSpec = strings.TrimSpace(thresholdSpec)
+		eq := strings.LastIndex(thresholdSpec, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("bad threshold %q in CLASS_THRESHOLDS, must be like speech=0.6", thresholdSpec)
+		}
+		threshold, err := strconv.ParseFloat(thresholdSpec[eq+1:], 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad threshold %q in CLASS_THRESHOLDS, must be like speech=0.6", thresholdSpec)
+		}
+		t[thresholdSpec[:eq]] = float32(threshold)
+	}
+	return
+}
+
+// check returns an error if any of the classes of t is not one of labels.
+func (t classThresholds) check(labels *classLabels) error {
+	for label := range t {
+		if labels == nil || labels.index(label) < 0 {
+			return fmt.Errorf("CLASS_THRESHOLDS has class %s, which is not in MODEL_LABELS_FILE", label)
+		}
+	}
+	return nil
+}
+
+// over reports whether any class of s scores over its threshold in t.
+func (t classThresholds) over(s audioScore) bool {
+	for label, threshold := range t {
+		if s.Classes[label] > threshold {
+			return true
+		}
+	}
+	return false
+}
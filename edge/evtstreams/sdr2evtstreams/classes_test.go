@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseClassThresholds(t *testing.T) {
+	tests := []struct {
+		spec string
+		want classThresholds
+	}{
+		{"speech=0.6", classThresholds{"speech": 0.6}},
+		{"speech=0.6, music=0.9", classThresholds{"speech": 0.6, "music": 0.9}},
+		{"speech=0.6,speech=0.8", classThresholds{"speech": 0.8}},
+		{"a=b=0.5", classThresholds{"a=b": 0.5}},
+	}
+	for _, test := range tests {
+		got, err := parseClassThresholds(test.spec)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseClassThresholds(%q) = %v, %v, want %v", test.spec, got, err, test.want)
+		}
+	}
+}
+
+func TestParseClassThresholdsErrors(t *testing.T) {
+	for _, spec := range []string{"", "speech", "=0.6", "speech=", "speech=high", "speech=0.6,", "speech=0.6,music"} {
+		if got, err := parseClassThresholds(spec); err == nil {
+			t.Errorf("parseClassThresholds(%q) = %v, want an error", spec, got)
+		}
+	}
+}
+
+func TestClassThresholdsCheck(t *testing.T) {
+	labels := &classLabels{Labels: []string{"speech", "music", "noise"}}
+	thresholds := classThresholds{"speech": 0.6, "music": 0.9}
+	if err := thresholds.check(labels); err != nil {
+		t.Errorf("check of labelled classes failed: %v", err)
+	}
+	thresholds["silence"] = 0.5
+	if err := thresholds.check(labels); err == nil {
+		t.Error("check of a class that isn't labelled succeeded, want an error")
+	}
+	if err := (classThresholds{"speech": 0.6}).check(nil); err == nil {
+		t.Error("check without labels succeeded, want an error")
+	}
+}
+
+func TestClassThresholdsOver(t *testing.T) {
+	thresholds := classThresholds{"speech": 0.6, "music": 0.9}
+	tests := []struct {
+		classes map[string]float32
+		want    bool
+	}{
+		{map[string]float32{"speech": 0.7, "music": 0.1}, true},
+		{map[string]float32{"speech": 0.05, "music": 0.95}, true},
+		{map[string]float32{"speech": 0.6, "music": 0.9}, false},
+		{map[string]float32{"noise": 1}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := thresholds.over(audioScore{Classes: test.classes}); got != test.want {
+			t.Errorf("over(%v) = %v, want %v", test.classes, got, test.want)
+		}
+	}
+}
+
+func TestClassLabelsApply(t *testing.T) {
+	labels := &classLabels{Labels: []string{"speech", "music", "noise"}}
+	var s audioScore
+	if err := labels.apply([]float32{0.5, 0.3, 0.2}, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Value != 0.5 || !reflect.DeepEqual(s.Classes, map[string]float32{"speech": 0.5, "music": 0.3, "noise": 0.2}) {
+		t.Errorf("applied labels gave value %v and classes %v, want the first class and all of them", s.Value, s.Classes)
+	}
+	labels.Good = []int{0, 1}
+	if err := labels.apply([]float32{0.5, 0.25, 0.25}, &s); err != nil || s.Value != 0.75 {
+		t.Errorf("applied labels gave value %v, %v, want 0.75 from the good classes", s.Value, err)
+	}
+	if err := labels.apply([]float32{0.5, 0.5}, &s); err == nil {
+		t.Error("applied 3 labels to 2 values, want an error")
+	}
+}
+
+func TestLoadClassLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "labels.txt")
+	err = ioutil.WriteFile(path, []byte("# classes\nspeech\n\nmusic\n noise \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := loadClassLabels(path, []string{"music", " speech"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels.Labels, []string{"speech", "music", "noise"}) || !reflect.DeepEqual(labels.Good, []int{1, 0}) {
+		t.Errorf("loaded labels %v with good %v, want [speech music noise] with good [1 0]", labels.Labels, labels.Good)
+	}
+	if _, err := loadClassLabels(path, []string{"silence"}); err == nil {
+		t.Error("loaded labels with good label silence, which isn't one, want an error")
+	}
+}
+
+func TestTopClasses(t *testing.T) {
+	classes := map[string]float32{"speech": 0.5, "music": 0.2, "noise": 0.2, "silence": 0.1}
+	tests := []struct {
+		k    int
+		want map[string]float32
+	}{
+		{0, classes},
+		{4, classes},
+		{1, map[string]float32{"speech": 0.5}},
+		// ties go to the first label in order.
+		{2, map[string]float32{"speech": 0.5, "music": 0.2}},
+	}
+	for _, test := range tests {
+		if got := topClasses(classes, test.k); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("topClasses(%d) = %v, want %v", test.k, got, test.want)
+		}
+	}
+}
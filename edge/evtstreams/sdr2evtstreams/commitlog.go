@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// commitLog gives publishing at least once semantics across restarts. Each message is written to the pending
+// directory of Dir before it is published, and only removed once it is, with a line appended to commit.log of
+// where the brokers put it. The messages still pending at startup were cut off by a crash, and are sent again.
+type commitLog struct {
+	Dir string
+	// MaxBytes is how large commit.log grows before it is moved to commit.log.1 and started over.
+	MaxBytes int64
+	pending  *spool
+	log      *os.File
+	logSize  int64
+}
+
+// messageAck is where the brokers put a message.
+type messageAck struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// commitLogEntry is a line of commit.log.
+type commitLogEntry struct {
+	Ts          int64        `json:"ts"`
+	Freq        int64        `json:"freq"`
+	CaptureID   string       `json:"captureID,omitempty"`
+	PublishedAt int64        `json:"publishedAt"`
+	Acks        []messageAck `json:"acks,omitempty"`
+}
+
+// ackingPublisher is a Publisher that knows where the brokers put the messages of its last publish.
+type ackingPublisher interface {
+	lastAcks() []messageAck
+}
+
+// newCommitLog opens the commit log in dir, raw keeps the raw audio of the pending messages as well.
+func newCommitLog(dir string, maxBytes int64, raw bool) (c *commitLog, err error) {
+	pendingDir := filepath.Join(dir, "pending")
+	err = os.MkdirAll(pendingDir, 0755)
+	if err != nil {
+		return
+	}
+	c = &commitLog{Dir: dir, MaxBytes: maxBytes, pending: &spool{Dir: pendingDir, MaxBytes: math.MaxInt64, Raw: raw}}
+	files, err := ioutil.ReadDir(pendingDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		// a .tmp file is a message that was never published, as it was still being written.
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			os.Remove(filepath.Join(pendingDir, file.Name()))
+		} else if strings.HasSuffix(file.Name(), ".json") {
+			c.pending.names = append(c.pending.names, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(c.pending.names)
+	err = c.openLog()
+	return
+}
+
+func (c *commitLog) openLog() (err error) {
+	c.log, err = os.OpenFile(filepath.Join(c.Dir, "commit.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	info, err := c.log.Stat()
+	if err == nil {
+		c.logSize = info.Size()
+	}
+	return
+}
+
+// begin writes audioMsg to the pending messages before it is published, and returns its name for commit.
+// If it can't be written it is published all the same, just without the guarantee, and name is empty.
+func (c *commitLog) begin(audioMsg *audiolib.AudioMsg, raw []byte) (name string) {
+	name, err := c.pending.write(audioMsg, raw)
+	if err != nil {
+		logError("can't write the message to the commit log, publishing it anyway:", err, field("freq", audioMsg.Freq))
+		return ""
+	}
+	return
+}
+
+// commit records that the message name was published with p, and removes it from the pending messages.
+func (c *commitLog) commit(name string, audioMsg *audiolib.AudioMsg, p Publisher) {
+	entry := commitLogEntry{Ts: audioMsg.Ts, Freq: audioMsg.Freq, CaptureID: audioMsg.CaptureID, PublishedAt: time.Now().Unix()}
+	if ap, ok := p.(ackingPublisher); ok {
+		entry.Acks = ap.lastAcks()
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		err = c.append(append(line, '\n'))
+	}
+	if err != nil {
+		logError("can't append to the commit log:", err)
+	}
+	c.abandon(name)
+}
+
+// abandon removes the message name from the pending messages without recording it, once its failure was
+// dealt with and it must not be sent again.
+func (c *commitLog) abandon(name string) {
+	if name != "" {
+		c.pending.remove(name)
+	}
+}
+
+func (c *commitLog) append(line []byte) error {
+	if c.logSize+int64(len(line)) > c.MaxBytes {
+		c.log.Close()
+		path := filepath.Join(c.Dir, "commit.log")
+		err := os.Rename(path, path+".1")
+		if err == nil {
+			err = c.openLog()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	n, err := c.log.Write(line)
+	c.logSize += int64(n)
+	return err
+}
+
+// recover publishes the messages that were still pending when the service last stopped, oldest first. Those that
+// fail are handed to s if it isn't nil, or else kept pending for the next start.
+// The pending messages were cut off while the node was publishing, so a standby node sends them all the same, with
+// the Publisher of the active role. Those that fail are kept pending then, as s drains through the standbyPublisher.
+func (c *commitLog) recover(p Publisher, s *spool) {
+	if active := activePublisher(p); active != p {
+		p, s = active, nil
+	}
+	names := c.pending.names
+	c.pending.names = nil
+	if len(names) > 0 {
+		logInfo("sending again the", len(names), "messages that were not acknowledged before the service stopped")
+	}
+	for _, name := range names {
+		audioMsg, raw, err := c.pending.read(name)
+		if err != nil {
+			logError("dropping pending message", name, "that can't be read:", err)
+			c.pending.remove(name)
+			continue
+		}
+		err = publishMessage(p, audioMsg, raw)
+		metrics.publishedOne(err)
+		if err == nil {
+			c.commit(name, audioMsg, p)
+		} else if s != nil && s.add(audioMsg, raw) {
+			c.pending.remove(name)
+		} else {
+			logWarn("can't send the pending message again, keeping it for the next start:", err, field("freq", audioMsg.Freq))
+		}
+	}
+}
+
+func (c *commitLog) close() error {
+	return c.log.Close()
+}
+
+// lastAcks are where the brokers put the messages of the last publishAudio, none when publishing asynchronously.
+func (conn *evtstreamsConn) lastAcks() []messageAck {
+	return conn.acks
+}
+
+func (f *fanoutPublisher) lastAcks() (acks []messageAck) {
+	for _, p := range f.Publishers {
+		if ap, ok := p.(ackingPublisher); ok {
+			acks = append(acks, ap.lastAcks()...)
+		}
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// failingPublisher fails to publish every message.
+type failingPublisher struct{}
+
+func (failingPublisher) publishAudio(audioMsg *audiolib.AudioMsg) error {
+	return errors.New("can't publish")
+}
+
+// crashedCommitLog is a commit log in a new directory with a message that was never committed, as after a crash,
+// reopened as at the next start.
+func crashedCommitLog(t *testing.T) *commitLog {
+	dir, err := ioutil.TempDir("", "commitlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c, err := newCommitLog(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.begin(&audiolib.AudioMsg{Freq: 88500000, Ts: 1}, nil) == "" {
+		t.Fatal("can't write the message to the commit log")
+	}
+	c.close()
+	c, err = newCommitLog(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.close() })
+	return c
+}
+
+// pendingFiles is how many messages are pending in c on disk.
+func pendingFiles(t *testing.T, c *commitLog) int {
+	files, err := filepath.Glob(filepath.Join(c.pending.Dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func testSpool(t *testing.T) *spool {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := newSpool(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCommitLogRecover(t *testing.T) {
+	c := crashedCommitLog(t)
+	p := &recordingPublisher{}
+	c.recover(p, nil)
+	if len(p.Msgs) != 1 || p.Msgs[0].Freq != 88500000 {
+		t.Errorf("recovered %+v, want the pending message", p.Msgs)
+	}
+	if n := pendingFiles(t, c); n != 0 {
+		t.Errorf("%d messages are still pending after they were sent, want none", n)
+	}
+}
+
+func TestCommitLogRecoverOnStandby(t *testing.T) {
+	c := crashedCommitLog(t)
+	p := &recordingPublisher{}
+	standby := &standbyPublisher{Publisher: p}
+	c.recover(standby, testSpool(t))
+	if len(p.Msgs) != 1 || standby.Suppressed != 0 {
+		t.Errorf("recovered %d messages and suppressed %d on a standby node, want the pending one sent", len(p.Msgs), standby.Suppressed)
+	}
+	if n := pendingFiles(t, c); n != 0 {
+		t.Errorf("%d messages are still pending after they were sent, want none", n)
+	}
+}
+
+func TestCommitLogRecoverFailure(t *testing.T) {
+	// an active node spools the messages that fail again.
+	c := crashedCommitLog(t)
+	s := testSpool(t)
+	c.recover(failingPublisher{}, s)
+	if len(s.names) != 1 || pendingFiles(t, c) != 0 {
+		t.Errorf("%d messages spooled and %d pending after failing, want the message moved to the spool", len(s.names), pendingFiles(t, c))
+	}
+	// a standby keeps them pending, as the spool would drain them into the standby.
+	c = crashedCommitLog(t)
+	s = testSpool(t)
+	c.recover(&standbyPublisher{Publisher: failingPublisher{}}, s)
+	if len(s.names) != 0 || pendingFiles(t, c) != 1 {
+		t.Errorf("%d messages spooled and %d pending after failing on a standby node, want the message kept pending", len(s.names), pendingFiles(t, c))
+	}
+}
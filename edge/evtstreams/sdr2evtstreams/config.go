@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// configType is what kind of value a configVar holds, so that a bad value is caught by validateConfig at startup.
+type configType string
+
+const (
+	configString   configType = "string"
+	configInt      configType = "int"
+	configFloat    configType = "float"
+	configBool     configType = "bool"
+	configDuration configType = "duration"
+)
+
+// configVar describes a setting of the service. Each can be given as an env var of its Name,
+// as a flag named like it in lower case with dashes, or in the file given with -config.
+type configVar struct {
+	Name    string
+	Type    configType
+	Default string
+	Usage   string
+}
+
+// configVars is every setting the service reads. configEnv refuses to read any other,
+// so that -help, which prints this table, can't drift from what is actually parsed.
+var configVars = []configVar{
+	{"HZN_ORG_ID", configString, "", "the org of the node, set by Horizon, HZN_ORGANIZATION is used if it is not set"},
+	{"HZN_ORGANIZATION", configString, "", "the org of the node, for older versions of Horizon"},
+	{"HZN_DEVICE_ID", configString, "", "the id of the node, set by Horizon"},
+	{"VERBOSE", configInt, "0", "set to 1 to log everything, same as LOG_LEVEL=debug"},
+	{"LOG_LEVEL", configString, "info", "one of error, warn, info or debug, overrides VERBOSE"},
+	{"LOG_FORMAT", configString, "text", "one of text, json or logfmt"},
+	{"RTLSDR_ADDR", configString, hostname, "the address of the sdr service"},
+	{"RTLSDR_MAX_CAPTURES", configInt, "1", "how many stations the sdr service can capture from at once"},
+	{"RTLSDR_FREQS_TIMEOUT", configDuration, "2m", "how long a scan for stations by the sdr service may take, 0 waits for ever"},
+	{"RTLSDR_AUDIO_TIMEOUT", configDuration, "2m", "how long a capture of audio or RDS by the sdr service may take, 0 waits for ever"},
+	{"RTLSDR_STREAM", configBool, "false", "set to true to stream the audio from the sdr service as it is captured, which needs an sdr service with /stream"},
+	{"RDS", configBool, "false", "set to true to name the station of each message by the call sign and name in its RDS"},
+	{"RDS_MAX_AGE", configDuration, "6h", "with RDS, how long the RDS of a station is kept before it is listened to again"},
+	{"SNR", configBool, "false", "set to true to measure the signal to noise ratio of each station when it is captured, send it in the messages, and sample weak stations less"},
+	{"SNR_MIN_DB", configFloat, "6", "with SNR, the SNR in dB at or under which a station is sampled least, a tenth as often"},
+	{"SNR_GOOD_DB", configFloat, "20", "with SNR, the SNR in dB from which a station is sampled as often as its goodness says"},
+	{"SDR_BACKEND", configString, "rtlsdr", "rtlsdr, usb to capture from a dongle attached to this device without the sdr service, or mock to make up stations and audio"},
+	{"DEMOD_MODE", configString, "wfm", "how the audio of the stations is demodulated, wfm for broadcast FM, nfm for narrow FM like NOAA weather radio, or am for airband"},
+	{"CAPTURE_MODE", configString, "audio", "audio to score and publish the audio of the stations, or iq to publish their raw IQ samples without scoring them"},
+	{"IQ_SAMPLE_RATE", configInt, "240000", "with CAPTURE_MODE=iq, how many IQ samples a second to capture"},
+	{"IQ_GAIN", configFloat, "0", "with CAPTURE_MODE=iq, the gain of the tuner in dB, 0 for automatic"},
+	{"IQ_SECONDS", configFloat, "1", "with CAPTURE_MODE=iq, how long each capture of IQ samples lasts, at most 10 seconds"},
+	{"SCAN_START", configInt, "85900000", "the first channel in Hz of the band to scan for stations, like 162400000 for NOAA weather radio, the FM band if none of the SCAN_ settings are set"},
+	{"SCAN_STOP", configInt, "109900000", "the last channel in Hz of the band to scan for stations"},
+	{"SCAN_STEP", configInt, "200000", "how far apart the channels of the band to scan are in Hz"},
+	{"SCAN_SQUELCH", configFloat, "-8", "the power in dB that a channel must be over for the sdr service to count it as a station"},
+	{"SDR_DEVICES", configString, "", "the comma-separated sdr service addresses, or dongle numbers with SDR_BACKEND=usb, to capture from at once, each in its own loop, RTLSDR_ADDR or RTLSDR_DEVICE if not set"},
+	{"RTLSDR_DEVICE", configInt, "0", "with SDR_BACKEND=usb, the number of the dongle to capture from, 0 for the first one"},
+	{"GOODNESS_MIN", configFloat, "0.05", "the least goodness a station can have, so it is still sampled now and then"},
+	{"GOODNESS_MAX", configFloat, "0.9", "the most goodness a station can have, so other stations still get sampled"},
+	{"GOODNESS_LEARNING_RATE", configFloat, "0", "how far the goodness moves toward each score, 0 is the original multiplicative rule"},
+	{"GOODNESS_IDLE_HALF_LIFE", configDuration, "0", "how long the goodness of a station that isn't sampled takes to decay halfway back to 0.5, 0 doesn't decay it"},
+	{"GOODNESS_FILE", configString, "", "a JSON file to keep the goodness of the stations in across restarts, off if not set"},
+	{"GOODNESS_SAVE_INTERVAL", configDuration, "5m", "how often the goodness is saved to GOODNESS_FILE, it is also saved on shutdown"},
+	{"GOODNESS_HALF_LIFE", configDuration, "24h", "how long a saved goodness takes to decay halfway back to 0.5, 0 doesn't decay it"},
+	{"CAPTURE_WORKERS", configInt, "1", "how many stations are captured from at once, up to what the sdr can do"},
+	{"PIPELINE_WORKERS", configInt, "1", "how many chunks of audio are scored at once"},
+	{"PIPELINE_QUEUE", configInt, "1", "how many chunks of audio can wait to be scored, and to be published"},
+	{"STATIONS_REFRESH", configString, "fixed", "fixed scans every STATIONS_REFRESH_INTERVAL, adaptive scans sooner or later depending on the stations"},
+	{"STATIONS_REFRESH_INTERVAL", configDuration, "5m", "how often to scan for stations, with adaptive how often after a scan that found new stations"},
+	{"STATIONS_REFRESH_MIN", configDuration, "1m", "with adaptive, the wait after a scan that found fewer than STATIONS_REFRESH_FEW stations"},
+	{"STATIONS_REFRESH_MAX", configDuration, "30m", "with adaptive, the longest wait between scans while the stations don't change"},
+	{"STATIONS_REFRESH_FEW", configInt, "3", "with adaptive, scans finding fewer stations than this are retried after STATIONS_REFRESH_MIN"},
+	{"STATIONS_REFRESH_DROP", configFloat, "0.3", "with adaptive, scan early when the mean value drops by this fraction, 0 doesn't"},
+	{"STATION_SELECTOR", configString, "goodness", "how stations are picked on each pass: goodness, epsilon-greedy, ucb1 or thompson"},
+	{"EXPLORE_EPSILON", configFloat, "0", "the chance on each pass of also sampling a random station, whatever its goodness"},
+	{"EXPLORE_FLOOR", configFloat, "0.05", "with epsilon-greedy, the chance of sampling each station that wasn't picked"},
+	{"STATIONS_PER_PASS", configInt, "1", "how many stations the epsilon-greedy, ucb1 and thompson selectors pick on each pass"},
+	{"UCB_C", configFloat, "1", "with ucb1, how much to favor stations that were sampled less"},
+	{"FIXED_STATIONS", configString, "", "comma-separated frequencies in Hz to sample instead of scanning for stations"},
+	{"STATIONS_INCLUDE", configString, "", "comma-separated frequencies in Hz to sample whether or not a scan finds them"},
+	{"STATIONS_EXCLUDE", configString, "", "comma-separated frequencies in Hz to never sample, even if a scan finds them"},
+	{"GPS_ADDR", configString, gpshostname, "the address of the gps service"},
+	{"USE_GPS", configBool, "true", "set to false to not get the location from the gps service"},
+	{"GPS_SOURCE", configString, "gps", "where the location comes from, gps for the gps service, static, gpsd or nmea"},
+	{"LATITUDE", configString, "", "with GPS_SOURCE=static, the latitude of the node in degrees"},
+	{"LONGITUDE", configString, "", "with GPS_SOURCE=static, the longitude of the node in degrees"},
+	{"ALTITUDE", configString, "", "with GPS_SOURCE=static, the altitude of the node in meters above sea level"},
+	{"GPSD_ADDR", configString, "localhost:2947", "with GPS_SOURCE=gpsd, the address of gpsd"},
+	{"GPS_DEVICE", configString, "", "with GPS_SOURCE=nmea, the serial device of the GPS receiver, like /dev/ttyUSB0"},
+	{"GPS_MAX_AGE", configDuration, "1m", "with gpsd or nmea, how old the last fix may be before the location is unknown"},
+	{"AUDIO_SAMPLE_RATE", configInt, "16000", "the sample rate in Hz of the raw audio"},
+	{"AUDIO_BYTES_PER_SAMPLE", configInt, "2", "the width in bytes of each sample of the raw audio"},
+	{"AUDIO_CODEC", configString, "mp3", "what the audio of each message is encoded with, mp3, flac, wav, or gzip for gzipped wav"},
+	{"AUDIO_ENCRYPTION_KEY", configString, "", "a base64 AES key of 16, 24 or 32 bytes to encrypt the audio of each message with, in the clear if not set"},
+	{"AUDIO_ENCRYPTION_KEY_FILE", configString, "", "a file to read AUDIO_ENCRYPTION_KEY from instead, like a mounted secret"},
+	{"AUDIO_ENCRYPTION_KEY_ID", configString, "", "the name of AUDIO_ENCRYPTION_KEY, sent in the keyID of each message"},
+	{"DEVICE_SIGNING_KEY", configString, "", "a PEM Ed25519 private key, or its base64 seed, to sign each message sent to evtstreams or http with"},
+	{"DEVICE_SIGNING_KEY_FILE", configString, "", "a file to read DEVICE_SIGNING_KEY from instead, like a mounted secret"},
+	{"DEVICE_SIGNING_KEY_ID", configString, "", "the name of DEVICE_SIGNING_KEY sent with each signature, HZN_ORG_ID/HZN_DEVICE_ID if not set"},
+	{"CAPTURE_SECONDS", configFloat, "29.328", "how many seconds of audio each capture is, up to 300, streamed from the sdr service if not 29.328"},
+	{"AUDIO_LENGTH_MODE", configString, "fit", "fit to pad or truncate captures of the wrong length, or error to drop them"},
+	{"NOISE_GATE", configBool, "false", "set to true to skip scoring audio that is silent or only static, which then scores 0"},
+	{"NOISE_GATE_MIN_DBFS", configFloat, "-50", "with NOISE_GATE, the power in dBFS under which audio is silent"},
+	{"NOISE_GATE_MIN_RANGE_DB", configFloat, "6", "with NOISE_GATE, how many dB the loudness of audio must vary by for it not to be static"},
+	{"WINDOW_HOP_SECONDS", configFloat, "0", "score captures in windows of MODEL_INPUT_SECONDS, one starting every this many seconds, and publish each window over the threshold, 0 scores whole captures"},
+	{"AUDIO_PREPROCESS", configBool, "false", "set to true to remove the DC offset and normalize audio before it is scored"},
+	{"MODEL_BACKEND", configString, "tensorflow", "the inference backend, tensorflow, tflite or onnx, or mock to score audio randomly"},
+	{"ONNXRUNTIME_LIB", configString, "", "with MODEL_BACKEND=onnx, the path of the ONNX Runtime shared library, onnxruntime.so on the library path if not set"},
+	{"MODEL_PATH", configString, "model.pb", "a frozen graph def file or a SavedModel directory"},
+	{"MODEL_URL", configString, "", "an http or https URL to download a frozen graph def file from at startup instead of MODEL_PATH"},
+	{"MODEL_SHA256", configString, "", "with MODEL_URL, the hex SHA-256 the downloaded model must have"},
+	{"MODEL_CACHE_DIR", configString, "", "with MODEL_URL, the directory to keep the downloaded models in, sdr2evtstreams-models in the temp directory if not set"},
+	{"MODEL_CA_FILE", configString, "", "with MODEL_URL, a PEM file of CA certificates to trust as well as the system ones"},
+	{"MODEL_DOWNLOAD_TIMEOUT", configDuration, "5m", "with MODEL_URL, how long each try at downloading the model may take"},
+	{"MODEL_TAGS", configString, "serve", "the comma-separated tags to load a SavedModel with"},
+	{"MODEL_NAME", configString, "", "the name of the model sent in each message, the file name of MODEL_PATH if not set"},
+	{"MODEL_VERSION", configString, "", "the version of the model, sent in each message and in its modelVersion header"},
+	{"MODEL_SKIP_OP_CHECK", configBool, "false", "set to true to not check the model OPs against the whitelist"},
+	{"MODEL_WARMUP", configBool, "true", "set to false to skip the warmup inference at startup"},
+	{"MODEL_RELOAD_INTERVAL", configDuration, "0", "how often to check MODEL_PATH for a new model to swap in, 0 never checks"},
+	{"MODEL_SAMPLE_RATE", configInt, "", "the sample rate in Hz of the audio the model takes, AUDIO_SAMPLE_RATE if not set"},
+	{"MODEL_SAMPLE_FORMAT", configString, "", "the sample format of the audio the model takes, u8, s16le, s24le, s32le or f32le, that of the captured audio if not set"},
+	{"MODEL_CHANNELS", configInt, "1", "the number of channels of the audio the model takes, 1 or 2"},
+	{"MODEL_INPUT_SECONDS", configFloat, "29.328", "how many seconds of audio the model takes, captures of other lengths are padded or truncated to it"},
+	{"MODEL_INPUT_OP", configString, "input/Placeholder", "the name of the placeholder OP that the audio is fed into"},
+	{"MODEL_OUTPUT_OP", configString, "output", "the name of the OP that holds the speech probability"},
+	{"MODEL_OUTPUT_INDEX", configInt, "0", "the port of MODEL_OUTPUT_OP that holds the speech probability"},
+	{"MODEL_EXTRA_OUTPUTS", configString, "", "comma-separated name or name:index outputs to include in the messages"},
+	{"MODEL_MAX_FAILURES", configInt, "0", "how many inferences in a row may fail before the node stops scoring, 0 panics on the first"},
+	{"INCLUDE_LOGITS", configBool, "false", "set to true to include the whole model output in the messages"},
+	{"MODEL_LABELS_FILE", configString, "", "a file with the label of each class the model output scores, one per line, for a model that scores several"},
+	{"MODEL_GOOD_LABELS", configString, "", "with MODEL_LABELS_FILE, the comma-separated labels whose probabilities add up to the goodness, the first label if not set"},
+	{"MODEL_TOP_CLASSES", configInt, "0", "with MODEL_LABELS_FILE, how many of the most likely classes to send in each message, 0 sends all"},
+	{"REPLAY_DIR", configString, "", "score the audio files in this directory instead of audio from the SDR, then exit"},
+	{"REPLAY_PUBLISH", configBool, "false", "set to true to publish the replayed files that score over 0.5"},
+	{"PUBLISH_THRESHOLD", configFloat, "0.5", "the value audio must score over to be published"},
+	{"CLASS_THRESHOLDS", configString, "", "with MODEL_LABELS_FILE, thresholds like speech=0.6,music=0.9 to publish audio that any class scores over instead"},
+	{"THRESHOLD_SCHEDULE", configString, "", "time of day windows with their own threshold, like 06:00-10:00=0.3,22:00-02:00=0.4"},
+	{"NODE_ROLE", configString, "active", "active, or standby to run everything but publish nothing"},
+	{"PUBLISH_BACKEND", configString, "evtstreams", "evtstreams, mqtt, nats, grpc, http, file to write the messages to FILE_SINK_DIR, or mock to only log them, or a comma-separated list to publish to several"},
+	{"MQTT_BROKER_URL", configString, "", "with PUBLISH_BACKEND=mqtt, the broker to publish to, like tcp://broker:1883 or ssl://broker:8883"},
+	{"MQTT_TOPIC", configString, "sdr/{devID}/{freq}", "with PUBLISH_BACKEND=mqtt, the topic, {devID}, {freq} and {origin} are replaced by those of the message"},
+	{"MQTT_QOS", configInt, "1", "with PUBLISH_BACKEND=mqtt, 0 to publish at most once, 1 to wait for the broker to acknowledge each message"},
+	{"MQTT_CLIENT_ID", configString, "", "with PUBLISH_BACKEND=mqtt, the client ID, sdr2evtstreams-HZN_DEVICE_ID if not set"},
+	{"MQTT_USERNAME", configString, "", "with PUBLISH_BACKEND=mqtt, the user name to connect with"},
+	{"MQTT_PASSWORD", configString, "", "with PUBLISH_BACKEND=mqtt, the password to connect with"},
+	{"MQTT_PASSWORD_FILE", configString, "", "a file to read MQTT_PASSWORD from instead, like a mounted secret"},
+	{"MQTT_CA_FILE", configString, "", "with an ssl MQTT_BROKER_URL, a PEM file of CAs to trust as well as the system ones"},
+	{"MQTT_CERT_FILE", configString, "", "with an ssl MQTT_BROKER_URL, a PEM client certificate to connect with"},
+	{"MQTT_KEY_FILE", configString, "", "the PEM key of MQTT_CERT_FILE"},
+	{"MQTT_TIMEOUT", configDuration, "30s", "with PUBLISH_BACKEND=mqtt, how long connecting and each publish may take"},
+	{"NATS_URL", configString, "", "with PUBLISH_BACKEND=nats, the server to publish to, like nats://server:4222 or tls://server:4222"},
+	{"NATS_SUBJECT", configString, "sdr.{devID}.{freq}", "with PUBLISH_BACKEND=nats, the subject, {devID}, {freq} and {origin} are replaced by those of the message"},
+	{"NATS_JETSTREAM", configBool, "false", "with PUBLISH_BACKEND=nats, set to true to wait for a JetStream stream to store each message"},
+	{"NATS_STREAM", configString, "", "with PUBLISH_BACKEND=nats, a JetStream stream to publish to, made for NATS_SUBJECT if it does not exist"},
+	{"NATS_TOKEN", configString, "", "with PUBLISH_BACKEND=nats, the token to connect with"},
+	{"NATS_TOKEN_FILE", configString, "", "a file to read NATS_TOKEN from instead, like a mounted secret"},
+	{"NATS_USERNAME", configString, "", "with PUBLISH_BACKEND=nats, the user name to connect with"},
+	{"NATS_PASSWORD", configString, "", "with PUBLISH_BACKEND=nats, the password to connect with"},
+	{"NATS_PASSWORD_FILE", configString, "", "a file to read NATS_PASSWORD from instead, like a mounted secret"},
+	{"NATS_CA_FILE", configString, "", "with a tls NATS_URL, a PEM file of CAs to trust as well as the system ones"},
+	{"NATS_CERT_FILE", configString, "", "with a tls NATS_URL, a PEM client certificate to connect with"},
+	{"NATS_KEY_FILE", configString, "", "the PEM key of NATS_CERT_FILE"},
+	{"NATS_TIMEOUT", configDuration, "30s", "with PUBLISH_BACKEND=nats, how long connecting and each publish may take"},
+	{"GRPC_URL", configString, "", "with PUBLISH_BACKEND=grpc, the https URL of the AudioIngest service in audiomsg.proto"},
+	{"GRPC_CERT_FILE", configString, "", "with PUBLISH_BACKEND=grpc, the PEM client certificate to connect with"},
+	{"GRPC_KEY_FILE", configString, "", "the PEM key of GRPC_CERT_FILE"},
+	{"GRPC_CA_FILE", configString, "", "with PUBLISH_BACKEND=grpc, a PEM file of CAs to trust as well as the system ones"},
+	{"GRPC_TOKEN", configString, "", "with PUBLISH_BACKEND=grpc, a bearer token to send as well"},
+	{"GRPC_TOKEN_FILE", configString, "", "a file to read GRPC_TOKEN from instead, like a mounted secret"},
+	{"GRPC_TIMEOUT", configDuration, "30s", "with PUBLISH_BACKEND=grpc, how long each message may take to be acknowledged"},
+	{"HTTP_SINK_URL", configString, "", "with PUBLISH_BACKEND=http, the endpoint to POST the messages to"},
+	{"HTTP_SINK_FORMAT", configString, "json", "with PUBLISH_BACKEND=http, json or protobuf, the AudioMsg of audiomsg.proto"},
+	{"HTTP_SINK_TOKEN", configString, "", "with PUBLISH_BACKEND=http, the bearer token to send"},
+	{"HTTP_SINK_TOKEN_FILE", configString, "", "a file to read HTTP_SINK_TOKEN from instead, like a mounted secret"},
+	{"HTTP_SINK_CHUNK_BYTES", configInt, "1048576", "with PUBLISH_BACKEND=http, upload messages longer than this in resumable chunks, 0 never does"},
+	{"HTTP_SINK_CA_FILE", configString, "", "with PUBLISH_BACKEND=http, a PEM file of CAs to trust as well as the system ones"},
+	{"HTTP_SINK_CERT_FILE", configString, "", "with PUBLISH_BACKEND=http, a PEM client certificate to connect with"},
+	{"HTTP_SINK_KEY_FILE", configString, "", "the PEM key of HTTP_SINK_CERT_FILE"},
+	{"HTTP_SINK_TIMEOUT", configDuration, "30s", "with PUBLISH_BACKEND=http, how long each request may take"},
+	{"FILE_SINK_DIR", configString, "", "with PUBLISH_BACKEND=file, the directory to write WAV and JSON files to"},
+	{"FILE_SINK_SEGMENT_BYTES", configInt, "104857600", "with PUBLISH_BACKEND=file, how many bytes go into each segment directory"},
+	{"FILE_SINK_MAX_SEGMENTS", configInt, "10", "with PUBLISH_BACKEND=file, how many segments to keep, 0 keeps them all"},
+	{"DRY_RUN", configBool, "false", "set to true to run the whole loop but only log the messages, same as PUBLISH_BACKEND=mock"},
+	{"EVTSTREAMS_BROKER_URL", configString, "", "the comma-separated brokers of IBM Event Streams"},
+	{"EVTSTREAMS_API_KEY", configString, "", "the API key of IBM Event Streams"},
+	{"EVTSTREAMS_API_KEY_FILE", configString, "", "a file to read the API key from instead, like a mounted secret"},
+	{"EVTSTREAMS_TOPIC", configString, "", "the topic to publish to"},
+	{"EVTSTREAMS_TOPIC_ROUTES", configString, "", "topics for the messages that score at least a threshold, like 0.9=sdr-speech,0.6=sdr-review, the rest go to EVTSTREAMS_TOPIC"},
+	{"EVTSTREAMS_SECURITY", configString, "sasl_ssl", "sasl_ssl, ssl for TLS without SASL, or plaintext for a local Kafka"},
+	{"EVTSTREAMS_CA_FILE", configString, "", "a PEM file of CAs to trust the brokers by, besides the system ones"},
+	{"EVTSTREAMS_CERT_FILE", configString, "", "a PEM client certificate to present to the brokers, with EVTSTREAMS_KEY_FILE"},
+	{"EVTSTREAMS_KEY_FILE", configString, "", "the PEM key of EVTSTREAMS_CERT_FILE"},
+	{"EVTSTREAMS_TLS_INSECURE_SKIP_VERIFY", configBool, "false", "set to true to not verify the certificates of the brokers, only for testing"},
+	{"EVTSTREAMS_SASL_MECHANISM", configString, "PLAIN", "with sasl_ssl, PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER"},
+	{"EVTSTREAMS_SASL_USER", configString, "token", "the user of PLAIN and SCRAM, whose password is EVTSTREAMS_API_KEY"},
+	{"EVTSTREAMS_OAUTH_TOKEN_URL", configString, "https://iam.cloud.ibm.com/identity/token", "with OAUTHBEARER, where to get the token from"},
+	{"EVTSTREAMS_OAUTH_CLIENT_ID", configString, "", "with OAUTHBEARER, the client ID of the client credentials grant, EVTSTREAMS_API_KEY is traded for the token if not set"},
+	{"EVTSTREAMS_OAUTH_CLIENT_SECRET", configString, "", "the secret of EVTSTREAMS_OAUTH_CLIENT_ID"},
+	{"EVTSTREAMS_OAUTH_CLIENT_SECRET_FILE", configString, "", "a file to read EVTSTREAMS_OAUTH_CLIENT_SECRET from instead, like a mounted secret"},
+	{"EVTSTREAMS_OAUTH_SCOPE", configString, "", "with OAUTHBEARER, the scope to ask for"},
+	{"EVTSTREAMS_CHECK_TOPIC", configBool, "true", "set to false to not check that EVTSTREAMS_TOPIC exists at startup"},
+	{"EVTSTREAMS_STARTUP_TEST", configBool, "false", "set to true to send a test message at startup, to SELFTEST_TOPIC or else EVTSTREAMS_TOPIC"},
+	{"EVTSTREAMS_CREATE_TOPIC", configBool, "false", "set to true to create EVTSTREAMS_TOPIC if it does not exist"},
+	{"EVTSTREAMS_TOPIC_PARTITIONS", configInt, "1", "the partitions of a topic made by EVTSTREAMS_CREATE_TOPIC"},
+	{"EVTSTREAMS_TOPIC_REPLICATION", configInt, "3", "the replication factor of a topic made by EVTSTREAMS_CREATE_TOPIC"},
+	{"EVTSTREAMS_CONNECT_TIMEOUT", configDuration, "2m", "how long to keep retrying the first connection"},
+	{"EVTSTREAMS_PRODUCER_TIMEOUT", configDuration, "10s", "how long the brokers may take to acknowledge a message"},
+	{"EVTSTREAMS_DIAL_TIMEOUT", configDuration, "30s", "how long to wait to connect to a broker"},
+	{"EVTSTREAMS_READ_TIMEOUT", configDuration, "30s", "how long to wait for a response from a broker"},
+	{"EVTSTREAMS_WRITE_TIMEOUT", configDuration, "30s", "how long to wait to send a request to a broker"},
+	{"EVTSTREAMS_KAFKA_VERSION", configString, "", "the Kafka protocol version to talk to the brokers with, like 2.1.0, the lowest that the other settings need if not set"},
+	{"EVTSTREAMS_COMPRESSION", configString, "none", "how the producer compresses the messages, none, gzip, snappy, lz4 or zstd"},
+	{"EVTSTREAMS_REQUIRED_ACKS", configString, "all", "which replicas must ack each message, all, local for only the leader, or none"},
+	{"EVTSTREAMS_MAX_MESSAGE_BYTES", configInt, "1000000", "the largest message the producer sends, the audio of larger ones is split, at most the max.message.bytes of the topic"},
+	{"EVTSTREAMS_IDEMPOTENT", configBool, "false", "set to true so that a message that is retried is still written only once"},
+	{"EVTSTREAMS_MAX_FRAGMENT_BYTES", configInt, "0", "split audio longer than this over several messages, 0 only splits messages over EVTSTREAMS_MAX_MESSAGE_BYTES"},
+	{"EVTSTREAMS_KEY", configString, "none", "what to key the messages by, none, station to keep the messages of each station in order, or device"},
+	{"EVTSTREAMS_PARTITIONER", configString, "hash", "how the messages are spread over the partitions, hash, reference, random or roundrobin"},
+	{"EVTSTREAMS_MESSAGE_FORMAT", configString, "json", "how the messages are serialized, json, avro with the schema of EVTSTREAMS_SCHEMA_REGISTRY_URL, or protobuf, the AudioMsg of audiomsg.proto"},
+	{"EVTSTREAMS_SCHEMA_REGISTRY_URL", configString, "", "with EVTSTREAMS_MESSAGE_FORMAT=avro, the URL of the Confluent compatible schema registry"},
+	{"EVTSTREAMS_SCHEMA_REGISTRY_USER", configString, "", "the basic auth user of EVTSTREAMS_SCHEMA_REGISTRY_URL, if it needs one"},
+	{"EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD", configString, "", "the basic auth password of EVTSTREAMS_SCHEMA_REGISTRY_URL"},
+	{"EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD_FILE", configString, "", "a file to read EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD from instead, like a mounted secret"},
+	{"EVTSTREAMS_HEADERS", configString, "devID,org,freq,modelVersion,contentType", "the comma-separated Kafka headers to send with each message, out of those, contentEncoding and origin, or none"},
+	{"EVTSTREAMS_ASYNC", configBool, "false", "set to true to queue each message and send them in batches, rather than wait for each to be sent"},
+	{"EVTSTREAMS_FLUSH_MESSAGES", configInt, "100", "with EVTSTREAMS_ASYNC=true, how many messages to batch into one request"},
+	{"EVTSTREAMS_FLUSH_FREQUENCY", configDuration, "1s", "with EVTSTREAMS_ASYNC=true, how often to send a batch that isn't full"},
+	{"EVTSTREAMS_MAX_MSGS_PER_MIN", configInt, "0", "the most messages to publish per minute, 0 is unlimited"},
+	{"EVTSTREAMS_MAX_MSGS_PER_SEC", configFloat, "0", "the most messages to publish per second, instead of per minute, 0 is unlimited"},
+	{"EVTSTREAMS_MAX_BYTES_PER_SEC", configInt, "0", "the most bytes of messages to publish per second on average, 0 is unlimited"},
+	{"EVTSTREAMS_MAX_BYTES_BURST", configInt, "", "the most bytes to publish at once under EVTSTREAMS_MAX_BYTES_PER_SEC, a minute's worth if not set"},
+	{"RETRY_MAX", configInt, "3", "how many times to retry a failed call to the SDR or evtstreams"},
+	{"RETRY_BACKOFF", configDuration, "1s", "the wait before the first retry, it doubles for each retry after that"},
+	{"RETRY_MAX_BACKOFF", configDuration, "30s", "the longest wait between retries"},
+	{"RETRY_JITTER", configFloat, "0.2", "the fraction by which each wait between retries is randomly changed"},
+	{"FAILURE_WINDOW", configDuration, "10m", "how long the SDR or publishing may keep failing before the service exits"},
+	{"SDR_BREAKER_FAILURES", configInt, "0", "how many times in a row the SDR may fail before captures from it are paused for SDR_BREAKER_COOLDOWN, instead of the service exiting after FAILURE_WINDOW, 0 exits"},
+	{"SDR_BREAKER_COOLDOWN", configDuration, "5m", "with SDR_BREAKER_FAILURES, how long captures from the SDR are paused for before it is tried again"},
+	{"MONITOR_ADDR", configString, "", "the address to serve /metrics, /healthz and /readyz on, like :8081, off if not set"},
+	{"SELFTEST_TOPIC", configString, "", "a throwaway topic that -selftest sends a test message to"},
+	{"SPOOL_DIR", configString, "", "a directory to keep the messages that fail to publish in until publishing works again, off if not set"},
+	{"SPOOL_MAX_BYTES", configInt, "268435456", "the most that SPOOL_DIR may hold, the oldest messages are dropped beyond it"},
+	{"SPOOL_DRAIN_BATCH", configInt, "10", "how many spooled messages to publish after each new message that publishes"},
+	{"COMMIT_LOG_DIR", configString, "", "a directory to keep each message in until it is published, to send it again after a crash, off if not set"},
+	{"COMMIT_LOG_MAX_BYTES", configInt, "10485760", "how large the commit.log of COMMIT_LOG_DIR grows before it is rotated"},
+	{"DEAD_LETTER_DIR", configString, "", "a directory to write the messages that fail to publish to, with the error, rather than drop them"},
+	{"DEAD_LETTER_TOPIC", configString, "", "a topic to send the messages that fail to publish to instead of DEAD_LETTER_DIR"},
+	{"DEDUP_WINDOW", configDuration, "0", "don't publish a chunk that sounds the same as the last one published from its station within this long"},
+	{"ON_NO_STATIONS", configString, "panic", "panic, or retry to keep scanning when no stations are found"},
+}
+
+// configFlags holds the flag of each configVar, configBoolFlags that of each configBool one, which can be given
+// bare like -model-skip-op-check, and configFile the values from the -config file.
+var configFlags = map[string]*string{}
+var configBoolFlags = map[string]*bool{}
+var configFile = map[string]string{}
+
+// configFlagsSet holds the configVars whose flags were given, set by markConfigFlags.
+var configFlagsSet = map[string]bool{}
+
+// configFlagName is the flag of the configVar name, like -evtstreams-topic for EVTSTREAMS_TOPIC.
+func configFlagName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+// registerConfigFlags adds a flag for each configVar to fs.
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, v := range configVars {
+		if v.Type == configBool {
+			defaultVal, _ := strconv.ParseBool(v.Default)
+			configBoolFlags[v.Name] = fs.Bool(configFlagName(v.Name), defaultVal, v.Usage)
+			continue
+		}
+		configFlags[v.Name] = fs.String(configFlagName(v.Name), "", v.Usage)
+	}
+}
+
+// markConfigFlags records which configVar flags were given, it must be called after fs is parsed.
+func markConfigFlags(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		for _, v := range configVars {
+			if configFlagName(v.Name) == f.Name {
+				configFlagsSet[v.Name] = true
+			}
+		}
+	})
+}
+
+// loadConfigFile reads the JSON object at path, which maps configVar names to values, like
+// {"EVTSTREAMS_TOPIC": "sdr-audio", "EVTSTREAMS_MAX_MSGS_PER_MIN": 10}, the same shape as the Horizon input file.
+func loadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	values := map[string]interface{}{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("can't parse config file %s: %v", path, err)
+	}
+	for name, value := range values {
+		if !isConfigVar(name) {
+			return fmt.Errorf("unknown setting %s in config file %s, run with -help to list them", name, path)
+		}
+		switch value := value.(type) {
+		case string:
+			configFile[name] = value
+		case json.Number, bool:
+			configFile[name] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("%s in config file %s must be a string, number or boolean", name, path)
+		}
+	}
+	return nil
+}
+
+func isConfigVar(name string) bool {
+	for _, v := range configVars {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configEnv returns the value of the configVar name, which must be in configVars.
+// A flag wins over an env var, which wins over the config file.
+func configEnv(name string) string {
+	if !isConfigVar(name) {
+		panic(fmt.Sprintf("%s is not in configVars, add it there so it is listed by -help", name))
+	}
+	if configFlagsSet[name] {
+		if flag, ok := configBoolFlags[name]; ok {
+			return strconv.FormatBool(*flag)
+		}
+		return *configFlags[name]
+	}
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return configFile[name]
+}
+
+// validateConfig checks that every setting that is given parses as its type, and that the settings go together,
+// and returns all the problems at once.
+func validateConfig() (errs []error) {
+	for _, v := range configVars {
+		val := configEnv(v.Name)
+		if val == "" {
+			continue
+		}
+		var err error
+		switch v.Type {
+		case configInt:
+			_, err = strconv.Atoi(val)
+		case configFloat:
+			_, err = strconv.ParseFloat(val, 64)
+		case configBool:
+			_, err = strconv.ParseBool(val)
+		case configDuration:
+			_, err = time.ParseDuration(val)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a %s, got %q", v.Name, v.Type, val))
+		}
+	}
+	if len(errs) > 0 {
+		// validateConfigValues reads the settings as their types, so it only runs once every setting parses.
+		return
+	}
+	return validateConfigValues()
+}
+
+// validateConfigValues checks that the settings are in range and go together, so that a bad one is an error at
+// startup rather than a panic. It doesn't check those that depend on the SDRs or the model, which main does.
+func validateConfigValues() (errs []error) {
+	problem := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if name := configEnv("LOG_LEVEL"); name != "" {
+		_, err := parseLogLevel(name)
+		problem(err)
+	}
+	if name := configEnv("LOG_FORMAT"); name != "" {
+		_, err := parseLogFormat(name)
+		problem(err)
+	}
+	_, err := scanRangeFromEnv()
+	problem(err)
+	mode, err := rtlsdr.ParseMode(configEnv("DEMOD_MODE"))
+	problem(err)
+	if err == nil && getEnvBool("RDS", false) && mode != rtlsdr.ModeWFM {
+		problem(errors.New("RDS=true needs DEMOD_MODE=wfm, only broadcast FM stations send RDS"))
+	}
+	iq, err := iqOptionsFromEnv()
+	problem(err)
+	if iq != nil && configEnv("REPLAY_DIR") != "" {
+		problem(errors.New("REPLAY_DIR replays audio, it can't be used with CAPTURE_MODE=iq"))
+	}
+	inputSeconds := getEnvFloat("MODEL_INPUT_SECONDS", audioChunkSeconds)
+	if inputSeconds <= 0 {
+		problem(errors.New("MODEL_INPUT_SECONDS must be positive"))
+	}
+	if hop := getEnvFloat("WINDOW_HOP_SECONDS", 0); hop != 0 {
+		if hop < 0 || hop > inputSeconds {
+			problem(errors.New("WINDOW_HOP_SECONDS must be more than 0 and at most MODEL_INPUT_SECONDS"))
+		}
+		if iq != nil {
+			problem(errors.New("WINDOW_HOP_SECONDS can't be used with CAPTURE_MODE=iq, whose captures aren't scored"))
+		}
+	}
+	bytesPerSample := getEnvInt("AUDIO_BYTES_PER_SAMPLE", audioBytesPerSample)
+	if getEnvInt("AUDIO_SAMPLE_RATE", audioSampleRate) <= 0 || bytesPerSample <= 0 {
+		problem(errors.New("AUDIO_SAMPLE_RATE and AUDIO_BYTES_PER_SAMPLE must be positive"))
+	}
+	if seconds := getEnvFloat("CAPTURE_SECONDS", audioChunkSeconds); seconds <= 0 || seconds > 300 {
+		problem(errors.New("CAPTURE_SECONDS must be more than 0 and at most 300"))
+	}
+	codec := audioCodec
+	if name := configEnv("AUDIO_CODEC"); name != "" {
+		codec = name
+	}
+	knownCodec := false
+	for _, known := range audioCodecs {
+		knownCodec = knownCodec || known == codec
+	}
+	if !knownCodec {
+		problem(fmt.Errorf("unknown AUDIO_CODEC %q, must be one of %s", codec, strings.Join(audioCodecs, ", ")))
+	}
+	if codec == "flac" && bytesPerSample > 3 {
+		problem(errors.New("AUDIO_CODEC=flac needs AUDIO_BYTES_PER_SAMPLE of at most 3"))
+	}
+	switch configEnv("AUDIO_LENGTH_MODE") {
+	case "", "fit", "error":
+	default:
+		problem(errors.New("AUDIO_LENGTH_MODE must be fit or error"))
+	}
+	switch configEnv("NODE_ROLE") {
+	case "", "active", "standby":
+	default:
+		problem(errors.New("NODE_ROLE must be active or standby"))
+	}
+	switch configEnv("ON_NO_STATIONS") {
+	case "", "panic", "retry":
+	default:
+		problem(errors.New("ON_NO_STATIONS must be panic or retry"))
+	}
+	_, err = parseThresholdSchedule(configEnv("THRESHOLD_SCHEDULE"), float32(getEnvFloat("PUBLISH_THRESHOLD", defaultPublishThreshold)))
+	problem(err)
+	if spec := configEnv("CLASS_THRESHOLDS"); spec != "" {
+		_, err = parseClassThresholds(spec)
+		problem(err)
+	}
+	_, err = goodnessRuleFromEnv()
+	problem(err)
+	_, err = stationSelectorFromEnv()
+	problem(err)
+	_, err = stationRefresherFromEnv()
+	problem(err)
+	for _, name := range []string{"FIXED_STATIONS", "STATIONS_INCLUDE", "STATIONS_EXCLUDE"} {
+		_, err = parseStations(name)
+		problem(err)
+	}
+	if getEnvBool("SNR", false) {
+		_, _, err = snrThresholdsFromEnv()
+		problem(err)
+	}
+	_, _, err = sdrBreakerFromEnv()
+	problem(err)
+	if getEnvInt("EVTSTREAMS_MAX_MSGS_PER_MIN", 0) > 0 && getEnvFloat("EVTSTREAMS_MAX_MSGS_PER_SEC", 0) > 0 {
+		problem(errors.New("set only one of EVTSTREAMS_MAX_MSGS_PER_MIN and EVTSTREAMS_MAX_MSGS_PER_SEC"))
+	}
+	// a message over the burst could never be sent.
+	if maxBytesPerSec := getEnvInt("EVTSTREAMS_MAX_BYTES_PER_SEC", 0); maxBytesPerSec > 0 {
+		burst, maxMessageBytes := getEnvInt("EVTSTREAMS_MAX_BYTES_BURST", 60*maxBytesPerSec), getEnvInt("EVTSTREAMS_MAX_MESSAGE_BYTES", 1000000)
+		if burst < maxMessageBytes {
+			problem(fmt.Errorf("EVTSTREAMS_MAX_BYTES_BURST of %d is below EVTSTREAMS_MAX_MESSAGE_BYTES of %d", burst, maxMessageBytes))
+		}
+	}
+	// an async message is only known to be sent after publishAudio returns, when the commit log has already dropped it.
+	if getEnvBool("EVTSTREAMS_ASYNC", false) && configEnv("COMMIT_LOG_DIR") != "" {
+		problem(errors.New("COMMIT_LOG_DIR can't be used with EVTSTREAMS_ASYNC=true"))
+	}
+	return
+}
+
+// printConfigHelp writes configVars as a table to w.
+func printConfigHelp(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENV VAR\tFLAG\tTYPE\tDEFAULT\tDESCRIPTION")
+	for _, v := range configVars {
+		fmt.Fprintf(tw, "%s\t-%s\t%s\t%s\t%s\n", v.Name, configFlagName(v.Name), v.Type, v.Default, v.Usage)
+	}
+	return tw.Flush()
+}
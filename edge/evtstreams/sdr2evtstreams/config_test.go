@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testConfigFlags registers the config flags on a new flag set, parses args with it, and restores the flags after t.
+func testConfigFlags(t *testing.T, args ...string) {
+	flags, boolFlags, set := configFlags, configBoolFlags, configFlagsSet
+	t.Cleanup(func() { configFlags, configBoolFlags, configFlagsSet = flags, boolFlags, set })
+	configFlags, configBoolFlags, configFlagsSet = map[string]*string{}, map[string]*bool{}, map[string]bool{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	markConfigFlags(fs)
+}
+
+// setEnv sets the env var key to val, or unsets it if val is "", and restores it after t.
+func setEnv(t *testing.T, key, val string) {
+	old, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	if val == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, val)
+	}
+}
+
+func TestConfigBoolFlags(t *testing.T) {
+	setEnv(t, "MODEL_SKIP_OP_CHECK", "")
+	setEnv(t, "USE_GPS", "")
+	tests := []struct {
+		args        []string
+		skipOpCheck bool
+		useGPS      bool
+	}{
+		{nil, false, true},
+		{[]string{"-model-skip-op-check"}, true, true},
+		{[]string{"-model-skip-op-check=false", "-use-gps=false"}, false, false},
+		{[]string{"-model-skip-op-check=1", "-use-gps=0"}, true, false},
+	}
+	for _, test := range tests {
+		testConfigFlags(t, test.args...)
+		if got := getEnvBool("MODEL_SKIP_OP_CHECK", false); got != test.skipOpCheck {
+			t.Errorf("%v: MODEL_SKIP_OP_CHECK is %v, want %v", test.args, got, test.skipOpCheck)
+		}
+		if got := getEnvBool("USE_GPS", true); got != test.useGPS {
+			t.Errorf("%v: USE_GPS is %v, want %v", test.args, got, test.useGPS)
+		}
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	testConfigFlags(t)
+	tests := []struct {
+		val        string
+		defaultVal bool
+		want       bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{"true", false, true},
+		{"TRUE", false, true},
+		{"1", false, true},
+		{"false", true, false},
+		{"0", true, false},
+	}
+	for _, test := range tests {
+		setEnv(t, "MODEL_SKIP_OP_CHECK", test.val)
+		if got := getEnvBool("MODEL_SKIP_OP_CHECK", test.defaultVal); got != test.want {
+			t.Errorf("MODEL_SKIP_OP_CHECK=%q with default %v is %v, want %v", test.val, test.defaultVal, got, test.want)
+		}
+	}
+}
+
+func TestValidateConfigBool(t *testing.T) {
+	testConfigFlags(t)
+	setEnv(t, "MODEL_SKIP_OP_CHECK", "yes")
+	errs := validateConfig()
+	if len(errs) != 1 {
+		t.Fatalf("validateConfig with MODEL_SKIP_OP_CHECK=yes returned %v, want one error", errs)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("getEnvBool with MODEL_SKIP_OP_CHECK=yes didn't panic")
+		}
+	}()
+	getEnvBool("MODEL_SKIP_OP_CHECK", false)
+}
+
+func TestValidateConfigAsyncCommitLog(t *testing.T) {
+	testConfigFlags(t)
+	setEnv(t, "EVTSTREAMS_ASYNC", "true")
+	if errs := validateConfig(); len(errs) != 0 {
+		t.Fatalf("validateConfig with EVTSTREAMS_ASYNC=true returned %v, want no errors", errs)
+	}
+	setEnv(t, "COMMIT_LOG_DIR", t.TempDir())
+	if errs := validateConfig(); len(errs) != 1 {
+		t.Fatalf("validateConfig with EVTSTREAMS_ASYNC=true and COMMIT_LOG_DIR returned %v, want one error", errs)
+	}
+}
+
+func TestValidateConfigByteBurst(t *testing.T) {
+	testConfigFlags(t)
+	setEnv(t, "EVTSTREAMS_MAX_BYTES_PER_SEC", "1000")
+	if errs := validateConfig(); len(errs) != 1 {
+		t.Fatalf("validateConfig with a minute's burst of 60000 bytes returned %v, want one error", errs)
+	}
+	setEnv(t, "EVTSTREAMS_MAX_MESSAGE_BYTES", "60000")
+	if errs := validateConfig(); len(errs) != 0 {
+		t.Fatalf("validateConfig with EVTSTREAMS_MAX_MESSAGE_BYTES=60000 returned %v, want no errors", errs)
+	}
+}
+
+func TestValidateConfigValues(t *testing.T) {
+	testConfigFlags(t)
+	setEnv(t, "MODEL_INPUT_SECONDS", "0")
+	setEnv(t, "NODE_ROLE", "backup")
+	setEnv(t, "EXPLORE_EPSILON", "2")
+	setEnv(t, "FIXED_STATIONS", "91100000,abc")
+	errs := validateConfig()
+	if len(errs) != 4 {
+		t.Fatalf("validateConfig returned %v, want an error for each of the 4 bad settings", errs)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// deadLetter keeps the messages that could not be published after all their retries, with why, rather than
+// losing them. They are written as JSON files to Dir if it is set, or else sent to the topic of Conn.
+type deadLetter struct {
+	Dir  string
+	Conn *evtstreamsConn
+}
+
+// deadLetterMsg is a message that failed to publish, with the error it last failed with.
+type deadLetterMsg struct {
+	audiolib.AudioMsg
+	Error string `json:"error"`
+	// FailedAt is when it was given up on, in Unix seconds.
+	FailedAt int64 `json:"failedAt"`
+}
+
+// add keeps audioMsg, which failed with publishErr, and reports whether it was kept.
+func (d *deadLetter) add(audioMsg *audiolib.AudioMsg, publishErr error) bool {
+	letter, err := json.Marshal(deadLetterMsg{AudioMsg: *audioMsg, Error: publishErr.Error(), FailedAt: time.Now().Unix()})
+	if err == nil {
+		if d.Dir != "" {
+			err = d.write(audioMsg, letter)
+		} else {
+			err = d.send(letter)
+		}
+	}
+	if err != nil {
+		logError("can't dead letter the message, it is lost:", err, field("freq", audioMsg.Freq))
+		return false
+	}
+	logWarn("dead lettered the message that failed to publish", field("freq", audioMsg.Freq), field("error", publishErr))
+	return true
+}
+
+func (d *deadLetter) write(audioMsg *audiolib.AudioMsg, letter []byte) error {
+	path := filepath.Join(d.Dir, fmt.Sprintf("%d_%d_%d.json", audioMsg.Ts, audioMsg.Freq, time.Now().UnixNano()))
+	// renamed into place, so that whatever picks up the files never sees half of one.
+	err := ioutil.WriteFile(path+".tmp", letter, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+func (d *deadLetter) send(letter []byte) error {
+	d.Conn.mu.RLock()
+	producer := d.Conn.Producer
+	d.Conn.mu.RUnlock()
+	_, _, err := producer.SendMessage(&sarama.ProducerMessage{Topic: d.Conn.Topic, Value: sarama.ByteEncoder(letter)})
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// dedup remembers the fingerprint of the last chunk published from each station,
+// so that the same audio is not published twice in quick succession.
+type dedup struct {
+	// Window is how long a chunk is remembered for.
+	Window time.Duration
+	// Skipped counts the duplicate chunks found.
+	Skipped int
+	last    map[int64]seenChunk
+}
+
+type seenChunk struct {
+	Fingerprint uint64
+	At          time.Time
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{Window: window, last: map[int64]seenChunk{}}
+}
+
+// check reports whether audio matches the last chunk published from station within the window, and returns
+// the fingerprint of audio, which is recorded once it is published.
+func (d *dedup) check(station int64, audio []byte, now time.Time) (fingerprint uint64, duplicate bool) {
+	fingerprint = audioFingerprint(audio)
+	last, ok := d.last[station]
+	if ok && last.Fingerprint == fingerprint && now.Sub(last.At) < d.Window {
+		d.Skipped++
+		return fingerprint, true
+	}
+	return fingerprint, false
+}
+
+// record makes the chunk with fingerprint, which was published from station, the one to compare the next one from
+// station against. A chunk that wasn't published, as it was rate limited or failed, isn't recorded, so that the same
+// audio can still be published.
+func (d *dedup) record(station int64, fingerprint uint64, now time.Time) {
+	d.last[station] = seenChunk{Fingerprint: fingerprint, At: now}
+}
+
+// fingerprintBlocks is how many blocks the audio is downsampled to for its fingerprint.
+const fingerprintBlocks = 256
+
+// audioFingerprint is a cheap hash of a coarse version of audio: its loudness envelope,
+// in fingerprintBlocks blocks, each quantized to 16 levels relative to the loudest block.
+// Audio that sounds the same gets the same fingerprint even if the samples differ slightly.
+func audioFingerprint(audio []byte) uint64 {
+	samples := decodeSamples(audio)
+	envelope := make([]float64, fingerprintBlocks)
+	blockLen := len(samples)/fingerprintBlocks + 1
+	for i, sample := range samples {
+		envelope[i/blockLen] += math.Abs(sample)
+	}
+	loudest := 0.0
+	for _, level := range envelope {
+		loudest = math.Max(loudest, level)
+	}
+	quantized := make([]byte, fingerprintBlocks)
+	if loudest > 0 {
+		for i, level := range envelope {
+			quantized[i] = byte(math.Round(level / loudest * 15))
+		}
+	}
+	hash := fnv.New64a()
+	hash.Write(quantized)
+	return hash.Sum64()
+}
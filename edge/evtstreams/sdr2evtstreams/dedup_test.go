@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	const station = 88500000
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	// a second of audio that is equally loud throughout, and one that gets louder.
+	audio := make([]byte, expectedAudioBytes(1))
+	other := make([]byte, len(audio))
+	for i := 0; i < len(audio); i += 2 {
+		binary.LittleEndian.PutUint16(audio[i:], 16000)
+		binary.LittleEndian.PutUint16(other[i:], uint16(i/2))
+	}
+	d := newDedup(time.Minute)
+	fingerprint, duplicate := d.check(station, audio, now)
+	if duplicate {
+		t.Fatal("the first chunk is a duplicate")
+	}
+	// a chunk that was checked but not published doesn't make the next one a duplicate.
+	if _, duplicate = d.check(station, audio, now); duplicate {
+		t.Error("a chunk is a duplicate of one that wasn't published")
+	}
+	d.record(station, fingerprint, now)
+	tests := []struct {
+		name    string
+		station int64
+		audio   []byte
+		after   time.Duration
+		want    bool
+	}{
+		{"the same", station, audio, time.Second, true},
+		{"different audio", station, other, time.Second, false},
+		{"another station", station + 200000, audio, time.Second, false},
+		{"after the window", station, audio, time.Minute, false},
+	}
+	for _, test := range tests {
+		if _, duplicate := d.check(test.station, test.audio, now.Add(test.after)); duplicate != test.want {
+			t.Errorf("%s: duplicate is %v, want %v", test.name, duplicate, test.want)
+		}
+	}
+	if d.Skipped != 1 {
+		t.Errorf("skipped %d duplicates, want 1", d.Skipped)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// audioEncryption encrypts the audio of each message with AEAD, so only those with the key can listen to it,
+// even on a shared topic. KeyID names the key in each message, so that keys can be rotated.
+type audioEncryption struct {
+	AEAD  cipher.AEAD
+	KeyID string
+}
+
+// newAudioEncryption makes the audioEncryption of AUDIO_ENCRYPTION_KEY, nil if it isn't set.
+func newAudioEncryption() (e *audioEncryption, err error) {
+	if configEnv("AUDIO_ENCRYPTION_KEY") == "" && configEnv("AUDIO_ENCRYPTION_KEY_FILE") == "" {
+		return
+	}
+	encoded, err := getSecret("AUDIO_ENCRYPTION_KEY")
+	if err != nil {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("AUDIO_ENCRYPTION_KEY must be base64: %v", err)
+	}
+	aead, err := audiolib.NewAudioCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad AUDIO_ENCRYPTION_KEY: %v", err)
+	}
+	e = &audioEncryption{AEAD: aead, KeyID: configEnv("AUDIO_ENCRYPTION_KEY_ID")}
+	logInfo("encrypting the audio of each message", field("keyID", e.KeyID))
+	return
+}
+
+// seal encrypts the audio of audioMsg. It panics if it can't, rather than send the audio in the clear.
+func (e *audioEncryption) seal(audioMsg *audiolib.AudioMsg) {
+	err := audioMsg.EncryptAudio(e.AEAD, e.KeyID)
+	if err != nil {
+		panic(fmt.Sprintf("can't encrypt the audio: %v", err))
+	}
+}
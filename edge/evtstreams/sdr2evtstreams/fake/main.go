@@ -101,7 +101,7 @@ func main() {
 	msg := &audiolib.AudioMsg{
 		Audio:         base64.StdEncoding.EncodeToString(audioBytes),
 		Ts:            time.Now().Unix(),
-		Freq:          123.45,
+		Freq:          123450000,
 		ExpectedValue: 0.9,
 		DevID:         devID,
 		Lat:           42.214607,
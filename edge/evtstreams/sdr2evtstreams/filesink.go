@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// fileSink is a Publisher that writes each message as a WAV file of its raw audio and a JSON file of the rest of it,
+// to build a training set on a node without a connection. The files go into numbered segment directories under Dir,
+// a new segment is started once the current one holds SegmentBytes, and the oldest segments are removed
+// so that there are at most MaxSegments. A MaxSegments of 0 keeps them all.
+type fileSink struct {
+	Dir          string
+	SegmentBytes int64
+	MaxSegments  int
+	mu           sync.Mutex
+	segment      int
+	segmentSize  int64
+	written      int
+}
+
+// fileSidecar is the JSON file next to each WAV file, the audio itself is only in the WAV file.
+// The raw IQ samples of CAPTURE_MODE=iq are in a .cu8 file instead, which WAV names all the same.
+type fileSidecar struct {
+	audiolib.AudioMsg
+	Audio string `json:"audio,omitempty"`
+	WAV   string `json:"wav"`
+}
+
+// newFileSink makes the fileSink for dir, carrying on with the latest segment already in it.
+func newFileSink(dir string, segmentBytes int64, maxSegments int) (s *fileSink, err error) {
+	if segmentBytes <= 0 {
+		return nil, fmt.Errorf("FILE_SINK_SEGMENT_BYTES must be over 0")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	s = &fileSink{Dir: dir, SegmentBytes: segmentBytes, MaxSegments: maxSegments}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return s, s.startSegment(1)
+	}
+	s.segment = segments[len(segments)-1]
+	s.segmentSize, err = dirSize(s.segmentDir(s.segment))
+	return
+}
+
+func (s *fileSink) publishAudio(audioMsg *audiolib.AudioMsg) error {
+	return errors.New("the file sink needs the raw audio of a message")
+}
+
+func (s *fileSink) publishRawAudio(audioMsg *audiolib.AudioMsg, raw []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.segmentSize >= s.SegmentBytes {
+		err = s.startSegment(s.segment + 1)
+		if err != nil {
+			return
+		}
+	}
+	s.written++
+	name := fmt.Sprintf("%d_%d_%d", audioMsg.Ts, audioMsg.Freq, s.written)
+	file, ext := wavFile(raw), ".wav"
+	meta := *audioMsg
+	meta.ContentType = "audio/wav"
+	// IQ samples aren't audio, they are written as they are.
+	if audioMsg.Mode == audiolib.ModeIQ {
+		file, ext = raw, ".cu8"
+		meta.ContentType = audioMsg.ContentType
+	}
+	sidecar, err := json.Marshal(fileSidecar{AudioMsg: meta, WAV: name + ext})
+	if err != nil {
+		return
+	}
+	dir := s.segmentDir(s.segment)
+	err = ioutil.WriteFile(filepath.Join(dir, name+ext), file, 0644)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, name+".json"), sidecar, 0644)
+	if err != nil {
+		return
+	}
+	s.segmentSize += int64(len(file) + len(sidecar))
+	logDebug("> message written to", filepath.Join(dir, name+ext), field("freq", audioMsg.Freq), field("bytes", len(file)))
+	return
+}
+
+func (s *fileSink) segmentDir(segment int) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%06d", segment))
+}
+
+// segments returns the numbers of the segments in Dir, oldest first.
+func (s *fileSink) segments() (segments []int, err error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if n, err := strconv.Atoi(file.Name()); err == nil && file.IsDir() {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return
+}
+
+// startSegment starts writing to segment, and removes the oldest segments beyond MaxSegments.
+func (s *fileSink) startSegment(segment int) (err error) {
+	err = os.MkdirAll(s.segmentDir(segment), 0755)
+	if err != nil {
+		return
+	}
+	s.segment, s.segmentSize = segment, 0
+	if s.MaxSegments <= 0 {
+		return
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return
+	}
+	for len(segments) > s.MaxSegments {
+		logInfo("removing the oldest file sink segment", s.segmentDir(segments[0]))
+		err = os.RemoveAll(s.segmentDir(segments[0]))
+		if err != nil {
+			return
+		}
+		segments = segments[1:]
+	}
+	return
+}
+
+func dirSize(dir string) (size int64, err error) {
+	files, err := ioutil.ReadDir(dir)
+	for _, file := range files {
+		size += file.Size()
+	}
+	return
+}
+
+// wavFile wraps raw audio in the format of audioSampleRate, audioChannels and audioBytesPerSample in a WAV header.
+func wavFile(raw []byte) []byte {
+	wav := make([]byte, 44, 44+len(raw))
+	copy(wav[0:], "RIFF")
+	binary.LittleEndian.PutUint32(wav[4:], uint32(36+len(raw)))
+	copy(wav[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(wav[16:], 16)
+	// 1 is PCM.
+	binary.LittleEndian.PutUint16(wav[20:], 1)
+	binary.LittleEndian.PutUint16(wav[22:], uint16(audioChannels))
+	binary.LittleEndian.PutUint32(wav[24:], uint32(audioSampleRate))
+	binary.LittleEndian.PutUint32(wav[28:], uint32(audioSampleRate*audioChannels*audioBytesPerSample))
+	binary.LittleEndian.PutUint16(wav[32:], uint16(audioChannels*audioBytesPerSample))
+	binary.LittleEndian.PutUint16(wav[34:], uint16(audioBytesPerSample*8))
+	copy(wav[36:], "data")
+	binary.LittleEndian.PutUint32(wav[40:], uint32(len(raw)))
+	return append(wav, raw...)
+}
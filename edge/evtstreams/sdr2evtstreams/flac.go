@@ -0,0 +1,230 @@
+package main
+
+import "crypto/md5"
+
+// flacBlockSize is how many samples each FLAC frame holds.
+const flacBlockSize = 4096
+
+// encodeFLAC losslessly compresses raw audio in the format of audioSampleRate, audioChannels and audioBytesPerSample
+// into a FLAC stream. Each frame uses the fixed predictor that leaves the smallest residual, Rice coded, or stores
+// the samples verbatim if that is smaller. It handles up to 3 bytes per sample, which is all that FLAC decoders
+// commonly take.
+func encodeFLAC(raw []byte) []byte {
+	bps := audioBytesPerSample * 8
+	samples := make([]int64, len(raw)/audioBytesPerSample)
+	sum := md5.New()
+	for i := range samples {
+		b := raw[i*audioBytesPerSample : (i+1)*audioBytesPerSample]
+		var s int64
+		if audioBytesPerSample == 1 {
+			// 8 bit audio is unsigned, FLAC samples are signed.
+			s = int64(b[0]) - 128
+		} else {
+			for j := len(b) - 1; j >= 0; j-- {
+				s = s<<8 | int64(b[j])
+			}
+			s = s << (64 - uint(bps)) >> (64 - uint(bps))
+		}
+		samples[i] = s
+	}
+	// the MD5 of the stream is of its samples as signed little endian.
+	signed := make([]byte, audioBytesPerSample)
+	for _, s := range samples {
+		for j := range signed {
+			signed[j] = byte(s >> (8 * uint(j)))
+		}
+		sum.Write(signed)
+	}
+
+	w := &bitWriter{}
+	w.buf = append(w.buf, "fLaC"...)
+	// STREAMINFO, the last and only metadata block.
+	w.writeBits(1, 1)
+	w.writeBits(0, 7)
+	w.writeBits(34, 24)
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(flacBlockSize, 16)
+	// the smallest and largest frame sizes are unknown.
+	w.writeBits(0, 24)
+	w.writeBits(0, 24)
+	w.writeBits(uint64(audioSampleRate), 20)
+	w.writeBits(uint64(audioChannels-1), 3)
+	w.writeBits(uint64(bps-1), 5)
+	w.writeBits(uint64(len(samples)/audioChannels), 36)
+	w.buf = append(w.buf, sum.Sum(nil)...)
+
+	for frame, start := 0, 0; start < len(samples); frame, start = frame+1, start+flacBlockSize {
+		end := start + flacBlockSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+		writeFLACFrame(w, frame, samples[start:end], bps)
+	}
+	return w.buf
+}
+
+func writeFLACFrame(w *bitWriter, frame int, block []int64, bps int) {
+	start := len(w.buf)
+	// sync code, fixed block size.
+	w.writeBits(0xfff8, 16)
+	// the block size is at the end of the header, the sample rate and size are those of STREAMINFO.
+	w.writeBits(7, 4)
+	w.writeBits(0, 4)
+	// mono.
+	w.writeBits(0, 4)
+	w.writeBits(0, 3)
+	w.writeBits(0, 1)
+	w.buf = appendFLACFrameNumber(w.buf, uint32(frame))
+	w.writeBits(uint64(len(block)-1), 16)
+	w.buf = append(w.buf, flacCRC8(w.buf[start:]))
+	writeFLACSubframe(w, block, bps)
+	w.flush()
+	crc := flacCRC16(w.buf[start:])
+	w.buf = append(w.buf, byte(crc>>8), byte(crc))
+}
+
+// writeFLACSubframe writes block with the fixed predictor of order 0 to 4 whose residual is the smallest.
+func writeFLACSubframe(w *bitWriter, block []int64, bps int) {
+	bestOrder, bestParam, bestBits := -1, 0, len(block)*bps
+	var best []int64
+	for order := 0; order <= 4 && order < len(block); order++ {
+		residual := fixedResidual(block, order)
+		param, bits := riceParameter(residual)
+		// the header of the residual and the warm up samples.
+		bits += 10 + order*bps
+		if bits < bestBits {
+			bestOrder, bestParam, bestBits, best = order, param, bits, residual
+		}
+	}
+	if bestOrder < 0 {
+		// verbatim.
+		w.writeBits(1<<1, 8)
+		for _, s := range block {
+			w.writeBits(uint64(s), uint(bps))
+		}
+		return
+	}
+	w.writeBits(uint64(0x08|bestOrder)<<1, 8)
+	for _, s := range block[:bestOrder] {
+		w.writeBits(uint64(s), uint(bps))
+	}
+	// Rice coding with 4 bit parameters, in one partition.
+	w.writeBits(0, 2)
+	w.writeBits(0, 4)
+	w.writeBits(uint64(bestParam), 4)
+	for _, r := range best {
+		u := uint64(r<<1) ^ uint64(r>>63)
+		for q := u >> uint(bestParam); q > 0; q-- {
+			w.writeBits(0, 1)
+		}
+		w.writeBits(1, 1)
+		w.writeBits(u, uint(bestParam))
+	}
+}
+
+// fixedResidual is what is left of block after the fixed predictor of order, after its first order samples.
+func fixedResidual(block []int64, order int) []int64 {
+	residual := make([]int64, 0, len(block)-order)
+	for i := order; i < len(block); i++ {
+		var prediction int64
+		switch order {
+		case 1:
+			prediction = block[i-1]
+		case 2:
+			prediction = 2*block[i-1] - block[i-2]
+		case 3:
+			prediction = 3*block[i-1] - 3*block[i-2] + block[i-3]
+		case 4:
+			prediction = 4*block[i-1] - 6*block[i-2] + 4*block[i-3] - block[i-4]
+		}
+		residual = append(residual, block[i]-prediction)
+	}
+	return residual
+}
+
+// riceParameter picks the Rice parameter that codes residual in the fewest bits, and how many bits that is.
+func riceParameter(residual []int64) (param, bits int) {
+	bits = -1
+	for k := uint(0); k <= 14; k++ {
+		n := 0
+		for _, r := range residual {
+			u := uint64(r<<1) ^ uint64(r>>63)
+			n += int(u>>k) + 1 + int(k)
+		}
+		if bits < 0 || n < bits {
+			param, bits = int(k), n
+		}
+	}
+	return
+}
+
+// appendFLACFrameNumber appends n in the UTF-8 like coding of FLAC frame headers.
+func appendFLACFrameNumber(buf []byte, n uint32) []byte {
+	if n < 0x80 {
+		return append(buf, byte(n))
+	}
+	var tail []byte
+	lead := byte(0x80)
+	// each continuation byte holds 6 bits, and the first byte has room for 1 less bit with each of them.
+	for room := uint32(0x1f); n > room; room >>= 1 {
+		tail = append([]byte{0x80 | byte(n&0x3f)}, tail...)
+		n >>= 6
+		lead = lead>>1 | 0x80
+	}
+	return append(append(buf, lead|byte(n)), tail...)
+}
+
+func flacCRC8(data []byte) (crc byte) {
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+func flacCRC16(data []byte) (crc uint16) {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+// bitWriter appends bits to buf, most significant first.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// writeBits writes the low n bits of v, n is at most 56.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	if n == 0 {
+		return
+	}
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nbits))
+	}
+}
+
+// flush pads the last byte with zero bits.
+func (w *bitWriter) flush() {
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
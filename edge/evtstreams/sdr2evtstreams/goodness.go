@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/goodness"
+)
+
+// goodnessRuleFromEnv returns the goodness.Rule of GOODNESS_LEARNING_RATE, GOODNESS_MIN, GOODNESS_MAX and
+// GOODNESS_IDLE_HALF_LIFE.
+func goodnessRuleFromEnv() (goodness.Rule, error) {
+	rule := goodness.Rule{
+		LearningRate: float32(getEnvFloat("GOODNESS_LEARNING_RATE", 0)),
+		Min:          float32(getEnvFloat("GOODNESS_MIN", 0.05)),
+		Max:          float32(getEnvFloat("GOODNESS_MAX", 0.9)),
+		HalfLife:     getEnvDuration("GOODNESS_IDLE_HALF_LIFE", 0),
+	}
+	return rule, rule.Check()
+}
+
+// goodnessStore saves the goodness of the stations to Path, so that a node that restarts doesn't learn them again from scratch.
+// A nil store saves nothing.
+type goodnessStore struct {
+	Path string
+	// Interval is how often the goodness is saved while running, it is also saved when run returns.
+	Interval time.Duration
+	// HalfLife is how long it takes a saved goodness to decay halfway back to goodness.Initial, as reception changes
+	// while the node is down. 0 doesn't decay it.
+	HalfLife  time.Duration
+	lastSaved time.Time
+}
+
+// savedGoodness is the file format, JSON can't have number keys so the stations are their frequency in Hz as a string.
+type savedGoodness struct {
+	SavedAt  time.Time          `json:"savedAt"`
+	Stations map[string]float32 `json:"stations"`
+}
+
+// load returns the saved goodness decayed to now, or an empty map if nothing was saved yet.
+func (s *goodnessStore) load(now time.Time) (stationGoodness map[int64]float32, err error) {
+	stationGoodness = map[int64]float32{}
+	if s == nil {
+		return
+	}
+	contents, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return stationGoodness, nil
+	}
+	if err != nil {
+		return
+	}
+	var saved savedGoodness
+	err = json.Unmarshal(contents, &saved)
+	if err != nil {
+		return
+	}
+	for freq, g := range saved.Stations {
+		// parsed as a float, as files from before the stations were whole Hz may have them like 1.011e+08.
+		station, err := strconv.ParseFloat(freq, 64)
+		if err != nil {
+			return nil, err
+		}
+		stationGoodness[int64(math.Round(station))] = goodness.Decay(g, now.Sub(saved.SavedAt), s.HalfLife)
+	}
+	s.lastSaved = now
+	return
+}
+
+// save writes stationGoodness to Path, through a temporary file so that a crash while saving doesn't lose the last save.
+func (s *goodnessStore) save(stationGoodness map[int64]float32, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	saved := savedGoodness{SavedAt: now, Stations: map[string]float32{}}
+	for station, g := range stationGoodness {
+		saved.Stations[strconv.FormatInt(station, 10)] = g
+	}
+	contents, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(s.Path+".tmp", contents, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.Path+".tmp", s.Path)
+	if err != nil {
+		return err
+	}
+	s.lastSaved = now
+	return nil
+}
+
+// forDevice is the store of the goodness of the stations of the SDR named device, in a file of its own next to Path,
+// like goodness.0.json for goodness.json. The only SDR, named "", uses Path itself.
+func (s *goodnessStore) forDevice(device string) *goodnessStore {
+	if s == nil || device == "" {
+		return s
+	}
+	ext := filepath.Ext(s.Path)
+	store := *s
+	store.Path = strings.TrimSuffix(s.Path, ext) + "." + device + ext
+	return &store
+}
+
+// checkpoint saves stationGoodness if it was last saved over Interval ago. A failed save is logged, and tried again on the next pass.
+func (s *goodnessStore) checkpoint(stationGoodness map[int64]float32, now time.Time) {
+	if s == nil || now.Sub(s.lastSaved) < s.Interval {
+		return
+	}
+	err := s.save(stationGoodness, now)
+	if err != nil {
+		logWarn("can't save the goodness of the stations:", err)
+		return
+	}
+	logDebug("saved the goodness of", len(stationGoodness), "stations to", s.Path)
+}
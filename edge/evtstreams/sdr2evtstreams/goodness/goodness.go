@@ -0,0 +1,74 @@
+// Package goodness is how the goodness of a station, the chance of it being sampled, is learned from the values its audio scores.
+package goodness
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Initial is the goodness of a newly found station, and what the goodness decays back to.
+const Initial = 0.5
+
+// Rule updates the goodness of the stations.
+type Rule struct {
+	// LearningRate, if set, moves the goodness that fraction of the way to each value.
+	// If it is 0, the goodness is multiplied by the value plus 0.3 and 0.05 is added, which is the original rule.
+	LearningRate float32
+	// Min and Max bound the goodness, so that no station is always or never sampled.
+	Min float32
+	Max float32
+	// HalfLife is how long it takes the goodness of a station that isn't sampled to decay halfway back to Initial,
+	// so that a station that scored badly once is tried again. 0 doesn't decay it.
+	HalfLife time.Duration
+}
+
+// Check returns an error if the Rule can't keep the goodness between 0 and 1.
+func (r Rule) Check() error {
+	if r.Min < 0 || r.Min > r.Max || r.Max > 1 {
+		return fmt.Errorf("the goodness bounds must be between 0 and 1, with the minimum no more than the maximum, got %v and %v", r.Min, r.Max)
+	}
+	if r.LearningRate < 0 || r.LearningRate > 1 {
+		return fmt.Errorf("the goodness learning rate must be between 0 and 1, got %v", r.LearningRate)
+	}
+	if r.HalfLife < 0 {
+		return fmt.Errorf("the goodness half life can't be negative, got %v", r.HalfLife)
+	}
+	return nil
+}
+
+// Update returns the new goodness of a station whose audio scored val.
+// If the value is close to 1, the goodness increases, if the value is small, the goodness decreases.
+func (r Rule) Update(goodness, val float32) float32 {
+	if r.LearningRate > 0 {
+		goodness += r.LearningRate * (val - goodness)
+	} else {
+		goodness = goodness*(val+0.3) + 0.05
+	}
+	return r.Clamp(goodness)
+}
+
+// Decay returns the goodness of a station after it has not been sampled for idle.
+func (r Rule) Decay(goodness float32, idle time.Duration) float32 {
+	return r.Clamp(Decay(goodness, idle, r.HalfLife))
+}
+
+// Clamp keeps goodness between Min and Max.
+func (r Rule) Clamp(goodness float32) float32 {
+	if goodness > r.Max {
+		goodness = r.Max
+	}
+	if goodness < r.Min {
+		goodness = r.Min
+	}
+	return goodness
+}
+
+// Decay moves goodness back toward Initial, halfway for each halfLife in elapsed. A halfLife of 0 doesn't decay it.
+func Decay(goodness float32, elapsed, halfLife time.Duration) float32 {
+	if halfLife <= 0 || elapsed <= 0 {
+		return goodness
+	}
+	remaining := math.Pow(0.5, float64(elapsed)/float64(halfLife))
+	return Initial + (goodness-Initial)*float32(remaining)
+}
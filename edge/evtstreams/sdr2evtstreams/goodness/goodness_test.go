@@ -0,0 +1,116 @@
+package goodness
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func near(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 1e-6
+}
+
+func TestUpdateWithLearningRate(t *testing.T) {
+	r := Rule{LearningRate: 0.25, Min: 0, Max: 1}
+	tests := []struct {
+		goodness, val, want float32
+	}{
+		{0.5, 1, 0.625},
+		{0.5, 0, 0.375},
+		{0.5, 0.5, 0.5},
+		{0.8, 0.4, 0.7},
+	}
+	for _, test := range tests {
+		if got := r.Update(test.goodness, test.val); !near(got, test.want) {
+			t.Errorf("Update(%v, %v) = %v, want %v", test.goodness, test.val, got, test.want)
+		}
+	}
+}
+
+func TestUpdateClampsToBounds(t *testing.T) {
+	r := Rule{LearningRate: 1, Min: 0.1, Max: 0.9}
+	tests := []struct {
+		val, want float32
+	}{
+		{0, 0.1},
+		{0.05, 0.1},
+		{0.5, 0.5},
+		{0.95, 0.9},
+		{1, 0.9},
+	}
+	for _, test := range tests {
+		if got := r.Update(0.5, test.val); !near(got, test.want) {
+			t.Errorf("Update(0.5, %v) = %v, want %v", test.val, got, test.want)
+		}
+	}
+}
+
+func TestUpdateOriginalRuleClamps(t *testing.T) {
+	tests := []struct {
+		name                string
+		min, max            float32
+		goodness, val, want float32
+	}{
+		// the original rule adds 0.05, so it only goes under a GOODNESS_MIN over that.
+		{"below min", 0.1, 0.9, 0.1, 0, 0.1},
+		{"far below min", 0.2, 0.9, 0, 0, 0.2},
+		{"in between", 0.05, 0.9, 0.5, 0.5, 0.45},
+		{"in between low", 0.05, 0.9, 0.1, 0, 0.08},
+		{"above max", 0.05, 0.9, 0.9, 1, 0.9},
+		{"far above max", 0.05, 0.5, 1, 1, 0.5},
+	}
+	for _, test := range tests {
+		r := Rule{Min: test.min, Max: test.max}
+		if got := r.Update(test.goodness, test.val); !near(got, test.want) {
+			t.Errorf("%s: Update(%v, %v) = %v, want %v", test.name, test.goodness, test.val, got, test.want)
+		}
+	}
+}
+
+func TestDecay(t *testing.T) {
+	tests := []struct {
+		goodness float32
+		elapsed  time.Duration
+		halfLife time.Duration
+		want     float32
+	}{
+		{0.9, time.Hour, time.Hour, 0.7},
+		{0.9, 2 * time.Hour, time.Hour, 0.6},
+		{0.1, time.Hour, time.Hour, 0.3},
+		{0.9, 0, time.Hour, 0.9},
+		{0.9, time.Hour, 0, 0.9},
+	}
+	for _, test := range tests {
+		if got := Decay(test.goodness, test.elapsed, test.halfLife); !near(got, test.want) {
+			t.Errorf("Decay(%v, %v, %v) = %v, want %v", test.goodness, test.elapsed, test.halfLife, got, test.want)
+		}
+	}
+}
+
+func TestRuleDecayClamps(t *testing.T) {
+	r := Rule{Min: 0.6, Max: 1, HalfLife: time.Hour}
+	// the goodness decays toward Initial, which is under Min.
+	if got := r.Decay(0.8, 10*time.Hour); got != 0.6 {
+		t.Errorf("Decay(0.8, 10h) = %v, want it clamped to 0.6", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{Min: 0.05, Max: 0.9}, true},
+		{Rule{Min: 0.05, Max: 0.9, LearningRate: 0.2, HalfLife: time.Hour}, true},
+		{Rule{Min: -0.1, Max: 0.9}, false},
+		{Rule{Min: 0.5, Max: 0.4}, false},
+		{Rule{Min: 0, Max: 1.1}, false},
+		{Rule{Max: 1, LearningRate: 1.5}, false},
+		{Rule{Max: 1, HalfLife: -time.Second}, false},
+	}
+	for _, test := range tests {
+		if err := test.rule.Check(); (err == nil) != test.ok {
+			t.Errorf("%+v.Check() = %v, want ok %v", test.rule, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newLocationSource returns what gets the location of each message for GPS_SOURCE, and whether to check that it
+// can get one at startup. gpsd and nmea follow the fixes in the background, so they have none yet at startup.
+func newLocationSource(source string) (get func() (locationData, error), checkAtStartup bool, err error) {
+	switch source {
+	case "", "gps":
+		return getGPS, true, nil
+	case "static":
+		location := locationData{LocSource: MANUAL}
+		location.Latitude, err = strconv.ParseFloat(getEnv("LATITUDE"), 64)
+		if err == nil {
+			location.Longitude, err = strconv.ParseFloat(getEnv("LONGITUDE"), 64)
+		}
+		if err == nil && configEnv("ALTITUDE") != "" {
+			location.ElevationM, err = strconv.ParseFloat(configEnv("ALTITUDE"), 64)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("bad LATITUDE, LONGITUDE or ALTITUDE: %v", err)
+		}
+		logInfo("using the static location", location.Latitude, location.Longitude)
+		return func() (locationData, error) { return location, nil }, true, nil
+	case "gpsd":
+		addr := getEnv("GPSD_ADDR")
+		t := &gpsTracker{MaxAge: getEnvDuration("GPS_MAX_AGE", time.Minute)}
+		go t.follow("gpsd at "+addr, func() (io.ReadCloser, error) { return dialGPSD(addr) }, parseGPSDReport)
+		return t.location, false, nil
+	case "nmea":
+		device := getEnv("GPS_DEVICE")
+		t := &gpsTracker{MaxAge: getEnvDuration("GPS_MAX_AGE", time.Minute)}
+		go t.follow("NMEA device "+device, func() (io.ReadCloser, error) { return os.Open(device) }, parseNMEASentence)
+		return t.location, false, nil
+	}
+	return nil, false, fmt.Errorf("unknown GPS_SOURCE %q, must be gps, static, gpsd or nmea", source)
+}
+
+// gpsTracker keeps the latest fix of a GPS that reports its position line by line.
+type gpsTracker struct {
+	// MaxAge is how old the latest fix may be before the location is unknown again.
+	MaxAge time.Duration
+	mu     sync.Mutex
+	fix    locationData
+	fixAt  time.Time
+}
+
+func (t *gpsTracker) location() (locationData, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fixAt.IsZero() {
+		return locationData{}, errors.New("no GPS fix yet")
+	}
+	if age := time.Since(t.fixAt); age > t.MaxAge {
+		return locationData{}, fmt.Errorf("the last GPS fix is %v old", age.Round(time.Second))
+	}
+	return t.fix, nil
+}
+
+// follow reads the lines of what open opens, and keeps each one that parse makes a fix of. It opens it again,
+// backing off, whenever it fails or ends, and never returns.
+func (t *gpsTracker) follow(name string, open func() (io.ReadCloser, error), parse func(line string) (locationData, bool)) {
+	backoff := time.Second
+	for {
+		r, err := open()
+		if err == nil {
+			logInfo("following the location from", name)
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				if fix, ok := parse(scanner.Text()); ok {
+					fix.LocSource, fix.LastUpdate = GPS, time.Now().Unix()
+					t.mu.Lock()
+					t.fix, t.fixAt = fix, time.Now()
+					t.mu.Unlock()
+					backoff = time.Second
+				}
+			}
+			err = scanner.Err()
+			r.Close()
+			if err == nil {
+				err = io.EOF
+			}
+		}
+		logWarn("can't read the location from", name+", trying again in", backoff, "-", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// dialGPSD connects to the gpsd at addr and asks it to report in JSON.
+func dialGPSD(addr string) (io.ReadCloser, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(conn, "?WATCH={\"enable\":true,\"json\":true};\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// parseGPSDReport makes a fix of a gpsd TPV report, if it has one. Mode 2 is a 2D fix, 3 a 3D fix with an altitude.
+func parseGPSDReport(line string) (fix locationData, ok bool) {
+	var report struct {
+		Class  string   `json:"class"`
+		Mode   int      `json:"mode"`
+		Lat    float64  `json:"lat"`
+		Lon    float64  `json:"lon"`
+		Alt    *float64 `json:"alt"`
+		AltMSL *float64 `json:"altMSL"`
+		// Epx and Epy are the expected longitude and latitude errors in meters.
+		Epx float64 `json:"epx"`
+		Epy float64 `json:"epy"`
+	}
+	if json.Unmarshal([]byte(line), &report) != nil || report.Class != "TPV" || report.Mode < 2 {
+		return
+	}
+	fix = locationData{Latitude: report.Lat, Longitude: report.Lon}
+	// newer gpsd reports the altitude above mean sea level as altMSL, and alt is then the height above the ellipsoid.
+	if report.AltMSL != nil {
+		fix.ElevationM = *report.AltMSL
+	} else if report.Alt != nil {
+		fix.ElevationM = *report.Alt
+	}
+	if report.Epx > report.Epy {
+		fix.AccuracyKM = report.Epx / 1000
+	} else {
+		fix.AccuracyKM = report.Epy / 1000
+	}
+	return fix, true
+}
+
+// parseNMEASentence makes a fix of a GGA sentence, like $GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47,
+// if its checksum is right and the receiver has a fix.
+func parseNMEASentence(line string) (fix locationData, ok bool) {
+	line = strings.TrimSpace(line)
+	star := strings.LastIndex(line, "*")
+	if !strings.HasPrefix(line, "$") || star < 0 {
+		return
+	}
+	checksum, err := hex.DecodeString(line[star+1:])
+	if err != nil || len(checksum) != 1 {
+		return
+	}
+	var sum byte
+	for i := 1; i < star; i++ {
+		sum ^= line[i]
+	}
+	fields := strings.Split(line[1:star], ",")
+	// any talker, GP for GPS, GN for several constellations and so on.
+	if sum != checksum[0] || len(fields) < 10 || !strings.HasSuffix(fields[0], "GGA") || fields[6] == "" || fields[6] == "0" {
+		return
+	}
+	lat, latOK := nmeaDegrees(fields[2], fields[3], "S")
+	lon, lonOK := nmeaDegrees(fields[4], fields[5], "W")
+	if !latOK || !lonOK {
+		return
+	}
+	fix = locationData{Latitude: lat, Longitude: lon}
+	fix.ElevationM, _ = strconv.ParseFloat(fields[9], 64)
+	return fix, true
+}
+
+// nmeaDegrees turns an NMEA angle like 4807.038, 48 degrees and 7.038 minutes, into degrees, negative if
+// hemisphere is negative.
+func nmeaDegrees(angle, hemisphere, negative string) (degrees float64, ok bool) {
+	dot := strings.Index(angle, ".")
+	if dot < 0 {
+		dot = len(angle)
+	}
+	if dot < 2 {
+		return
+	}
+	whole, err := strconv.ParseFloat(angle[:dot-2], 64)
+	if err != nil && dot > 2 {
+		return
+	}
+	minutes, err := strconv.ParseFloat(angle[dot-2:], 64)
+	if err != nil {
+		return
+	}
+	degrees = whole + minutes/60
+	if hemisphere == negative {
+		degrees = -degrees
+	}
+	return degrees, true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// grpcStreamAudio is the path of the StreamAudio method of the AudioIngest service in audiomsg.proto.
+const grpcStreamAudio = "/audiolib.AudioIngest/StreamAudio"
+
+// grpcSink is a Publisher that streams each message as the AudioMsg protobuf of audiomsg.proto over one long lived
+// StreamAudio call, which is a persistent HTTP/2 stream, and waits for its AudioAck. It speaks the gRPC wire format
+// with net/http rather than pulling in a gRPC library, to keep the binary small. When a message fails, the call is
+// dropped and the next publish starts a new one.
+type grpcSink struct {
+	URL    string
+	Token  string
+	Client *http.Client
+	// Timeout is how long each message may take to be acknowledged.
+	Timeout time.Duration
+	mu      sync.Mutex
+	call    *grpcCall
+}
+
+// grpcCall is one StreamAudio call, resp is nil until the server has replied with its headers.
+type grpcCall struct {
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+	respc  chan *http.Response
+	errc   chan error
+	resp   *http.Response
+}
+
+func (s *grpcSink) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	payload, err := audioMsg.EncodeProto()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.call == nil {
+		s.call = s.open()
+	}
+	start := time.Now()
+	// writing to the call can block for as long as the server doesn't read it, so all of it is bounded by Timeout.
+	call := s.call
+	done := make(chan error, 1)
+	go func() {
+		done <- call.exchange(payload)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(s.Timeout):
+		err = fmt.Errorf("no AudioAck within %v", s.Timeout)
+	}
+	if err != nil {
+		s.call.drop()
+		s.call = nil
+		return fmt.Errorf("can't publish to gRPC %s: %v", s.URL, err)
+	}
+	logInfo("> message sent to gRPC", field("freq", audioMsg.Freq), field("bytes", len(payload)), field("latency", time.Since(start)))
+	return
+}
+
+// open starts a StreamAudio call. The server may not reply until it gets the first message, so the call
+// runs in the background until it does.
+func (s *grpcSink) open() *grpcCall {
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &grpcCall{w: w, cancel: cancel, respc: make(chan *http.Response, 1), errc: make(chan error, 1)}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.URL, "/")+grpcStreamAudio, r)
+	if err != nil {
+		call.errc <- err
+		return call
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	go func() {
+		resp, err := s.Client.Do(req)
+		if err != nil {
+			call.errc <- err
+			return
+		}
+		call.respc <- resp
+	}()
+	return call
+}
+
+// exchange writes payload to the call and reads its AudioAck.
+func (call *grpcCall) exchange(payload []byte) (err error) {
+	// each gRPC message is a byte that is 0 if it isn't compressed, its length, and the message.
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err = call.w.Write(append(frame, payload...))
+	if err != nil {
+		return
+	}
+	if call.resp == nil {
+		select {
+		case call.resp = <-call.respc:
+		case err = <-call.errc:
+			return
+		}
+		if call.resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("the server replied %s", call.resp.Status)
+		}
+		// a call that fails straight away only has headers, with the status in them.
+		if status := call.resp.Header.Get("Grpc-Status"); status != "" && status != "0" {
+			return fmt.Errorf("gRPC status %s: %s", status, call.resp.Header.Get("Grpc-Message"))
+		}
+	}
+	header := make([]byte, 5)
+	_, err = io.ReadFull(call.resp.Body, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the server ended the call, the trailers say why.
+		return fmt.Errorf("the call ended with gRPC status %s: %s", call.resp.Trailer.Get("Grpc-Status"), call.resp.Trailer.Get("Grpc-Message"))
+	}
+	if err != nil {
+		return
+	}
+	if header[0] != 0 {
+		return errors.New("the server sent a compressed AudioAck")
+	}
+	ack := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	_, err = io.ReadFull(call.resp.Body, ack)
+	if err != nil {
+		return
+	}
+	if ackError := protoStringField(ack, 1); ackError != "" {
+		return fmt.Errorf("the server didn't store the message: %s", ackError)
+	}
+	return
+}
+
+// drop abandons the call, which also ends any exchange still blocked on it.
+func (call *grpcCall) drop() {
+	call.w.CloseWithError(errors.New("call dropped"))
+	call.cancel()
+}
+
+// close ends the call, and waits up to Timeout for the server to end it too.
+func (s *grpcSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.call == nil {
+		return nil
+	}
+	s.call.w.Close()
+	if s.call.resp != nil {
+		done := make(chan struct{})
+		go func(body io.Reader) {
+			io.Copy(ioutil.Discard, body)
+			close(done)
+		}(s.call.resp.Body)
+		select {
+		case <-done:
+		case <-time.After(s.Timeout):
+		}
+	}
+	s.call.drop()
+	s.call = nil
+	return nil
+}
+
+// protoStringField returns the string field number of a protobuf message, or "" if it isn't there.
+func protoStringField(msg []byte, number uint64) string {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ""
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return ""
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return ""
+			}
+			msg = msg[8:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return ""
+			}
+			if key>>3 == number {
+				return string(msg[n : n+int(length)])
+			}
+			msg = msg[n+int(length):]
+		case 5:
+			if len(msg) < 4 {
+				return ""
+			}
+			msg = msg[4:]
+		default:
+			return ""
+		}
+	}
+	return ""
+}
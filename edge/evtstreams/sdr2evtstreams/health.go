@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// nodeHealth is the state of the node that orchestration may want to act on, served on /healthz and /readyz.
+type nodeHealth struct {
+	mu sync.RWMutex
+	// Degraded is set when the node can still scan but can no longer score audio, DegradedReason says why.
+	Degraded       bool   `json:"degraded"`
+	DegradedReason string `json:"degradedReason,omitempty"`
+	// the node is ready once the model is loaded, the SDR is reachable and the publisher is connected.
+	ModelLoaded        bool `json:"modelLoaded"`
+	SDRReachable       bool `json:"sdrReachable"`
+	PublisherConnected bool `json:"publisherConnected"`
+	// unreachableSDRs are the SDRs that their loop last failed to reach by name, SDRReachable is set only
+	// while there are none.
+	unreachableSDRs map[string]bool
+}
+
+// health is the state of this node.
+var health = &nodeHealth{}
+
+func (h *nodeHealth) setDegraded(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Degraded = true
+	h.DegradedReason = reason
+}
+
+// degraded returns whether the node is degraded, and why.
+func (h *nodeHealth) degraded() (degraded bool, reason string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Degraded, h.DegradedReason
+}
+
+// set sets one of the readiness fields under the lock, like health.set(&health.SDRReachable, true).
+func (h *nodeHealth) set(field *bool, value bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*field = value
+}
+
+// setSDRReachable sets whether the SDR named device was reachable the last time its loop tried it.
+func (h *nodeHealth) setSDRReachable(device string, reachable bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.unreachableSDRs == nil {
+		h.unreachableSDRs = map[string]bool{}
+	}
+	if reachable {
+		delete(h.unreachableSDRs, device)
+	} else {
+		h.unreachableSDRs[device] = true
+	}
+	h.SDRReachable = len(h.unreachableSDRs) == 0
+}
+
+// serveHealthz is the liveness probe, it fails once the node is degraded so that it can be restarted.
+func (h *nodeHealth) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	h.write(w, !h.Degraded)
+}
+
+// serveReadyz is the readiness probe.
+func (h *nodeHealth) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	h.write(w, !h.Degraded && h.ModelLoaded && h.SDRReachable && h.PublisherConnected)
+}
+
+// write writes the state as JSON, with a 503 status if ok is false. h.mu must be held.
+func (h *nodeHealth) write(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
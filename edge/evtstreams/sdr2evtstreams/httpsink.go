@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// httpSink is a Publisher that POSTs each message to URL, for cloud ingest that is a plain web service.
+// A message longer than ChunkBytes is uploaded in chunks, each a PUT with a Content-Range and the Upload-ID
+// of the message. When a chunk fails, publishing the same message again, as a retry does, carries on from the
+// chunk that failed, or from the end of the Range the endpoint replied with, rather than from the start.
+type httpSink struct {
+	URL string
+	// Token is sent as a bearer token, if set.
+	Token string
+	// Format is json or protobuf, the AudioMsg of audiomsg.proto.
+	Format     string
+	ChunkBytes int
+	Client     *http.Client
+	// Signer signs the body of each message in its X-Signature header, nil doesn't.
+	Signer *messageSigner
+	mu     sync.Mutex
+	// the upload of last that is still to finish, it carries on from offset. signature is of its whole body.
+	last      *audiolib.AudioMsg
+	uploadID  string
+	offset    int
+	signature string
+}
+
+// newHTTPSink makes the httpSink for url, format is json or protobuf.
+func newHTTPSink(url, format string, chunkBytes int, client *http.Client) (s *httpSink, err error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("bad HTTP_SINK_URL %q, it must be an http or https URL", url)
+	}
+	switch format {
+	case "":
+		format = "json"
+	case "json", "protobuf":
+	default:
+		return nil, fmt.Errorf("unknown HTTP_SINK_FORMAT %q, must be json or protobuf", format)
+	}
+	return &httpSink{URL: url, Format: format, ChunkBytes: chunkBytes, Client: client}, nil
+}
+
+func (s *httpSink) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	body, contentType, err := s.encode(audioMsg)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if audioMsg != s.last {
+		s.last, s.uploadID, s.offset, s.signature = audioMsg, "", 0, ""
+		if s.Signer != nil {
+			s.signature = s.Signer.sign(body)
+		}
+	}
+	start := time.Now()
+	if s.ChunkBytes <= 0 || len(body) <= s.ChunkBytes {
+		_, err = s.send("POST", body, contentType, nil)
+	} else {
+		err = s.upload(body, contentType)
+	}
+	if err != nil {
+		return fmt.Errorf("can't publish to %s: %v", s.URL, err)
+	}
+	s.last = nil
+	logInfo("> message sent to", s.URL, field("freq", audioMsg.Freq), field("bytes", len(body)), field("latency", time.Since(start)))
+	return
+}
+
+func (s *httpSink) encode(audioMsg *audiolib.AudioMsg) (body []byte, contentType string, err error) {
+	if s.Format == "protobuf" {
+		body, err = audioMsg.EncodeProto()
+		return body, "application/x-protobuf", err
+	}
+	body, err = audioMsg.Encode()
+	return body, "application/json", err
+}
+
+// upload sends body in chunks from s.offset, it expects s.mu to be held.
+func (s *httpSink) upload(body []byte, contentType string) (err error) {
+	if s.uploadID == "" {
+		s.uploadID, err = newCaptureID()
+		if err != nil {
+			return
+		}
+	} else {
+		logInfo("resuming upload", s.uploadID, "at byte", s.offset, "of", len(body))
+	}
+	for s.offset < len(body) {
+		end := s.offset + s.ChunkBytes
+		if end > len(body) {
+			end = len(body)
+		}
+		header := http.Header{}
+		header.Set("Upload-ID", s.uploadID)
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", s.offset, end-1, len(body)))
+		resp, err := s.send("PUT", body[s.offset:end], contentType, header)
+		if err != nil {
+			return err
+		}
+		s.offset = end
+		// the endpoint may say how much it has, like bytes=0-1023, in which case the next chunk starts after that.
+		if received := resp.Header.Get("Range"); strings.HasPrefix(received, "bytes=0-") {
+			if last, err := strconv.Atoi(strings.TrimPrefix(received, "bytes=0-")); err == nil && last < len(body) {
+				s.offset = last + 1
+			}
+		}
+	}
+	return
+}
+
+// send makes one request, any status but 2xx is an error.
+func (s *httpSink) send(method string, body []byte, contentType string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	if s.signature != "" {
+		req.Header.Set("X-Signature", s.signature)
+		req.Header.Set("X-Signature-Key-ID", s.Signer.KeyID)
+	}
+	resp, err = s.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s %s", method, s.URL, resp.Status, strings.TrimSpace(string(reply)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return
+}
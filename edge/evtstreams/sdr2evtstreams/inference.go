@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audioconv"
+)
+
+// Inference is a model that an inferenceBackend loaded, which scores audio in modelAudioFormat until it is closed.
+type Inference interface {
+	Scorer
+	close() error
+}
+
+// inferenceBackend loads the model at path, like a TensorFlow graph or an ONNX model, with opts.
+type inferenceBackend func(path string, opts modelOptions) (Inference, error)
+
+// inferenceBackends are the backends that MODEL_BACKEND can name. Each registers itself in the init of its own file,
+// and a backend that needs a library the service was built without registers one that fails saying which build tag
+// it needs, so that a binary only links the runtimes it uses.
+var inferenceBackends = map[string]inferenceBackend{}
+
+// inferenceBackendNames are the names of inferenceBackends, sorted.
+func inferenceBackendNames() (names []string) {
+	for name := range inferenceBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// modelOptions are the settings an inferenceBackend loads a model with. Those that a backend has no use for are ignored.
+type modelOptions struct {
+	// Tags to load a SavedModel with, not used for frozen graphs.
+	Tags []string
+	// SkipOpCheck skips the whitelist check; only do this for models you fully trust.
+	SkipOpCheck bool
+	// InputOp is the name of the placeholder OP that the audio is fed into, input/Placeholder if empty.
+	// For ONNX it is the name of the input, and OutputOp that of the output, the first ones of the model if empty.
+	InputOp string
+	// OutputOp is the name of the OP that holds the goodness, output if empty, and OutputIndex its port.
+	// For TensorFlow Lite OutputIndex is the index of the output tensor.
+	OutputOp    string
+	OutputIndex int
+	// ExtraOutputs are the specs of other outputs to include in the messages, see parseOutputSpec.
+	ExtraOutputs []string
+	// IncludeLogits includes every value of the output in the messages.
+	IncludeLogits bool
+	// InputSeconds is how long the audio is that the model takes, audioChunkSeconds if 0.
+	InputSeconds float64
+	// Labels names the classes of the output, if it scores several.
+	Labels *classLabels
+}
+
+// inputSeconds is how long the audio is that the model takes.
+func (opts modelOptions) inputSeconds() float64 {
+	if opts.InputSeconds == 0 {
+		return audioChunkSeconds
+	}
+	return opts.InputSeconds
+}
+
+// firstScalar returns the first number in the value of a tensor, which may be a scalar or nested slices of any depth.
+func firstScalar(value interface{}) (scalar float32, err error) {
+	values, err := tensorValues(value)
+	if err != nil {
+		return
+	}
+	if len(values) == 0 {
+		err = errors.New("model output is empty")
+		return
+	}
+	return values[0], nil
+}
+
+// tensorValues flattens the value of a tensor, which may be a scalar or nested slices of any depth, into its numbers in order.
+func tensorValues(value interface{}) (values []float32, err error) {
+	var flatten func(v reflect.Value) error
+	flatten = func(v reflect.Value) error {
+		switch v.Kind() {
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				if err := flatten(v.Index(i)); err != nil {
+					return err
+				}
+			}
+		case reflect.Float32, reflect.Float64:
+			values = append(values, float32(v.Float()))
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			values = append(values, float32(v.Int()))
+		case reflect.Uint8, reflect.Uint16:
+			values = append(values, float32(v.Uint()))
+		default:
+			return fmt.Errorf("model output is of type %T, not a number", value)
+		}
+		return nil
+	}
+	err = flatten(reflect.ValueOf(value))
+	return
+}
+
+// parseOutputSpec parses an output spec of the form "name" or "name:index" into the OP name and port index.
+func parseOutputSpec(spec string) (name string, index int, err error) {
+	name = spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		name = spec[:i]
+		index, err = strconv.Atoi(spec[i+1:])
+		if err != nil || index < 0 {
+			err = fmt.Errorf("bad output index in %q", spec)
+			return
+		}
+	}
+	if name == "" {
+		err = fmt.Errorf("no OP name in output %q", spec)
+	}
+	return
+}
+
+// fitAudio pads audio with silence, or truncates it, so that it is exactly n bytes long.
+func fitAudio(audio []byte, n int) []byte {
+	if len(audio) >= n {
+		return audio[:n]
+	}
+	return append(audio, make([]byte, n-len(audio))...)
+}
+
+// outputScore makes the score of an output whose values are a vector of numbers, as the TensorFlow Lite and ONNX
+// backends have them, going by the labels and whether logits are kept in opts.
+func outputScore(values []float32, opts modelOptions) (s audioScore, err error) {
+	if opts.Labels != nil {
+		err = opts.Labels.apply(values, &s)
+	} else if len(values) == 0 {
+		err = errors.New("model output is empty")
+	} else {
+		s.Value = values[0]
+	}
+	if err != nil {
+		return
+	}
+	if opts.IncludeLogits {
+		s.Logits = values
+	}
+	return
+}
+
+// audioSamples is raw audio in modelAudioFormat as the interleaved float samples between -1 and 1 that the
+// TensorFlow Lite and ONNX backends feed their models, n of them, padded with silence or truncated to that.
+func audioSamples(audio []byte, n int) []float32 {
+	channels := audioconv.Decode(audio, modelAudioFormat)
+	samples := make([]float32, n)
+	for i := range samples {
+		c, frame := i%len(channels), i/len(channels)
+		if frame >= len(channels[c]) {
+			break
+		}
+		samples[i] = float32(channels[c][frame])
+	}
+	return samples
+}
+
+// warmup runs one inference over silence and discards the result,
+// so that the lazy initialization of the runtime does not slow down the first real inference.
+// It also checks that the model takes audio of inputSeconds, which is otherwise only found out on the first capture.
+func warmup(m Scorer, inputSeconds float64) (elapsed time.Duration, err error) {
+	start := time.Now()
+	_, err = m.score(make([]byte, modelAudioFormat.Bytes(inputSeconds)))
+	if err != nil {
+		err = fmt.Errorf("the model can't score %g seconds of audio, check MODEL_INPUT_SECONDS: %v", inputSeconds, err)
+		return
+	}
+	elapsed = time.Since(start)
+	return
+}
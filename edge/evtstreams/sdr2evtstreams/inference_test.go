@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audioconv"
+)
+
+func TestFitAudio(t *testing.T) {
+	tests := []struct {
+		name  string
+		audio []byte
+		n     int
+		want  []byte
+	}{
+		{"short", []byte{1, 2}, 4, []byte{1, 2, 0, 0}},
+		{"empty", nil, 2, []byte{0, 0}},
+		{"exact", []byte{1, 2, 3, 4}, 4, []byte{1, 2, 3, 4}},
+		{"over-long", []byte{1, 2, 3, 4, 5, 6}, 4, []byte{1, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		if got := fitAudio(test.audio, test.n); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: fitAudio(%v, %d) = %v, want %v", test.name, test.audio, test.n, got, test.want)
+		}
+	}
+}
+
+func TestOutputScore(t *testing.T) {
+	labels := &classLabels{Labels: []string{"speech", "music"}, Good: []int{0}}
+	tests := []struct {
+		name    string
+		values  []float32
+		opts    modelOptions
+		want    audioScore
+		wantErr bool
+	}{
+		{"first value", []float32{0.7, 0.2}, modelOptions{}, audioScore{Value: 0.7}, false},
+		{"logits", []float32{0.7, 0.2}, modelOptions{IncludeLogits: true}, audioScore{Value: 0.7, Logits: []float32{0.7, 0.2}}, false},
+		{"labels", []float32{0.7, 0.3}, modelOptions{Labels: labels},
+			audioScore{Value: 0.7, Classes: map[string]float32{"speech": 0.7, "music": 0.3}}, false},
+		{"empty", nil, modelOptions{}, audioScore{}, true},
+		{"too few for the labels", []float32{0.7}, modelOptions{Labels: labels}, audioScore{}, true},
+	}
+	for _, test := range tests {
+		got, err := outputScore(test.values, test.opts)
+		if (err != nil) != test.wantErr || !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: outputScore(%v) = %+v, %v, want %+v", test.name, test.values, got, err, test.want)
+		}
+	}
+}
+
+func TestAudioSamples(t *testing.T) {
+	defer func(f audioconv.Format) { modelAudioFormat = f }(modelAudioFormat)
+	modelAudioFormat = audioconv.Format{SampleRate: 16000, Channels: 2, Encoding: audioconv.F32LE}
+	// two frames of stereo, left then right.
+	audio := audioconv.Encode([][]float64{{0.5, 0.25}, {-0.5, -0.25}}, audioconv.F32LE)
+	tests := []struct {
+		n    int
+		want []float32
+	}{
+		{4, []float32{0.5, -0.5, 0.25, -0.25}},
+		{6, []float32{0.5, -0.5, 0.25, -0.25, 0, 0}},
+		{2, []float32{0.5, -0.5}},
+	}
+	for _, test := range tests {
+		if got := audioSamples(audio, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("audioSamples(%d) = %v, want %v", test.n, got, test.want)
+		}
+	}
+}
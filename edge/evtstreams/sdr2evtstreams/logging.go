@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLevel gates how much is logged, each level includes all the levels below it.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var logLevelNames = map[string]logLevel{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+func (l logLevel) String() string {
+	return [...]string{"error", "warn", "info", "debug"}[l]
+}
+
+// currentLogLevel is set in main via LOG_LEVEL.
+var currentLogLevel = levelInfo
+
+func parseLogLevel(name string) (level logLevel, err error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		err = fmt.Errorf("unknown LOG_LEVEL %q, must be one of error, warn, info or debug", name)
+	}
+	return
+}
+
+// logFormat is how a log line is written: text is the classic line for people, json and logfmt are for log collectors.
+type logFormat int
+
+const (
+	formatText logFormat = iota
+	formatJSON
+	formatLogfmt
+)
+
+var logFormatNames = map[string]logFormat{
+	"text":   formatText,
+	"json":   formatJSON,
+	"logfmt": formatLogfmt,
+}
+
+// currentLogFormat is set in main via LOG_FORMAT.
+var currentLogFormat = formatText
+
+func parseLogFormat(name string) (format logFormat, err error) {
+	format, ok := logFormatNames[strings.ToLower(name)]
+	if !ok {
+		err = fmt.Errorf("unknown LOG_FORMAT %q, must be one of text, json or logfmt", name)
+	}
+	return
+}
+
+// structuredLog writes json and logfmt lines, which carry their own timestamp.
+var structuredLog = log.New(os.Stderr, "", 0)
+
+// logField is a named value on a log line, like the frequency of the station it is about.
+// Fields can be passed among the other arguments of logInfo and the rest, they are taken out of the message.
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+func field(key string, value interface{}) logField {
+	return logField{key, value}
+}
+
+func logAt(level logLevel, args ...interface{}) {
+	if level > currentLogLevel {
+		return
+	}
+	var msgArgs []interface{}
+	var fields []logField
+	for _, arg := range args {
+		if f, ok := arg.(logField); ok {
+			// a field without a key, like the device of the only SDR, is left out.
+			if f.Key != "" {
+				fields = append(fields, f)
+			}
+		} else {
+			msgArgs = append(msgArgs, arg)
+		}
+	}
+	msg := strings.TrimSuffix(fmt.Sprintln(msgArgs...), "\n")
+	// secrets are redacted from the whole line, wherever they ended up in it.
+	switch currentLogFormat {
+	case formatJSON:
+		structuredLog.Println(redact(jsonLine(time.Now(), level, msg, fields)))
+	case formatLogfmt:
+		structuredLog.Println(redact(logfmtLine(time.Now(), level, msg, fields)))
+	default:
+		line := strings.ToUpper(level.String()) + ": " + msg
+		for _, f := range fields {
+			line += " " + f.Key + "=" + logfmtValue(f.Value)
+		}
+		log.Println(redact(line))
+	}
+}
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func jsonLine(t time.Time, level logLevel, msg string, fields []logField) string {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	buf.WriteString(strconv.Quote(t.Format(logTimeFormat)))
+	buf.WriteString(`,"level":`)
+	buf.WriteString(strconv.Quote(level.String()))
+	buf.WriteString(`,"msg":`)
+	buf.Write(jsonValue(msg))
+	for _, f := range fields {
+		buf.WriteByte(',')
+		buf.Write(jsonValue(f.Key))
+		buf.WriteByte(':')
+		buf.Write(jsonValue(f.Value))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// jsonValue encodes v, as a string if it is an error or a Stringer like time.Duration, or if it can't be encoded like NaN.
+func jsonValue(v interface{}) []byte {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case fmt.Stringer:
+		v = value.String()
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return encoded
+}
+
+func logfmtLine(t time.Time, level logLevel, msg string, fields []logField) string {
+	line := "time=" + t.Format(logTimeFormat) + " level=" + level.String() + " msg=" + logfmtValue(msg)
+	for _, f := range fields {
+		line += " " + f.Key + "=" + logfmtValue(f.Value)
+	}
+	return line
+}
+
+// logfmtValue formats v for logfmt, quoting it if needed. Frequencies are written in full, not like 9.19e+07.
+func logfmtValue(v interface{}) (s string) {
+	switch value := v.(type) {
+	case float32:
+		s = strconv.FormatFloat(float64(value), 'f', -1, 32)
+	case float64:
+		s = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func logDebug(args ...interface{}) {
+	logAt(levelDebug, args...)
+}
+
+func logInfo(args ...interface{}) {
+	logAt(levelInfo, args...)
+}
+
+func logWarn(args ...interface{}) {
+	logAt(levelWarn, args...)
+}
+
+func logError(args ...interface{}) {
+	logAt(levelError, args...)
+}
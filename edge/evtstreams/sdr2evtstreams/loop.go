@@ -0,0 +1,789 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/goodness"
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+	"golang.org/x/time/rate"
+)
+
+// audioScore is what a Scorer makes of a chunk of audio.
+type audioScore struct {
+	// Value is 1 for good (speech) and 0 for nongood (nonspeech).
+	Value float32
+	// Extras holds the values of any extra model outputs by name, they are passed on in the messages.
+	Extras map[string]float32
+	// Logits holds every value of the model output, only if it was asked for.
+	Logits []float32
+	// Classes holds how likely each class is by its label, for a model with MODEL_LABELS_FILE.
+	Classes map[string]float32
+}
+
+// Scorer scores a chunk of raw audio.
+type Scorer interface {
+	score(audio []byte) (s audioScore, err error)
+}
+
+// Publisher sends audio messages on to the cloud.
+type Publisher interface {
+	publishAudio(audioMsg *audiolib.AudioMsg) (err error)
+}
+
+// rawAudioPublisher is a Publisher that also wants the raw audio that a message was encoded from, like the file sink.
+type rawAudioPublisher interface {
+	publishRawAudio(audioMsg *audiolib.AudioMsg, raw []byte) (err error)
+}
+
+// publishMessage publishes audioMsg with p, along with raw if p wants it.
+func publishMessage(p Publisher, audioMsg *audiolib.AudioMsg, raw []byte) error {
+	if rp, ok := p.(rawAudioPublisher); ok {
+		return rp.publishRawAudio(audioMsg, raw)
+	}
+	return p.publishAudio(audioMsg)
+}
+
+// standbyPublisher is the Publisher of a standby node. It holds on to the Publisher of the active role,
+// but instead of publishing only counts the messages it would have published.
+type standbyPublisher struct {
+	Publisher  Publisher
+	Suppressed int
+}
+
+func (p *standbyPublisher) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	p.Suppressed++
+	logDebug("standby, not publishing message from", audioMsg.Freq, "suppressed so far:", p.Suppressed)
+	return
+}
+
+// activePublisher is the Publisher that p publishes with in the active role, p itself unless it is a standbyPublisher.
+func activePublisher(p Publisher) Publisher {
+	if standby, ok := p.(*standbyPublisher); ok {
+		return standby.Publisher
+	}
+	return p
+}
+
+// loopConfig holds the settings of the main loop.
+type loopConfig struct {
+	DevID string
+	// Device is the name of the SDR of the loop in SDR_DEVICES, which is on its log lines and metrics.
+	// It is "" when SDR_DEVICES isn't set.
+	Device         string
+	UseGPS         bool
+	FitAudioLength bool
+	// PreprocessAudio removes the DC offset and normalizes audio before it is scored, the audio is published as it was captured.
+	PreprocessAudio bool
+	// NoiseGate skips scoring the chunks that are silent or only static, which then score 0, nil scores them all.
+	NoiseGate *noiseGate
+	// Windows scores each chunk in sliding windows and publishes each window that scores over the threshold on its
+	// own, nil scores and publishes whole chunks.
+	Windows         *slidingWindows
+	RetryNoStations bool
+	// Refresher decides when the list of stations is refreshed, nil is every 5 minutes.
+	Refresher StationRefresher
+	// Limiter caps how many messages are published, and ByteLimiter how many bytes, nil is unlimited.
+	Limiter     *rate.Limiter
+	ByteLimiter *rate.Limiter
+	// GoodnessRule updates the goodness of a station from the values its audio scores, and decays it while it isn't sampled.
+	GoodnessRule goodness.Rule
+	// FixedStations, if set, are sampled on every pass at a goodness of 1 instead of scanning for stations.
+	FixedStations []int64
+	// IncludeStations are added to the stations every scan finds, and ExcludeStations are taken out of them,
+	// so they are never sampled.
+	IncludeStations []int64
+	ExcludeStations []int64
+	// Selector picks the stations to sample on each pass, nil is a goodnessSelector that doesn't explore.
+	Selector StationSelector
+	// MaxScoreFailures is how many times in a row scoring may fail before the node is degraded,
+	// after which it keeps capturing audio but no longer scores or publishes it. 0 panics on the first failure.
+	MaxScoreFailures int
+	// Threshold is the value audio must score over to be published, nil is defaultPublishThreshold.
+	Threshold *thresholdSchedule
+	// ClassThresholds, if set, publish audio that any of their classes scores over its threshold in instead.
+	ClassThresholds classThresholds
+	// TopClasses is how many of the most likely classes are sent in each message, all of them if 0.
+	TopClasses int
+	// Retry is how calls to the SDR and the Publisher are retried, and FailureWindow how long they may keep
+	// failing before the service gives up.
+	Retry         retryPolicy
+	FailureWindow time.Duration
+	// SDRBreaker pauses captures while the SDR keeps failing, instead of giving up on it after FailureWindow,
+	// nil gives up. Each loop has its own.
+	SDRBreaker *circuitBreaker
+	// Dedup skips publishing audio that was just published from the same station, nil publishes everything.
+	Dedup *dedup
+	// Spool holds the messages that failed to publish until publishing works again, nil drops them.
+	// SpoolDrainBatch is how many of them are published after each message that is.
+	Spool           *spool
+	SpoolDrainBatch int
+	// DeadLetter keeps the messages that fail to publish and can't be spooled, nil drops them.
+	DeadLetter *deadLetter
+	// StationInfos looks up the RDS of each station to name it in the messages, nil doesn't.
+	StationInfos *stationInfos
+	// SNRs measures the SNR of each station when it is captured, to send in the messages and to sample weak
+	// stations less, nil doesn't. Each loop has its own, as the SNR of a station is different on each SDR.
+	SNRs *stationSNRs
+	// Mode is how the SDR demodulates the audio, named in each message.
+	Mode rtlsdr.Mode
+	// IQ, if set, captures the raw IQ samples of each station with its options instead of audio, and publishes
+	// all of them without scoring them.
+	IQ *rtlsdr.IQOptions
+	// ModelName and ModelVersion name the model in each message.
+	ModelName    string
+	ModelVersion string
+	// Encryption encrypts the audio of each message, nil sends it in the clear.
+	Encryption *audioEncryption
+	// CommitLog keeps each message until it is published, so that it is sent again after a crash, nil doesn't.
+	CommitLog *commitLog
+	// Pipeline is how many stations are captured from and how many chunks are scored at once,
+	// and how many chunks can wait between capturing, scoring and publishing.
+	Pipeline pipelineConfig
+	// Goodness saves the goodness of the stations after each pass once its interval is up, and when run returns.
+	// nil saves nothing.
+	Goodness *goodnessStore
+	// HandleMu is held while a chunk is handled, when the loops of several SDRs share the Publisher, spool,
+	// dedup and commit log, which are only safe to use from one loop at a time. nil when there is one loop.
+	HandleMu *sync.Mutex
+}
+
+// deviceField is the field that names the SDR of the loop on its log lines, which is left out when there is only one.
+func (cfg loopConfig) deviceField() logField {
+	return deviceField(cfg.Device)
+}
+
+// deviceField is the field that names the SDR called device on a log line, which is left out for "", the only SDR.
+func deviceField(device string) logField {
+	if device == "" {
+		return logField{}
+	}
+	return field("device", device)
+}
+
+// loopDeps holds everything the main loop talks to, so that each of them can be swapped for a mock.
+type loopDeps struct {
+	SDR       SDR
+	Scorer    Scorer
+	Publisher Publisher
+	// GetLocation is only called if UseGPS is set.
+	GetLocation func() (locationData, error)
+	// Now is the clock, nil is the real one. Sleeping between scans always uses the real clock.
+	Now func() time.Time
+}
+
+func (deps loopDeps) now() time.Time {
+	if deps.Now == nil {
+		return time.Now()
+	}
+	return deps.Now()
+}
+
+// newAudioMsg makes the message to publish for a chunk of raw audio that scored s, captured at ts.
+func newAudioMsg(cfg loopConfig, audio []byte, station int64, s audioScore, origin string, location locationData, ts time.Time) *audiolib.AudioMsg {
+	encoded, contentType, contentEncoding := encodeAudio(audio)
+	msg := &audiolib.AudioMsg{
+		Audio:           encoded,
+		Ts:              ts.Unix(),
+		Freq:            station,
+		ExpectedValue:   s.Value,
+		DevID:           cfg.DevID,
+		Lat:             float32(location.Latitude),
+		Lon:             float32(location.Longitude),
+		Alt:             float32(location.ElevationM),
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		SampleRate:      audioSampleRate,
+		Channels:        audioChannels,
+		SampleFormat:    audioSampleFormat(),
+		Duration:        audioDuration(audio),
+		PowerDBFS:       audioPowerDBFS(audio),
+		ModelName:       cfg.ModelName,
+		ModelVersion:    cfg.ModelVersion,
+		Origin:          origin,
+		Mode:            string(cfg.Mode),
+		Extras:          s.Extras,
+		Logits:          s.Logits,
+		Classes:         topClasses(s.Classes, cfg.TopClasses),
+		SchemaVersion:   audiolib.SchemaVersion,
+	}
+	if cfg.Encryption != nil {
+		cfg.Encryption.seal(msg)
+	}
+	// the hash is of the audio as it is sent, encrypted or not.
+	msg.SetAudioSHA256()
+	return msg
+}
+
+// newIQMsg makes the message to publish for the raw IQ samples of station, captured at ts with cfg.IQ.
+func newIQMsg(cfg loopConfig, iq []byte, station int64, origin string, location locationData, ts time.Time) *audiolib.AudioMsg {
+	msg := &audiolib.AudioMsg{
+		Audio:         base64.StdEncoding.EncodeToString(iq),
+		Ts:            ts.Unix(),
+		Freq:          station,
+		DevID:         cfg.DevID,
+		Lat:           float32(location.Latitude),
+		Lon:           float32(location.Longitude),
+		Alt:           float32(location.ElevationM),
+		ContentType:   "application/octet-stream",
+		SampleRate:    cfg.IQ.SampleRate,
+		Channels:      1,
+		SampleFormat:  "cu8",
+		Duration:      float32(len(iq)/2) / float32(cfg.IQ.SampleRate),
+		Origin:        origin,
+		Mode:          audiolib.ModeIQ,
+		Gain:          cfg.IQ.Gain,
+		SchemaVersion: audiolib.SchemaVersion,
+	}
+	if cfg.Encryption != nil {
+		cfg.Encryption.seal(msg)
+	}
+	msg.SetAudioSHA256()
+	return msg
+}
+
+// scoredAudio is the audio that is given to the Scorer, which is preprocessed if cfg.PreprocessAudio is set,
+// and converted to modelAudioFormat.
+func scoredAudio(cfg loopConfig, audio []byte) []byte {
+	if cfg.PreprocessAudio {
+		audio = preprocessAudio(audio)
+	}
+	return modelAudio(audio)
+}
+
+// overThreshold reports whether audio that scored s at now is worth sending to the cloud, because its value is over
+// the threshold then, or with ClassThresholds because any of their classes scores over its threshold.
+func (cfg loopConfig) overThreshold(s audioScore, now time.Time) bool {
+	if cfg.ClassThresholds != nil {
+		return cfg.ClassThresholds.over(s)
+	}
+	return s.Value > cfg.Threshold.at(now)
+}
+
+// decayGoodness decays the goodness of every station by how long it has been since it was last decayed or updated.
+// The goodness of a station that was just found starts decaying from now.
+func decayGoodness(rule goodness.Rule, device string, stationGoodness map[int64]float32, decayedAt map[int64]time.Time, now time.Time) {
+	if rule.HalfLife <= 0 {
+		return
+	}
+	for station, g := range stationGoodness {
+		if last, ok := decayedAt[station]; ok {
+			stationGoodness[station] = rule.Decay(g, now.Sub(last))
+			metrics.setGoodness(device, station, stationGoodness[station])
+		}
+		decayedAt[station] = now
+	}
+}
+
+// applyStationLists returns the stations that a scan found plus those in include, less those in exclude.
+// A station in both include and exclude is excluded.
+func applyStationLists(found, include, exclude []int64) (stations []int64) {
+	excluded := map[int64]bool{}
+	for _, station := range exclude {
+		excluded[station] = true
+	}
+	seen := map[int64]bool{}
+	for _, list := range [][]int64{found, include} {
+		for _, station := range list {
+			if !excluded[station] && !seen[station] {
+				seen[station] = true
+				stations = append(stations, station)
+			}
+		}
+	}
+	return
+}
+
+const minNoStationsDelay = 30 * time.Second
+const maxNoStationsDelay = 30 * time.Minute
+
+// run is the main loop. Whenever cfg.Refresher says so it refreshes the list of stations,
+// and in between it samples stations according to their goodness, scores their audio,
+// and publishes the audio that is worth sending to the cloud, capturing, scoring and publishing at the same time.
+// stationGoodness is updated in place. run returns when ctx is done.
+func run(ctx context.Context, cfg loopConfig, deps loopDeps, stationGoodness map[int64]float32) error {
+	dev := cfg.deviceField()
+	if cfg.Refresher == nil {
+		cfg.Refresher = &intervalRefresher{Interval: 5 * time.Minute}
+	}
+	// lastScan is the stations the last refresh found.
+	lastScan := map[int64]bool{}
+	throttledMsgs := 0
+	noStationsDelay := minNoStationsDelay
+	sdr_origin := ""
+	var hasCapturedFirstClip = false
+	var hasSentFirstClip = false
+	fixed := len(cfg.FixedStations) > 0
+	if fixed {
+		logInfo("not scanning, using the", len(cfg.FixedStations), "stations in FIXED_STATIONS", dev)
+		sdr_origin = "fixed"
+		for _, station := range cfg.FixedStations {
+			stationGoodness[station] = 1.0
+			metrics.setGoodness(cfg.Device, station, 1.0)
+		}
+	}
+	if !fixed {
+		for _, station := range cfg.ExcludeStations {
+			delete(stationGoodness, station)
+		}
+		// the included stations are sampled even before the first scan succeeds.
+		for _, station := range applyStationLists(nil, cfg.IncludeStations, cfg.ExcludeStations) {
+			if _, ok := stationGoodness[station]; !ok {
+				stationGoodness[station] = goodness.Initial
+				metrics.setGoodness(cfg.Device, station, goodness.Initial)
+			}
+		}
+	}
+	defer func() {
+		err := cfg.Goodness.save(stationGoodness, deps.now())
+		if err != nil {
+			logWarn("can't save the goodness of the stations:", err, dev)
+		}
+	}()
+	if cfg.Selector == nil {
+		cfg.Selector = &goodnessSelector{}
+	}
+	// decayedAt is when the goodness of each station was last decayed or updated.
+	decayedAt := map[int64]time.Time{}
+	var pass passStats
+	sdrFailures := failureWindow{Window: cfg.FailureWindow}
+	publishFailures := failureWindow{Window: cfg.FailureWindow}
+	// captureMu guards sdrFailures and hasCapturedFirstClip while the capture workers run.
+	var captureMu sync.Mutex
+	// scoreFailures is shared by the scoring workers.
+	var scoreFailures struct {
+		sync.Mutex
+		count int
+	}
+	// capture captures a chunk of audio from station, it runs in several goroutines at once.
+	capture := func(station int64) *chunk {
+		// the rest of the pass is skipped once the breaker trips.
+		if cfg.SDRBreaker.wait(deps.now()) > 0 {
+			return nil
+		}
+		var audio []byte
+		captureStart := deps.now()
+		err := cfg.Retry.do(ctx, fmt.Sprint("getting audio from ", station), func() (err error) {
+			if cfg.IQ != nil {
+				audio, err = deps.SDR.(iqSDR).GetIQ(ctx, station, *cfg.IQ)
+				return
+			}
+			audio, err = deps.SDR.GetAudio(ctx, station)
+			return
+		})
+		captureTime := deps.now().Sub(captureStart)
+		// look up the RDS and measure the SNR of the station while this worker still has the SDR to itself.
+		var info rtlsdr.StationInfo
+		var snr float32
+		if err == nil {
+			info = cfg.StationInfos.lookup(ctx, deps.SDR, station, deps.now())
+			snr = cfg.SNRs.measure(ctx, deps.SDR, station)
+		}
+		captureMu.Lock()
+		defer captureMu.Unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if cfg.SDRBreaker == nil && sdrFailures.failed(deps.now()) {
+				panic(fmt.Sprintf("the sdr has been failing for over %v, last with: %v", cfg.FailureWindow, err))
+			}
+			logError("can't get audio:", err, field("freq", station), dev)
+			health.setSDRReachable(cfg.Device, false)
+			cfg.SDRBreaker.failed(deps.now())
+			return nil
+		}
+		sdrFailures.succeeded()
+		cfg.SDRBreaker.succeeded()
+		health.setSDRReachable(cfg.Device, true)
+		metrics.captured(cfg.Device, captureTime)
+		if expected := expectedAudioBytes(captureSeconds); cfg.IQ == nil && len(audio) != expected {
+			if !cfg.FitAudioLength {
+				logError("audio is", len(audio), "bytes long, expected", expected, field("freq", station), dev)
+				releaseAudioBuffer(audio)
+				return nil
+			}
+			logWarn("audio is", len(audio), "bytes long, expected", expected, field("freq", station), dev)
+			audio = fitAudio(audio, expected)
+		}
+		if !hasCapturedFirstClip {
+			logInfo("Captured first clip", dev)
+			hasCapturedFirstClip = true
+		}
+		return &chunk{Station: station, Audio: audio, Info: info, SNR: snr}
+	}
+	// score scores c, it runs in several goroutines at once.
+	score := func(c *chunk) bool {
+		// IQ samples aren't scored, they are all published.
+		if cfg.IQ != nil {
+			return true
+		}
+		if degraded, reason := health.degraded(); degraded {
+			logError("DEGRADED, not scoring or publishing audio because", reason, field("freq", c.Station), dev)
+			releaseAudioBuffer(c.Audio)
+			return false
+		}
+		if reason := cfg.NoiseGate.check(c.Audio); reason != "" {
+			logDebug("not scoring audio that is", reason, field("freq", c.Station), dev)
+			metrics.gated(cfg.Device)
+			c.Score, c.Gated = audioScore{}, true
+			return true
+		}
+		scoreStart := deps.now()
+		var s audioScore
+		var err error
+		if cfg.Windows == nil {
+			s, err = deps.Scorer.score(scoredAudio(cfg, c.Audio))
+		} else {
+			c.Windows = cfg.Windows.split(c.Audio)
+			for i := range c.Windows {
+				w := &c.Windows[i]
+				w.Score, err = deps.Scorer.score(scoredAudio(cfg, c.Audio[w.Start:w.End]))
+				if err != nil {
+					break
+				}
+				// the chunk scores as well as its best window, which is what the station learns from.
+				if i == 0 || w.Score.Value > s.Value {
+					s = w.Score
+				}
+			}
+		}
+		scoreFailures.Lock()
+		defer scoreFailures.Unlock()
+		if err != nil {
+			releaseAudioBuffer(c.Audio)
+			if cfg.MaxScoreFailures <= 0 {
+				panic(err)
+			}
+			scoreFailures.count++
+			logError("failed to score audio:", err, field("freq", c.Station), field("failures", scoreFailures.count), dev)
+			if scoreFailures.count >= cfg.MaxScoreFailures {
+				health.setDegraded(fmt.Sprintf("scoring failed %d times in a row, last with: %v", scoreFailures.count, err))
+			}
+			return false
+		}
+		scoreFailures.count = 0
+		metrics.inferred(cfg.Device, deps.now().Sub(scoreStart))
+		c.Score = s
+		return true
+	}
+	// publish publishes audio of c, which scored s, offset seconds into it.
+	publish := func(c *chunk, audio []byte, s audioScore, offset float32) {
+		station := c.Station
+		var fingerprint uint64
+		if cfg.Dedup != nil {
+			var duplicate bool
+			fingerprint, duplicate = cfg.Dedup.check(station, audio, deps.now())
+			if duplicate {
+				logInfo("not sending sample because it is the same as the last one", field("freq", station), field("duplicates", cfg.Dedup.Skipped), dev)
+				return
+			}
+		}
+		var location = locationData{}
+		var err error
+		if cfg.UseGPS {
+			location, err = deps.GetLocation()
+			if err != nil {
+				logWarn("can't get location from GPS:", err, dev)
+				return
+			}
+		}
+		// construct the message,
+		var msg *audiolib.AudioMsg
+		if cfg.IQ != nil {
+			msg = newIQMsg(cfg, audio, station, sdr_origin, location, deps.now())
+		} else {
+			msg = newAudioMsg(cfg, audio, station, s, sdr_origin, location, deps.now())
+		}
+		msg.CallSign, msg.StationName = c.Info.CallSign, c.Info.PS
+		msg.SNR = c.SNR
+		msg.Offset = offset
+		// the bytes are checked first and given back if the message limit turns the sample away,
+		// so that a sample only uses up the budget of either limiter if it is sent.
+		now := deps.now()
+		var reserved *rate.Reservation
+		if cfg.ByteLimiter != nil {
+			reserved = cfg.ByteLimiter.ReserveN(now, msg.Length())
+			if !reserved.OK() || reserved.DelayFrom(now) > 0 {
+				reserved.CancelAt(now)
+				throttledMsgs++
+				logWarn("over EVTSTREAMS_MAX_BYTES_PER_SEC, not sending sample", field("freq", station), field("bytes", msg.Length()), field("throttled", throttledMsgs), dev)
+				return
+			}
+		}
+		if !cfg.Limiter.AllowN(now, 1) {
+			if reserved != nil {
+				reserved.CancelAt(now)
+			}
+			throttledMsgs++
+			logWarn("rate limited, not sending sample", field("freq", station), field("throttled", throttledMsgs), dev)
+			return
+		}
+		var pending string
+		if cfg.CommitLog != nil {
+			pending = cfg.CommitLog.begin(msg, audio)
+		}
+		// and publish it to evtstreams
+		err = cfg.Retry.do(ctx, "publishing", func() error {
+			return publishMessage(deps.Publisher, msg, audio)
+		})
+		metrics.publishedOne(err)
+		health.set(&health.PublisherConnected, err == nil)
+		if err != nil {
+			logError(err, dev)
+			// while messages can be spooled, the node keeps going however long publishing fails.
+			spooled := cfg.Spool != nil && !publishErrorIsPermanent(err) && cfg.Spool.add(msg, audio)
+			if !spooled && cfg.DeadLetter != nil {
+				cfg.DeadLetter.add(msg, err)
+			}
+			if cfg.CommitLog != nil {
+				cfg.CommitLog.abandon(pending)
+			}
+			if publishFailures.failed(deps.now()) && !spooled {
+				panic(fmt.Sprintf("publishing has been failing for over %v, last with: %v", cfg.FailureWindow, err))
+			}
+		} else {
+			publishFailures.succeeded()
+			if cfg.CommitLog != nil {
+				cfg.CommitLog.commit(pending, msg, deps.Publisher)
+			}
+			if cfg.Dedup != nil {
+				cfg.Dedup.record(station, fingerprint, deps.now())
+			}
+			pass.Published++
+			if cfg.Spool != nil {
+				cfg.Spool.drain(deps.Publisher, cfg.SpoolDrainBatch)
+			}
+		}
+		if !hasSentFirstClip {
+			logInfo("Sent first clip", dev)
+			hasSentFirstClip = true
+		}
+	}
+	// handle learns from the score of c and maybe publishes it.
+	handle := func(c *chunk) {
+		if cfg.HandleMu != nil {
+			cfg.HandleMu.Lock()
+			defer cfg.HandleMu.Unlock()
+		}
+		// the message holds the audio as mp3, so the raw audio can be reused once it has been published.
+		defer releaseAudioBuffer(c.Audio)
+		station, audio, s := c.Station, c.Audio, c.Score
+		val := s.Value
+		// there is nothing to learn from IQ samples, which aren't scored.
+		if cfg.IQ == nil {
+			pass.observe(val)
+			cfg.Refresher.observe(val)
+			if !fixed {
+				stationGoodness[station] = cfg.GoodnessRule.Update(stationGoodness[station], val)
+				decayedAt[station] = deps.now()
+				metrics.setGoodness(cfg.Device, station, stationGoodness[station])
+				cfg.Selector.observe(station, val)
+			}
+			logDebug("observed", field("freq", station), field("value", val), field("goodness", stationGoodness[station]), dev)
+		}
+		if c.Gated {
+			return
+		}
+		// each window that scores over the threshold is sent on its own, with where it starts in the chunk.
+		if len(c.Windows) > 0 {
+			sent := false
+			for _, w := range c.Windows {
+				if cfg.overThreshold(w.Score, deps.now()) {
+					publish(c, audio[w.Start:w.End], w.Score, w.Offset)
+					sent = true
+				}
+			}
+			if !sent {
+				logDebug("not sending sample with no window over the threshold", field("freq", station), field("value", val), dev)
+			}
+			return
+		}
+		// if the value is over the threshold, it is worth sending to the cloud.
+		if cfg.IQ != nil || cfg.overThreshold(s, deps.now()) {
+			publish(c, audio, s, 0)
+		} else {
+			logDebug("not sending sample below the threshold", field("freq", station), field("value", val), dev)
+		}
+	}
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// while the breaker is tripped, the SDR is left alone until the cooldown is up.
+		if wait := cfg.SDRBreaker.wait(deps.now()); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		// if it has been over the refresh interval since we last updated the list of strong stations,
+		if !fixed && cfg.Refresher.due(deps.now()) {
+			logInfo("fetching new list of stations", dev)
+			// for ever, we aquire a list of stations,
+			var freqs rtlsdr.Freqs
+			err := cfg.Retry.do(ctx, "getting stations", func() (err error) {
+				freqs, err = deps.SDR.GetFreqs(ctx)
+				return
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if cfg.SDRBreaker == nil && sdrFailures.failed(deps.now()) {
+					panic(fmt.Sprintf("the sdr has been failing for over %v, last with: %v", cfg.FailureWindow, err))
+				}
+				logError("can't get stations:", err, dev)
+				health.setSDRReachable(cfg.Device, false)
+				cfg.SDRBreaker.failed(deps.now())
+				// keep sampling the stations we know of, if there are none wait before trying again.
+				if len(stationGoodness) == 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-time.After(cfg.Retry.MaxBackoff):
+					}
+					continue
+				}
+			} else {
+				sdrFailures.succeeded()
+				cfg.SDRBreaker.succeeded()
+				health.setSDRReachable(cfg.Device, true)
+				logDebug("got", len(freqs.Freqs), "freqs from sdr", dev)
+				freqs.Freqs = applyStationLists(freqs.Freqs, cfg.IncludeStations, cfg.ExcludeStations)
+				sdr_origin = freqs.Origin
+				for _, station := range freqs.Freqs {
+					_, prs := stationGoodness[station]
+					if !prs {
+						// only if the station is not already in our map, do we add it, with an initial value of 0.5
+						logInfo("found new station", field("freq", station), dev)
+						stationGoodness[station] = goodness.Initial
+						metrics.stationDiscovered(cfg.Device)
+						metrics.setGoodness(cfg.Device, station, goodness.Initial)
+					}
+				}
+				// if no stations can be found, we can't do anything, so panic, or wait and scan again.
+				if len(stationGoodness) < 1 {
+					if !cfg.RetryNoStations {
+						panic("No FM stations. Move the antenna?")
+					}
+					logWarn("No FM stations. Move the antenna? Scanning again in", noStationsDelay, dev)
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-time.After(noStationsDelay):
+					}
+					noStationsDelay *= 2
+					if noStationsDelay > maxNoStationsDelay {
+						noStationsDelay = maxNoStationsDelay
+					}
+					continue
+				}
+				noStationsDelay = minNoStationsDelay
+				logInfo("found", len(freqs.Freqs), "stations from", freqs.Origin, dev)
+				logDebug(stationGoodness, dev)
+				scan := map[int64]bool{}
+				changed := 0
+				for _, station := range freqs.Freqs {
+					scan[station] = true
+					if !lastScan[station] {
+						changed++
+					}
+				}
+				for station := range lastScan {
+					if !scan[station] {
+						changed++
+					}
+				}
+				lastScan = scan
+				cfg.Refresher.refreshed(deps.now(), len(freqs.Freqs), changed)
+			}
+		}
+		stations := cfg.FixedStations
+		if !fixed {
+			decayGoodness(cfg.GoodnessRule, cfg.Device, stationGoodness, decayedAt, deps.now())
+			stations = cfg.Selector.selectStations(stationGoodness)
+		}
+		stations = cfg.SNRs.thin(stations)
+		pass = passStats{Start: deps.now()}
+		runPipeline(ctx, stations, cfg.Pipeline, capture, score, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// nothing happens on a pass where no station is picked, so don't log it.
+		if pass.Evaluated > 0 {
+			pass.log(len(stationGoodness), deps.now(), dev)
+		}
+		cfg.Goodness.checkpoint(stationGoodness, deps.now())
+	}
+}
+
+// deviceLoop is the main loop of one SDR, with the goodness of its stations.
+type deviceLoop struct {
+	Config          loopConfig
+	Deps            loopDeps
+	StationGoodness map[int64]float32
+}
+
+// runLoops runs the loop of each SDR at once, sharing the Scorer and the Publisher, until ctx is done.
+// If a loop fails, the others are stopped and its error is returned.
+func runLoops(ctx context.Context, loops []deviceLoop) error {
+	if len(loops) == 1 {
+		return run(ctx, loops[0].Config, loops[0].Deps, loops[0].StationGoodness)
+	}
+	loopCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var handleMu sync.Mutex
+	errs := make(chan error, len(loops))
+	for _, l := range loops {
+		l.Config.HandleMu = &handleMu
+		go func(l deviceLoop) {
+			errs <- run(loopCtx, l.Config, l.Deps, l.StationGoodness)
+		}(l)
+	}
+	var failed error
+	for range loops {
+		err := <-errs
+		if failed == nil && err != nil && err != context.Canceled {
+			failed = err
+			cancel()
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return ctx.Err()
+}
+
+// passStats sums up one pass over the stations, for the line that is logged after it.
+type passStats struct {
+	Start     time.Time
+	Evaluated int
+	Published int
+	MinValue  float32
+	MaxValue  float32
+	SumValue  float32
+}
+
+// observe counts a chunk that scored val.
+func (p *passStats) observe(val float32) {
+	if p.Evaluated == 0 || val < p.MinValue {
+		p.MinValue = val
+	}
+	if p.Evaluated == 0 || val > p.MaxValue {
+		p.MaxValue = val
+	}
+	p.SumValue += val
+	p.Evaluated++
+}
+
+func (p *passStats) log(stations int, now time.Time, dev logField) {
+	logInfo(fmt.Sprintf("pass done: %d stations, %d chunks evaluated, %d published, value min %.3f mean %.3f max %.3f, took %v",
+		stations, p.Evaluated, p.Published, p.MinValue, p.SumValue/float32(p.Evaluated), p.MaxValue, now.Sub(p.Start).Round(time.Millisecond)), dev)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/goodness"
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+	"golang.org/x/time/rate"
+)
+
+// stationSDR is a mockSDR whose audio starts with the station it is from, so that stationScorer can tell.
+type stationSDR struct {
+	Mock *mockSDR
+}
+
+func (s stationSDR) GetFreqs(ctx context.Context) (rtlsdr.Freqs, error) {
+	return s.Mock.GetFreqs(ctx)
+}
+
+func (s stationSDR) GetAudio(ctx context.Context, freq int64) (audio []byte, err error) {
+	audio, err = s.Mock.GetAudio(ctx, freq)
+	if err == nil {
+		binary.LittleEndian.PutUint64(audio, uint64(freq))
+	}
+	return
+}
+
+// stationScorer scores the audio of each station from stationSDR with its value in Values,
+// and cancels the loop once it has scored Scores chunks.
+type stationScorer struct {
+	Values map[int64]float32
+	Scores int
+	Cancel context.CancelFunc
+	scores int
+}
+
+func (s *stationScorer) score(audio []byte) (audioScore, error) {
+	s.scores++
+	if s.scores == s.Scores {
+		s.Cancel()
+	}
+	return audioScore{Value: s.Values[int64(binary.LittleEndian.Uint64(audio))]}, nil
+}
+
+// recordingPublisher keeps every message it is given.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	Msgs []*audiolib.AudioMsg
+}
+
+func (p *recordingPublisher) publishAudio(audioMsg *audiolib.AudioMsg) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Msgs = append(p.Msgs, audioMsg)
+	return nil
+}
+
+// testLoop is a loop over the stations of a mockSDR that captures instantly, scoring them with values,
+// which is cancelled once it has scored scores chunks.
+func testLoop(t *testing.T, values map[int64]float32, scores int) (ctx context.Context, cfg loopConfig, deps loopDeps) {
+	sdr := newMockSDR()
+	sdr.CaptureTime = 0
+	sdr.Stations = nil
+	for station := range values {
+		sdr.Stations = append(sdr.Stations, station)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cfg = loopConfig{
+		DevID:          "test",
+		FitAudioLength: true,
+		Limiter:        rate.NewLimiter(rate.Inf, 0),
+		GoodnessRule:   goodness.Rule{Min: 0, Max: 1},
+	}
+	deps = loopDeps{
+		SDR:       stationSDR{Mock: sdr},
+		Scorer:    &stationScorer{Values: values, Scores: scores, Cancel: cancel},
+		Publisher: &recordingPublisher{},
+	}
+	return
+}
+
+func TestRunPublishesOverThresholdAndLearnsGoodness(t *testing.T) {
+	const good, bad = 88500000, 101100000
+	ctx, cfg, deps := testLoop(t, map[int64]float32{good: 0.9, bad: 0.1}, 2)
+	publisher := deps.Publisher.(*recordingPublisher)
+	// a goodness of 1 is always sampled, so one pass scores each station once.
+	stationGoodness := map[int64]float32{good: 1, bad: 1}
+	err := run(ctx, cfg, deps, stationGoodness)
+	if err != context.Canceled {
+		t.Fatalf("run returned %v, want %v", err, context.Canceled)
+	}
+	if len(publisher.Msgs) != 1 {
+		t.Fatalf("published %d messages, want 1 from the good station", len(publisher.Msgs))
+	}
+	if msg := publisher.Msgs[0]; msg.Freq != good || msg.ExpectedValue != 0.9 || msg.DevID != "test" {
+		t.Errorf("published %d with value %v from %q, want %d with 0.9 from test", msg.Freq, msg.ExpectedValue, msg.DevID, good)
+	}
+	// goodness*(value+0.3) + 0.05, which for the good station is over the most it can have.
+	for station, want := range map[int64]float32{good: 1, bad: 0.45} {
+		if got := stationGoodness[station]; math.Abs(float64(got-want)) > 1e-6 {
+			t.Errorf("goodness of %d is %v, want %v", station, got, want)
+		}
+	}
+}
+
+func TestRunSamplesEveryFixedStation(t *testing.T) {
+	values := map[int64]float32{88500000: 0.9, 91100000: 0.9, 95300000: 0.9}
+	// fixed stations are all sampled on every pass, so the first pass ends after one chunk of each.
+	ctx, cfg, deps := testLoop(t, values, len(values))
+	for station := range values {
+		cfg.FixedStations = append(cfg.FixedStations, station)
+	}
+	stationGoodness := map[int64]float32{}
+	run(ctx, cfg, deps, stationGoodness)
+	published := map[int64]int{}
+	for _, msg := range deps.Publisher.(*recordingPublisher).Msgs {
+		published[msg.Freq]++
+	}
+	for station := range values {
+		if published[station] != 1 {
+			t.Errorf("published %d messages from %d on the first pass, want 1", published[station], station)
+		}
+		if stationGoodness[station] != 1 {
+			t.Errorf("goodness of fixed station %d is %v, want 1", station, stationGoodness[station])
+		}
+	}
+}
+
+// flakyPublisher fails to publish the first Failures messages, and records the rest like recordingPublisher.
+type flakyPublisher struct {
+	recordingPublisher
+	Failures int
+}
+
+func (p *flakyPublisher) publishAudio(audioMsg *audiolib.AudioMsg) error {
+	if p.Failures > 0 {
+		p.Failures--
+		return errors.New("can't publish")
+	}
+	return p.recordingPublisher.publishAudio(audioMsg)
+}
+
+func TestRunDedupSkipsOnlyPublishedAudio(t *testing.T) {
+	const station = 88500000
+	ctx, cfg, deps := testLoop(t, map[int64]float32{station: 0.9}, 3)
+	cfg.Dedup = newDedup(time.Hour)
+	cfg.FailureWindow = time.Hour
+	publisher := &flakyPublisher{Failures: 1}
+	deps.Publisher = publisher
+	run(ctx, cfg, deps, map[int64]float32{station: 1})
+	// the first capture fails to publish, so the second, which sounds the same, is published, and the third skipped.
+	if len(publisher.Msgs) != 1 || cfg.Dedup.Skipped != 1 {
+		t.Errorf("published %d messages and skipped %d duplicates, want 1 of each", len(publisher.Msgs), cfg.Dedup.Skipped)
+	}
+}
+
+func TestRunTimestampsWithClock(t *testing.T) {
+	const station = 88500000
+	ctx, cfg, deps := testLoop(t, map[int64]float32{station: 0.9}, 2)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	deps.Now = func() time.Time {
+		return now
+	}
+	run(ctx, cfg, deps, map[int64]float32{station: 1})
+	msgs := deps.Publisher.(*recordingPublisher).Msgs
+	if len(msgs) != 2 {
+		t.Fatalf("published %d messages, want 2", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Ts != now.Unix() {
+			t.Errorf("published a message at %v, want %v from the clock", time.Unix(msg.Ts, 0).UTC(), now)
+		}
+	}
+}
+
+func TestRunThresholdScheduleFollowsClock(t *testing.T) {
+	const station = 88500000
+	schedule, err := parseThresholdSchedule("22:00-02:00=0.95", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hour, want := range map[int]int{12: 1, 23: 0} {
+		ctx, cfg, deps := testLoop(t, map[int64]float32{station: 0.9}, 1)
+		cfg.Threshold = schedule
+		now := time.Date(2020, 6, 1, hour, 0, 0, 0, time.UTC)
+		deps.Now = func() time.Time {
+			return now
+		}
+		run(ctx, cfg, deps, map[int64]float32{station: 1})
+		if got := len(deps.Publisher.(*recordingPublisher).Msgs); got != want {
+			t.Errorf("published %d messages that scored 0.9 at %02d:00, want %d", got, hour, want)
+		}
+	}
+}
@@ -2,129 +2,168 @@ package main
 
 import (
 	"bytes"
+	"context"
+	cryptorand "crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"math/rand"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audioconv"
 	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
 	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
-	tf "github.com/tensorflow/tensorflow/tensorflow/go"
 	"github.com/viert/lame"
+	"golang.org/x/time/rate"
 )
 
-func opIsSafe(a string) bool {
-	safeOPtypes := []string{
-		"Const",
-		"Placeholder",
-		"Conv2D",
-		"Cast",
-		"Div",
-		"StatelessRandomNormal",
-		"ExpandDims",
-		"AudioSpectrogram",
-		"DecodeRaw",
-		"Reshape",
-		"MatMul",
-		"Sum",
-		"Softmax",
-		"Squeeze",
-		"RandomUniform",
-		"Identity",
-	}
-	for _, b := range safeOPtypes {
-		if b == a {
-			return true
-		}
-	}
-	return false
-}
-
-// model holds the session, the input placeholder and output.
-type model struct {
-	Sess    *tf.Session
-	InputPH tf.Output
-	Output  tf.Output
-}
-
-// goodness takes a chunk of raw audio with no headers and returns a value between 0 and 1.
-// 1 for good (in this case speech), 0 for nongood (in this case nonspeech).
-// the audio must be exactly 32 seconds long.
-func (m *model) goodness(audio []byte) (value float32, err error) {
-	// first we must convert the audio to a string tensor.
-	inputTensor, err := tf.NewTensor(string(audio))
-	if err != nil {
-		return
+// modelNameFromEnv is MODEL_NAME, or else the file name of MODEL_PATH without its extension.
+func modelNameFromEnv() string {
+	if name := configEnv("MODEL_NAME"); name != "" {
+		return name
 	}
-	// then feed the input into the input placeholder while pulling on the output.
-	result, err := m.Sess.Run(map[tf.Output]*tf.Tensor{m.InputPH: inputTensor}, []tf.Output{m.Output}, nil)
-	if err != nil {
-		return
+	modelPath := configEnv("MODEL_PATH")
+	if modelPath == "" {
+		modelPath = "model.pb"
 	}
-	value = result[0].Value().([]float32)[0]
-	return
+	name := filepath.Base(strings.TrimSuffix(modelPath, "/"))
+	return strings.TrimSuffix(name, filepath.Ext(name))
 }
 
-func newModel(path string) (m model, err error) {
-	def, err := ioutil.ReadFile(path)
-	if err != nil {
-		panic(err)
+// modelFromEnv loads the model at MODEL_PATH, or the one downloaded from MODEL_URL, with the MODEL_BACKEND
+// inference backend and the MODEL_* settings.
+func modelFromEnv(tags []string, skipOpCheck bool, warmup bool) (m *reloadingModel, err error) {
+	backendName := configEnv("MODEL_BACKEND")
+	if backendName == "" {
+		backendName = "tensorflow"
 	}
-	graph := tf.NewGraph()
-	err = graph.Import(def, "")
-	if err != nil {
-		panic(err)
+	backend, ok := inferenceBackends[backendName]
+	if !ok {
+		return nil, fmt.Errorf("MODEL_BACKEND must be mock or one of %s, got %q", strings.Join(inferenceBackendNames(), ", "), backendName)
+	}
+	modelPath := configEnv("MODEL_PATH")
+	if modelPath == "" {
+		modelPath = "model.pb"
 	}
-	ops := graph.Operations()
-	unsafeOPs := map[string]bool{}
-	graphIsUnsafe := false
-	for _, op := range ops {
-		if !opIsSafe(op.Type()) {
-			unsafeOPs[op.Type()] = true
-			graphIsUnsafe = true
+	if modelURL := configEnv("MODEL_URL"); modelURL != "" {
+		modelPath, err = modelPathFromURL(modelURL)
+		if err != nil {
+			return
 		}
 	}
-	if graphIsUnsafe {
-		fmt.Println("The following OP types are not in whitelist:")
-		for op := range unsafeOPs {
-			fmt.Println(op)
+	opts := modelOptions{
+		Tags:        tags,
+		SkipOpCheck: skipOpCheck,
+		InputOp:     configEnv("MODEL_INPUT_OP"),
+		OutputOp:    configEnv("MODEL_OUTPUT_OP"),
+		OutputIndex: getEnvInt("MODEL_OUTPUT_INDEX", 0),
+		// the whole output vector is useful for offline analysis and tuning the threshold, but makes the messages bigger.
+		IncludeLogits: getEnvBool("INCLUDE_LOGITS", false),
+		InputSeconds:  getEnvFloat("MODEL_INPUT_SECONDS", audioChunkSeconds),
+	}
+	if opts.InputSeconds <= 0 {
+		return nil, errors.New("MODEL_INPUT_SECONDS must be positive")
+	}
+	// a model that scores several classes has their labels in a file, the goodness is the sum of the good ones.
+	if labelsPath := configEnv("MODEL_LABELS_FILE"); labelsPath != "" {
+		var good []string
+		if goodLabels := configEnv("MODEL_GOOD_LABELS"); goodLabels != "" {
+			good = strings.Split(goodLabels, ",")
+		}
+		opts.Labels, err = loadClassLabels(labelsPath, good)
+		if err != nil {
+			return
 		}
-		err = errors.New("unsafe OPs")
-		return
 	}
-	outputOP := graph.Operation("output")
-	if outputOP == nil {
-		err = errors.New("output OP not found")
-		return
+	// extra outputs, such as a language id head, are evaluated along with the goodness and included in the messages.
+	if extras := configEnv("MODEL_EXTRA_OUTPUTS"); extras != "" {
+		opts.ExtraOutputs = strings.Split(extras, ",")
 	}
-	m.Output = outputOP.Output(0)
+	// load the graph def from FS
+	return newReloadingModel(modelPath, opts, backend, warmup)
+}
 
-	inputPHOP := graph.Operation("input/Placeholder")
-	if inputPHOP == nil {
-		err = errors.New("input OP not found")
+// modelPathFromURL downloads the model at modelURL into MODEL_CACHE_DIR, unless it is already cached there,
+// and returns its path.
+func modelPathFromURL(modelURL string) (path string, err error) {
+	cacheDir := configEnv("MODEL_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "sdr2evtstreams-models")
+	}
+	tlsConfig, err := newTLSConfig(configEnv("MODEL_CA_FILE"), "", "")
+	if err != nil {
 		return
 	}
-	m.InputPH = inputPHOP.Output(0)
-	m.Sess, err = tf.NewSession(graph, nil)
-	return
+	client := &http.Client{
+		Timeout:   getEnvDuration("MODEL_DOWNLOAD_TIMEOUT", 5*time.Minute),
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+	retry := retryPolicy{
+		MaxRetries: getEnvInt("RETRY_MAX", 3),
+		Backoff:    getEnvDuration("RETRY_BACKOFF", time.Second),
+		MaxBackoff: getEnvDuration("RETRY_MAX_BACKOFF", 30*time.Second),
+		Jitter:     getEnvFloat("RETRY_JITTER", 0.2),
+	}
+	fetcher, err := newModelFetcher(modelURL, configEnv("MODEL_SHA256"), cacheDir, client, retry)
+	if err != nil {
+		return
+	}
+	return fetcher.fetch(context.Background())
 }
 
 type evtstreamsConn struct {
-	Producer sarama.SyncProducer
-	Topic    string
+	// FailedSends counts the messages that could not be sent, even after the producer's retries.
+	// It is first so that it is 64 bit aligned for atomic access on arm.
+	FailedSends int64
+	Producer    sarama.SyncProducer
+	Topic       string
+	// MaxFragmentBytes is the most audio to send in one message, longer audio is split over several messages.
+	// 0 means the audio is only split if the message would be over MaxMessageBytes, the most the producer sends.
+	MaxFragmentBytes int
+	MaxMessageBytes  int
+	// mu guards Producer, as it may be swapped out by reconnect, or left nil if reconnect gives up.
+	mu sync.RWMutex
+	// KeyBy is what the messages are keyed by, station, device, or nothing if empty.
+	KeyBy string
+	// Headers are the names of the messageHeaders to send, Org and ModelVersion are what the org and modelVersion ones hold.
+	Headers      []string
+	Org          string
+	ModelVersion string
+	// Routes send the messages that score high enough to other topics than Topic, highest threshold first.
+	Routes []topicRoute
+	// Signer signs the value of each record in its signature header, nil doesn't.
+	Signer *messageSigner
+	// Format is how the messages are serialized, json if empty, avro with the schema IDs of Registry, or protobuf.
+	Format   string
+	Registry *schemaRegistry
+	// acks are where the brokers put the messages of the last publishAudio, for the commit log.
+	acks []messageAck
+	// Async replaces Producer when publishing asynchronously, handled is closed once all its results are read.
+	Async   sarama.AsyncProducer
+	handled chan struct{}
 }
 
+// maxReconnectAttempts is how many times reconnect tries to build a new producer before giving up.
+const maxReconnectAttempts = 5
+
 // taken from cloud/sdr/data-ingest/example-go-clients/util/util.go
-func populateConfig(config *sarama.Config, user, pw, apiKey string) error {
-	config.ClientID = apiKey
+// The client ID is sent to the brokers and shows up in their logs, so it is not the API key.
+func populateConfig(config *sarama.Config, user, pw string) error {
+	config.ClientID = "sdr2evtstreams"
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 5
 	config.Producer.Return.Successes = true
@@ -135,35 +174,605 @@ func populateConfig(config *sarama.Config, user, pw, apiKey string) error {
 	return nil
 }
 
-func connect(topic string) (conn evtstreamsConn, err error) {
-	conn.Topic = topic
-	apiKey := getEnv("EVTSTREAMS_API_KEY")
-	username := "token"
-	password := apiKey
+// newSaramaConfig returns the brokers and the config to talk to them with, from the EVTSTREAMS_* env vars.
+func newSaramaConfig() (brokers []string, config *sarama.Config, err error) {
 	brokerStr := getEnv("EVTSTREAMS_BROKER_URL")
-	brokers := strings.Split(brokerStr, ",")
-	config := sarama.NewConfig()
-	err = populateConfig(config, username, password, apiKey)
+	brokers = strings.Split(brokerStr, ",")
+	config = sarama.NewConfig()
+	switch security := configEnv("EVTSTREAMS_SECURITY"); security {
+	case "", "sasl_ssl":
+		err = populateConfig(config, "", "")
+		if err == nil {
+			err = configureSASL(config)
+		}
+		if err == nil {
+			err = configureKafkaTLS(config)
+		}
+	case "ssl":
+		// TLS without SASL, for a cluster that authenticates clients by their certificate.
+		err = populateConfig(config, "", "")
+		config.Net.SASL.Enable = false
+		if err == nil {
+			err = configureKafkaTLS(config)
+		}
+	case "plaintext":
+		// for a local kafka without TLS or authentication, so no API key is needed.
+		err = populateConfig(config, "", "")
+		config.Net.TLS.Enable = false
+		config.Net.SASL.Enable = false
+	default:
+		err = fmt.Errorf("unknown EVTSTREAMS_SECURITY %q, must be sasl_ssl, ssl or plaintext", security)
+	}
 	if err != nil {
 		return
 	}
-	fmt.Println("now connecting to evtstreams")
-	conn.Producer, err = sarama.NewSyncProducer(brokers, config)
-	fmt.Println("done trying to connect")
+	name := configEnv("EVTSTREAMS_PARTITIONER")
+	if name == "" {
+		name = "hash"
+	}
+	partitioner, ok := partitioners[name]
+	if !ok {
+		err = fmt.Errorf("unknown EVTSTREAMS_PARTITIONER %q, must be one of %s", name, strings.Join(partitionerNames(), ", "))
+		return
+	}
+	config.Producer.Partitioner = partitioner
+	err = configureProducer(config)
 	if err != nil {
 		return
 	}
+	// these default to the sarama defaults, raise them for high latency links.
+	config.Producer.Timeout = getEnvDuration("EVTSTREAMS_PRODUCER_TIMEOUT", config.Producer.Timeout)
+	config.Net.DialTimeout = getEnvDuration("EVTSTREAMS_DIAL_TIMEOUT", config.Net.DialTimeout)
+	config.Net.ReadTimeout = getEnvDuration("EVTSTREAMS_READ_TIMEOUT", config.Net.ReadTimeout)
+	config.Net.WriteTimeout = getEnvDuration("EVTSTREAMS_WRITE_TIMEOUT", config.Net.WriteTimeout)
+	return
+}
+
+// configureKafkaTLS sets the CA, the client certificate and whether to verify the brokers from EVTSTREAMS_CA_FILE,
+// EVTSTREAMS_CERT_FILE, EVTSTREAMS_KEY_FILE and EVTSTREAMS_TLS_INSECURE_SKIP_VERIFY on config.
+func configureKafkaTLS(config *sarama.Config) (err error) {
+	tlsConfig, err := newTLSConfig(configEnv("EVTSTREAMS_CA_FILE"), configEnv("EVTSTREAMS_CERT_FILE"), configEnv("EVTSTREAMS_KEY_FILE"))
+	if err != nil {
+		return fmt.Errorf("bad EVTSTREAMS TLS settings: %v", err)
+	}
+	if getEnvBool("EVTSTREAMS_TLS_INSECURE_SKIP_VERIFY", false) {
+		logWarn("EVTSTREAMS_TLS_INSECURE_SKIP_VERIFY is set, the certificates of the brokers are not verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	config.Net.TLS.Config = tlsConfig
+	return
+}
+
+// configureProducer sets the protocol version, the compression, the acks and the message size of the producer
+// from the EVTSTREAMS_* env vars. Without EVTSTREAMS_KAFKA_VERSION the version is the lowest that the rest needs.
+func configureProducer(config *sarama.Config) (err error) {
+	v := configEnv("EVTSTREAMS_KAFKA_VERSION")
+	if v != "" {
+		config.Version, err = sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return fmt.Errorf("bad EVTSTREAMS_KAFKA_VERSION %q: %v", v, err)
+		}
+	}
+	// needVersion raises the version to at least least for what, or fails if EVTSTREAMS_KAFKA_VERSION is lower.
+	needVersion := func(least sarama.KafkaVersion, what string) error {
+		if config.Version.IsAtLeast(least) {
+			return nil
+		}
+		if v != "" {
+			return fmt.Errorf("%s needs EVTSTREAMS_KAFKA_VERSION %s or later", what, least)
+		}
+		config.Version = least
+		return nil
+	}
+	if configEnv("EVTSTREAMS_HEADERS") != "none" {
+		err = needVersion(sarama.V0_11_0_0, "EVTSTREAMS_HEADERS")
+		if err != nil {
+			return fmt.Errorf("%v, or EVTSTREAMS_HEADERS=none", err)
+		}
+	}
+	if configEnv("DEVICE_SIGNING_KEY") != "" || configEnv("DEVICE_SIGNING_KEY_FILE") != "" {
+		// the signatures are sent in headers too.
+		err = needVersion(sarama.V0_11_0_0, "DEVICE_SIGNING_KEY")
+		if err != nil {
+			return
+		}
+	}
+	name := configEnv("EVTSTREAMS_COMPRESSION")
+	if name == "" {
+		name = "none"
+	}
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		return fmt.Errorf("unknown EVTSTREAMS_COMPRESSION %q, must be none, gzip, snappy, lz4 or zstd", name)
+	}
+	config.Producer.Compression = codec
+	if codec == sarama.CompressionZSTD {
+		err = needVersion(sarama.V2_1_0_0, "zstd compression")
+		if err != nil {
+			return
+		}
+	}
+	name = configEnv("EVTSTREAMS_REQUIRED_ACKS")
+	if name == "" {
+		name = "all"
+	}
+	acks, ok := requiredAcks[name]
+	if !ok {
+		return fmt.Errorf("unknown EVTSTREAMS_REQUIRED_ACKS %q, must be all, local or none", name)
+	}
+	config.Producer.RequiredAcks = acks
+	config.Producer.MaxMessageBytes = getEnvInt("EVTSTREAMS_MAX_MESSAGE_BYTES", config.Producer.MaxMessageBytes)
+	if getEnvBool("EVTSTREAMS_IDEMPOTENT", false) {
+		// so that a retried message is written once, the brokers have to ack every message and get them one request at a time.
+		if acks != sarama.WaitForAll {
+			return fmt.Errorf("EVTSTREAMS_IDEMPOTENT=true needs EVTSTREAMS_REQUIRED_ACKS=all")
+		}
+		err = needVersion(sarama.V0_11_0_0, "EVTSTREAMS_IDEMPOTENT")
+		if err != nil {
+			return
+		}
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+	return
+}
+
+// compressionCodecs are the codecs that EVTSTREAMS_COMPRESSION can name.
+var compressionCodecs = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// requiredAcks are the acks that EVTSTREAMS_REQUIRED_ACKS can name. all waits for every in sync replica, local
+// only for the leader, and none doesn't wait at all, so a message can be lost without the producer knowing.
+var requiredAcks = map[string]sarama.RequiredAcks{
+	"all":   sarama.WaitForAll,
+	"local": sarama.WaitForLocal,
+	"none":  sarama.NoResponse,
+}
+
+// partitioners are the partitioners that EVTSTREAMS_PARTITIONER can name. hash sends the messages with the same key
+// to the same partition, reference does too but the same way as the Java client, so that both agree.
+var partitioners = map[string]sarama.PartitionerConstructor{
+	"hash":       sarama.NewHashPartitioner,
+	"reference":  sarama.NewReferenceHashPartitioner,
+	"random":     sarama.NewRandomPartitioner,
+	"roundrobin": sarama.NewRoundRobinPartitioner,
+}
+
+func partitionerNames() (names []string) {
+	for name := range partitioners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// messageKey is the key that EVTSTREAMS_KEY gives audioMsg, nil if it has none.
+func (conn *evtstreamsConn) messageKey(audioMsg *audiolib.AudioMsg) sarama.Encoder {
+	switch conn.KeyBy {
+	case "station":
+		return sarama.StringEncoder(strconv.FormatInt(audioMsg.Freq, 10))
+	case "device":
+		return sarama.StringEncoder(audioMsg.DevID)
+	}
+	return nil
+}
+
+// messageHeaders are the Kafka headers that EVTSTREAMS_HEADERS can name.
+var messageHeaders = []string{"devID", "org", "freq", "modelVersion", "contentType", "contentEncoding", "origin"}
+
+// headerValue is what the header name holds for audioMsg.
+func (conn *evtstreamsConn) headerValue(name string, audioMsg *audiolib.AudioMsg) string {
+	switch name {
+	case "devID":
+		return audioMsg.DevID
+	case "org":
+		return conn.Org
+	case "freq":
+		return strconv.FormatInt(audioMsg.Freq, 10)
+	case "modelVersion":
+		return conn.ModelVersion
+	case "contentType":
+		return audioMsg.ContentType
+	case "contentEncoding":
+		return audioMsg.ContentEncoding
+	case "origin":
+		return audioMsg.Origin
+	}
+	return ""
+}
+
+// defaultMessageHeaders are the headers sent if EVTSTREAMS_HEADERS isn't set.
+const defaultMessageHeaders = "devID,org,freq,modelVersion,contentType"
+
+// parseMessageHeaders parses the comma-separated EVTSTREAMS_HEADERS, none is no headers.
+func parseMessageHeaders(names string) (headers []string, err error) {
+	switch names {
+	case "":
+		names = defaultMessageHeaders
+	case "none":
+		return nil, nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, header := range messageHeaders {
+			known = known || header == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown header %q in EVTSTREAMS_HEADERS, must be one of %s", name, strings.Join(messageHeaders, ", "))
+		}
+		headers = append(headers, name)
+	}
 	return
 }
 
+// recordHeaders are the headers of conn.Headers for audioMsg, those that are empty are left out.
+func (conn *evtstreamsConn) recordHeaders(audioMsg *audiolib.AudioMsg) (headers []sarama.RecordHeader) {
+	for _, name := range conn.Headers {
+		if value := conn.headerValue(name, audioMsg); value != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(name), Value: []byte(value)})
+		}
+	}
+	return
+}
+
+func newProducer() (producer sarama.SyncProducer, err error) {
+	brokers, config, err := newSaramaConfig()
+	if err != nil {
+		return
+	}
+	logDebug("now connecting to evtstreams")
+	producer, err = sarama.NewSyncProducer(brokers, config)
+	logDebug("done trying to connect")
+	return
+}
+
+// connect makes the producer for topic, retrying with exponential backoff
+// for up to timeout, as the brokers may not be reachable yet when we start.
+func connect(topic string, timeout time.Duration) (conn *evtstreamsConn, err error) {
+	conn = &evtstreamsConn{Topic: topic}
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		logInfo("connecting to evtstreams, attempt", attempt)
+		conn.Producer, err = newProducer()
+		if err == nil {
+			// a missing topic won't fix itself, so fail right away rather than retrying.
+			if getEnvBool("EVTSTREAMS_CHECK_TOPIC", true) {
+				err = checkTopic(topic)
+				if err != nil {
+					conn.Producer.Close()
+					err = explainKafkaError(err)
+				}
+			}
+			return
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, explainKafkaError(err)
+		}
+		logWarn("failed to connect to evtstreams:", err, "retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// checkTopic makes sure that topic exists on the brokers, so that a misconfigured topic is caught at startup
+// rather than on the first publish. If EVTSTREAMS_CREATE_TOPIC=true a missing topic is created.
+func checkTopic(topic string) (err error) {
+	brokers, config, err := newSaramaConfig()
+	if err != nil {
+		return
+	}
+	// the admin requests need a newer protocol version than the producer.
+	if !config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		config.Version = sarama.V1_0_0_0
+	}
+	admin, err := sarama.NewClusterAdmin(brokers, config)
+	if err != nil {
+		return
+	}
+	defer admin.Close()
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return
+	}
+	if _, ok := topics[topic]; ok {
+		logDebug("topic", topic, "exists")
+		return
+	}
+	if !getEnvBool("EVTSTREAMS_CREATE_TOPIC", false) {
+		return fmt.Errorf("topic %s does not exist, create it or set EVTSTREAMS_CREATE_TOPIC=true", topic)
+	}
+	detail := &sarama.TopicDetail{
+		NumPartitions:     int32(getEnvInt("EVTSTREAMS_TOPIC_PARTITIONS", 1)),
+		ReplicationFactor: int16(getEnvInt("EVTSTREAMS_TOPIC_REPLICATION", 3)),
+	}
+	logInfo("creating topic", topic, "with", detail.NumPartitions, "partitions and a replication factor of", detail.ReplicationFactor)
+	err = admin.CreateTopic(topic, detail, false)
+	// another node may have just created it.
+	if topicErr, ok := err.(*sarama.TopicError); ok && topicErr.Err == sarama.ErrTopicAlreadyExists {
+		err = nil
+	}
+	return
+}
+
+// producerIsBroken reports whether err means the producer can never send again and must be replaced.
+func producerIsBroken(err error) bool {
+	return errors.Is(err, sarama.ErrOutOfBrokers) ||
+		errors.Is(err, sarama.ErrClosedClient) ||
+		errors.Is(err, sarama.ErrNotConnected) ||
+		errors.Is(err, sarama.ErrShuttingDown)
+}
+
+// publishErrorIsPermanent reports whether err means that the message can never be published as it is,
+// like one that is too large for the topic, so that spooling it to try again later is pointless.
+func publishErrorIsPermanent(err error) bool {
+	return errors.Is(err, sarama.ErrMessageSizeTooLarge) ||
+		errors.Is(err, sarama.ErrInvalidMessage) ||
+		errors.Is(err, sarama.ErrInvalidMessageSize) ||
+		errors.Is(err, sarama.ErrInvalidTopic) ||
+		errors.Is(err, sarama.ErrTopicAuthorizationFailed)
+}
+
+// explainKafkaError adds what to check to the errors that a misconfigured connection causes.
+func explainKafkaError(err error) error {
+	var hint string
+	switch {
+	case errors.Is(err, sarama.ErrOutOfBrokers):
+		hint = "check EVTSTREAMS_BROKER_URL, and that the node can reach the brokers through any firewall or proxy"
+	case errors.Is(err, sarama.ErrSASLAuthenticationFailed):
+		hint = "check EVTSTREAMS_API_KEY and EVTSTREAMS_SASL_MECHANISM"
+	case errors.Is(err, sarama.ErrTopicAuthorizationFailed):
+		hint = "check that EVTSTREAMS_API_KEY is allowed to write to the topic"
+	case errors.Is(err, sarama.ErrUnknownTopicOrPartition), errors.Is(err, sarama.ErrInvalidTopic):
+		hint = "check EVTSTREAMS_TOPIC"
+	case errors.Is(err, sarama.ErrMessageSizeTooLarge):
+		hint = "set EVTSTREAMS_MAX_FRAGMENT_BYTES below the max.message.bytes of the topic"
+	default:
+		return err
+	}
+	return fmt.Errorf("%v (%s)", err, hint)
+}
+
+// sendTestMessage sends a small message from the selftest origin to topic, to prove that the brokers take messages.
+func (conn *evtstreamsConn) sendTestMessage(topic string) error {
+	producer, err := conn.producer()
+	if err != nil {
+		return err
+	}
+	msg := &audiolib.AudioMsg{Ts: time.Now().Unix(), Origin: "selftest"}
+	value, err := conn.messageValue(topic, msg)
+	if err == nil {
+		_, _, err = producer.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: value, Headers: conn.recordHeaders(msg)})
+	}
+	if err != nil {
+		return fmt.Errorf("can't send a test message to topic %s: %v", topic, explainKafkaError(err))
+	}
+	logInfo("sent a test message to topic", topic)
+	return nil
+}
+
+// reconnect replaces the broken producer with a new one, backing off between attempts.
+// If another publish has already replaced it, reconnect does nothing.
+// If no new producer can be made after maxReconnectAttempts, Producer is left nil for producer to make one later.
+func (conn *evtstreamsConn) reconnect(broken sarama.SyncProducer) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.Producer != broken {
+		return nil
+	}
+	broken.Close()
+	conn.Producer = nil
+	backoff := time.Second
+	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+		logWarn("reconnecting to evtstreams, attempt", attempt, "of", maxReconnectAttempts)
+		producer, err := newProducer()
+		if err == nil {
+			conn.Producer = producer
+			logInfo("reconnected to evtstreams")
+			return nil
+		}
+		logError("failed to reconnect:", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return errors.New("can't reconnect to evtstreams")
+}
+
+// producer returns Producer, first trying once to make a new one if reconnect gave up on it.
+func (conn *evtstreamsConn) producer() (sarama.SyncProducer, error) {
+	conn.mu.RLock()
+	producer := conn.Producer
+	conn.mu.RUnlock()
+	if producer != nil {
+		return producer, nil
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.Producer == nil {
+		producer, err := newProducer()
+		if err != nil {
+			return nil, fmt.Errorf("can't reconnect to evtstreams: %v", err)
+		}
+		conn.Producer = producer
+		logInfo("reconnected to evtstreams")
+	}
+	return conn.Producer, nil
+}
+
+// close closes the producer, which flushes any messages it still holds.
+func (conn *evtstreamsConn) close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.Async != nil {
+		// the results of the messages still to send are read before close returns.
+		conn.Async.AsyncClose()
+		<-conn.handled
+		return nil
+	}
+	if conn.Producer == nil {
+		return nil
+	}
+	return conn.Producer.Close()
+}
+
+// fragmentOverhead is room left in each fragment for its fragment fields and the record overhead of Kafka.
+const fragmentOverhead = 1024
+
+// publishAudio sends audioMsg, split into fragments first if its audio is longer than MaxFragmentBytes,
+// or if it would be over MaxMessageBytes.
 func (conn *evtstreamsConn) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
-	// as AudioMsg implements the sarama.Encoder interface, we can pass it directly to ProducerMessage.
-	msg := &sarama.ProducerMessage{Topic: conn.Topic, Key: nil, Value: audioMsg}
-	partition, offset, err := conn.Producer.SendMessage(msg)
+	conn.acks = nil
+	maxAudioBytes := conn.MaxFragmentBytes
+	if conn.MaxMessageBytes > 0 {
+		if size := audioMsg.Length(); size > conn.MaxMessageBytes {
+			fits := conn.MaxMessageBytes - (size - len(audioMsg.Audio)) - fragmentOverhead
+			if fits <= 0 {
+				return fmt.Errorf("a message of %d bytes is over EVTSTREAMS_MAX_MESSAGE_BYTES even without its audio", size-len(audioMsg.Audio))
+			}
+			if maxAudioBytes <= 0 || fits < maxAudioBytes {
+				maxAudioBytes = fits
+			}
+		}
+	}
+	if maxAudioBytes <= 0 || len(audioMsg.Audio) <= maxAudioBytes {
+		return conn.sendAudioMsg(audioMsg)
+	}
+	captureID, err := newCaptureID()
+	if err != nil {
+		return
+	}
+	fragments := audioMsg.Fragment(captureID, maxAudioBytes)
+	logDebug("sending capture", captureID, "in", len(fragments), "fragments")
+	for _, fragment := range fragments {
+		err = conn.sendAudioMsg(fragment)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// newCaptureID makes a random ID to tie the fragments of one capture together.
+func newCaptureID() (string, error) {
+	id := make([]byte, 16)
+	_, err := cryptorand.Read(id)
+	return hex.EncodeToString(id), err
+}
+
+// messageValue is the value of the record of audioMsg on topic in conn.Format, audioMsg itself for JSON. Avro
+// is after a zero byte and the big endian ID of the schema of the subject of topic, topic-value, as Confluent
+// serializers frame it.
+func (conn *evtstreamsConn) messageValue(topic string, audioMsg *audiolib.AudioMsg) (sarama.Encoder, error) {
+	switch conn.Format {
+	case "protobuf":
+		serialized, err := audioMsg.EncodeProto()
+		return sarama.ByteEncoder(serialized), err
+	case "avro":
+	default:
+		// as AudioMsg implements the sarama.Encoder interface, we can pass it directly to ProducerMessage.
+		return audioMsg, nil
+	}
+	id, err := conn.Registry.schemaID(topic + "-value")
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 5)
+	binary.BigEndian.PutUint32(value[1:], id)
+	serialized, err := audioMsg.EncodeAvro()
+	if err != nil {
+		return nil, err
+	}
+	return sarama.ByteEncoder(append(value, serialized...)), nil
+}
+
+// producerMessage is the record of audioMsg, signed if conn.Signer is set.
+func (conn *evtstreamsConn) producerMessage(audioMsg *audiolib.AudioMsg) (msg *sarama.ProducerMessage, err error) {
+	msg = &sarama.ProducerMessage{Topic: conn.topicFor(audioMsg), Key: conn.messageKey(audioMsg), Headers: conn.recordHeaders(audioMsg)}
+	msg.Value, err = conn.messageValue(msg.Topic, audioMsg)
+	if err != nil {
+		return
+	}
+	if conn.Signer != nil {
+		// the signature is of the exact bytes that are sent, so they are serialized once here.
+		var value []byte
+		value, err = msg.Value.Encode()
+		if err != nil {
+			return
+		}
+		msg.Value = sarama.ByteEncoder(value)
+		msg.Headers = append(msg.Headers,
+			sarama.RecordHeader{Key: []byte("signature"), Value: []byte(conn.Signer.sign(value))},
+			sarama.RecordHeader{Key: []byte("signatureKeyID"), Value: []byte(conn.Signer.KeyID)})
+	}
+	return
+}
+
+func (conn *evtstreamsConn) sendAudioMsg(audioMsg *audiolib.AudioMsg) (err error) {
+	if conn.Async != nil {
+		return conn.sendAsync(audioMsg)
+	}
+	msg, err := conn.producerMessage(audioMsg)
+	if err != nil {
+		return
+	}
+	producer, err := conn.producer()
+	if err != nil {
+		atomic.AddInt64(&conn.FailedSends, 1)
+		return
+	}
+	size := audioMsg.Length()
+	start := time.Now()
+	partition, offset, err := producer.SendMessage(msg)
+	latency := time.Since(start)
 	if err != nil {
-		log.Printf("FAILED to send message: %s\n", err)
+		failed := atomic.AddInt64(&conn.FailedSends, 1)
+		logWarn("FAILED to send message:", err, field("freq", audioMsg.Freq), field("bytes", size), field("latency", latency), field("failed", failed))
+		if producerIsBroken(err) {
+			if reconnectErr := conn.reconnect(producer); reconnectErr != nil {
+				logError(reconnectErr)
+			}
+		}
 	} else {
-		log.Printf("> message sent to partition %d at offset %d\n", partition, offset)
+		conn.acks = append(conn.acks, messageAck{Topic: msg.Topic, Partition: partition, Offset: offset})
+		logInfo("> message sent", field("freq", audioMsg.Freq), field("topic", msg.Topic), field("partition", partition), field("offset", offset), field("bytes", size), field("latency", latency))
+	}
+	return
+}
+
+// exitConfigError prints problem like the errors of validateConfig, rather than panic with a stack trace, and exits.
+func exitConfigError(problem interface{}) {
+	fmt.Fprintln(os.Stderr, "config error:", problem)
+	os.Exit(2)
+}
+
+// configPublishBackend is PUBLISH_BACKEND, or mock if DRY_RUN=true.
+func configPublishBackend() string {
+	if getEnvBool("DRY_RUN", false) {
+		return "mock"
+	}
+	return configEnv("PUBLISH_BACKEND")
+}
+
+// parseStations parses the comma-separated list of frequencies in Hz, like 91100000,95300000, in the config var name.
+func parseStations(name string) (stations []int64, err error) {
+	list := configEnv(name)
+	if list == "" {
+		return
+	}
+	for _, str := range strings.Split(list, ",") {
+		// parsed as a float so that frequencies like 101.1e6 work too.
+		station, parseErr := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if parseErr != nil || station <= 0 {
+			err = fmt.Errorf("bad frequency %q in %s", str, name)
+			return
+		}
+		stations = append(stations, int64(math.Round(station)))
 	}
 	return
 }
@@ -174,18 +783,74 @@ func getEnv(keys ...string) (val string) {
 		panic("must give at least one key")
 	}
 	for _, key := range keys {
-		val = os.Getenv(key)
+		val = configEnv(key)
 		if val != "" {
 			return
 		}
 	}
 	if val == "" {
-		fmt.Println("none of", keys, "are set")
+		logError("none of", keys, "are set, set one as an env var, a flag or in the -config file")
 		panic("can't any find set value")
 	}
 	return
 }
 
+// read an int env var from system, falling back to defaultVal if it is not set.
+func getEnvInt(key string, defaultVal int) int {
+	valStr := configEnv(key)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.Atoi(valStr)
+	if err != nil {
+		logError(key, "must be an integer, got", valStr)
+		panic(err)
+	}
+	return val
+}
+
+// read a float env var from system, falling back to defaultVal if it is not set.
+func getEnvFloat(key string, defaultVal float64) float64 {
+	valStr := configEnv(key)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.ParseFloat(valStr, 64)
+	if err != nil {
+		logError(key, "must be a number, got", valStr)
+		panic(err)
+	}
+	return val
+}
+
+// read a duration env var (like 30s or 5m) from system, falling back to defaultVal if it is not set.
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	valStr := configEnv(key)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil {
+		logError(key, "must be a duration like 30s or 5m, got", valStr)
+		panic(err)
+	}
+	return val
+}
+
+// read a bool env var (like true, false, 1 or 0) from system, falling back to defaultVal if it is not set.
+func getEnvBool(key string, defaultVal bool) bool {
+	valStr := configEnv(key)
+	if valStr == "" {
+		return defaultVal
+	}
+	val, err := strconv.ParseBool(valStr)
+	if err != nil {
+		logError(key, "must be true or false, got", valStr)
+		panic(err)
+	}
+	return val
+}
+
 // Copy pasted from github.com/open-horizon/examples/edge/services/gps/src/hgps to workaround package import issues.
 type sourceType string
 
@@ -231,8 +896,8 @@ func rawToB64Mp3(rawBytes []byte) (b64Bytes string) {
 	wr := lame.NewWriter(&mp3Buff)
 	wr.Encoder.SetBitrate(30)
 	wr.Encoder.SetQuality(1)
-	wr.Encoder.SetInSamplerate(16000)
-	wr.Encoder.SetNumChannels(1)
+	wr.Encoder.SetInSamplerate(audioSampleRate)
+	wr.Encoder.SetNumChannels(audioChannels)
 	// IMPORTANT!
 	wr.Encoder.InitParams()
 	reader.WriteTo(wr)
@@ -251,140 +916,538 @@ var hostname string = "ibm.sdr"
 var gpshostname string = "ibm.gps"
 
 func main() {
-	alt_addr := os.Getenv("RTLSDR_ADDR")
+	inspectModelPath := flag.String("inspect-model", "", "list the OPs of the model at this path, then exit")
+	selftestMode := flag.Bool("selftest", false, "check the model, the SDR and the connection to evtstreams, then exit")
+	configPath := flag.String("config", "", "read settings from this JSON file, env vars and flags override it")
+	registerConfigFlags(flag.CommandLine)
+	// -h and -help list the settings along with the other flags.
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+		flag.VisitAll(func(f *flag.Flag) {
+			if !isConfigVar(strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))) {
+				fmt.Fprintf(out, "  -%s\n    \t%s\n", f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintln(out, "\nThe service is configured with these settings, each as an env var, a flag or in the -config file:")
+		printConfigHelp(out)
+	}
+	flag.Parse()
+	markConfigFlags(flag.CommandLine)
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			exitConfigError(err)
+		}
+	}
+	if errs := validateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "config error:", err)
+		}
+		os.Exit(2)
+	}
+	// the tags to load a SavedModel with, not used for frozen graphs.
+	modelTags := []string{"serve"}
+	if tagsStr := configEnv("MODEL_TAGS"); tagsStr != "" {
+		modelTags = strings.Split(tagsStr, ",")
+	}
+	if *inspectModelPath != "" {
+		err := inspectModel(*inspectModelPath, modelTags)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	// VERBOSE=1 is kept for compatibility, it is the same as LOG_LEVEL=debug.
+	if configEnv("VERBOSE") == "1" {
+		currentLogLevel = levelDebug
+	}
+	if levelName := configEnv("LOG_LEVEL"); levelName != "" {
+		var err error
+		currentLogLevel, err = parseLogLevel(levelName)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+	// the API key is redacted from the logs from the start, not only once it is used.
+	addSecret(configEnv("EVTSTREAMS_API_KEY"))
+	if formatName := configEnv("LOG_FORMAT"); formatName != "" {
+		var err error
+		currentLogFormat, err = parseLogFormat(formatName)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+	logDebug("debug logging enabled")
+	// start serving early, so that the probes say the node is not ready while it starts.
+	if addr := configEnv("MONITOR_ADDR"); addr != "" {
+		logInfo("serving metrics and health probes on", addr)
+		go func() {
+			panic(serveMonitoring(addr))
+		}()
+	}
+	alt_addr := configEnv("RTLSDR_ADDR")
 	// if no alternative address is set, use the default.
 	if alt_addr != "" {
-		fmt.Println("connecting to remote rtlsdr:", alt_addr)
+		logInfo("connecting to remote rtlsdr:", alt_addr)
 		hostname = alt_addr
 	}
-	gps_alt_addr := os.Getenv("GPS_ADDR")
+	// each SDR in SDR_DEVICES gets a loop of its own.
+	sdrs, err := newSDRDevices(configEnv("SDR_BACKEND"), configEnv("SDR_DEVICES"), hostname, getEnvInt("RTLSDR_DEVICE", 0))
+	if err != nil {
+		exitConfigError(err)
+	}
+	if len(sdrs) == 0 {
+		exitConfigError("SDR_DEVICES has no SDRs in it")
+	}
+	scan, err := scanRangeFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	if scan != nil {
+		logInfo("scanning for stations from", scan.Start, "to", scan.Stop, "Hz every", scan.Step, "Hz")
+	}
+	mode, err := rtlsdr.ParseMode(configEnv("DEMOD_MODE"))
+	if err != nil {
+		exitConfigError(err)
+	}
+	if mode != rtlsdr.ModeWFM {
+		logInfo("demodulating the audio as", mode)
+	}
+	iq, err := iqOptionsFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	if iq != nil {
+		logInfo("capturing raw IQ samples at", iq.SampleRate, "samples a second instead of audio, they aren't scored")
+		for _, device := range sdrs {
+			if _, ok := device.SDR.(iqSDR); !ok {
+				exitConfigError(fmt.Sprintf("SDR_BACKEND=%s can't capture IQ samples", configEnv("SDR_BACKEND")))
+			}
+			if _, ok := device.SDR.(*usbSDR); ok && (iq.SampleRate != usbSampleRate || iq.Gain != 0) {
+				exitConfigError(fmt.Sprintf("SDR_BACKEND=usb captures IQ samples at %d samples a second with the gain automatic, set IQ_SAMPLE_RATE to match and IQ_GAIN to 0", usbSampleRate))
+			}
+		}
+	}
+	for _, device := range sdrs {
+		if usb, ok := device.SDR.(*usbSDR); ok {
+			usb.Scan = scan
+			usb.Mode = mode
+		}
+		if client, ok := device.SDR.(*rtlsdrClient); ok {
+			client.Scan = scan
+			client.Mode = mode
+			client.MaxCaptures = getEnvInt("RTLSDR_MAX_CAPTURES", 1)
+			client.FreqsTimeout = getEnvDuration("RTLSDR_FREQS_TIMEOUT", 2*time.Minute)
+			client.AudioTimeout = getEnvDuration("RTLSDR_AUDIO_TIMEOUT", 2*time.Minute)
+			client.Stream = getEnvBool("RTLSDR_STREAM", false)
+		}
+		metrics.addDevice(device.Name)
+	}
+	if len(sdrs) > 1 {
+		logInfo("capturing from", len(sdrs), "SDRs at once")
+	}
+	gps_alt_addr := configEnv("GPS_ADDR")
 	// if no alternative address is set, use the default.
 	if gps_alt_addr != "" {
-		fmt.Println("connecting to remote gps:", gps_alt_addr)
+		logInfo("connecting to remote gps:", gps_alt_addr)
 		gpshostname = gps_alt_addr
 	}
-	use_gps := os.Getenv("USE_GPS") != "false"
+	use_gps := getEnvBool("USE_GPS", true)
+	getLocation, checkLocation := getGPS, true
 	if !use_gps {
-		fmt.Println("not using GPS because USE_GPS=false")
+		logInfo("not using GPS because USE_GPS=false")
+	} else {
+		getLocation, checkLocation, err = newLocationSource(configEnv("GPS_SOURCE"))
+		if err != nil {
+			exitConfigError(err)
+		}
 	}
-	verbose := os.Getenv("VERBOSE") == "1"
-	if verbose {
-		fmt.Println("verbose logging enabled")
+	skipOpCheck := getEnvBool("MODEL_SKIP_OP_CHECK", false)
+	warmupModel := getEnvBool("MODEL_WARMUP", true)
+	if !warmupModel {
+		logInfo("not warming up the model because MODEL_WARMUP=false")
 	}
-	devID := getEnv("HZN_ORG_ID", "HZN_ORGANIZATION") + "/" + getEnv("HZN_DEVICE_ID")
-	// load the graph def from FS
-	m, err := newModel("model.pb")
+	audioSampleRate = getEnvInt("AUDIO_SAMPLE_RATE", audioSampleRate)
+	audioBytesPerSample = getEnvInt("AUDIO_BYTES_PER_SAMPLE", audioBytesPerSample)
+	// captures of other lengths than the sdr service's /audio chunks are streamed from /stream, which sends at most 5 minutes.
+	captureSeconds = getEnvFloat("CAPTURE_SECONDS", audioChunkSeconds)
+	if _, ok := sdrs[0].SDR.(*usbSDR); ok && iq == nil && (audioSampleRate != usbAudioSampleRate || audioBytesPerSample != 2) {
+		exitConfigError(fmt.Sprintf("SDR_BACKEND=usb captures 16 bit audio at %d Hz, set AUDIO_SAMPLE_RATE and AUDIO_BYTES_PER_SAMPLE to match, and MODEL_SAMPLE_RATE and MODEL_SAMPLE_FORMAT to what the model takes", usbAudioSampleRate))
+	}
+	// the model takes audio in the format it is captured in, unless it is told otherwise.
+	modelAudioFormat = capturedAudioFormat()
+	modelAudioFormat.SampleRate = getEnvInt("MODEL_SAMPLE_RATE", audioSampleRate)
+	modelAudioFormat.Channels = getEnvInt("MODEL_CHANNELS", audioChannels)
+	if format := configEnv("MODEL_SAMPLE_FORMAT"); format != "" {
+		modelAudioFormat.Encoding = audioconv.Encoding(format)
+	}
+	if err := modelAudioFormat.Check(); err != nil {
+		exitConfigError(fmt.Sprintf("bad MODEL_SAMPLE_RATE, MODEL_CHANNELS or MODEL_SAMPLE_FORMAT: %v", err))
+	}
+	if modelAudioFormat != capturedAudioFormat() {
+		if err := capturedAudioFormat().Check(); err != nil {
+			exitConfigError(fmt.Sprintf("can't convert the audio for the model: %v", err))
+		}
+		logInfo("converting the audio to", modelAudioFormat.Channels, "channels of", modelAudioFormat.Encoding, "at", modelAudioFormat.SampleRate, "Hz for the model")
+	}
+	if codec := configEnv("AUDIO_CODEC"); codec != "" {
+		audioCodec = codec
+	}
+	// by default audio of the wrong length is padded or truncated, AUDIO_LENGTH_MODE=error rejects it instead.
+	fitAudioLength := configEnv("AUDIO_LENGTH_MODE") != "error"
+	preprocess := getEnvBool("AUDIO_PREPROCESS", false)
+	// skip scoring silence and static, off by default.
+	var gate *noiseGate
+	if getEnvBool("NOISE_GATE", false) {
+		gate = &noiseGate{
+			MinPowerDBFS: float32(getEnvFloat("NOISE_GATE_MIN_DBFS", -50)),
+			MinRangeDB:   float32(getEnvFloat("NOISE_GATE_MIN_RANGE_DB", 6)),
+		}
+		logInfo("not scoring audio under", gate.MinPowerDBFS, "dBFS or whose loudness varies by less than", gate.MinRangeDB, "dB")
+	}
+	// score captures in overlapping windows as long as the model takes, off by default.
+	var windows *slidingWindows
+	if hop := getEnvFloat("WINDOW_HOP_SECONDS", 0); hop != 0 {
+		windows = &slidingWindows{Seconds: getEnvFloat("MODEL_INPUT_SECONDS", audioChunkSeconds), HopSeconds: hop}
+		logInfo("scoring captures in windows of", windows.Seconds, "seconds, one every", hop, "seconds")
+	}
+	encryption, err := newAudioEncryption()
 	if err != nil {
-		panic(err)
+		exitConfigError(err)
+	}
+	if *selftestMode {
+		if !runSelftest(selftestSteps(sdrs, modelTags, skipOpCheck)) {
+			os.Exit(1)
+		}
+		return
+	}
+	devID := getEnv("HZN_ORG_ID", "HZN_ORGANIZATION") + "/" + getEnv("HZN_DEVICE_ID")
+	// closers close the model and the producer on shutdown.
+	var closers []func() error
+	defer func() {
+		for _, closer := range closers {
+			if err := closer(); err != nil {
+				logWarn("error shutting down:", err)
+			}
+		}
+	}()
+	for _, device := range sdrs {
+		if usb, ok := device.SDR.(*usbSDR); ok {
+			closers = append(closers, usb.Close)
+		}
+	}
+	var scorer Scorer
+	// labels names the classes of the model, if it scores several.
+	var labels *classLabels
+	modelName := modelNameFromEnv()
+	switch backend := configEnv("MODEL_BACKEND"); {
+	case iq != nil:
+		// the IQ samples aren't scored, so the model isn't loaded.
+		modelName = ""
+	case backend == "mock":
+		logWarn("using a mock model that scores audio randomly because MODEL_BACKEND=mock")
+		scorer = mockModel{}
+		modelName = "mock"
+	default:
+		m, err := modelFromEnv(modelTags, skipOpCheck, warmupModel)
+		if err != nil {
+			panic(err)
+		}
+		// a changed model is only picked up if MODEL_RELOAD_INTERVAL is set.
+		if reloadInterval := getEnvDuration("MODEL_RELOAD_INTERVAL", 0); reloadInterval > 0 {
+			logInfo("checking the model for changes every", reloadInterval)
+			go m.watch(reloadInterval)
+		}
+		scorer = m
+		labels = m.Opts.Labels
+		closers = append(closers, m.close)
+	}
+	// in replay mode audio comes from the files in REPLAY_DIR instead of the SDR, and is only published if REPLAY_PUBLISH=true.
+	replayDir := configEnv("REPLAY_DIR")
+	replayPublish := getEnvBool("REPLAY_PUBLISH", false)
+	publishBackend := configPublishBackend()
+	if replayDir != "" && !replayPublish {
+		publishBackend = "none"
+	}
+	var publisher Publisher
+	if publishBackend != "none" {
+		var publisherClosers []func() error
+		publisher, publisherClosers, err = newPublishers(publishBackend)
+		closers = append(closers, publisherClosers...)
+		if err != nil {
+			panic(err)
+		}
+	}
+	health.set(&health.ModelLoaded, true)
+	health.set(&health.PublisherConnected, true)
+	// of a pair of nodes on the same antenna feed, only the active one publishes, the standby scores silently.
+	switch configEnv("NODE_ROLE") {
+	case "", "active":
+	case "standby":
+		if publisher != nil {
+			logWarn("not publishing anything because NODE_ROLE=standby")
+			publisher = &standbyPublisher{Publisher: publisher}
+		}
 	}
-	fmt.Println("model loaded")
-	topic := getEnv("EVTSTREAMS_TOPIC")
-	fmt.Printf("using topic %s\n", topic)
-	conn, err := connect(topic)
+	threshold, err := parseThresholdSchedule(configEnv("THRESHOLD_SCHEDULE"), float32(getEnvFloat("PUBLISH_THRESHOLD", defaultPublishThreshold)))
 	if err != nil {
-		panic(err)
+		exitConfigError(err)
 	}
-	fmt.Println("connected to evtstreams")
-	// create a map to hold the goodness for each station we have ever oberved.
-	// This map will grow as long as the program lives
-	stationGoodness := map[float32]float32{}
-	lastStationsRefresh := time.Time{}
-
-	// make it fail sooner.
-	if use_gps {
-		_, err = getGPS()
+	// per class thresholds replace the threshold of the goodness, they need the labels of the model's classes.
+	var classes classThresholds
+	if spec := configEnv("CLASS_THRESHOLDS"); spec != "" {
+		classes, err = parseClassThresholds(spec)
 		if err != nil {
-			fmt.Println(err)
-			panic("can't get location from GPS")
+			exitConfigError(err)
+		}
+		if err = classes.check(labels); err != nil {
+			exitConfigError(err)
+		}
+		logInfo("publishing audio that any of", len(classes), "classes scores over its threshold in, instead of by PUBLISH_THRESHOLD")
+	}
+	topClasses := getEnvInt("MODEL_TOP_CLASSES", 0)
+	if replayDir != "" {
+		logInfo("replaying audio files from", replayDir)
+		err = replay(replayDir, replayPublish, loopConfig{DevID: devID, FitAudioLength: fitAudioLength, PreprocessAudio: preprocess, Threshold: threshold, ClassThresholds: classes, TopClasses: topClasses, ModelName: modelName, ModelVersion: configEnv("MODEL_VERSION"), Encryption: encryption}, loopDeps{Scorer: scorer, Publisher: publisher})
+		if err != nil {
+			panic(err)
 		}
+		return
 	}
-	sdr_origin := ""
-	var hasCapturedFirstClip = false
-	var hasSentFirstClip = false
-	for {
-		// if it has been over 5 minuts since we last updated the list of strong stations,
-		if time.Now().Sub(lastStationsRefresh) > (5 * time.Minute) {
-			fmt.Println("fetching new list of stations")
-			// for ever, we aquire a list of stations,
-			freqs, err := rtlsdr.GetFreqs(hostname)
+	// a bad RTLSDR_ADDR would otherwise only show up as a panic in the loop.
+	for _, device := range sdrs {
+		if client, ok := device.SDR.(*rtlsdrClient); ok {
+			err = client.probe()
 			if err != nil {
 				panic(err)
 			}
-			fmt.Println("got", len(freqs.Freqs), "freqs from sdr")
-			sdr_origin = freqs.Origin
-			for _, station := range freqs.Freqs {
-				_, prs := stationGoodness[station]
-				if !prs {
-					// only if the station is not already in our map, do we add it, with an initial value of 0.5
-					fmt.Println("found new station: ", station)
-					stationGoodness[station] = 0.5
-				}
+		}
+	}
+	health.set(&health.SDRReachable, true)
+	// make it fail sooner.
+	if use_gps && checkLocation {
+		_, err = getLocation()
+		if err != nil {
+			logError(err)
+			panic("can't get location from GPS")
+		}
+	}
+	// limit how many messages are published per minute or per second, unlimited by default.
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	maxMsgsPerMin := getEnvInt("EVTSTREAMS_MAX_MSGS_PER_MIN", 0)
+	maxMsgsPerSec := getEnvFloat("EVTSTREAMS_MAX_MSGS_PER_SEC", 0)
+	if maxMsgsPerMin > 0 {
+		logInfo("publishing at most", maxMsgsPerMin, "messages per minute")
+		limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(maxMsgsPerMin)), maxMsgsPerMin)
+	}
+	if maxMsgsPerSec > 0 {
+		logInfo("publishing at most", maxMsgsPerSec, "messages per second")
+		limiter = rate.NewLimiter(rate.Limit(maxMsgsPerSec), int(math.Ceil(maxMsgsPerSec)))
+	}
+	// and how many bytes, to stay within a metered data plan.
+	var byteLimiter *rate.Limiter
+	if maxBytesPerSec := getEnvInt("EVTSTREAMS_MAX_BYTES_PER_SEC", 0); maxBytesPerSec > 0 {
+		burst := getEnvInt("EVTSTREAMS_MAX_BYTES_BURST", 60*maxBytesPerSec)
+		logInfo("publishing at most", maxBytesPerSec, "bytes per second, in bursts of up to", burst, "bytes")
+		byteLimiter = rate.NewLimiter(rate.Limit(maxBytesPerSec), burst)
+	}
+	// by default we panic when no stations are found, ON_NO_STATIONS=retry keeps scanning with backoff instead.
+	retryNoStations := configEnv("ON_NO_STATIONS") == "retry"
+	goodnessRule, err := goodnessRuleFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	// the loop of each SDR picks its stations, and refreshes them, on its own.
+	selector, err := stationSelectorFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	fixedStations, err := parseStations("FIXED_STATIONS")
+	if err != nil {
+		exitConfigError(err)
+	}
+	includeStations, err := parseStations("STATIONS_INCLUDE")
+	if err != nil {
+		exitConfigError(err)
+	}
+	excludeStations, err := parseStations("STATIONS_EXCLUDE")
+	if err != nil {
+		exitConfigError(err)
+	}
+	refresher, err := stationRefresherFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	// sample several stations at once if the sdr can, every SDR is of the same backend.
+	captureWorkers := getEnvInt("CAPTURE_WORKERS", 1)
+	if limit := sdrMaxCaptures(sdrs[0].SDR); captureWorkers > limit {
+		logWarn("CAPTURE_WORKERS is", captureWorkers, "but the sdr can only capture from", limit, "stations at once, using", limit)
+		captureWorkers = limit
+	}
+	cfg := loopConfig{
+		DevID:           devID,
+		UseGPS:          use_gps,
+		FitAudioLength:  fitAudioLength,
+		PreprocessAudio: preprocess,
+		NoiseGate:       gate,
+		Windows:         windows,
+		Refresher:       refresher,
+		GoodnessRule:    goodnessRule,
+		Pipeline: pipelineConfig{
+			Captures: captureWorkers,
+			Workers:  getEnvInt("PIPELINE_WORKERS", 1),
+			Queue:    getEnvInt("PIPELINE_QUEUE", 1),
+		},
+		Selector:        selector,
+		Threshold:       threshold,
+		ClassThresholds: classes,
+		TopClasses:      topClasses,
+		Retry: retryPolicy{
+			MaxRetries: getEnvInt("RETRY_MAX", 3),
+			Backoff:    getEnvDuration("RETRY_BACKOFF", time.Second),
+			MaxBackoff: getEnvDuration("RETRY_MAX_BACKOFF", 30*time.Second),
+			Jitter:     getEnvFloat("RETRY_JITTER", 0.2),
+		},
+		FailureWindow:    getEnvDuration("FAILURE_WINDOW", 10*time.Minute),
+		MaxScoreFailures: getEnvInt("MODEL_MAX_FAILURES", 0),
+		FixedStations:    fixedStations,
+		IncludeStations:  includeStations,
+		ExcludeStations:  excludeStations,
+		RetryNoStations:  retryNoStations,
+		Limiter:          limiter,
+		ByteLimiter:      byteLimiter,
+		Mode:             mode,
+		IQ:               iq,
+		ModelName:        modelName,
+		ModelVersion:     configEnv("MODEL_VERSION"),
+		Encryption:       encryption,
+	}
+	// name the stations in the messages by their RDS, off by default as it takes the sdr 10 seconds a station.
+	if getEnvBool("RDS", false) {
+		cfg.StationInfos = newStationInfos(getEnvDuration("RDS_MAX_AGE", 6*time.Hour))
+		logInfo("naming the stations by their RDS")
+	}
+	// measure the SNR of each station when it is captured, off by default as it takes the sdr service a second a station.
+	measureSNR := getEnvBool("SNR", false)
+	var snrMinDB, snrGoodDB float32
+	if measureSNR {
+		snrMinDB, snrGoodDB, err = snrThresholdsFromEnv()
+		if err != nil {
+			exitConfigError(err)
+		}
+		for _, device := range sdrs {
+			if _, ok := device.SDR.(snrSDR); !ok {
+				exitConfigError(fmt.Sprintf("SDR_BACKEND=%s can't measure SNR", configEnv("SDR_BACKEND")))
 			}
-			// if no stations can be found, we can't do anything, so panic.
-			if len(stationGoodness) < 1 {
-				panic("No FM stations. Move the antenna?")
+			if _, ok := device.SDR.(*usbSDR); ok && len(fixedStations) > 0 {
+				exitConfigError("SDR_BACKEND=usb measures SNR over the noise of its scans, so SNR=true can't be used with FIXED_STATIONS")
 			}
-			fmt.Println("found", len(freqs.Freqs), "stations from", freqs.Origin)
-			fmt.Println(stationGoodness)
-			lastStationsRefresh = time.Now()
-		}
-		for station, goodness := range stationGoodness {
-			// if our goodness is less then a random number between 0 and 1.
-			if rand.Float32() < goodness {
-				audio, err := rtlsdr.GetAudio(hostname, int(station))
-				if err != nil {
-					panic(err)
-				}
-				if !hasCapturedFirstClip {
-					fmt.Println("Captured first clip")
-					hasCapturedFirstClip = true
-				}
-				val, err := m.goodness(audio)
-				if err != nil {
-					panic(err)
-				}
-				// if the value is close to 1, the goodness of that station will increase, if the value is small, the goodness will decrease.
-				stationGoodness[station] = stationGoodness[station]*(val+0.3) + 0.05
-				if verbose {
-					fmt.Println(station, "observed value:", val, "updated goodness:", stationGoodness[station])
-				}
-				// if the value is over 0.5, it is worth sending to the cloud.
-				if val > 0.5 {
-					var location = locationData{}
-					if use_gps {
-						location, err = getGPS()
-						if err != nil {
-							fmt.Println(err)
-							continue
-						}
-					}
-					// construct the message,
-					msg := &audiolib.AudioMsg{
-						Audio:         rawToB64Mp3(audio),
-						Ts:            time.Now().Unix(),
-						Freq:          station,
-						ExpectedValue: val,
-						DevID:         devID,
-						Lat:           float32(location.Latitude),
-						Lon:           float32(location.Longitude),
-						ContentType:   "audio/mpeg",
-						Origin:        sdr_origin,
-					}
-					// and publish it to evtstreams
-					err = conn.publishAudio(msg)
-					if err != nil {
-						fmt.Println(err)
-					}
-					if !hasSentFirstClip {
-						fmt.Println("Sent first clip")
-						hasSentFirstClip = true
-					}
-				} else {
-					if verbose {
-						fmt.Println("Not sending sample from", station, "becouse value is", val)
-					}
-				}
+		}
+		logInfo("measuring the SNR of the stations, sampling those under", snrGoodDB, "dB less")
+	}
+	// skip publishing a chunk that matches the last one published from the same station within DEDUP_WINDOW, off by default.
+	if dedupWindow := getEnvDuration("DEDUP_WINDOW", 0); dedupWindow > 0 {
+		logInfo("skipping duplicate chunks within", dedupWindow)
+		cfg.Dedup = newDedup(dedupWindow)
+	}
+	// keep the messages that fail to publish on disk until publishing works again, off by default.
+	if dir := configEnv("SPOOL_DIR"); dir != "" && publisher != nil {
+		_, raw := publisher.(rawAudioPublisher)
+		cfg.Spool, err = newSpool(dir, int64(getEnvInt("SPOOL_MAX_BYTES", 256<<20)), raw)
+		if err != nil {
+			panic(err)
+		}
+		cfg.SpoolDrainBatch = getEnvInt("SPOOL_DRAIN_BATCH", 10)
+		logInfo("spooling the messages that fail to publish in", dir)
+	}
+	// send the messages that a crash cut off again at startup, off by default.
+	if dir := configEnv("COMMIT_LOG_DIR"); dir != "" && publisher != nil {
+		_, raw := activePublisher(publisher).(rawAudioPublisher)
+		cfg.CommitLog, err = newCommitLog(dir, int64(getEnvInt("COMMIT_LOG_MAX_BYTES", 10<<20)), raw)
+		if err != nil {
+			panic(err)
+		}
+		closers = append(closers, cfg.CommitLog.close)
+		logInfo("logging the messages that are published in", dir)
+		cfg.CommitLog.recover(publisher, cfg.Spool)
+	}
+	// keep the messages that can't be published at all, off by default.
+	if dir := configEnv("DEAD_LETTER_DIR"); dir != "" {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			panic(err)
+		}
+		cfg.DeadLetter = &deadLetter{Dir: dir}
+		logInfo("dead lettering the messages that fail to publish in", dir)
+	} else if topic := configEnv("DEAD_LETTER_TOPIC"); topic != "" {
+		conn, err := connect(topic, getEnvDuration("EVTSTREAMS_CONNECT_TIMEOUT", 2*time.Minute))
+		if err != nil {
+			panic(err)
+		}
+		closers = append(closers, conn.close)
+		cfg.DeadLetter = &deadLetter{Conn: conn}
+		logInfo("dead lettering the messages that fail to publish to topic", topic)
+	}
+	// keep the goodness of the stations across restarts, unless they are fixed.
+	if path := configEnv("GOODNESS_FILE"); path != "" && len(fixedStations) == 0 {
+		cfg.Goodness = &goodnessStore{
+			Path:     path,
+			Interval: getEnvDuration("GOODNESS_SAVE_INTERVAL", 5*time.Minute),
+			HalfLife: getEnvDuration("GOODNESS_HALF_LIFE", 24*time.Hour),
+		}
+	}
+	// pause the captures of an SDR that keeps failing instead of exiting, off by default.
+	breakerFailures, breakerCooldown, err := sdrBreakerFromEnv()
+	if err != nil {
+		exitConfigError(err)
+	}
+	if breakerFailures > 0 {
+		logInfo("pausing captures for", breakerCooldown, "after the sdr fails", breakerFailures, "times in a row")
+	}
+	var loops []deviceLoop
+	for i, device := range sdrs {
+		loop := deviceLoop{Config: cfg, Deps: loopDeps{
+			SDR:         device.SDR,
+			Scorer:      scorer,
+			Publisher:   publisher,
+			GetLocation: getLocation,
+			Now:         time.Now,
+		}}
+		loop.Config.Device = device.Name
+		// the first loop takes the selector and refresher made above, the others get their own.
+		if i > 0 {
+			loop.Config.Selector, err = stationSelectorFromEnv()
+			if err == nil {
+				loop.Config.Refresher, err = stationRefresherFromEnv()
 			}
+			if err != nil {
+				exitConfigError(err)
+			}
+		}
+		if measureSNR {
+			loop.Config.SNRs = newStationSNRs(snrMinDB, snrGoodDB)
 		}
+		if breakerFailures > 0 {
+			loop.Config.SDRBreaker = newCircuitBreaker(device.Name, breakerFailures, breakerCooldown)
+		}
+		loop.Config.Goodness = cfg.Goodness.forDevice(device.Name)
+		// create a map to hold the goodness for each station we have ever oberved.
+		// This map will grow as long as the program lives
+		loop.StationGoodness, err = loop.Config.Goodness.load(time.Now())
+		if err != nil {
+			logWarn("can't load GOODNESS_FILE, learning the stations from scratch:", err, loop.Config.deviceField())
+			loop.StationGoodness = map[int64]float32{}
+		} else if len(loop.StationGoodness) > 0 {
+			logInfo("loaded the goodness of", len(loop.StationGoodness), "stations from", loop.Config.Goodness.Path, loop.Config.deviceField())
+		}
+		for station, g := range loop.StationGoodness {
+			metrics.setGoodness(device.Name, station, g)
+		}
+		loops = append(loops, loop)
+	}
+	err = runLoops(shutdownContext(), loops)
+	if err != nil && err != context.Canceled {
+		panic(err)
 	}
+	logInfo("shutting down")
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// histogram counts observations into buckets, like a Prometheus histogram.
+type histogram struct {
+	// Buckets are the upper bounds of the buckets, in increasing order.
+	Buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{Buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.Buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.writeSeries(w, name, "")
+}
+
+// writeSeries writes the buckets, sum and count of h without the HELP and TYPE lines, labels are
+// added to each line, like device="0", so that several histograms can be written under one name.
+func (h *histogram) writeSeries(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, braced(labels), h.sum, name, braced(labels), h.count)
+}
+
+// braced is labels in braces, or nothing if there are none.
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// deviceLabel is the label of the SDR named device, or nothing for the only SDR of a node.
+func deviceLabel(device string) string {
+	if device == "" {
+		return ""
+	}
+	return fmt.Sprintf("device=%q", device)
+}
+
+// serviceMetrics are what the service has done so far, served in the Prometheus text format on /metrics.
+type serviceMetrics struct {
+	mu              sync.Mutex
+	Published       int
+	PublishFailures int
+	// Spooled is how many messages are in the spool.
+	Spooled int
+	// ModelReloads is how many times a changed model was swapped in, and ModelReloadFailures how many times
+	// one failed to load and the old one was kept.
+	ModelReloads        int
+	ModelReloadFailures int
+	InferenceLatency    *histogram
+	// Devices are the metrics of each SDR by its name in SDR_DEVICES, "" is the only SDR of a node without it.
+	Devices map[string]*deviceMetrics
+}
+
+// deviceMetrics are the metrics of one SDR and its loop.
+type deviceMetrics struct {
+	StationsDiscovered int
+	Inferences         int
+	// Gated is how many chunks the noise gate skipped scoring.
+	Gated int
+	// Goodness is the current goodness of each station.
+	Goodness       map[int64]float32
+	CaptureLatency *histogram
+	// BreakerTrips is how many times the circuit breaker of the SDR tripped, and BreakerOpen whether it hasn't
+	// seen the SDR work since it last did.
+	BreakerTrips int
+	BreakerOpen  bool
+}
+
+// metrics are the metrics of this node.
+var metrics = &serviceMetrics{
+	InferenceLatency: newHistogram(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	Devices:          map[string]*deviceMetrics{},
+}
+
+// device returns the metrics of the SDR named name, m.mu must be held.
+func (m *serviceMetrics) device(name string) *deviceMetrics {
+	d, ok := m.Devices[name]
+	if !ok {
+		d = &deviceMetrics{
+			Goodness: map[int64]float32{},
+			// a capture from the sdr service takes about 30 seconds.
+			CaptureLatency: newHistogram(1, 5, 10, 20, 30, 35, 40, 60, 120),
+		}
+		m.Devices[name] = d
+	}
+	return d
+}
+
+// addDevice adds the SDR named device, so that its counters are served as 0 before its loop starts.
+func (m *serviceMetrics) addDevice(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device)
+}
+
+func (m *serviceMetrics) stationDiscovered(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).StationsDiscovered++
+}
+
+func (m *serviceMetrics) captured(device string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).CaptureLatency.observe(latency.Seconds())
+}
+
+func (m *serviceMetrics) inferred(device string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).Inferences++
+	m.InferenceLatency.observe(latency.Seconds())
+}
+
+func (m *serviceMetrics) gated(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).Gated++
+}
+
+func (m *serviceMetrics) setGoodness(device string, station int64, goodness float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).Goodness[station] = goodness
+}
+
+func (m *serviceMetrics) breakerTripped(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.device(device)
+	d.BreakerTrips++
+	d.BreakerOpen = true
+}
+
+func (m *serviceMetrics) breakerClosed(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(device).BreakerOpen = false
+}
+
+// publishedOne counts a message, which was published unless err is set.
+func (m *serviceMetrics) publishedOne(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.PublishFailures++
+	} else {
+		m.Published++
+	}
+}
+
+func (m *serviceMetrics) setSpooled(spooled int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Spooled = spooled
+}
+
+// modelReloaded counts a changed model that was swapped in, unless err is set.
+func (m *serviceMetrics) modelReloaded(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.ModelReloadFailures++
+	} else {
+		m.ModelReloads++
+	}
+}
+
+// publishFailedLater counts a message that was counted as published when it was queued, but then failed.
+func (m *serviceMetrics) publishFailedLater() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Published--
+	m.PublishFailures++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *serviceMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counter := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	devices := make([]string, 0, len(m.Devices))
+	for device := range m.Devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	// deviceCounter writes a counter with a line for each SDR.
+	deviceCounter := func(name, help string, v func(d *deviceMetrics) int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, device := range devices {
+			fmt.Fprintf(w, "%s%s %d\n", name, braced(deviceLabel(device)), v(m.Devices[device]))
+		}
+	}
+	deviceCounter("sdr_stations_discovered_total", "Stations found by scanning.", func(d *deviceMetrics) int { return d.StationsDiscovered })
+	deviceCounter("sdr_inferences_total", "Chunks of audio scored by the model.", func(d *deviceMetrics) int { return d.Inferences })
+	deviceCounter("sdr_chunks_gated_total", "Chunks of audio that the noise gate skipped scoring as silent or static.", func(d *deviceMetrics) int { return d.Gated })
+	deviceCounter("sdr_breaker_trips_total", "Times the SDR failed SDR_BREAKER_FAILURES times in a row and captures were paused.", func(d *deviceMetrics) int { return d.BreakerTrips })
+	fmt.Fprintf(w, "# HELP sdr_breaker_open Whether captures from the SDR are paused, or it hasn't worked since they were.\n# TYPE sdr_breaker_open gauge\n")
+	for _, device := range devices {
+		open := 0
+		if m.Devices[device].BreakerOpen {
+			open = 1
+		}
+		fmt.Fprintf(w, "sdr_breaker_open%s %d\n", braced(deviceLabel(device)), open)
+	}
+	counter("sdr_messages_published_total", "Messages published.", m.Published)
+	counter("sdr_publish_failures_total", "Messages that failed to publish after all retries.", m.PublishFailures)
+	counter("sdr_model_reloads_total", "Times a changed model was swapped in with MODEL_RELOAD_INTERVAL.", m.ModelReloads)
+	counter("sdr_model_reload_failures_total", "Times a changed model failed to load and the old one was kept.", m.ModelReloadFailures)
+	fmt.Fprintf(w, "# HELP sdr_spooled_messages Messages in the spool waiting to be published.\n# TYPE sdr_spooled_messages gauge\nsdr_spooled_messages %d\n", m.Spooled)
+	fmt.Fprintf(w, "# HELP sdr_station_goodness The chance of each station being sampled on a pass.\n# TYPE sdr_station_goodness gauge\n")
+	for _, device := range devices {
+		goodness := m.Devices[device].Goodness
+		stations := make([]int64, 0, len(goodness))
+		for station := range goodness {
+			stations = append(stations, station)
+		}
+		sort.Slice(stations, func(i, j int) bool { return stations[i] < stations[j] })
+		labels := deviceLabel(device)
+		if labels != "" {
+			labels += ","
+		}
+		for _, station := range stations {
+			fmt.Fprintf(w, "sdr_station_goodness{%sfreq=\"%d\"} %g\n", labels, station, goodness[station])
+		}
+	}
+	m.InferenceLatency.write(w, "sdr_inference_seconds", "How long scoring a chunk of audio takes.")
+	fmt.Fprintf(w, "# HELP sdr_capture_seconds How long capturing a chunk of audio from the SDR takes.\n# TYPE sdr_capture_seconds histogram\n")
+	for _, device := range devices {
+		m.Devices[device].CaptureLatency.writeSeries(w, "sdr_capture_seconds", deviceLabel(device))
+	}
+}
+
+// serveMonitoring serves /metrics, /healthz and /readyz on addr, it only returns if the server fails.
+func serveMonitoring(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", health.serveHealthz)
+	mux.HandleFunc("/readyz", health.serveReadyz)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// mockModel is a Scorer that gives audio a random score, for development without a TensorFlow model.
+type mockModel struct{}
+
+func (mockModel) score(audio []byte) (s audioScore, err error) {
+	s.Value = rand.Float32()
+	return
+}
+
+// mockPublisher is a Publisher that only logs and counts the messages it is given, for development without IBM Event Streams.
+type mockPublisher struct {
+	mu        sync.Mutex
+	Published int
+}
+
+func (p *mockPublisher) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Published++
+	logInfo("> mock published message", p.Published, field("freq", audioMsg.Freq), field("value", audioMsg.ExpectedValue),
+		field("devID", audioMsg.DevID), field("ts", audioMsg.Ts), field("lat", audioMsg.Lat), field("lon", audioMsg.Lon),
+		field("origin", audioMsg.Origin), field("bytes", audioMsg.Length()))
+	return
+}
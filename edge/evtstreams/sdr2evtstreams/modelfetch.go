@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// modelFetcher downloads a frozen graph from URL into CacheDir, so that the model doesn't have to be baked into
+// the container image. The model must have the hex SHA-256 SHA256, which also names it in the cache, so a model
+// that is already cached is used without downloading it again, even when URL can't be reached.
+type modelFetcher struct {
+	URL      string
+	SHA256   string
+	CacheDir string
+	Client   *http.Client
+	Retry    retryPolicy
+}
+
+func newModelFetcher(rawURL, sha, cacheDir string, client *http.Client, retry retryPolicy) (f *modelFetcher, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("the model URL must be an http or https URL")
+	}
+	sha = strings.ToLower(sha)
+	if decoded, err := hex.DecodeString(sha); err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("the SHA-256 of the model must be 64 hex digits, got %q", sha)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &modelFetcher{URL: rawURL, SHA256: sha, CacheDir: cacheDir, Client: client, Retry: retry}, nil
+}
+
+// path is where the model is cached.
+func (f *modelFetcher) path() string {
+	return filepath.Join(f.CacheDir, "model-"+f.SHA256+".pb")
+}
+
+// host is the host of URL, which is what is logged of it, as the query of a presigned object storage URL
+// holds its credentials.
+func (f *modelFetcher) host() string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// fetch returns the path of the cached model, downloading it first if it isn't cached yet.
+// A cached model whose hash doesn't match, as after a partial write, is downloaded again.
+func (f *modelFetcher) fetch(ctx context.Context) (path string, err error) {
+	path = f.path()
+	if sha, err := fileSHA256(path); err == nil && sha == f.SHA256 {
+		logInfo("using the cached model", path)
+		return path, nil
+	}
+	err = os.MkdirAll(f.CacheDir, 0755)
+	if err != nil {
+		return
+	}
+	logInfo("downloading the model from", f.host())
+	err = f.Retry.do(ctx, "downloading the model", func() error {
+		return f.download(ctx, path)
+	})
+	if err != nil {
+		return "", err
+	}
+	logInfo("downloaded the model to", path)
+	return
+}
+
+// download downloads the model into a temporary file next to path, checks its hash and then renames it to path,
+// so that path only ever holds a whole model that was checked.
+func (f *modelFetcher) download(ctx context.Context, path string) (err error) {
+	req, err := http.NewRequest(http.MethodGet, f.URL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := f.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		// the error holds the URL, which may hold credentials.
+		return fmt.Errorf("can't get the model from %s: %v", f.host(), unwrapURLError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't get the model from %s: %s", f.host(), resp.Status)
+	}
+	tmp, err := ioutil.TempFile(f.CacheDir, ".model-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if sha := hex.EncodeToString(hash.Sum(nil)); sha != f.SHA256 {
+		return fmt.Errorf("the model from %s has SHA-256 %s, not MODEL_SHA256 %s", f.host(), sha, f.SHA256)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// unwrapURLError is the error under the *url.Error err, without its URL.
+func unwrapURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+// fileSHA256 is the hex SHA-256 of the file at path.
+func fileSHA256(path string) (sha string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testModel = []byte("a frozen graph")
+
+func testModelSHA256() string {
+	sum := sha256.Sum256(testModel)
+	return hex.EncodeToString(sum[:])
+}
+
+// testModelServer serves testModel, counting the requests for it.
+func testModelServer(t *testing.T, requests *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Write(testModel)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "modelfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestModelFetcherCaches(t *testing.T) {
+	var requests int
+	server := testModelServer(t, &requests)
+	f, err := newModelFetcher(server.URL+"/model.pb", strings.ToUpper(testModelSHA256()), testCacheDir(t), server.Client(), retryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		path, err := f.fetch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		model, err := ioutil.ReadFile(path)
+		if err != nil || string(model) != string(testModel) {
+			t.Errorf("fetched %q, %v, want %q", model, err, testModel)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("downloaded the model %d times, want once and then from the cache", requests)
+	}
+}
+
+func TestModelFetcherSHA256Mismatch(t *testing.T) {
+	var requests int
+	server := testModelServer(t, &requests)
+	dir := testCacheDir(t)
+	sha := strings.Repeat("0", 64)
+	f, err := newModelFetcher(server.URL+"/model.pb", sha, dir, server.Client(), retryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := f.fetch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), testModelSHA256()) || !strings.Contains(err.Error(), sha) {
+		t.Fatalf("fetched %q, %v, want an error naming both hashes", path, err)
+	}
+	// neither the model nor the temporary file it was downloaded to is left in the cache.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Errorf("%s is left in the cache", file.Name())
+	}
+}
+
+func TestModelFetcherRejectsSettings(t *testing.T) {
+	sha := testModelSHA256()
+	tests := []struct {
+		url, sha string
+	}{
+		{"ftp://example.com/model.pb", sha},
+		{"https:///model.pb", sha},
+		{"not a url", sha},
+		{"https://example.com/model.pb", sha[:63]},
+		{"https://example.com/model.pb", sha[:62] + "zz"},
+		{"https://example.com/model.pb", ""},
+	}
+	for _, test := range tests {
+		if _, err := newModelFetcher(test.url, test.sha, "", nil, retryPolicy{}); err == nil {
+			t.Errorf("newModelFetcher(%q, %q) succeeded, want an error", test.url, test.sha)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// mqttSink is a Publisher that publishes each message as JSON to an MQTT 3.1.1 broker, for deployments with an
+// MQTT broker rather than Kafka. It only speaks the part of the protocol that publishing at QoS 0 or 1 needs,
+// and connects again on the next publish after a failure.
+type mqttSink struct {
+	// Addr is the host:port of the broker, TLS is nil for a plain TCP connection.
+	Addr     string
+	TLS      *tls.Config
+	ClientID string
+	Username string
+	Password string
+	// Topic is the topic to publish to, {devID}, {freq} and {origin} are replaced by those of the message.
+	Topic   string
+	QoS     byte
+	Timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	// packetID numbers the QoS 1 publishes.
+	packetID uint16
+}
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttDisconnect = 14
+)
+
+// newMQTTSink makes the mqttSink for brokerURL, like tcp://broker:1883 or ssl://broker:8883. tlsConfig is only used with ssl.
+func newMQTTSink(brokerURL string, tlsConfig *tls.Config) (s *mqttSink, err error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad MQTT_BROKER_URL %q: %v", brokerURL, err)
+	}
+	s = &mqttSink{Addr: u.Host, Timeout: 30 * time.Second, QoS: 1, Topic: "sdr/{devID}/{freq}"}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			s.Addr = net.JoinHostPort(u.Host, "1883")
+		}
+	case "ssl", "tls", "mqtts":
+		if u.Port() == "" {
+			s.Addr = net.JoinHostPort(u.Host, "8883")
+		}
+		s.TLS = tlsConfig
+		if s.TLS == nil {
+			s.TLS = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("bad MQTT_BROKER_URL %q, the scheme must be tcp or ssl", brokerURL)
+	}
+	return
+}
+
+func (s *mqttSink) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	payload, err := audioMsg.Encode()
+	if err != nil {
+		return
+	}
+	topic := strings.NewReplacer("{devID}", audioMsg.DevID, "{freq}", strconv.FormatInt(audioMsg.Freq, 10), "{origin}", audioMsg.Origin).Replace(s.Topic)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		err = s.connect()
+		if err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	err = s.publish(topic, payload)
+	if err != nil {
+		// the connection can't be trusted after a failure, so the next publish makes a new one.
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("can't publish to MQTT: %v", err)
+	}
+	logInfo("> message sent to MQTT", field("topic", topic), field("freq", audioMsg.Freq), field("bytes", len(payload)), field("latency", time.Since(start)))
+	return
+}
+
+// dial connects to the broker now, rather than on the first publish.
+func (s *mqttSink) dial() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connect()
+}
+
+// connect dials the broker and sends CONNECT, it expects s.mu to be held.
+func (s *mqttSink) connect() (err error) {
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	var conn net.Conn
+	if s.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Addr, s.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("can't connect to MQTT broker %s: %v", s.Addr, err)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	var flags byte = 0x02 // clean session
+	payload := mqttString(s.ClientID)
+	if s.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(s.Username)...)
+		if s.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(s.Password)...)
+		}
+	}
+	// a keep alive of 0 turns it off, as messages may be minutes apart. A dropped connection shows up on the next publish.
+	header := append(mqttString("MQTT"), 4, flags, 0, 0)
+	err = s.writePacket(mqttConnect<<4, append(header, payload...))
+	if err == nil {
+		var body []byte
+		body, err = s.readPacket(mqttConnack)
+		if err == nil && (len(body) != 2 || body[1] != 0) {
+			err = fmt.Errorf("the broker refused the connection, return code %v", body)
+		}
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("can't connect to MQTT broker %s: %v", s.Addr, err)
+	}
+	logInfo("connected to MQTT broker", s.Addr)
+	return nil
+}
+
+// publish sends PUBLISH, and at QoS 1 waits for its PUBACK.
+func (s *mqttSink) publish(topic string, payload []byte) (err error) {
+	body := mqttString(topic)
+	if s.QoS > 0 {
+		s.packetID++
+		if s.packetID == 0 {
+			s.packetID = 1
+		}
+		body = append(body, byte(s.packetID>>8), byte(s.packetID))
+	}
+	err = s.writePacket(mqttPublish<<4|s.QoS<<1, append(body, payload...))
+	if err != nil || s.QoS == 0 {
+		return
+	}
+	for {
+		ack, err := s.readPacket(mqttPuback)
+		if err != nil {
+			return err
+		}
+		if len(ack) == 2 && binary.BigEndian.Uint16(ack) == s.packetID {
+			return nil
+		}
+	}
+}
+
+// close disconnects from the broker.
+func (s *mqttSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	s.writePacket(mqttDisconnect<<4, nil)
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *mqttSink) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	// the remaining length is a varint of 7 bits per byte.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	_, err := s.conn.Write(append(packet, body...))
+	return err
+}
+
+// readPacket reads packets until one of packetType, and returns its body. Others, which a broker may send at any time, are skipped.
+func (s *mqttSink) readPacket(packetType byte) (body []byte, err error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.Timeout))
+	for {
+		header, err := s.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length, multiplier := 0, 1
+		for i := 0; ; i++ {
+			b, err := s.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if i == 4 {
+				return nil, errors.New("bad packet length from the broker")
+			}
+			length += int(b&0x7f) * multiplier
+			multiplier *= 128
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		body = make([]byte, length)
+		_, err = io.ReadFull(s.r, body)
+		if err != nil {
+			return nil, err
+		}
+		if header>>4 == packetType {
+			return body, nil
+		}
+	}
+}
+
+// mqttString encodes str the MQTT way, prefixed by its length.
+func mqttString(str string) []byte {
+	return append([]byte{byte(len(str) >> 8), byte(len(str))}, str...)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// natsSink is a Publisher that publishes each message as JSON to a NATS server, a lighter alternative to Kafka
+// for small deployments. With JetStream set, each publish waits for the stream that holds the subject to store it,
+// otherwise it only waits for the server to have it. Like mqttSink, it connects again on the next publish after a failure.
+type natsSink struct {
+	// Addr is the host:port of the server, TLS is nil for a plain TCP connection.
+	Addr     string
+	TLS      *tls.Config
+	Token    string
+	Username string
+	Password string
+	// Subject is the subject to publish to, {devID}, {freq} and {origin} are replaced by those of the message.
+	Subject   string
+	JetStream bool
+	Timeout   time.Duration
+	mu        sync.Mutex
+	conn      net.Conn
+	r         *bufio.Reader
+	// inbox is the prefix of the subjects that replies come to, requests numbers them.
+	inbox    string
+	requests int
+}
+
+// natsAPIError is how JetStream reports a failed request.
+type natsAPIError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+// natsReply is the reply of JetStream to a publish or an API request, with only the fields used here.
+type natsReply struct {
+	Stream string        `json:"stream"`
+	Seq    uint64        `json:"seq"`
+	Error  *natsAPIError `json:"error"`
+}
+
+// newNATSSink makes the natsSink for serverURL, like nats://server:4222 or tls://server:4222. tlsConfig is only used with tls.
+func newNATSSink(serverURL string, tlsConfig *tls.Config) (s *natsSink, err error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad NATS_URL %q: %v", serverURL, err)
+	}
+	s = &natsSink{Addr: u.Host, Timeout: 30 * time.Second, Subject: "sdr.{devID}.{freq}"}
+	if u.Port() == "" {
+		s.Addr = net.JoinHostPort(u.Host, "4222")
+	}
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		s.TLS = tlsConfig
+		if s.TLS == nil {
+			s.TLS = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("bad NATS_URL %q, the scheme must be nats or tls", serverURL)
+	}
+	return
+}
+
+func (s *natsSink) publishAudio(audioMsg *audiolib.AudioMsg) (err error) {
+	payload, err := audioMsg.Encode()
+	if err != nil {
+		return
+	}
+	subject := s.subject(audioMsg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		err = s.connect()
+		if err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	var reply natsReply
+	if s.JetStream {
+		err = s.request(subject, payload, &reply)
+	} else {
+		// the PONG to a PING after the PUB shows that the server has the message, or it sends -ERR first.
+		_, err = fmt.Fprintf(s.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+		if err == nil {
+			_, _, err = s.read("PONG")
+		}
+	}
+	if err != nil {
+		// the connection can't be trusted after a failure, so the next publish makes a new one.
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("can't publish to NATS: %v", err)
+	}
+	fields := []interface{}{field("subject", subject), field("freq", audioMsg.Freq), field("bytes", len(payload)), field("latency", time.Since(start))}
+	if s.JetStream {
+		fields = append(fields, field("stream", reply.Stream), field("seq", reply.Seq))
+	}
+	logInfo(append([]interface{}{"> message sent to NATS"}, fields...)...)
+	return
+}
+
+// subject fills in Subject for audioMsg. The dots that separate subject tokens, and the wildcards, are replaced in the values.
+func (s *natsSink) subject(audioMsg *audiolib.AudioMsg) string {
+	token := strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+	return strings.NewReplacer("{devID}", token.Replace(audioMsg.DevID), "{freq}", strconv.FormatInt(audioMsg.Freq, 10), "{origin}", token.Replace(audioMsg.Origin)).Replace(s.Subject)
+}
+
+// dial connects to the server now, rather than on the first publish.
+func (s *natsSink) dial() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connect()
+}
+
+// ensureStream makes the JetStream stream called name for the subjects of Subject, unless it exists already.
+func (s *natsSink) ensureStream(name string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		err = s.connect()
+		if err != nil {
+			return
+		}
+	}
+	var reply natsReply
+	err = s.request("$JS.API.STREAM.INFO."+name, nil, &reply)
+	if err == nil {
+		logInfo("using JetStream stream", name)
+		return
+	}
+	if reply.Error == nil || reply.Error.Code != 404 {
+		return
+	}
+	// every token with a placeholder in it matches any value.
+	tokens := strings.Split(s.Subject, ".")
+	for i, token := range tokens {
+		if strings.Contains(token, "{") {
+			tokens[i] = "*"
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{"name": name, "subjects": []string{strings.Join(tokens, ".")}})
+	if err != nil {
+		return
+	}
+	err = s.request("$JS.API.STREAM.CREATE."+name, config, &reply)
+	if err != nil {
+		return fmt.Errorf("can't create JetStream stream %s: %v", name, err)
+	}
+	logInfo("created JetStream stream", name, "for", strings.Join(tokens, "."))
+	return
+}
+
+// connect dials the server and sends CONNECT, it expects s.mu to be held.
+func (s *natsSink) connect() (err error) {
+	conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return fmt.Errorf("can't connect to NATS server %s: %v", s.Addr, err)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	err = s.handshake()
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("can't connect to NATS server %s: %v", s.Addr, err)
+	}
+	logInfo("connected to NATS server", s.Addr)
+	return nil
+}
+
+// handshake reads the INFO of the server, starts TLS if it is used, and sends CONNECT.
+func (s *natsSink) handshake() (err error) {
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+	defer s.conn.SetDeadline(time.Time{})
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO from the server, got %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if err != nil {
+		return
+	}
+	if info.TLSRequired && s.TLS == nil {
+		return errors.New("the server requires TLS, use a tls:// NATS_URL")
+	}
+	if s.TLS != nil {
+		config := s.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(s.Addr)
+		}
+		conn := tls.Client(s.conn, config)
+		err = conn.Handshake()
+		if err != nil {
+			return
+		}
+		s.conn, s.r = conn, bufio.NewReader(conn)
+	}
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          "sdr2evtstreams",
+		"lang":          "go",
+		"version":       "1.0",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+		"tls_required":  s.TLS != nil,
+	}
+	if s.Token != "" {
+		options["auth_token"] = s.Token
+	}
+	if s.Username != "" {
+		options["user"], options["pass"] = s.Username, s.Password
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	id, err := newCaptureID()
+	if err != nil {
+		return
+	}
+	s.inbox = "_INBOX." + id
+	_, err = fmt.Fprintf(s.conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, s.inbox)
+	if err != nil {
+		return
+	}
+	_, _, err = s.read("PONG")
+	return
+}
+
+// request publishes payload to subject and decodes the reply into reply, it expects s.mu to be held and s.conn to be set.
+func (s *natsSink) request(subject string, payload []byte, reply *natsReply) (err error) {
+	s.requests++
+	inbox := s.inbox + "." + strconv.Itoa(s.requests)
+	_, err = fmt.Fprintf(s.conn, "PUB %s %s %d\r\n%s\r\n", subject, inbox, len(payload), payload)
+	if err != nil {
+		return
+	}
+	body, header, err := s.read(inbox)
+	if err != nil {
+		return
+	}
+	// a 503 status without a body is how the server says that nothing listens on subject, so no stream holds it.
+	if strings.HasPrefix(header, "NATS/1.0 503") {
+		return fmt.Errorf("no JetStream stream holds subject %s", subject)
+	}
+	*reply = natsReply{}
+	err = json.Unmarshal(body, reply)
+	if err != nil {
+		return fmt.Errorf("bad reply from JetStream: %v", err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("JetStream error %d: %s", reply.Error.Code, reply.Error.Description)
+	}
+	return
+}
+
+// read reads from the server until a PONG, if want is PONG, or else a message to the subject want, and returns
+// the payload and headers of the message. It answers the PINGs of the server on the way.
+func (s *natsSink) read(want string) (payload []byte, header string, err error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.Timeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, "", err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "PING":
+			_, err = io.WriteString(s.conn, "PONG\r\n")
+			if err != nil {
+				return nil, "", err
+			}
+		case "PONG":
+			if want == "PONG" {
+				return nil, "", nil
+			}
+		case "-ERR":
+			return nil, "", fmt.Errorf("the server replied %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>, HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>.
+			headerLen := 0
+			if args[0] == "HMSG" && len(args) >= 5 {
+				headerLen, err = strconv.Atoi(args[len(args)-2])
+				if err != nil {
+					return nil, "", fmt.Errorf("bad message from the server: %q", strings.TrimSpace(line))
+				}
+			}
+			total, err := strconv.Atoi(args[len(args)-1])
+			if err != nil || len(args) < 4 || headerLen > total {
+				return nil, "", fmt.Errorf("bad message from the server: %q", strings.TrimSpace(line))
+			}
+			body := make([]byte, total+2)
+			_, err = io.ReadFull(s.r, body)
+			if err != nil {
+				return nil, "", err
+			}
+			if args[1] == want {
+				return body[headerLen:total], string(body[:headerLen]), nil
+			}
+		}
+	}
+}
+
+// close disconnects from the server.
+func (s *natsSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// noiseGateFrameSeconds is how long the frames are whose loudness noiseGate compares, about a syllable.
+const noiseGateFrameSeconds = 0.02
+
+// noiseGate skips scoring chunks of audio that are obviously neither speech nor music, so that a small device
+// doesn't spend the time on them. A chunk is silent if its power is under MinPowerDBFS, as when a station
+// goes off the air. It is static if the loudness of its frames varies by less than MinRangeDB, from the
+// quietest tenth to the loudest tenth of them, as the hiss of a channel without a station hardly varies at
+// all while speech pauses between words.
+type noiseGate struct {
+	MinPowerDBFS float32
+	MinRangeDB   float32
+}
+
+// check returns why raw audio should be skipped, or "" if it should be scored. A nil noiseGate skips nothing.
+func (g *noiseGate) check(audio []byte) (reason string) {
+	if g == nil {
+		return ""
+	}
+	power := audioPowerDBFS(audio)
+	if power < g.MinPowerDBFS {
+		return fmt.Sprintf("silent at %.1f dBFS", power)
+	}
+	frames := frameLoudness(decodeSamples(audio), int(math.Round(noiseGateFrameSeconds*float64(audioSampleRate))))
+	if len(frames) < 10 {
+		return ""
+	}
+	sort.Float64s(frames)
+	spread := frames[len(frames)*9/10] - frames[len(frames)/10]
+	if spread < float64(g.MinRangeDB) {
+		return fmt.Sprintf("static, its loudness only varies by %.1f dB", spread)
+	}
+	return ""
+}
+
+// frameLoudness returns the power in dB of each whole frame of size samples, down to minPowerDBFS for silence.
+func frameLoudness(samples []float64, size int) (loudness []float64) {
+	if size < 1 {
+		return nil
+	}
+	for start := 0; start+size <= len(samples); start += size {
+		var sum float64
+		for _, sample := range samples[start : start+size] {
+			sum += sample * sample
+		}
+		db := float64(minPowerDBFS)
+		if sum > 0 {
+			db = math.Max(db, 10*math.Log10(sum/float64(size)))
+		}
+		loudness = append(loudness, db)
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testAudio encodes seconds of samples made by sample, which is given the time of each, as raw audio.
+func testAudio(seconds float64, sample func(t float64) float64) []byte {
+	samples := make([]float64, int(seconds*float64(audioSampleRate)))
+	for i := range samples {
+		samples[i] = sample(float64(i) / float64(audioSampleRate))
+	}
+	audio := make([]byte, len(samples)*audioBytesPerSample)
+	encodeSamples(samples, audio)
+	return audio
+}
+
+func TestNoiseGate(t *testing.T) {
+	g := &noiseGate{MinPowerDBFS: -50, MinRangeDB: 6}
+	noise := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name  string
+		audio []byte
+		want  string
+	}{
+		{"silence", testAudio(2, func(t float64) float64 { return 0 }), "silent"},
+		{"quiet", testAudio(2, func(t float64) float64 { return 0.001 * math.Sin(2*math.Pi*440*t) }), "silent"},
+		{"hiss", testAudio(2, func(t float64) float64 { return 0.3 * (noise.Float64()*2 - 1) }), "static"},
+		// words half a second long with pauses between them.
+		{"speech", testAudio(2, func(t float64) float64 {
+			level := 0.5
+			if int(t*2)%2 == 1 {
+				level = 0.005
+			}
+			return level * math.Sin(2*math.Pi*300*t)
+		}), ""},
+		{"too short to tell", testAudio(0.1, func(t float64) float64 { return 0.3 * (noise.Float64()*2 - 1) }), ""},
+	}
+	for _, test := range tests {
+		reason := g.check(test.audio)
+		if test.want == "" && reason != "" || !strings.HasPrefix(reason, test.want) {
+			t.Errorf("%s: noise gate says %q, want %q", test.name, reason, test.want)
+		}
+	}
+	var nilGate *noiseGate
+	if reason := nilGate.check(tests[0].audio); reason != "" {
+		t.Errorf("nil noise gate says %q, want it to skip nothing", reason)
+	}
+}
+
+func TestFrameLoudness(t *testing.T) {
+	loudness := frameLoudness([]float64{1, -1, 0.5, -0.5, 0, 0, 1}, 2)
+	want := []float64{0, 10 * math.Log10(0.25), minPowerDBFS}
+	if len(loudness) != len(want) {
+		t.Fatalf("loudness of 3 whole frames is %v, want %v", loudness, want)
+	}
+	for i := range want {
+		if math.Abs(loudness[i]-want[i]) > 1e-9 {
+			t.Errorf("loudness is %v, want %v", loudness, want)
+			break
+		}
+	}
+	if loudness := frameLoudness([]float64{1, 1}, 0); loudness != nil {
+		t.Errorf("loudness of frames of 0 samples is %v, want nil", loudness)
+	}
+}
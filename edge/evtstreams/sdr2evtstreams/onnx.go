@@ -0,0 +1,164 @@
+//go:build onnx
+// +build onnx
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+func init() {
+	inferenceBackends["onnx"] = func(path string, opts modelOptions) (Inference, error) {
+		m, err := newONNXModel(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+var (
+	// onnxInit loads the ONNX Runtime library once, from ONNXRUNTIME_LIB if it is set.
+	onnxInit    sync.Once
+	onnxInitErr error
+)
+
+func initONNXRuntime() error {
+	onnxInit.Do(func() {
+		if lib := configEnv("ONNXRUNTIME_LIB"); lib != "" {
+			ort.SetSharedLibraryPath(lib)
+		}
+		onnxInitErr = ort.InitializeEnvironment()
+	})
+	return onnxInitErr
+}
+
+// onnxModel is an ONNX model run by ONNX Runtime, so that models trained outside of TensorFlow can be used
+// as they are. It takes the audio as float samples in input InputOp, and the goodness is read from output OutputOp,
+// the first input and output of the model if they aren't set.
+type onnxModel struct {
+	Opts modelOptions
+	// mu guards the session, whose input and output tensors are reused by each inference.
+	mu      sync.Mutex
+	session *ort.AdvancedSession
+	input   *ort.Tensor[float32]
+	output  *ort.Tensor[float32]
+}
+
+// newONNXModel loads the .onnx model at path, with tensors shaped for audio of opts.InputSeconds.
+func newONNXModel(path string, opts modelOptions) (m *onnxModel, err error) {
+	if len(opts.ExtraOutputs) > 0 {
+		return nil, errors.New("MODEL_EXTRA_OUTPUTS is only supported with MODEL_BACKEND=tensorflow")
+	}
+	err = initONNXRuntime()
+	if err != nil {
+		return nil, fmt.Errorf("can't load ONNX Runtime, check ONNXRUNTIME_LIB: %v", err)
+	}
+	inputs, outputs, err := ort.GetInputOutputInfo(path)
+	if err != nil {
+		return
+	}
+	input, err := onnxInfo(inputs, opts.InputOp, "input", "MODEL_INPUT_OP")
+	if err != nil {
+		return
+	}
+	output, err := onnxInfo(outputs, opts.OutputOp, "output", "MODEL_OUTPUT_OP")
+	if err != nil {
+		return
+	}
+	// the audio fills the input, with any dimension the model leaves open, like the batch, sized to fit it.
+	samples := modelAudioFormat.Bytes(opts.inputSeconds()) / modelAudioFormat.Encoding.Width()
+	m = &onnxModel{Opts: opts}
+	defer func() {
+		if err != nil {
+			m.close()
+			m = nil
+		}
+	}()
+	m.input, err = ort.NewEmptyTensor[float32](onnxShape(input.Dimensions, int64(samples)))
+	if err != nil {
+		return
+	}
+	m.output, err = ort.NewEmptyTensor[float32](onnxShape(output.Dimensions, 0))
+	if err != nil {
+		return
+	}
+	m.session, err = ort.NewAdvancedSession(path, []string{input.Name}, []string{output.Name},
+		[]ort.Value{m.input}, []ort.Value{m.output}, nil)
+	return
+}
+
+// onnxInfo returns the input or output of the model named name, or the first one if name is "".
+func onnxInfo(infos []ort.InputOutputInfo, name, kind, setting string) (info ort.InputOutputInfo, err error) {
+	var names []string
+	for _, candidate := range infos {
+		if name == "" || candidate.Name == name {
+			if candidate.DataType != ort.TensorElementDataTypeFloat {
+				return candidate, fmt.Errorf("the %s %s of the ONNX model must be float, got %v", kind, candidate.Name, candidate.DataType)
+			}
+			return candidate, nil
+		}
+		names = append(names, candidate.Name)
+	}
+	if name == "" {
+		return info, fmt.Errorf("the ONNX model has no %s", kind)
+	}
+	return info, fmt.Errorf("%s %s not found, set %s to one of: %s", kind, name, setting, strings.Join(names, ", "))
+}
+
+// onnxShape resolves the dimensions that dims leaves open, which are -1. The last open one holds whatever of
+// size the known ones don't, and the others, like the batch, are 1.
+func onnxShape(dims ort.Shape, size int64) ort.Shape {
+	shape := make(ort.Shape, len(dims))
+	last := -1
+	known := int64(1)
+	for i, dim := range dims {
+		shape[i] = dim
+		if dim < 0 {
+			shape[i] = 1
+			last = i
+		} else {
+			known *= dim
+		}
+	}
+	if last >= 0 && size > known {
+		shape[last] = size / known
+	}
+	return shape
+}
+
+// score feeds audio to the model as float samples, padded with silence or truncated to fit its input.
+func (m *onnxModel) score(audio []byte) (s audioScore, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := m.input.GetData()
+	copy(data, audioSamples(audio, len(data)))
+	err = m.session.Run()
+	if err != nil {
+		return
+	}
+	// the output is overwritten by the next inference.
+	values := append([]float32(nil), m.output.GetData()...)
+	return outputScore(values, m.Opts)
+}
+
+// close destroys the session and its tensors, waiting for any inference in progress.
+func (m *onnxModel) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.session != nil {
+		m.session.Destroy()
+	}
+	if m.input != nil {
+		m.input.Destroy()
+	}
+	if m.output != nil {
+		m.output.Destroy()
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !onnx
+// +build !onnx
+
+package main
+
+import "errors"
+
+func init() {
+	inferenceBackends["onnx"] = func(path string, opts modelOptions) (Inference, error) {
+		return nil, errors.New("MODEL_BACKEND=onnx needs the service to be built with -tags onnx, which loads the ONNX Runtime library")
+	}
+}
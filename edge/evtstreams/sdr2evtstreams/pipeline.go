@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// chunk is a capture of audio from Station on its way through the pipeline, Score is set once it has been scored.
+// Info is what the RDS of Station says, if it is looked up, and SNR its signal to noise ratio, if it is measured.
+// Gated is set if the noise gate skipped scoring it, so that it scores 0 and isn't published.
+// Windows are its scored windows if it is scored in sliding windows, then Score is that of the best of them.
+type chunk struct {
+	Station int64
+	Audio   []byte
+	Score   audioScore
+	Info    rtlsdr.StationInfo
+	SNR     float32
+	Gated   bool
+	Windows []audioWindow
+}
+
+// pipelineConfig sizes the pipeline that a pass of the main loop runs through.
+type pipelineConfig struct {
+	// Captures is how many stations are captured from at once, less than 1 is 1.
+	Captures int
+	// Workers is how many chunks are scored at once, less than 1 is 1.
+	Workers int
+	// Queue is how many chunks can wait between two stages, so that a slow stage holds up the ones before it.
+	Queue int
+}
+
+// runPipeline samples stations through three stages that run at the same time: capture, which runs in Captures goroutines,
+// score, which runs in Workers goroutines, and handle, which runs in the calling goroutine so that it alone can use
+// the state of the loop. capture returns nil and score returns false to drop a chunk, after releasing its audio.
+// New captures stop once ctx is done, the chunks already captured go on through the pipeline.
+// runPipeline returns once every chunk has been handled.
+func runPipeline(ctx context.Context, stations []int64, p pipelineConfig, capture func(station int64) *chunk, score func(c *chunk) bool, handle func(c *chunk)) {
+	captures := p.Captures
+	if captures < 1 {
+		captures = 1
+	}
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := p.Queue
+	if queue < 0 {
+		queue = 0
+	}
+	toCapture := make(chan int64)
+	captured := make(chan *chunk, queue)
+	scored := make(chan *chunk, queue)
+	go func() {
+		defer close(toCapture)
+		for _, station := range stations {
+			if ctx.Err() != nil {
+				return
+			}
+			toCapture <- station
+		}
+	}()
+	var capturers sync.WaitGroup
+	capturers.Add(captures)
+	for i := 0; i < captures; i++ {
+		go func() {
+			defer capturers.Done()
+			for station := range toCapture {
+				if c := capture(station); c != nil {
+					captured <- c
+				}
+			}
+		}()
+	}
+	go func() {
+		capturers.Wait()
+		close(captured)
+	}()
+	var scorers sync.WaitGroup
+	scorers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer scorers.Done()
+			for c := range captured {
+				if score(c) {
+					scored <- c
+				}
+			}
+		}()
+	}
+	go func() {
+		scorers.Wait()
+		close(scored)
+	}()
+	for c := range scored {
+		handle(c)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// newPublishers makes the Publisher for PUBLISH_BACKEND, which is a comma-separated list of backends,
+// like evtstreams,file, to publish every message to all of them. closers are what has to be closed on shutdown.
+func newPublishers(backends string) (publisher Publisher, closers []func() error, err error) {
+	fanout := &fanoutPublisher{}
+	for _, backend := range strings.Split(backends, ",") {
+		backend = strings.TrimSpace(backend)
+		p, closer, err := newPublisher(backend)
+		if err != nil {
+			return nil, closers, err
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		if backend == "" {
+			backend = "evtstreams"
+		}
+		fanout.Names = append(fanout.Names, backend)
+		fanout.Publishers = append(fanout.Publishers, p)
+	}
+	if len(fanout.Publishers) == 1 {
+		return fanout.Publishers[0], closers, nil
+	}
+	logInfo("publishing every message to", strings.Join(fanout.Names, ", "))
+	return fanout, closers, nil
+}
+
+// publishesTo reports whether the PUBLISH_BACKEND list backends has backend in it, evtstreams if it is empty.
+func publishesTo(backends, backend string) bool {
+	for _, b := range strings.Split(backends, ",") {
+		b = strings.TrimSpace(b)
+		if b == backend || b == "" && backend == "evtstreams" {
+			return true
+		}
+	}
+	return false
+}
+
+// newPublisher makes the Publisher for one backend, and if it has to be closed on shutdown its closer.
+func newPublisher(backend string) (publisher Publisher, closer func() error, err error) {
+	switch backend {
+	case "", "evtstreams":
+		topic := getEnv("EVTSTREAMS_TOPIC")
+		logInfo("using topic", topic)
+		conn, err := connect(topic, getEnvDuration("EVTSTREAMS_CONNECT_TIMEOUT", 2*time.Minute))
+		if err != nil {
+			return nil, nil, err
+		}
+		logInfo("connected to evtstreams")
+		switch conn.Format = configEnv("EVTSTREAMS_MESSAGE_FORMAT"); conn.Format {
+		case "", "json", "protobuf":
+		case "avro":
+			conn.Registry, err = newSchemaRegistry()
+			if err == nil {
+				// registering the schema now stops the service at startup if the registry can't be used.
+				_, err = conn.Registry.schemaID(topic + "-value")
+			}
+			if err != nil {
+				conn.close()
+				return nil, nil, err
+			}
+		default:
+			conn.close()
+			return nil, nil, fmt.Errorf("unknown EVTSTREAMS_MESSAGE_FORMAT %q, must be json, avro or protobuf", conn.Format)
+		}
+		if getEnvBool("EVTSTREAMS_STARTUP_TEST", false) {
+			// a throwaway topic keeps the test message away from the consumers of the real one.
+			testTopic := configEnv("SELFTEST_TOPIC")
+			if testTopic == "" {
+				testTopic = topic
+			}
+			err = conn.sendTestMessage(testTopic)
+			if err != nil {
+				conn.close()
+				return nil, nil, err
+			}
+		}
+		conn.MaxFragmentBytes = getEnvInt("EVTSTREAMS_MAX_FRAGMENT_BYTES", 0)
+		conn.MaxMessageBytes = getEnvInt("EVTSTREAMS_MAX_MESSAGE_BYTES", 1000000)
+		switch conn.KeyBy = configEnv("EVTSTREAMS_KEY"); conn.KeyBy {
+		case "none":
+			conn.KeyBy = ""
+		case "", "station", "device":
+		default:
+			conn.close()
+			return nil, nil, fmt.Errorf("unknown EVTSTREAMS_KEY %q, must be none, station or device", conn.KeyBy)
+		}
+		conn.Headers, err = parseMessageHeaders(configEnv("EVTSTREAMS_HEADERS"))
+		if err != nil {
+			conn.close()
+			return nil, nil, err
+		}
+		conn.Routes, err = parseTopicRoutes(configEnv("EVTSTREAMS_TOPIC_ROUTES"))
+		if err == nil && getEnvBool("EVTSTREAMS_CHECK_TOPIC", true) {
+			for _, route := range conn.Routes {
+				err = checkTopic(route.Topic)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			conn.close()
+			return nil, nil, err
+		}
+		for _, route := range conn.Routes {
+			logInfo("routing the messages that score at least", route.Threshold, "to topic", route.Topic)
+		}
+		conn.Org = configEnv("HZN_ORG_ID")
+		if conn.Org == "" {
+			conn.Org = configEnv("HZN_ORGANIZATION")
+		}
+		conn.ModelVersion = configEnv("MODEL_VERSION")
+		conn.Signer, err = newMessageSigner()
+		if err != nil {
+			conn.close()
+			return nil, nil, err
+		}
+		if getEnvBool("EVTSTREAMS_ASYNC", false) {
+			err = conn.startAsync(getEnvInt("EVTSTREAMS_FLUSH_MESSAGES", 100), getEnvDuration("EVTSTREAMS_FLUSH_FREQUENCY", time.Second))
+			if err != nil {
+				conn.close()
+				return nil, nil, err
+			}
+		}
+		return conn, conn.close, nil
+	case "mock":
+		if getEnvBool("DRY_RUN", false) {
+			logWarn("not sending anything to evtstreams because DRY_RUN=true, the messages are only logged")
+		} else {
+			logWarn("not sending anything to evtstreams because PUBLISH_BACKEND=mock")
+		}
+		return &mockPublisher{}, nil, nil
+	case "file":
+		dir := getEnv("FILE_SINK_DIR")
+		sink, err := newFileSink(dir, int64(getEnvInt("FILE_SINK_SEGMENT_BYTES", 100<<20)), getEnvInt("FILE_SINK_MAX_SEGMENTS", 10))
+		if err != nil {
+			return nil, nil, err
+		}
+		logInfo("writing the messages to", dir)
+		return sink, nil, nil
+	case "mqtt":
+		tlsConfig, err := newTLSConfig(configEnv("MQTT_CA_FILE"), configEnv("MQTT_CERT_FILE"), configEnv("MQTT_KEY_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		sink, err := newMQTTSink(getEnv("MQTT_BROKER_URL"), tlsConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink.ClientID = configEnv("MQTT_CLIENT_ID")
+		if sink.ClientID == "" {
+			sink.ClientID = "sdr2evtstreams-" + configEnv("HZN_DEVICE_ID")
+		}
+		sink.Username = configEnv("MQTT_USERNAME")
+		if configEnv("MQTT_PASSWORD") != "" || configEnv("MQTT_PASSWORD_FILE") != "" {
+			sink.Password, err = getSecret("MQTT_PASSWORD")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if topic := configEnv("MQTT_TOPIC"); topic != "" {
+			sink.Topic = topic
+		}
+		switch qos := getEnvInt("MQTT_QOS", 1); qos {
+		case 0, 1:
+			sink.QoS = byte(qos)
+		default:
+			return nil, nil, fmt.Errorf("MQTT_QOS must be 0 or 1, got %d", qos)
+		}
+		sink.Timeout = getEnvDuration("MQTT_TIMEOUT", sink.Timeout)
+		err = sink.dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.close, nil
+	case "http":
+		tlsConfig, err := newTLSConfig(configEnv("HTTP_SINK_CA_FILE"), configEnv("HTTP_SINK_CERT_FILE"), configEnv("HTTP_SINK_KEY_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+			Timeout:   getEnvDuration("HTTP_SINK_TIMEOUT", 30*time.Second),
+		}
+		sink, err := newHTTPSink(getEnv("HTTP_SINK_URL"), configEnv("HTTP_SINK_FORMAT"), getEnvInt("HTTP_SINK_CHUNK_BYTES", 1<<20), client)
+		if err != nil {
+			return nil, nil, err
+		}
+		if configEnv("HTTP_SINK_TOKEN") != "" || configEnv("HTTP_SINK_TOKEN_FILE") != "" {
+			sink.Token, err = getSecret("HTTP_SINK_TOKEN")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		sink.Signer, err = newMessageSigner()
+		if err != nil {
+			return nil, nil, err
+		}
+		logInfo("sending the messages as", sink.Format, "to", sink.URL)
+		return sink, nil, nil
+	case "nats":
+		tlsConfig, err := newTLSConfig(configEnv("NATS_CA_FILE"), configEnv("NATS_CERT_FILE"), configEnv("NATS_KEY_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		sink, err := newNATSSink(getEnv("NATS_URL"), tlsConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		if configEnv("NATS_TOKEN") != "" || configEnv("NATS_TOKEN_FILE") != "" {
+			sink.Token, err = getSecret("NATS_TOKEN")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		sink.Username = configEnv("NATS_USERNAME")
+		if configEnv("NATS_PASSWORD") != "" || configEnv("NATS_PASSWORD_FILE") != "" {
+			sink.Password, err = getSecret("NATS_PASSWORD")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if subject := configEnv("NATS_SUBJECT"); subject != "" {
+			sink.Subject = subject
+		}
+		stream := configEnv("NATS_STREAM")
+		sink.JetStream = getEnvBool("NATS_JETSTREAM", false) || stream != ""
+		sink.Timeout = getEnvDuration("NATS_TIMEOUT", sink.Timeout)
+		err = sink.dial()
+		if err == nil && stream != "" {
+			err = sink.ensureStream(stream)
+		}
+		if err != nil {
+			sink.close()
+			return nil, nil, err
+		}
+		return sink, sink.close, nil
+	case "grpc":
+		url := getEnv("GRPC_URL")
+		if !strings.HasPrefix(url, "https://") {
+			return nil, nil, fmt.Errorf("bad GRPC_URL %q, it must be an https URL", url)
+		}
+		if configEnv("GRPC_CERT_FILE") == "" {
+			return nil, nil, fmt.Errorf("GRPC_CERT_FILE and GRPC_KEY_FILE must be set, PUBLISH_BACKEND=grpc uses mTLS")
+		}
+		tlsConfig, err := newTLSConfig(configEnv("GRPC_CA_FILE"), configEnv("GRPC_CERT_FILE"), configEnv("GRPC_KEY_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		sink := &grpcSink{
+			URL:     url,
+			Client:  &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}},
+			Timeout: getEnvDuration("GRPC_TIMEOUT", 30*time.Second),
+		}
+		if configEnv("GRPC_TOKEN") != "" || configEnv("GRPC_TOKEN_FILE") != "" {
+			sink.Token, err = getSecret("GRPC_TOKEN")
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		logInfo("streaming the messages to", url+grpcStreamAudio)
+		return sink, sink.close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown backend %q in PUBLISH_BACKEND, must be evtstreams, mqtt, nats, grpc, http, file or mock", backend)
+}
+
+// fanoutPublisher publishes every message to all of its Publishers. When some of them fail, publishing the same
+// message again, as a retry does, only publishes it to those that failed, so the others don't get it twice.
+type fanoutPublisher struct {
+	Names      []string
+	Publishers []Publisher
+	mu         sync.Mutex
+	last       *audiolib.AudioMsg
+	failed     map[int]bool
+}
+
+func (f *fanoutPublisher) publishAudio(audioMsg *audiolib.AudioMsg) error {
+	return f.publish(audioMsg, func(p Publisher) error {
+		return p.publishAudio(audioMsg)
+	})
+}
+
+func (f *fanoutPublisher) publishRawAudio(audioMsg *audiolib.AudioMsg, raw []byte) error {
+	return f.publish(audioMsg, func(p Publisher) error {
+		return publishMessage(p, audioMsg, raw)
+	})
+}
+
+func (f *fanoutPublisher) publish(audioMsg *audiolib.AudioMsg, publishTo func(p Publisher) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	retry := audioMsg == f.last
+	if !retry {
+		f.last = audioMsg
+		f.failed = map[int]bool{}
+	}
+	var errs []string
+	for i, p := range f.Publishers {
+		if retry && !f.failed[i] {
+			continue
+		}
+		err := publishTo(p)
+		f.failed[i] = err != nil
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", f.Names[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("publishing failed to %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
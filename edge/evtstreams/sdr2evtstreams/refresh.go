@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// StationRefresher decides when the main loop scans for stations again.
+type StationRefresher interface {
+	// due reports whether the stations should be scanned for at now.
+	due(now time.Time) bool
+	// refreshed records a scan at now that found stations, of which changed were new or missing from the last scan.
+	refreshed(now time.Time, found, changed int)
+	// observe records the value that a chunk of audio scored.
+	observe(val float32)
+}
+
+// newStationRefresher makes the StationRefresher called name, fixed or adaptive.
+func newStationRefresher(name string, interval, min, max time.Duration, fewStations int, qualityDrop float32) (StationRefresher, error) {
+	switch name {
+	case "", "fixed":
+		return &intervalRefresher{Interval: interval}, nil
+	case "adaptive":
+		if min <= 0 || min > interval || interval > max {
+			return nil, fmt.Errorf("STATIONS_REFRESH_MIN, STATIONS_REFRESH_INTERVAL and STATIONS_REFRESH_MAX must be over 0 and in that order")
+		}
+		return &adaptiveRefresher{Base: interval, Min: min, Max: max, FewStations: fewStations, QualityDrop: qualityDrop, interval: interval}, nil
+	}
+	return nil, fmt.Errorf("unknown STATIONS_REFRESH %q, must be fixed or adaptive", name)
+}
+
+// stationRefresherFromEnv makes the StationRefresher of STATIONS_REFRESH and the settings that tune it.
+func stationRefresherFromEnv() (StationRefresher, error) {
+	return newStationRefresher(configEnv("STATIONS_REFRESH"),
+		getEnvDuration("STATIONS_REFRESH_INTERVAL", 5*time.Minute),
+		getEnvDuration("STATIONS_REFRESH_MIN", time.Minute),
+		getEnvDuration("STATIONS_REFRESH_MAX", 30*time.Minute),
+		getEnvInt("STATIONS_REFRESH_FEW", 3),
+		float32(getEnvFloat("STATIONS_REFRESH_DROP", 0.3)))
+}
+
+// intervalRefresher scans every Interval.
+type intervalRefresher struct {
+	Interval time.Duration
+	last     time.Time
+}
+
+func (r *intervalRefresher) due(now time.Time) bool {
+	return now.Sub(r.last) > r.Interval
+}
+
+func (r *intervalRefresher) refreshed(now time.Time, found, changed int) {
+	r.last = now
+}
+
+func (r *intervalRefresher) observe(val float32) {}
+
+// adaptiveRefresher scans again after Min when fewer than FewStations were found, and doubles the wait up to Max
+// for as long as the scans find the same stations. When they find different ones, it goes back to waiting Base.
+// It also scans early when the mean value since the last scan has dropped by over QualityDrop from the mean
+// between the two scans before, as the reception may have changed.
+type adaptiveRefresher struct {
+	Base        time.Duration
+	Min         time.Duration
+	Max         time.Duration
+	FewStations int
+	QualityDrop float32
+	interval    time.Duration
+	last        time.Time
+	// the values scored since the last scan, and the mean of those before it.
+	sum, lastMean float32
+	n, lastN      int
+}
+
+// minQualitySamples is how many chunks have to be scored since the last scan before a drop in their mean counts.
+const minQualitySamples = 10
+
+func (r *adaptiveRefresher) due(now time.Time) bool {
+	if now.Sub(r.last) > r.interval {
+		return true
+	}
+	if r.QualityDrop <= 0 || r.n < minQualitySamples || r.lastN < minQualitySamples {
+		return false
+	}
+	if mean := r.sum / float32(r.n); mean < r.lastMean*(1-r.QualityDrop) {
+		logInfo("the mean value dropped from", r.lastMean, "to", mean, "since the last scan, scanning again")
+		return true
+	}
+	return false
+}
+
+func (r *adaptiveRefresher) refreshed(now time.Time, found, changed int) {
+	r.last = now
+	switch {
+	case found < r.FewStations:
+		r.interval = r.Min
+	case changed > 0:
+		r.interval = r.Base
+	default:
+		r.interval *= 2
+		if r.interval > r.Max {
+			r.interval = r.Max
+		}
+	}
+	if r.n > 0 {
+		r.lastMean, r.lastN = r.sum/float32(r.n), r.n
+	}
+	r.sum, r.n = 0, 0
+	logDebug("scanning for stations again in", r.interval)
+}
+
+func (r *adaptiveRefresher) observe(val float32) {
+	r.sum += val
+	r.n++
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// reloadingModel is a Scorer that reloads its model when the model at Path changes,
+// so that a retrained model can be pushed to a node without restarting it.
+type reloadingModel struct {
+	Path string
+	Opts modelOptions
+	// Backend loads the model, like the one that MODEL_BACKEND names in inferenceBackends.
+	Backend inferenceBackend
+	Warmup  bool
+	mu      sync.RWMutex
+	current Inference
+	modTime time.Time
+}
+
+// newReloadingModel loads the model at path with backend, failing like backend if it can't.
+func newReloadingModel(path string, opts modelOptions, backend inferenceBackend, warmup bool) (r *reloadingModel, err error) {
+	r = &reloadingModel{Path: path, Opts: opts, Backend: backend, Warmup: warmup}
+	r.modTime, err = modelModTime(path)
+	if err != nil {
+		return
+	}
+	r.current, err = r.load()
+	return
+}
+
+func (r *reloadingModel) score(audio []byte) (s audioScore, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.score(audio)
+}
+
+// close closes the current model, waiting for any inference in progress.
+func (r *reloadingModel) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current.close()
+}
+
+// load loads and checks the model at r.Path, and warms it up if asked to.
+func (r *reloadingModel) load() (m Inference, err error) {
+	m, err = r.Backend(r.Path, r.Opts)
+	if err != nil {
+		return
+	}
+	logInfo("model loaded from", r.Path)
+	if r.Warmup {
+		elapsed, err := warmup(m, r.Opts.inputSeconds())
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		logInfo("model warmed up in", elapsed)
+	}
+	return
+}
+
+// watch checks every interval whether the model has changed, and if it has swaps in the new one.
+// A changed model is only loaded once it has stayed the same for a whole interval, so that a model that is
+// still being copied in isn't loaded half written. A new model that fails to load or to pass the OP check
+// is logged, and the old one is kept. Scoring goes on with the old model while the new one loads.
+func (r *reloadingModel) watch(interval time.Duration) {
+	var changed time.Time
+	for range time.Tick(interval) {
+		modTime, err := modelModTime(r.Path)
+		if err != nil {
+			logWarn("can't check the model for changes:", err)
+			continue
+		}
+		if !modTime.After(r.modTime) {
+			continue
+		}
+		if !modTime.Equal(changed) {
+			changed = modTime
+			logInfo("model at", r.Path, "changed, reloading it once it stops changing")
+			continue
+		}
+		// the new model is only looked at once per change, whether or not it loads.
+		r.modTime = modTime
+		logInfo("model at", r.Path, "changed, reloading it")
+		m, err := r.load()
+		metrics.modelReloaded(err)
+		if err != nil {
+			logError("not using the changed model, keeping the old one:", err)
+			continue
+		}
+		r.mu.Lock()
+		old := r.current
+		r.current = m
+		r.mu.Unlock()
+		old.close()
+		logInfo("now using the reloaded model")
+	}
+}
+
+// modelModTime is when the model at path last changed. For a SavedModel directory that is when any file in it
+// last changed, as the directory itself may not change when a file in it, like one of its variables, is replaced.
+func modelModTime(path string) (modTime time.Time, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return info.ModTime(), nil
+	}
+	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return
+}
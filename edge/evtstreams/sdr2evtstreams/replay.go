@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// replay scores every WAV or raw audio file in dir, in place of audio from the SDR,
+// and logs the score of each. If publish is set, files that score over the threshold are published just like SDR audio.
+func replay(dir string, publish bool, cfg loopConfig, deps loopDeps) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	scored := 0
+	var total float32
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		audio, err := readAudioFile(path)
+		if err != nil {
+			logWarn("skipping", path, ":", err)
+			continue
+		}
+		if expected := expectedAudioBytes(captureSeconds); len(audio) != expected {
+			if !cfg.FitAudioLength {
+				logWarn("skipping", path, ":", len(audio), "bytes of audio, expected", expected)
+				continue
+			}
+			logDebug(path, "is", len(audio), "bytes of audio, expected", expected)
+			audio = fitAudio(audio, expected)
+		}
+		s, err := deps.Scorer.score(scoredAudio(cfg, audio))
+		if err != nil {
+			logWarn("can't score", path, ":", err)
+			continue
+		}
+		val := s.Value
+		scored++
+		total += val
+		logInfo(path, "value:", val)
+		if publish && cfg.overThreshold(s, deps.now()) {
+			err = publishMessage(deps.Publisher, newAudioMsg(cfg, audio, 0, s, "replay:"+file.Name(), locationData{}, deps.now()), audio)
+			if err != nil {
+				logError(err)
+			}
+		}
+	}
+	if scored > 0 {
+		logInfo("replayed", scored, "files from", dir, "mean value:", total/float32(scored))
+	}
+	return nil
+}
+
+// readAudioFile reads the raw audio from path. WAV files have their headers stripped, anything else is taken to be raw audio.
+func readAudioFile(path string) (audio []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if strings.ToLower(filepath.Ext(path)) != ".wav" {
+		return data, nil
+	}
+	return wavData(data)
+}
+
+// wavData returns the samples in the data chunk of a WAV file.
+func wavData(wav []byte) (data []byte, err error) {
+	if len(wav) < 12 || !bytes.Equal(wav[0:4], []byte("RIFF")) || !bytes.Equal(wav[8:12], []byte("WAVE")) {
+		err = errors.New("not a WAV file")
+		return
+	}
+	// after the RIFF header come chunks, each an ID and a little endian length.
+	for pos := 12; pos+8 <= len(wav); {
+		id := string(wav[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(wav[pos+4 : pos+8]))
+		pos += 8
+		if pos+size > len(wav) {
+			size = len(wav) - pos
+		}
+		if id == "data" {
+			return wav[pos : pos+size], nil
+		}
+		// chunks are padded to an even length.
+		pos += size + size%2
+	}
+	err = errors.New("WAV file has no data chunk")
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy is how calls to the SDR and to evtstreams are retried.
+type retryPolicy struct {
+	// MaxRetries is how many times a failed call is retried, 0 tries it once.
+	MaxRetries int
+	// Backoff is the wait before the first retry, it doubles for each retry after that up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction by which each wait is randomly made longer or shorter, so that nodes don't retry in step.
+	Jitter float64
+}
+
+// wait returns how long to wait before retry number attempt, counting from 0.
+func (p retryPolicy) wait(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 0; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait + time.Duration(float64(wait)*p.Jitter*(rand.Float64()*2-1))
+}
+
+// do calls fn until it succeeds, it has been retried MaxRetries times, or ctx is done, and returns its last error.
+// A panic in fn, which is how rtlsdrclientlib fails, is returned as an error.
+func (p retryPolicy) do(ctx context.Context, what string, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = callRecovering(fn)
+		if err == nil || attempt >= p.MaxRetries {
+			return
+		}
+		wait := p.wait(attempt)
+		logWarn(what, "failed:", err, "retrying in", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func callRecovering(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fn()
+}
+
+// failureWindow tracks how long something has been failing, so that the service only gives up on a sustained failure.
+type failureWindow struct {
+	Window time.Duration
+	since  time.Time
+}
+
+// failed records a failure at now, and reports whether it has been failing for Window or longer.
+func (w *failureWindow) failed(now time.Time) bool {
+	if w.since.IsZero() {
+		w.since = now
+	}
+	return now.Sub(w.since) >= w.Window
+}
+
+func (w *failureWindow) succeeded() {
+	w.since = time.Time{}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// topicRoute sends the messages whose value is at least Threshold to Topic.
+type topicRoute struct {
+	Threshold float32
+	Topic     string
+}
+
+// parseTopicRoutes parses a comma-separated list of routes like 0.9=sdr-speech,0.6=sdr-review, highest threshold first.
+func parseTopicRoutes(spec string) (routes []topicRoute, err error) {
+	if spec == "" {
+		return
+	}
+	for _, routeSpec := range strings.Split(spec, ",") {
+		routeSpec = strings.TrimSpace(routeSpec)
+		eq := strings.Index(routeSpec, "=")
+		if eq < 0 || strings.TrimSpace(routeSpec[eq+1:]) == "" {
+			return nil, fmt.Errorf("bad route %q in EVTSTREAMS_TOPIC_ROUTES, must be like 0.9=sdr-speech", routeSpec)
+		}
+		threshold, parseErr := strconv.ParseFloat(strings.TrimSpace(routeSpec[:eq]), 32)
+		if parseErr != nil || threshold < 0 || threshold > 1 {
+			return nil, fmt.Errorf("bad threshold in route %q in EVTSTREAMS_TOPIC_ROUTES, must be between 0 and 1", routeSpec)
+		}
+		routes = append(routes, topicRoute{Threshold: float32(threshold), Topic: strings.TrimSpace(routeSpec[eq+1:])})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Threshold > routes[j].Threshold })
+	return
+}
+
+// topicFor is the topic of the first route that audioMsg scores high enough for, or conn.Topic if there is none.
+func (conn *evtstreamsConn) topicFor(audioMsg *audiolib.AudioMsg) string {
+	for _, route := range conn.Routes {
+		if audioMsg.ExpectedValue >= route.Threshold {
+			return route.Topic
+		}
+	}
+	return conn.Topic
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// configureSASL sets the SASL mechanism of EVTSTREAMS_SASL_MECHANISM and its credentials on config.
+// PLAIN and SCRAM authenticate with EVTSTREAMS_SASL_USER and EVTSTREAMS_API_KEY, OAUTHBEARER with a token
+// that is fetched from EVTSTREAMS_OAUTH_TOKEN_URL, and fetched again before it expires.
+func configureSASL(config *sarama.Config) (err error) {
+	mechanism := configEnv("EVTSTREAMS_SASL_MECHANISM")
+	if mechanism == "" {
+		mechanism = sarama.SASLTypePlaintext
+	}
+	switch mechanism {
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Password, err = getSecret("EVTSTREAMS_API_KEY")
+		if err != nil {
+			return
+		}
+		config.Net.SASL.User = configEnv("EVTSTREAMS_SASL_USER")
+		if config.Net.SASL.User == "" {
+			config.Net.SASL.User = "token"
+		}
+		switch mechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{Hash: sha256.New} }
+		case sarama.SASLTypeSCRAMSHA512:
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{Hash: sha512.New} }
+		}
+	case sarama.SASLTypeOAuth:
+		config.Net.SASL.TokenProvider, err = newOAuthTokenProvider()
+		if err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unknown EVTSTREAMS_SASL_MECHANISM %q, must be PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or OAUTHBEARER", mechanism)
+	}
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	return
+}
+
+// scramClient is the client side of SCRAM, RFC 5802, with Hash as the hash function.
+type scramClient struct {
+	Hash     func() hash.Hash
+	user     string
+	password string
+	authzID  string
+	step     int
+	nonce    string
+	// clientFirstBare is the first message without its header, and serverSignature what the server has to prove.
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	c.user, c.password, c.authzID, c.step = userName, password, authzID, 0
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (response string, err error) {
+	c.step++
+	switch c.step {
+	case 1:
+		nonce := make([]byte, 24)
+		_, err = cryptorand.Read(nonce)
+		if err != nil {
+			return
+		}
+		c.nonce = base64.RawStdEncoding.EncodeToString(nonce)
+		c.clientFirstBare = "n=" + scramName(c.user) + ",r=" + c.nonce
+		return c.gs2Header() + c.clientFirstBare, nil
+	case 2:
+		return c.clientFinal(challenge)
+	case 3:
+		attrs := scramAttributes(challenge)
+		if e, ok := attrs["e"]; ok {
+			return "", fmt.Errorf("SCRAM authentication failed: %s", e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(signature, c.serverSignature) {
+			return "", errors.New("SCRAM authentication failed: the server signature doesn't match")
+		}
+		return "", nil
+	}
+	return "", errors.New("SCRAM authentication is already done")
+}
+
+func (c *scramClient) Done() bool {
+	return c.step >= 3
+}
+
+// gs2Header is the header of the first message, no channel binding and the authorization identity if there is one.
+func (c *scramClient) gs2Header() string {
+	if c.authzID == "" {
+		return "n,,"
+	}
+	return "n,a=" + scramName(c.authzID) + ","
+}
+
+// clientFinal answers the first message of the server, with the proof that the client knows the password.
+func (c *scramClient) clientFinal(serverFirst string) (response string, err error) {
+	attrs := scramAttributes(serverFirst)
+	if !strings.HasPrefix(attrs["r"], c.nonce) {
+		return "", errors.New("SCRAM authentication failed: the server nonce doesn't start with the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return "", fmt.Errorf("SCRAM authentication failed: bad salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("SCRAM authentication failed: bad iteration count %q", attrs["i"])
+	}
+	saltedPassword := pbkdf2(c.Hash, []byte(c.password), salt, iterations)
+	clientKey := c.hmac(saltedPassword, "Client Key")
+	storedKey := c.Hash()
+	storedKey.Write(clientKey)
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(c.gs2Header())) + ",r=" + attrs["r"]
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	proof := c.hmac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSignature = c.hmac(c.hmac(saltedPassword, "Server Key"), authMessage)
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (c *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(c.Hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramName escapes name for a SCRAM message.
+func scramName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// scramAttributes splits a SCRAM message like r=abc,s=def into its attributes.
+func scramAttributes(message string) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// pbkdf2 is PBKDF2 with the HMAC of h, for a key as long as h.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// oauthTokenProvider fetches the OAUTHBEARER token from TokenURL with Form, and keeps it until shortly before it expires.
+type oauthTokenProvider struct {
+	TokenURL string
+	Form     url.Values
+	Client   *http.Client
+	mu       sync.Mutex
+	token    string
+	expires  time.Time
+}
+
+// oauthRefreshMargin is how long before it expires a token is fetched again.
+const oauthRefreshMargin = time.Minute
+
+// newOAuthTokenProvider makes the oauthTokenProvider for the EVTSTREAMS_OAUTH_* settings. With a client ID it
+// uses the client credentials grant, without one it trades EVTSTREAMS_API_KEY for a token, as IBM Cloud IAM does.
+func newOAuthTokenProvider() (p *oauthTokenProvider, err error) {
+	p = &oauthTokenProvider{TokenURL: configEnv("EVTSTREAMS_OAUTH_TOKEN_URL"), Form: url.Values{}, Client: &http.Client{Timeout: 30 * time.Second}}
+	if p.TokenURL == "" {
+		p.TokenURL = "https://iam.cloud.ibm.com/identity/token"
+	}
+	if clientID := configEnv("EVTSTREAMS_OAUTH_CLIENT_ID"); clientID != "" {
+		secret, err := getSecret("EVTSTREAMS_OAUTH_CLIENT_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		p.Form.Set("grant_type", "client_credentials")
+		p.Form.Set("client_id", clientID)
+		p.Form.Set("client_secret", secret)
+	} else {
+		apiKey, err := getSecret("EVTSTREAMS_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		p.Form.Set("grant_type", "urn:ibm:params:oauth:grant-type:apikey")
+		p.Form.Set("apikey", apiKey)
+	}
+	if scope := configEnv("EVTSTREAMS_OAUTH_SCOPE"); scope != "" {
+		p.Form.Set("scope", scope)
+	}
+	return
+}
+
+func (p *oauthTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Until(p.expires) > oauthRefreshMargin {
+		return &sarama.AccessToken{Token: p.token}, nil
+	}
+	resp, err := p.Client.PostForm(p.TokenURL, p.Form)
+	if err != nil {
+		return nil, fmt.Errorf("can't get an OAuth token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't get an OAuth token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't get an OAuth token from %s: %s", p.TokenURL, resp.Status)
+	}
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		// ExpiresIn is in seconds.
+		ExpiresIn int64 `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &reply)
+	if err != nil || reply.AccessToken == "" {
+		return nil, fmt.Errorf("no access_token from %s", p.TokenURL)
+	}
+	addSecret(reply.AccessToken)
+	p.token, p.expires = reply.AccessToken, time.Now().Add(time.Duration(reply.ExpiresIn)*time.Second)
+	logDebug("got an OAuth token that expires at", p.expires)
+	return &sarama.AccessToken{Token: p.token}, nil
+}
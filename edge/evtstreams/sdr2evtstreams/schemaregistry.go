@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// schemaRegistry registers audiolib.AvroSchema with a Confluent compatible schema registry at URL, once for
+// each subject, and keeps the IDs it gets back to frame the Avro messages with.
+type schemaRegistry struct {
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+	mu       sync.Mutex
+	ids      map[string]uint32
+}
+
+// newSchemaRegistry makes the schemaRegistry of EVTSTREAMS_SCHEMA_REGISTRY_URL, with the basic auth
+// credentials of EVTSTREAMS_SCHEMA_REGISTRY_USER and EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD if they are set.
+func newSchemaRegistry() (r *schemaRegistry, err error) {
+	r = &schemaRegistry{URL: strings.TrimSuffix(getEnv("EVTSTREAMS_SCHEMA_REGISTRY_URL"), "/"), User: configEnv("EVTSTREAMS_SCHEMA_REGISTRY_USER"), Client: &http.Client{Timeout: 30 * time.Second}, ids: map[string]uint32{}}
+	if configEnv("EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD") != "" || configEnv("EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD_FILE") != "" {
+		r.Password, err = getSecret("EVTSTREAMS_SCHEMA_REGISTRY_PASSWORD")
+	}
+	return
+}
+
+// schemaID registers the schema under subject if it isn't yet, and returns its ID. Registering a schema that
+// the subject already has just returns its ID, so this is safe to do on every start.
+func (r *schemaRegistry) schemaID(subject string) (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[subject]; ok {
+		return id, nil
+	}
+	body, err := json.Marshal(map[string]string{"schema": audiolib.AvroSchema})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", r.URL+"/subjects/"+subject+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.User != "" || r.Password != "" {
+		req.SetBasicAuth(r.User, r.Password)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("can't register the schema of subject %s: %v", subject, err)
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("can't register the schema of subject %s: %v", subject, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("can't register the schema of subject %s: %s %s", subject, resp.Status, bytes.TrimSpace(reply))
+	}
+	var registered struct {
+		ID uint32 `json:"id"`
+	}
+	err = json.Unmarshal(reply, &registered)
+	if err != nil {
+		return 0, fmt.Errorf("bad reply from the schema registry for subject %s: %v", subject, err)
+	}
+	logInfo("registered the Avro schema", field("subject", subject), field("schemaID", registered.ID))
+	r.ids[subject] = registered.ID
+	return registered.ID, nil
+}
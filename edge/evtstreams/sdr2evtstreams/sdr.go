@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// SDR is the source of stations and audio for the main loop. Its calls give up once ctx is done.
+type SDR interface {
+	// GetFreqs returns the frequencies of the strong stations that can currently be received.
+	GetFreqs(ctx context.Context) (freqs rtlsdr.Freqs, err error)
+	// GetAudio returns a chunk of raw audio from the station at freq.
+	GetAudio(ctx context.Context, freq int64) (audio []byte, err error)
+}
+
+// newSDR returns the SDR backend selected by name.
+// "rtlsdr" talks to the sdr service at hostname, "usb" to dongle number device attached to this device,
+// and "mock" needs no hardware at all.
+func newSDR(backend, hostname string, device int) (sdr SDR, err error) {
+	switch backend {
+	case "", "rtlsdr":
+		sdr = &rtlsdrClient{Hostname: hostname}
+	case "usb":
+		sdr, err = newUSBSDR(device)
+	case "mock":
+		sdr = newMockSDR()
+	default:
+		err = fmt.Errorf("unknown SDR_BACKEND %q, must be rtlsdr, usb or mock", backend)
+	}
+	return
+}
+
+// sdrDevice is one of the SDRs that the service captures from, each in its own loop.
+type sdrDevice struct {
+	// Name is the SDR in SDR_DEVICES, or "" when SDR_DEVICES isn't set and there is only the one SDR.
+	Name string
+	SDR  SDR
+}
+
+// newSDRDevices returns the SDRs in devices, the comma-separated SDR_DEVICES: the addresses of sdr services,
+// or the numbers of the dongles with the usb backend. If devices is empty, there is only the SDR at hostname,
+// or dongle number device.
+func newSDRDevices(backend, devices, hostname string, device int) (sdrs []sdrDevice, err error) {
+	if strings.TrimSpace(devices) == "" {
+		sdr, err := newSDR(backend, hostname, device)
+		if err != nil {
+			return nil, err
+		}
+		return []sdrDevice{{SDR: sdr}}, nil
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(devices, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s is in SDR_DEVICES twice", name)
+		}
+		seen[name] = true
+		index := device
+		if backend == "usb" {
+			index, err = strconv.Atoi(name)
+			if err != nil {
+				return nil, fmt.Errorf("bad dongle number %q in SDR_DEVICES, it must be like 0 or 1", name)
+			}
+		}
+		var sdr SDR
+		sdr, err = newSDR(backend, name, index)
+		if err != nil {
+			return nil, fmt.Errorf("SDR %s: %v", name, err)
+		}
+		sdrs = append(sdrs, sdrDevice{Name: name, SDR: sdr})
+	}
+	return
+}
+
+// scanRangeFromEnv returns the band of SCAN_START, SCAN_STOP, SCAN_STEP and SCAN_SQUELCH, with those that
+// aren't set from the FM band. It returns nil if none are set, so each SDR scans its own default band.
+func scanRangeFromEnv() (*rtlsdr.ScanRange, error) {
+	if configEnv("SCAN_START") == "" && configEnv("SCAN_STOP") == "" && configEnv("SCAN_STEP") == "" && configEnv("SCAN_SQUELCH") == "" {
+		return nil, nil
+	}
+	scan := rtlsdr.FMBand
+	scan.Start = int64(getEnvInt("SCAN_START", int(scan.Start)))
+	scan.Stop = int64(getEnvInt("SCAN_STOP", int(scan.Stop)))
+	scan.Step = int64(getEnvInt("SCAN_STEP", int(scan.Step)))
+	scan.Squelch = float32(getEnvFloat("SCAN_SQUELCH", float64(scan.Squelch)))
+	return &scan, scan.Check()
+}
+
+// iqOptionsFromEnv returns how IQ samples are captured with CAPTURE_MODE=iq, from IQ_SAMPLE_RATE, IQ_GAIN and
+// IQ_SECONDS. It returns nil if CAPTURE_MODE is audio, so that audio is captured instead.
+func iqOptionsFromEnv() (*rtlsdr.IQOptions, error) {
+	switch configEnv("CAPTURE_MODE") {
+	case "", "audio":
+		return nil, nil
+	case "iq":
+	default:
+		return nil, fmt.Errorf("unknown CAPTURE_MODE %q, must be audio or iq", configEnv("CAPTURE_MODE"))
+	}
+	opts := rtlsdr.DefaultIQ
+	opts.SampleRate = getEnvInt("IQ_SAMPLE_RATE", opts.SampleRate)
+	opts.Gain = float32(getEnvFloat("IQ_GAIN", float64(opts.Gain)))
+	opts.Seconds = getEnvFloat("IQ_SECONDS", opts.Seconds)
+	return &opts, opts.Check()
+}
+
+// iqSDR is an SDR that can also capture the raw IQ samples of a station, for CAPTURE_MODE=iq.
+type iqSDR interface {
+	// GetIQ returns the IQ samples centered on freq, captured with opts, each an unsigned byte of I then one of Q.
+	GetIQ(ctx context.Context, freq int64, opts rtlsdr.IQOptions) (iq []byte, err error)
+}
+
+// sdrMaxCaptures is how many stations sdr can capture from at once, 1 unless it has a maxCaptures method that says otherwise.
+func sdrMaxCaptures(sdr SDR) int {
+	if c, ok := sdr.(interface{ maxCaptures() int }); ok {
+		return c.maxCaptures()
+	}
+	return 1
+}
+
+// rtlsdrClient is the SDR backed by the sdr service.
+type rtlsdrClient struct {
+	Hostname string
+	// FreqsTimeout and AudioTimeout are how long a scan for stations and a capture of audio or RDS may take
+	// before they are given up on, so that a hung sdr service doesn't stall the loop. 0 waits for ever.
+	FreqsTimeout time.Duration
+	AudioTimeout time.Duration
+	// MaxCaptures is how many stations the sdr service can capture from at once, less than 1 is 1.
+	// A service with a single dongle tunes it to one station at a time.
+	MaxCaptures int
+	// Stream streams the audio from the sdr service as it is captured, instead of having it buffer the whole
+	// chunk until the capture is done, which the sdr service can't do on a small device.
+	Stream bool
+	// Scan is the band that the sdr service scans for stations, nil is the FM band.
+	Scan *rtlsdr.ScanRange
+	// Mode is how the sdr service demodulates the audio, "" is wfm.
+	Mode rtlsdr.Mode
+}
+
+func (c *rtlsdrClient) maxCaptures() int {
+	if c.MaxCaptures < 1 {
+		return 1
+	}
+	return c.MaxCaptures
+}
+
+// probeTimeout is how long probe waits for the sdr service to accept a connection.
+const probeTimeout = 10 * time.Second
+
+// probe checks that Hostname is a host name or IP address with an optional port, rtlsdr.DefaultPort if it has none,
+// and that the sdr service is listening on it, so that a bad RTLSDR_ADDR fails at startup rather than as a panic deep in the loop.
+func (c *rtlsdrClient) probe() error {
+	if c.Hostname == "" {
+		return fmt.Errorf("the sdr service address is empty")
+	}
+	host, port, err := net.SplitHostPort(c.Hostname)
+	if err != nil {
+		// a bare host, or IPv6 address, has no port.
+		host, port = strings.Trim(c.Hostname, "[]"), rtlsdr.DefaultPort
+	}
+	portNum, err := strconv.Atoi(port)
+	if host == "" || strings.ContainsAny(host, "/@ ") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) || err != nil || portNum < 1 || portNum > 65535 {
+		return fmt.Errorf("bad sdr service address %q, it must be a host name or IP address without a scheme, with an optional port", c.Hostname)
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), probeTimeout)
+	if err != nil {
+		return fmt.Errorf("can't reach the sdr service at %s, check RTLSDR_ADDR: %v", c.Hostname, err)
+	}
+	return conn.Close()
+}
+
+// withTimeout is ctx with a deadline timeout from now, unless timeout is 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *rtlsdrClient) GetFreqs(ctx context.Context) (rtlsdr.Freqs, error) {
+	ctx, cancel := withTimeout(ctx, c.FreqsTimeout)
+	defer cancel()
+	if c.Scan != nil {
+		return rtlsdr.GetFreqsRangeContext(ctx, c.Hostname, *c.Scan)
+	}
+	return rtlsdr.GetFreqsContext(ctx, c.Hostname)
+}
+
+// GetAudio reads the audio into a buffer from audioBuffers, which the caller should release once it is done with it.
+func (c *rtlsdrClient) GetAudio(ctx context.Context, freq int64) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, c.AudioTimeout)
+	defer cancel()
+	// /audio only captures chunks of audioChunkSeconds, captures of any other length are streamed.
+	if !c.Stream && captureSeconds == audioChunkSeconds {
+		return rtlsdr.GetAudioIntoModeContext(ctx, c.Hostname, freq, c.Mode, getAudioBuffer())
+	}
+	stream, err := rtlsdr.StreamAudioMode(ctx, c.Hostname, freq, captureSeconds, c.Mode)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	audio := getAudioBuffer()[:expectedAudioBytes(captureSeconds)]
+	_, err = io.ReadFull(stream, audio)
+	if err != nil {
+		releaseAudioBuffer(audio)
+		return nil, err
+	}
+	return audio, nil
+}
+
+func (c *rtlsdrClient) GetIQ(ctx context.Context, freq int64, opts rtlsdr.IQOptions) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, c.AudioTimeout)
+	defer cancel()
+	return rtlsdr.GetIQContext(ctx, c.Hostname, freq, opts, nil)
+}
+
+// GetSNR measures the SNR of the station at freq in a channel as wide as those of Mode.
+func (c *rtlsdrClient) GetSNR(ctx context.Context, freq int64) (rtlsdr.SignalPower, error) {
+	ctx, cancel := withTimeout(ctx, c.AudioTimeout)
+	defer cancel()
+	return rtlsdr.GetSNRContext(ctx, c.Hostname, freq, c.Mode.Bandwidth())
+}
+
+func (c *rtlsdrClient) GetStationInfo(ctx context.Context, freq int64) (rtlsdr.StationInfo, error) {
+	ctx, cancel := withTimeout(ctx, c.AudioTimeout)
+	defer cancel()
+	return rtlsdr.GetStationInfoContext(ctx, c.Hostname, freq)
+}
+
+// mockSDR is an SDR that makes up its stations and audio, for development without hardware.
+type mockSDR struct {
+	Stations []int64
+	// CaptureTime is how long GetAudio takes, so the loop doesn't spin. The real sdr service takes 30 seconds.
+	CaptureTime time.Duration
+}
+
+func newMockSDR() *mockSDR {
+	return &mockSDR{
+		Stations:    []int64{88500000, 91100000, 95300000, 101100000, 104700000},
+		CaptureTime: time.Second,
+	}
+}
+
+// maxCaptures is every station, as the mock makes up its audio.
+func (s *mockSDR) maxCaptures() int {
+	return len(s.Stations)
+}
+
+func (s *mockSDR) GetFreqs(ctx context.Context) (freqs rtlsdr.Freqs, err error) {
+	freqs.Origin = "mock"
+	freqs.Freqs = append(freqs.Freqs, s.Stations...)
+	return
+}
+
+// GetStationInfo makes up the RDS of a station, a call sign like WMCX and a name like "101.1 FM".
+func (s *mockSDR) GetStationInfo(ctx context.Context, freq int64) (info rtlsdr.StationInfo, err error) {
+	info.Origin = "mock"
+	info.Freq = freq
+	info.PI = fmt.Sprintf("%04X", freq/100000)
+	info.CallSign = "WMC" + string(rune('A'+freq/100000%26))
+	info.PS = fmt.Sprintf("%.1f FM", float64(freq)/1e6)
+	return
+}
+
+// GetSNR makes up the SNR of a station, from 5 to 32 dB.
+func (s *mockSDR) GetSNR(ctx context.Context, freq int64) (power rtlsdr.SignalPower, err error) {
+	power.Origin = "mock"
+	power.Freq = freq
+	power.NoiseDB = -30
+	power.SNR = 5 + float32(freq/100000%10)*3
+	power.PowerDB = power.NoiseDB + power.SNR
+	return
+}
+
+// GetAudio returns a chunk of 16 bit little endian mono audio at audioSampleRate.
+// Each station plays its own tone mixed with some noise.
+func (s *mockSDR) GetAudio(ctx context.Context, freq int64) (audio []byte, err error) {
+	// map the station onto an audible tone between 200 and 1200 Hz.
+	tone := 200 + float64(freq/100000%10)*100
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.CaptureTime):
+	}
+	audio = getAudioBuffer()[:expectedAudioBytes(captureSeconds)]
+	for i := 0; i < len(audio)/2; i++ {
+		sample := 0.5*math.Sin(2*math.Pi*tone*float64(i)/float64(audioSampleRate)) + 0.1*(rand.Float64()*2-1)
+		binary.LittleEndian.PutUint16(audio[i*2:], uint16(int16(sample*math.MaxInt16)))
+	}
+	return
+}
+
+// GetIQ makes up the IQ samples of a station, its carrier a little off center in some noise.
+func (s *mockSDR) GetIQ(ctx context.Context, freq int64, opts rtlsdr.IQOptions) (iq []byte, err error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.CaptureTime):
+	}
+	// the carrier is between 1 and 10 kHz above the center.
+	offset := float64(1+freq/100000%10) * 1000
+	iq = make([]byte, opts.Samples()*2)
+	for i := 0; i < len(iq)/2; i++ {
+		phase := 2 * math.Pi * offset * float64(i) / float64(opts.SampleRate)
+		iq[i*2] = byte(127.5 + 60*math.Cos(phase) + 10*(rand.Float64()*2-1))
+		iq[i*2+1] = byte(127.5 + 60*math.Sin(phase) + 10*(rand.Float64()*2-1))
+	}
+	return
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProbeTakesAPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := (&rtlsdrClient{Hostname: l.Addr().String()}).probe(); err != nil {
+		t.Errorf("probe of %s: %v", l.Addr(), err)
+	}
+	for _, addr := range []string{"http://sdr", "sdr:port", "sdr:0", "user@sdr", "sdr/audio", "sdr:99999"} {
+		if err := (&rtlsdrClient{Hostname: addr}).probe(); err == nil {
+			t.Errorf("probe of bad address %q returned no error", addr)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// redactedSecret replaces a secret wherever it would be logged.
+const redactedSecret = "[REDACTED]"
+
+// secrets are the values that are redacted from every log line.
+var secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// addSecret makes sure that value is never logged.
+func addSecret(value string) {
+	if value == "" {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.values = append(secrets.values, value)
+}
+
+// redact replaces every secret in line.
+func redact(line string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for _, secret := range secrets.values {
+		line = strings.Replace(line, secret, redactedSecret, -1)
+	}
+	return line
+}
+
+// getSecret returns the secret in the config var name, or if name_FILE is set the contents of that file,
+// like a Docker or Horizon secret mounted in the container. Either way the secret is redacted from the logs.
+func getSecret(name string) (secret string, err error) {
+	if path := configEnv(name + "_FILE"); path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("can't read %s_FILE: %v", name, err)
+		}
+		secret = strings.TrimSpace(string(contents))
+		if secret == "" {
+			return "", fmt.Errorf("%s_FILE %s is empty", name, path)
+		}
+	} else if secret = configEnv(name); secret == "" {
+		return "", fmt.Errorf("%s or %s_FILE must be set", name, name)
+	}
+	addSecret(secret)
+	return
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// StationSelector picks the stations to sample on each pass, and learns from the values their audio scores.
+type StationSelector interface {
+	selectStations(stationGoodness map[int64]float32) []int64
+	observe(station int64, val float32)
+}
+
+// newStationSelector makes the StationSelector called name, which is one of goodness, epsilon-greedy, ucb1 or thompson.
+// perPass is how many stations the selectors other than goodness pick on each pass.
+func newStationSelector(name string, epsilon, floor float32, perPass int, ucbC float64) (StationSelector, error) {
+	if perPass < 1 {
+		return nil, fmt.Errorf("STATIONS_PER_PASS must be at least 1")
+	}
+	switch name {
+	case "", "goodness":
+		return &goodnessSelector{Epsilon: epsilon}, nil
+	case "epsilon-greedy":
+		return &epsilonGreedySelector{Epsilon: epsilon, Floor: floor, PerPass: perPass}, nil
+	case "ucb1":
+		return &ucbSelector{C: ucbC, PerPass: perPass, stats: map[int64]*armStats{}}, nil
+	case "thompson":
+		return &thompsonSelector{PerPass: perPass, stats: map[int64]*armStats{}}, nil
+	}
+	return nil, fmt.Errorf("unknown STATION_SELECTOR %q, must be one of goodness, epsilon-greedy, ucb1 or thompson", name)
+}
+
+// stationSelectorFromEnv makes the StationSelector of STATION_SELECTOR, with EXPLORE_EPSILON, EXPLORE_FLOOR,
+// STATIONS_PER_PASS and UCB_C.
+func stationSelectorFromEnv() (StationSelector, error) {
+	epsilon := float32(getEnvFloat("EXPLORE_EPSILON", 0))
+	if epsilon < 0 || epsilon > 1 {
+		return nil, fmt.Errorf("EXPLORE_EPSILON must be between 0 and 1")
+	}
+	floor := float32(getEnvFloat("EXPLORE_FLOOR", 0.05))
+	if floor < 0 || floor > 1 {
+		return nil, fmt.Errorf("EXPLORE_FLOOR must be between 0 and 1")
+	}
+	return newStationSelector(configEnv("STATION_SELECTOR"), epsilon, floor, getEnvInt("STATIONS_PER_PASS", 1), getEnvFloat("UCB_C", 1))
+}
+
+// goodnessSelector picks each station with a chance of its goodness, and with a chance of Epsilon one more station
+// picked at random from the others, so that every station is re-evaluated now and then.
+type goodnessSelector struct {
+	Epsilon float32
+	// Rand is what the picks are drawn from, nil is the global source.
+	Rand *rand.Rand
+}
+
+func (s *goodnessSelector) selectStations(stationGoodness map[int64]float32) (stations []int64) {
+	var unpicked []int64
+	for station, goodness := range stationGoodness {
+		// if our goodness is less then a random number between 0 and 1.
+		if s.float32() < goodness {
+			stations = append(stations, station)
+		} else {
+			unpicked = append(unpicked, station)
+		}
+	}
+	if len(unpicked) == 0 || s.Epsilon <= 0 || s.float32() >= s.Epsilon {
+		return
+	}
+	explore := unpicked[s.intn(len(unpicked))]
+	logDebug("exploring station", field("freq", explore))
+	return append(stations, explore)
+}
+
+func (s *goodnessSelector) float32() float32 {
+	if s.Rand == nil {
+		return rand.Float32()
+	}
+	return s.Rand.Float32()
+}
+
+func (s *goodnessSelector) intn(n int) int {
+	if s.Rand == nil {
+		return rand.Intn(n)
+	}
+	return s.Rand.Intn(n)
+}
+
+func (s *goodnessSelector) observe(station int64, val float32) {}
+
+// epsilonGreedySelector picks the PerPass stations with the highest goodness, each of which is swapped for a random
+// station with a chance of Epsilon. Every station that isn't picked still is with a chance of Floor, so none starves.
+type epsilonGreedySelector struct {
+	Epsilon float32
+	Floor   float32
+	PerPass int
+}
+
+func (s *epsilonGreedySelector) selectStations(stationGoodness map[int64]float32) (stations []int64) {
+	scores := make(map[int64]float64, len(stationGoodness))
+	for station, goodness := range stationGoodness {
+		scores[station] = float64(goodness)
+	}
+	best := topStations(scores, s.PerPass)
+	picked := map[int64]bool{}
+	for _, station := range best {
+		if rand.Float32() < s.Epsilon {
+			station = randomStation(stationGoodness, picked)
+			logDebug("exploring station", field("freq", station))
+		}
+		picked[station] = true
+	}
+	for station := range stationGoodness {
+		if !picked[station] && rand.Float32() < s.Floor {
+			picked[station] = true
+		}
+	}
+	for station := range picked {
+		stations = append(stations, station)
+	}
+	return
+}
+
+func (s *epsilonGreedySelector) observe(station int64, val float32) {}
+
+// armStats are what the ucb1 and thompson selectors know about a station.
+type armStats struct {
+	Samples int
+	// Sum is the sum of the values the station scored.
+	Sum float64
+}
+
+func observeArm(stats map[int64]*armStats, station int64, val float32) {
+	arm, ok := stats[station]
+	if !ok {
+		arm = &armStats{}
+		stats[station] = arm
+	}
+	arm.Samples++
+	arm.Sum += float64(val)
+}
+
+// ucbSelector picks the PerPass stations with the highest upper confidence bound of their mean value,
+// mean + C*sqrt(2*ln(samples of all stations)/samples of the station), so stations that were rarely sampled are tried.
+// Stations that were never sampled are picked first.
+type ucbSelector struct {
+	C       float64
+	PerPass int
+	stats   map[int64]*armStats
+	total   int
+}
+
+func (s *ucbSelector) selectStations(stationGoodness map[int64]float32) []int64 {
+	scores := make(map[int64]float64, len(stationGoodness))
+	for station := range stationGoodness {
+		arm, ok := s.stats[station]
+		if !ok || arm.Samples == 0 {
+			scores[station] = math.Inf(1)
+			continue
+		}
+		mean := arm.Sum / float64(arm.Samples)
+		scores[station] = mean + s.C*math.Sqrt(2*math.Log(float64(s.total))/float64(arm.Samples))
+	}
+	return topStations(scores, s.PerPass)
+}
+
+func (s *ucbSelector) observe(station int64, val float32) {
+	observeArm(s.stats, station, val)
+	s.total++
+}
+
+// thompsonSelector keeps a beta distribution of the value of each station, counting a value of v as v of a success
+// and 1-v of a failure, and picks the PerPass stations whose draw from it is highest.
+type thompsonSelector struct {
+	PerPass int
+	stats   map[int64]*armStats
+}
+
+func (s *thompsonSelector) selectStations(stationGoodness map[int64]float32) []int64 {
+	scores := make(map[int64]float64, len(stationGoodness))
+	for station := range stationGoodness {
+		alpha, beta := 1.0, 1.0
+		if arm, ok := s.stats[station]; ok {
+			alpha += arm.Sum
+			beta += float64(arm.Samples) - arm.Sum
+		}
+		scores[station] = betaSample(alpha, beta)
+	}
+	return topStations(scores, s.PerPass)
+}
+
+func (s *thompsonSelector) observe(station int64, val float32) {
+	// values outside [0,1] would make the distribution invalid.
+	if val < 0 {
+		val = 0
+	} else if val > 1 {
+		val = 1
+	}
+	observeArm(s.stats, station, val)
+}
+
+// topStations returns the n stations with the highest scores, ties are broken at random.
+func topStations(scores map[int64]float64, n int) []int64 {
+	stations := make([]int64, 0, len(scores))
+	for station := range scores {
+		stations = append(stations, station)
+	}
+	rand.Shuffle(len(stations), func(i, j int) {
+		stations[i], stations[j] = stations[j], stations[i]
+	})
+	sort.SliceStable(stations, func(i, j int) bool {
+		return scores[stations[i]] > scores[stations[j]]
+	})
+	if len(stations) > n {
+		stations = stations[:n]
+	}
+	return stations
+}
+
+// randomStation returns a station that is not in picked, or one that is if all of them are.
+func randomStation(stationGoodness map[int64]float32, picked map[int64]bool) int64 {
+	var candidates, all []int64
+	for station := range stationGoodness {
+		all = append(all, station)
+		if !picked[station] {
+			candidates = append(candidates, station)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// betaSample draws from a beta distribution, as the ratio of two gamma draws.
+func betaSample(alpha, beta float64) float64 {
+	x := gammaSample(alpha)
+	return x / (x + gammaSample(beta))
+}
+
+// gammaSample draws from a gamma distribution with the given shape and a scale of 1, with the method of Marsaglia and Tsang.
+func gammaSample(shape float64) float64 {
+	if shape < 1 {
+		return gammaSample(shape+1) * math.Pow(rand.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
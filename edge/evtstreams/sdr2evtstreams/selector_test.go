@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testGoodness has stations that are always picked, with a goodness of 1, and stations that never are, with 0.
+var testGoodness = map[int64]float32{
+	88500000:  1,
+	91100000:  1,
+	95300000:  0,
+	101100000: 0,
+	104700000: 0,
+}
+
+func TestGoodnessSelectorWithoutEpsilonDoesNotExplore(t *testing.T) {
+	s := &goodnessSelector{Epsilon: 0, Rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < 100; i++ {
+		stations := s.selectStations(testGoodness)
+		if len(stations) != 2 {
+			t.Fatalf("picked %v, want only the 2 stations with a goodness of 1", stations)
+		}
+		for _, station := range stations {
+			if testGoodness[station] != 1 {
+				t.Fatalf("picked %v, want only the 2 stations with a goodness of 1", stations)
+			}
+		}
+	}
+}
+
+func TestGoodnessSelectorWithEpsilonOneExploresOneMore(t *testing.T) {
+	s := &goodnessSelector{Epsilon: 1, Rand: rand.New(rand.NewSource(1))}
+	explored := map[int64]bool{}
+	for i := 0; i < 100; i++ {
+		stations := s.selectStations(testGoodness)
+		if len(stations) != 3 {
+			t.Fatalf("picked %v, want the 2 stations with a goodness of 1 and one more", stations)
+		}
+		seen := map[int64]bool{}
+		for _, station := range stations {
+			if seen[station] {
+				t.Fatalf("picked %d twice in %v", station, stations)
+			}
+			seen[station] = true
+			if testGoodness[station] == 0 {
+				explored[station] = true
+			}
+		}
+	}
+	if len(explored) != 3 {
+		t.Errorf("explored %v, want each of the 3 stations with a goodness of 0 now and then", explored)
+	}
+}
+
+func TestGoodnessSelectorExploresNothingWhenAllArePicked(t *testing.T) {
+	s := &goodnessSelector{Epsilon: 1, Rand: rand.New(rand.NewSource(1))}
+	stations := s.selectStations(map[int64]float32{88500000: 1, 91100000: 1})
+	if len(stations) != 2 {
+		t.Errorf("picked %v, want both stations once", stations)
+	}
+}
+
+func TestGoodnessSelectorWithoutStations(t *testing.T) {
+	s := &goodnessSelector{Epsilon: 1, Rand: rand.New(rand.NewSource(1))}
+	if stations := s.selectStations(map[int64]float32{}); stations != nil {
+		t.Errorf("picked %v from no stations, want nil", stations)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// selftestStep is one check of -selftest. Run returns an error, or panics like the rest of the service, if the check fails.
+// A step that does not apply to the configured backends returns a skip reason instead.
+type selftestStep struct {
+	Name string
+	Run  func() (skipped string, err error)
+}
+
+// runSelftest runs every step, even after one fails, prints a line for each and returns whether they all passed.
+func runSelftest(steps []selftestStep) (passed bool) {
+	passed = true
+	for _, step := range steps {
+		start := time.Now()
+		skipped, err := runSelftestStep(step)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		switch {
+		case err != nil:
+			passed = false
+			fmt.Printf("FAIL  %s (%v): %v\n", step.Name, elapsed, err)
+		case skipped != "":
+			fmt.Printf("SKIP  %s: %s\n", step.Name, skipped)
+		default:
+			fmt.Printf("PASS  %s (%v)\n", step.Name, elapsed)
+		}
+	}
+	if passed {
+		fmt.Println("selftest passed")
+	} else {
+		fmt.Println("selftest FAILED")
+	}
+	return
+}
+
+// runSelftestStep runs step, turning a panic into its error.
+func runSelftestStep(step selftestStep) (skipped string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return step.Run()
+}
+
+// selftestSteps are the checks that a node is ready to go live: the model loads and warms up,
+// each SDR lists its stations, and the brokers accept a connection, and optionally a test message to SELFTEST_TOPIC.
+func selftestSteps(sdrs []sdrDevice, modelTags []string, skipOpCheck bool) []selftestStep {
+	steps := []selftestStep{
+		{"model", func() (skipped string, err error) {
+			if configEnv("MODEL_BACKEND") == "mock" {
+				return "MODEL_BACKEND=mock", nil
+			}
+			m, err := modelFromEnv(modelTags, skipOpCheck, true)
+			if err != nil {
+				return
+			}
+			m.close()
+			return
+		}},
+	}
+	for _, device := range sdrs {
+		steps = append(steps, sdrSelftestStep(device))
+	}
+	steps = append(steps, selftestStep{"evtstreams", func() (skipped string, err error) {
+		if getEnvBool("DRY_RUN", false) {
+			return "DRY_RUN=true", nil
+		}
+		if backends := configPublishBackend(); !publishesTo(backends, "evtstreams") {
+			return "PUBLISH_BACKEND=" + backends, nil
+		}
+		conn, err := connect(getEnv("EVTSTREAMS_TOPIC"), getEnvDuration("EVTSTREAMS_CONNECT_TIMEOUT", 2*time.Minute))
+		if err != nil {
+			return
+		}
+		defer conn.Producer.Close()
+		// the test message goes to its own topic, so that consumers of the real topic don't see it.
+		if topic := configEnv("SELFTEST_TOPIC"); topic != "" {
+			err = conn.sendTestMessage(topic)
+		}
+		return
+	}})
+	return steps
+}
+
+// sdrSelftestStep checks that device lists its stations, it is named after the device when there are several.
+func sdrSelftestStep(device sdrDevice) selftestStep {
+	name := "sdr"
+	if device.Name != "" {
+		name += " " + device.Name
+	}
+	sdr := device.SDR
+	return selftestStep{name, func() (skipped string, err error) {
+		if client, ok := sdr.(*rtlsdrClient); ok {
+			err = client.probe()
+			if err != nil {
+				return
+			}
+		}
+		freqs, err := sdr.GetFreqs(context.Background())
+		if err != nil {
+			return
+		}
+		logInfo("selftest: the", name, "found", len(freqs.Freqs), "stations")
+		return
+	}}
+}
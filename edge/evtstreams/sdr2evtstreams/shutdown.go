@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownContext returns a context that is done on the first SIGINT or SIGTERM, so that the loop can finish
+// the sample it is on and everything can be closed cleanly. A second signal exits right away.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logInfo("got", sig, "so shutting down once the current sample is done, send it again to exit now")
+		cancel()
+		<-sigs
+		logWarn("exiting without shutting down cleanly")
+		os.Exit(1)
+	}()
+	return ctx
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// messageSigner makes detached Ed25519 signatures of the serialized messages, so that the cloud can check which
+// node published each message and that it wasn't changed. KeyID names the key, the public key of which the
+// cloud looks up to verify the signature.
+type messageSigner struct {
+	Key   ed25519.PrivateKey
+	KeyID string
+}
+
+// newMessageSigner makes the messageSigner of DEVICE_SIGNING_KEY, nil if it isn't set. The key is either a PEM
+// PKCS #8 private key, like openssl genpkey -algorithm ed25519 makes, or the base64 32 byte seed of one.
+func newMessageSigner() (s *messageSigner, err error) {
+	if configEnv("DEVICE_SIGNING_KEY") == "" && configEnv("DEVICE_SIGNING_KEY_FILE") == "" {
+		return
+	}
+	encoded, err := getSecret("DEVICE_SIGNING_KEY")
+	if err != nil {
+		return
+	}
+	s = &messageSigner{KeyID: configEnv("DEVICE_SIGNING_KEY_ID")}
+	if s.KeyID == "" {
+		s.KeyID = getEnv("HZN_ORG_ID", "HZN_ORGANIZATION") + "/" + getEnv("HZN_DEVICE_ID")
+	}
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("bad DEVICE_SIGNING_KEY: %v", err)
+		}
+		var ok bool
+		if s.Key, ok = key.(ed25519.PrivateKey); !ok {
+			return nil, fmt.Errorf("DEVICE_SIGNING_KEY is a %T, not an Ed25519 key", key)
+		}
+		return s, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("DEVICE_SIGNING_KEY must be a PEM Ed25519 private key or a base64 %d byte seed", ed25519.SeedSize)
+	}
+	s.Key = ed25519.NewKeyFromSeed(seed)
+	return
+}
+
+// sign is the base64 signature of the serialized message.
+func (s *messageSigner) sign(serialized []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, serialized))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// snrSDR is an SDR that can also measure how strong a station is over the noise around it.
+type snrSDR interface {
+	GetSNR(ctx context.Context, freq int64) (power rtlsdr.SignalPower, err error)
+}
+
+// snrSmoothing is how much each measurement moves the SNR that stationSNRs keeps of a station, so that a
+// single bad measurement doesn't stop it from being sampled.
+const snrSmoothing = 0.3
+
+// snrMinWeight is the chance that the weakest stations are still sampled when they are picked, so that a
+// station whose signal improves is noticed.
+const snrMinWeight = 0.1
+
+// stationSNRs keeps the signal to noise ratio of each station, smoothed over the captures it was measured on,
+// so that weak stations are sampled less. A station that is picked is sampled with a chance that rises from
+// snrMinWeight at MinDB to 1 at GoodDB.
+type stationSNRs struct {
+	MinDB  float32
+	GoodDB float32
+	mu     sync.Mutex
+	snrs   map[int64]float32
+}
+
+// snrThresholdsFromEnv returns SNR_MIN_DB and SNR_GOOD_DB, the second must be over the first.
+func snrThresholdsFromEnv() (minDB, goodDB float32, err error) {
+	minDB, goodDB = float32(getEnvFloat("SNR_MIN_DB", 6)), float32(getEnvFloat("SNR_GOOD_DB", 20))
+	if goodDB <= minDB {
+		err = fmt.Errorf("SNR_GOOD_DB must be over SNR_MIN_DB")
+	}
+	return
+}
+
+func newStationSNRs(minDB, goodDB float32) *stationSNRs {
+	return &stationSNRs{MinDB: minDB, GoodDB: goodDB, snrs: map[int64]float32{}}
+}
+
+// measure measures the SNR of station with sdr, and returns it after smoothing it into the SNR of the station.
+// It returns 0 if s is nil, sdr can't measure SNR, or measuring it failed. Like stationInfos.lookup, it runs in
+// the capture workers, which each have the SDR to themselves.
+func (s *stationSNRs) measure(ctx context.Context, sdr SDR, station int64) float32 {
+	meter, ok := sdr.(snrSDR)
+	if s == nil || !ok {
+		return 0
+	}
+	power, err := meter.GetSNR(ctx, station)
+	if err != nil {
+		logWarn("can't measure the SNR of the station:", err, field("freq", station))
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	smoothed, ok := s.snrs[station]
+	if !ok {
+		smoothed = power.SNR
+	}
+	s.snrs[station] = smoothed + snrSmoothing*(power.SNR-smoothed)
+	logDebug("measured SNR", field("freq", station), field("snr", power.SNR), field("smoothed", s.snrs[station]))
+	return power.SNR
+}
+
+// weight is the chance that station is sampled when it is picked, 1 if its SNR isn't known yet.
+func (s *stationSNRs) weight(station int64) float32 {
+	s.mu.Lock()
+	snr, ok := s.snrs[station]
+	s.mu.Unlock()
+	if !ok || snr >= s.GoodDB {
+		return 1
+	}
+	if snr <= s.MinDB || s.GoodDB <= s.MinDB {
+		return snrMinWeight
+	}
+	return snrMinWeight + (1-snrMinWeight)*(snr-s.MinDB)/(s.GoodDB-s.MinDB)
+}
+
+// thin drops each of the stations with a chance of 1 less its weight, so that weak stations are sampled less.
+// It returns stations as they are if s is nil.
+func (s *stationSNRs) thin(stations []int64) []int64 {
+	if s == nil {
+		return stations
+	}
+	var kept []int64
+	for _, station := range stations {
+		if weight := s.weight(station); rand.Float32() < weight {
+			kept = append(kept, station)
+		} else {
+			logDebug("not sampling weak station", field("freq", station), field("weight", weight))
+		}
+	}
+	return kept
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// meteredSDR is a mockSDR whose stations measure the SNRs in SNRs, one after the other.
+type meteredSDR struct {
+	*mockSDR
+	SNRs []float32
+}
+
+func (s *meteredSDR) GetSNR(ctx context.Context, freq int64) (power rtlsdr.SignalPower, err error) {
+	power.SNR, s.SNRs = s.SNRs[0], s.SNRs[1:]
+	return
+}
+
+func TestStationSNRsSmoothing(t *testing.T) {
+	const station = 88500000
+	s := newStationSNRs(10, 20)
+	sdr := &meteredSDR{mockSDR: newMockSDR(), SNRs: []float32{20, 10, 10}}
+	// the first measurement is taken as it is, and each after that moves it snrSmoothing of the way.
+	for _, want := range []float32{20, 17, 14.9} {
+		measured := sdr.SNRs[0]
+		if got := s.measure(context.Background(), sdr, station); got != measured {
+			t.Errorf("measured SNR %v, want %v as measured", got, measured)
+		}
+		if got := s.snrs[station]; math.Abs(float64(got-want)) > 1e-4 {
+			t.Errorf("smoothed SNR is %v, want %v", got, want)
+		}
+	}
+}
+
+func TestStationSNRsMeasureWithoutMeter(t *testing.T) {
+	s := newStationSNRs(10, 20)
+	if got := s.measure(context.Background(), stationSDR{Mock: newMockSDR()}, 88500000); got != 0 {
+		t.Errorf("measured SNR %v with an SDR that can't, want 0", got)
+	}
+	var nilSNRs *stationSNRs
+	if got := nilSNRs.measure(context.Background(), newMockSDR(), 88500000); got != 0 {
+		t.Errorf("measured SNR %v without stationSNRs, want 0", got)
+	}
+}
+
+func TestStationSNRsWeight(t *testing.T) {
+	s := newStationSNRs(10, 20)
+	s.snrs = map[int64]float32{1: 5, 2: 10, 3: 15, 4: 20, 5: 30}
+	tests := []struct {
+		station int64
+		want    float32
+	}{
+		{0, 1},
+		{1, snrMinWeight},
+		{2, snrMinWeight},
+		{3, 0.55},
+		{4, 1},
+		{5, 1},
+	}
+	for _, test := range tests {
+		if got := s.weight(test.station); math.Abs(float64(got-test.want)) > 1e-6 {
+			t.Errorf("weight at %v dB is %v, want %v", s.snrs[test.station], got, test.want)
+		}
+	}
+}
+
+func TestStationSNRsThin(t *testing.T) {
+	stations := []int64{88500000, 91100000}
+	var nilSNRs *stationSNRs
+	if got := nilSNRs.thin(stations); len(got) != len(stations) {
+		t.Errorf("thinned %v to %v without stationSNRs, want them all", stations, got)
+	}
+	// stations whose SNR isn't known yet are always sampled.
+	if got := newStationSNRs(10, 20).thin(stations); len(got) != len(stations) {
+		t.Errorf("thinned %v to %v before measuring them, want them all", stations, got)
+	}
+}
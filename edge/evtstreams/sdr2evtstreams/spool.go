@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/examples/edge/evtstreams/sdr2evtstreams/audiolib"
+)
+
+// spool holds the messages that failed to publish in Dir, so that they aren't lost while the node is offline.
+// Each message is a JSON file, and a .raw file of its raw audio if Raw is set. Once it holds over MaxBytes,
+// the oldest messages are dropped. It is drained, oldest first, once publishing works again.
+type spool struct {
+	Dir      string
+	MaxBytes int64
+	// Raw keeps the raw audio of each message as well, for the publishers that use it.
+	Raw  bool
+	size int64
+	// names are of the messages in Dir without their extension, oldest first.
+	names []string
+}
+
+// newSpool makes the spool for dir, with any messages already in it from before a restart.
+func newSpool(dir string, maxBytes int64, raw bool) (s *spool, err error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("SPOOL_MAX_BYTES must be over 0")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	s = &spool{Dir: dir, MaxBytes: maxBytes, Raw: raw}
+	for _, file := range files {
+		// a .tmp file is a message that was being spooled when the service stopped.
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		s.size += file.Size()
+		if strings.HasSuffix(file.Name(), ".json") {
+			s.names = append(s.names, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(s.names)
+	metrics.setSpooled(len(s.names))
+	if len(s.names) > 0 {
+		logInfo(len(s.names), "messages are spooled in", dir, "from before, publishing them once publishing works")
+	}
+	return
+}
+
+// add spools audioMsg and its raw audio, and reports whether it was spooled.
+func (s *spool) add(audioMsg *audiolib.AudioMsg, raw []byte) bool {
+	name, err := s.write(audioMsg, raw)
+	if err != nil {
+		logError("can't spool the message, it is lost:", err, field("freq", audioMsg.Freq))
+		return false
+	}
+	s.names = append(s.names, name)
+	for s.size > s.MaxBytes && len(s.names) > 1 {
+		logWarn("the spool is over SPOOL_MAX_BYTES, dropping its oldest message", s.names[0])
+		s.remove(s.names[0])
+		s.names = s.names[1:]
+	}
+	metrics.setSpooled(len(s.names))
+	logInfo("spooled the message until publishing works again", field("freq", audioMsg.Freq), field("spooled", len(s.names)))
+	return true
+}
+
+func (s *spool) write(audioMsg *audiolib.AudioMsg, raw []byte) (name string, err error) {
+	// the names sort in the order the messages were spooled.
+	name = fmt.Sprintf("%020d", time.Now().UnixNano())
+	if s.Raw {
+		err = ioutil.WriteFile(filepath.Join(s.Dir, name+".raw"), raw, 0644)
+		if err != nil {
+			return
+		}
+		s.size += int64(len(raw))
+	}
+	msg, err := json.Marshal(audioMsg)
+	if err != nil {
+		return
+	}
+	// the JSON file is written last and renamed into place, so that a spooled message is always whole.
+	tmp := filepath.Join(s.Dir, name+".tmp")
+	err = ioutil.WriteFile(tmp, msg, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.Dir, name+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		s.remove(name)
+		return
+	}
+	s.size += int64(len(msg))
+	return
+}
+
+// drain publishes up to batch spooled messages with p, oldest first, and stops at the first that fails.
+func (s *spool) drain(p Publisher, batch int) {
+	for i := 0; i < batch && len(s.names) > 0; i++ {
+		name := s.names[0]
+		audioMsg, raw, err := s.read(name)
+		if err != nil {
+			logError("dropping spooled message", name, "that can't be read:", err)
+		} else if err = publishMessage(p, audioMsg, raw); err != nil {
+			logWarn("can't publish the spooled messages yet:", err, field("spooled", len(s.names)))
+			return
+		}
+		metrics.publishedOne(err)
+		s.remove(name)
+		s.names = s.names[1:]
+		metrics.setSpooled(len(s.names))
+		if len(s.names) == 0 {
+			logInfo("published every spooled message")
+		}
+	}
+}
+
+func (s *spool) read(name string) (audioMsg *audiolib.AudioMsg, raw []byte, err error) {
+	msg, err := ioutil.ReadFile(filepath.Join(s.Dir, name+".json"))
+	if err != nil {
+		return
+	}
+	audioMsg = &audiolib.AudioMsg{}
+	err = json.Unmarshal(msg, audioMsg)
+	if err != nil || !s.Raw {
+		return
+	}
+	raw, err = ioutil.ReadFile(filepath.Join(s.Dir, name+".raw"))
+	if os.IsNotExist(err) {
+		// it was spooled by a configuration without a raw publisher.
+		err = nil
+	}
+	return
+}
+
+// remove deletes the files of the message name, it doesn't take it out of s.names.
+func (s *spool) remove(name string) {
+	for _, ext := range []string{".json", ".raw"} {
+		path := filepath.Join(s.Dir, name+ext)
+		if info, err := os.Stat(path); err == nil {
+			s.size -= info.Size()
+			if err = os.Remove(path); err != nil {
+				logError("can't remove", path, "from the spool:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// stationInfoSDR is an SDR that can also tell what the RDS of a station says about it.
+type stationInfoSDR interface {
+	GetStationInfo(ctx context.Context, freq int64) (info rtlsdr.StationInfo, err error)
+}
+
+// stationInfos remembers what the RDS of each station says, so that it is only listened to once every MaxAge,
+// as it takes the SDR as long as capturing a few seconds of audio. A station that has no RDS, or that the
+// SDR fails to listen to, isn't listened to again for MaxAge either.
+type stationInfos struct {
+	MaxAge time.Duration
+	mu     sync.Mutex
+	infos  map[int64]stationInfoAt
+}
+
+type stationInfoAt struct {
+	Info rtlsdr.StationInfo
+	At   time.Time
+}
+
+func newStationInfos(maxAge time.Duration) *stationInfos {
+	return &stationInfos{MaxAge: maxAge, infos: map[int64]stationInfoAt{}}
+}
+
+// lookup returns the RDS of station, listening to it with sdr if it isn't known or is older than MaxAge.
+// It returns nothing if s is nil or sdr can't listen to RDS. It runs in the capture workers, which each have
+// the SDR to themselves, so that it doesn't tune away from a station that is being captured.
+func (s *stationInfos) lookup(ctx context.Context, sdr SDR, station int64, now time.Time) rtlsdr.StationInfo {
+	rds, ok := sdr.(stationInfoSDR)
+	if s == nil || !ok {
+		return rtlsdr.StationInfo{}
+	}
+	s.mu.Lock()
+	known, ok := s.infos[station]
+	s.mu.Unlock()
+	if ok && now.Sub(known.At) < s.MaxAge {
+		return known.Info
+	}
+	info, err := rds.GetStationInfo(ctx, station)
+	if err != nil {
+		logWarn("can't get the RDS of the station:", err, field("freq", station))
+		info = rtlsdr.StationInfo{}
+	} else if info.PI == "" {
+		logInfo("the station has no RDS", field("freq", station))
+	} else {
+		logInfo("the RDS of the station is", field("freq", station), field("callSign", info.CallSign), field("ps", info.PS))
+	}
+	s.mu.Lock()
+	s.infos[station] = stationInfoAt{Info: info, At: now}
+	s.mu.Unlock()
+	return info
+}
@@ -0,0 +1,290 @@
+//go:build !notensorflow
+// +build !notensorflow
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+)
+
+func init() {
+	inferenceBackends["tensorflow"] = func(path string, opts modelOptions) (Inference, error) {
+		m, err := newModel(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+}
+
+func opIsSafe(a string) bool {
+	safeOPtypes := []string{
+		"Const",
+		"Placeholder",
+		"Conv2D",
+		"Cast",
+		"Div",
+		"StatelessRandomNormal",
+		"ExpandDims",
+		"AudioSpectrogram",
+		"DecodeRaw",
+		"Reshape",
+		"MatMul",
+		"Sum",
+		"Softmax",
+		"Squeeze",
+		"RandomUniform",
+		"Identity",
+	}
+	for _, b := range safeOPtypes {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsafeOpsError is returned by newModel when the graph uses OP types that are not in the whitelist.
+type UnsafeOpsError struct {
+	// OpTypes is the sorted list of OP types that are not in the whitelist.
+	OpTypes []string
+}
+
+func (e *UnsafeOpsError) Error() string {
+	return "unsafe OPs, the following OP types are not in whitelist: " + strings.Join(e.OpTypes, ", ")
+}
+
+// model holds the session, the input placeholder and outputs.
+type model struct {
+	Sess    *tf.Session
+	InputPH tf.Output
+	Output  tf.Output
+	// Extras are any other outputs to evaluate along with Output, by name.
+	Extras map[string]tf.Output
+	// IncludeLogits keeps every value of Output in the scores, not just the first.
+	IncludeLogits bool
+	// InputSeconds is how long the audio is that the model takes.
+	InputSeconds float64
+	// Labels names the classes of a model whose Output scores several, nil if it only scores the goodness.
+	Labels *classLabels
+}
+
+// score takes a chunk of raw audio with no headers and returns a value between 0 and 1,
+// 1 for good (in this case speech), 0 for nongood (in this case nonspeech), along with the values of any extra outputs.
+// the audio is in modelAudioFormat, audio that is not m.InputSeconds long, as when CAPTURE_SECONDS is not what the
+// model takes, is padded with silence or truncated.
+func (m *model) score(audio []byte) (s audioScore, err error) {
+	if expected := modelAudioFormat.Bytes(m.InputSeconds); len(audio) != expected {
+		audio = fitAudio(audio, expected)
+	}
+	// first we must convert the audio to a string tensor.
+	inputTensor, err := tf.NewTensor(string(audio))
+	if err != nil {
+		return
+	}
+	// the goodness is always fetched first, followed by the extras.
+	fetches := []tf.Output{m.Output}
+	names := []string{}
+	for name, output := range m.Extras {
+		fetches = append(fetches, output)
+		names = append(names, name)
+	}
+	// then feed the input into the input placeholder while pulling on the outputs.
+	result, err := m.Sess.Run(map[tf.Output]*tf.Tensor{m.InputPH: inputTensor}, fetches, nil)
+	if err != nil {
+		return
+	}
+	if m.Labels != nil {
+		values, valuesErr := tensorValues(result[0].Value())
+		if valuesErr != nil {
+			err = valuesErr
+			return
+		}
+		err = m.Labels.apply(values, &s)
+	} else {
+		s.Value, err = firstScalar(result[0].Value())
+	}
+	if err != nil {
+		return
+	}
+	if m.IncludeLogits {
+		s.Logits, err = tensorValues(result[0].Value())
+		if err != nil {
+			return
+		}
+	}
+	for i, name := range names {
+		if s.Extras == nil {
+			s.Extras = map[string]float32{}
+		}
+		s.Extras[name], err = firstScalar(result[i+1].Value())
+		if err != nil {
+			err = fmt.Errorf("output %s: %v", name, err)
+			return
+		}
+	}
+	return
+}
+
+// close closes the session of the model.
+func (m *model) close() error {
+	return m.Sess.Close()
+}
+
+// loadGraph loads the model at path, which is either a frozen graph def file or a SavedModel directory.
+// A SavedModel is loaded with the given tags, and comes with its session already made.
+// For a frozen graph, sess is nil.
+func loadGraph(path string, tags []string) (graph *tf.Graph, sess *tf.Session, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		savedModel, err := tf.LoadSavedModel(path, tags, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return savedModel.Graph, savedModel.Session, nil
+	}
+	def, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	graph = tf.NewGraph()
+	err = graph.Import(def, "")
+	return
+}
+
+// maxListedOps is how many OP names opNames lists, as a graph can have thousands.
+const maxListedOps = 50
+
+// opNames returns the sorted names of the OPs in graph of type opType, or of any type if it is "",
+// for the errors that say which OPs there are. Past maxListedOps, the rest are only counted.
+func opNames(graph *tf.Graph, opType string) (names []string) {
+	for _, op := range graph.Operations() {
+		if opType == "" || op.Type() == opType {
+			names = append(names, op.Name())
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxListedOps {
+		names = append(names[:maxListedOps], fmt.Sprintf("and %d more, see -inspect-model", len(names)-maxListedOps))
+	}
+	return
+}
+
+// inspectModel prints the name and type of each OP in the graph at path,
+// and whether its type is in the whitelist.
+func inspectModel(path string, tags []string) (err error) {
+	graph, sess, err := loadGraph(path, tags)
+	if err != nil {
+		return
+	}
+	if sess != nil {
+		defer sess.Close()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tWHITELISTED")
+	for _, op := range graph.Operations() {
+		fmt.Fprintf(w, "%s\t%s\t%t\n", op.Name(), op.Type(), opIsSafe(op.Type()))
+	}
+	return w.Flush()
+}
+
+// newModel loads the model at path and checks that it only uses whitelisted OPs.
+// path is either a frozen graph def file or a SavedModel directory, which is loaded with the given tags.
+// The audio is fed into the opts.InputOp OP, and the goodness is read from port opts.OutputIndex of the opts.OutputOp OP.
+func newModel(path string, opts modelOptions) (m model, err error) {
+	graph, sess, err := loadGraph(path, opts.Tags)
+	if err != nil {
+		return
+	}
+	m.Sess = sess
+	// don't leak the SavedModel session if the model is rejected.
+	defer func() {
+		if err != nil && m.Sess != nil {
+			m.Sess.Close()
+			m.Sess = nil
+		}
+	}()
+	ops := graph.Operations()
+	unsafeOPs := map[string]bool{}
+	if opts.SkipOpCheck {
+		logWarn("MODEL_SKIP_OP_CHECK=true, NOT checking the model OPs against the whitelist!")
+		logWarn("only do this with a model you fully trust.")
+	} else {
+		for _, op := range ops {
+			if !opIsSafe(op.Type()) {
+				unsafeOPs[op.Type()] = true
+			}
+		}
+	}
+	if len(unsafeOPs) > 0 {
+		unsafeErr := &UnsafeOpsError{}
+		for op := range unsafeOPs {
+			unsafeErr.OpTypes = append(unsafeErr.OpTypes, op)
+		}
+		sort.Strings(unsafeErr.OpTypes)
+		err = unsafeErr
+		return
+	}
+	outputName := opts.OutputOp
+	if outputName == "" {
+		outputName = "output"
+	}
+	outputOP := graph.Operation(outputName)
+	if outputOP == nil {
+		err = fmt.Errorf("output OP %s not found, set MODEL_OUTPUT_OP to one of: %s", outputName, strings.Join(opNames(graph, ""), ", "))
+		return
+	}
+	if opts.OutputIndex < 0 || opts.OutputIndex >= outputOP.NumOutputs() {
+		err = fmt.Errorf("output OP %s has %d outputs, MODEL_OUTPUT_INDEX %d is out of range", outputName, outputOP.NumOutputs(), opts.OutputIndex)
+		return
+	}
+	m.Output = outputOP.Output(opts.OutputIndex)
+	m.IncludeLogits = opts.IncludeLogits
+	m.InputSeconds = opts.inputSeconds()
+	m.Labels = opts.Labels
+	for _, spec := range opts.ExtraOutputs {
+		name, index, specErr := parseOutputSpec(spec)
+		if specErr != nil {
+			err = specErr
+			return
+		}
+		op := graph.Operation(name)
+		if op == nil {
+			err = fmt.Errorf("extra output OP %s not found", name)
+			return
+		}
+		if index >= op.NumOutputs() {
+			err = fmt.Errorf("extra output OP %s has %d outputs, index %d is out of range", name, op.NumOutputs(), index)
+			return
+		}
+		if m.Extras == nil {
+			m.Extras = map[string]tf.Output{}
+		}
+		m.Extras[spec] = op.Output(index)
+	}
+
+	inputName := opts.InputOp
+	if inputName == "" {
+		inputName = "input/Placeholder"
+	}
+	inputPHOP := graph.Operation(inputName)
+	if inputPHOP == nil {
+		err = fmt.Errorf("input OP %s not found, set MODEL_INPUT_OP to one of the placeholders: %s", inputName, strings.Join(opNames(graph, "Placeholder"), ", "))
+		return
+	}
+	m.InputPH = inputPHOP.Output(0)
+	if m.Sess == nil {
+		m.Sess, err = tf.NewSession(graph, nil)
+	}
+	return
+}
@@ -0,0 +1,20 @@
+//go:build notensorflow
+// +build notensorflow
+
+package main
+
+import "errors"
+
+// errNoTensorFlow is returned by the tensorflow backend when the service was built without libtensorflow.
+var errNoTensorFlow = errors.New("MODEL_BACKEND=tensorflow needs the service to be built without -tags notensorflow, which leaves out libtensorflow")
+
+func init() {
+	inferenceBackends["tensorflow"] = func(path string, opts modelOptions) (Inference, error) {
+		return nil, errNoTensorFlow
+	}
+}
+
+// inspectModel always fails, as the service was built without libtensorflow.
+func inspectModel(path string, tags []string) error {
+	return errNoTensorFlow
+}
@@ -0,0 +1,104 @@
+//go:build tflite
+// +build tflite
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	tflite "github.com/mattn/go-tflite"
+)
+
+func init() {
+	inferenceBackends["tflite"] = func(path string, opts modelOptions) (Inference, error) {
+		m, err := newTFLiteModel(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// tfliteModel is a TensorFlow Lite model, which needs only the small libtensorflowlite_c rather than all of
+// libtensorflow. It takes the audio as float samples, as many as its input tensor holds, and the goodness is
+// read from output tensor OutputIndex.
+type tfliteModel struct {
+	Opts modelOptions
+	// mu guards the interpreter, which runs one inference at a time.
+	mu          sync.Mutex
+	model       *tflite.Model
+	interpreter *tflite.Interpreter
+	samples     int
+}
+
+// newTFLiteModel loads the .tflite model at path and allocates its tensors.
+func newTFLiteModel(path string, opts modelOptions) (m *tfliteModel, err error) {
+	if len(opts.ExtraOutputs) > 0 {
+		return nil, errors.New("MODEL_EXTRA_OUTPUTS is only supported with MODEL_BACKEND=tensorflow")
+	}
+	m = &tfliteModel{Opts: opts}
+	m.model = tflite.NewModelFromFile(path)
+	if m.model == nil {
+		return nil, fmt.Errorf("can't load the TensorFlow Lite model at %s", path)
+	}
+	options := tflite.NewInterpreterOptions()
+	defer options.Delete()
+	m.interpreter = tflite.NewInterpreter(m.model, options)
+	if m.interpreter == nil {
+		m.model.Delete()
+		return nil, fmt.Errorf("can't make an interpreter for the TensorFlow Lite model at %s", path)
+	}
+	// don't leak the interpreter if the model is rejected.
+	defer func() {
+		if err != nil {
+			m.close()
+			m = nil
+		}
+	}()
+	if status := m.interpreter.AllocateTensors(); status != tflite.OK {
+		return m, fmt.Errorf("can't allocate the tensors of the TensorFlow Lite model: status %v", status)
+	}
+	input := m.interpreter.GetInputTensor(0)
+	if input == nil || input.Type() != tflite.Float32 {
+		return m, errors.New("the input of the TensorFlow Lite model must be a float32 tensor of samples")
+	}
+	if count := m.interpreter.GetOutputTensorCount(); opts.OutputIndex < 0 || opts.OutputIndex >= count {
+		return m, fmt.Errorf("the TensorFlow Lite model has %d outputs, MODEL_OUTPUT_INDEX %d is out of range", count, opts.OutputIndex)
+	}
+	m.samples = input.ByteSize() / 4
+	return
+}
+
+// score feeds audio to the model as float samples, padded with silence or truncated to fit its input tensor.
+func (m *tfliteModel) score(audio []byte) (s audioScore, err error) {
+	samples := audioSamples(audio, m.samples)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status := m.interpreter.GetInputTensor(0).CopyFromBuffer(samples); status != tflite.OK {
+		err = fmt.Errorf("can't copy the audio into the TensorFlow Lite model: status %v", status)
+		return
+	}
+	if status := m.interpreter.Invoke(); status != tflite.OK {
+		err = fmt.Errorf("TensorFlow Lite inference failed: status %v", status)
+		return
+	}
+	output := m.interpreter.GetOutputTensor(m.Opts.OutputIndex)
+	if output.Type() != tflite.Float32 {
+		err = fmt.Errorf("TensorFlow Lite model output is of type %v, not float32", output.Type())
+		return
+	}
+	// the output aliases the interpreter's memory, which the next inference overwrites.
+	values := append([]float32(nil), output.Float32s()...)
+	return outputScore(values, m.Opts)
+}
+
+// close frees the interpreter and the model, waiting for any inference in progress.
+func (m *tfliteModel) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.interpreter.Delete()
+	m.model.Delete()
+	return nil
+}
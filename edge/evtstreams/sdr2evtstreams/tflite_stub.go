@@ -0,0 +1,12 @@
+//go:build !tflite
+// +build !tflite
+
+package main
+
+import "errors"
+
+func init() {
+	inferenceBackends["tflite"] = func(path string, opts modelOptions) (Inference, error) {
+		return nil, errors.New("MODEL_BACKEND=tflite needs the service to be built with -tags tflite, which links libtensorflowlite_c")
+	}
+}
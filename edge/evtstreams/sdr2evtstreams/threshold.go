@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPublishThreshold is the value audio must score over to be published, unless PUBLISH_THRESHOLD says otherwise.
+const defaultPublishThreshold = 0.5
+
+// thresholdWindow overrides the publish threshold between Start and End, which are times of day as offsets from midnight.
+// If End is before Start the window wraps around midnight.
+type thresholdWindow struct {
+	Start     time.Duration
+	End       time.Duration
+	Threshold float32
+}
+
+// thresholdSchedule is the publish threshold by time of day, Default applies outside all the windows.
+type thresholdSchedule struct {
+	Default float32
+	Windows []thresholdWindow
+}
+
+// at returns the threshold at t, in t's location. The first window that t falls in wins.
+// A nil schedule always returns defaultPublishThreshold.
+func (s *thresholdSchedule) at(t time.Time) float32 {
+	if s == nil {
+		return defaultPublishThreshold
+	}
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range s.Windows {
+		var in bool
+		if w.Start <= w.End {
+			in = sinceMidnight >= w.Start && sinceMidnight < w.End
+		} else {
+			in = sinceMidnight >= w.Start || sinceMidnight < w.End
+		}
+		if in {
+			return w.Threshold
+		}
+	}
+	return s.Default
+}
+
+// parseThresholdSchedule parses a comma-separated list of windows like 06:00-10:00=0.3,22:00-02:00=0.4.
+func parseThresholdSchedule(spec string, defaultThreshold float32) (s *thresholdSchedule, err error) {
+	s = &thresholdSchedule{Default: defaultThreshold}
+	if spec == "" {
+		return
+	}
+	for _, windowSpec := range strings.Split(spec, ",") {
+		windowSpec = strings.TrimSpace(windowSpec)
+		eq := strings.Index(windowSpec, "=")
+		dash := strings.Index(windowSpec, "-")
+		if eq < 0 || dash < 0 || dash > eq {
+			return nil, fmt.Errorf("bad window %q in THRESHOLD_SCHEDULE, must be like 06:00-10:00=0.3", windowSpec)
+		}
+		var w thresholdWindow
+		w.Start, err = parseTimeOfDay(windowSpec[:dash])
+		if err != nil {
+			return nil, err
+		}
+		w.End, err = parseTimeOfDay(windowSpec[dash+1 : eq])
+		if err != nil {
+			return nil, err
+		}
+		threshold, parseErr := strconv.ParseFloat(windowSpec[eq+1:], 32)
+		if parseErr != nil || threshold < 0 || threshold > 1 {
+			return nil, fmt.Errorf("bad threshold in window %q in THRESHOLD_SCHEDULE, must be between 0 and 1", windowSpec)
+		}
+		w.Threshold = float32(threshold)
+		s.Windows = append(s.Windows, w)
+	}
+	return
+}
+
+// parseTimeOfDay parses a time of day like 06:30 into its offset from midnight.
+func parseTimeOfDay(str string) (sinceMidnight time.Duration, err error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(str))
+	if err != nil {
+		err = fmt.Errorf("bad time of day %q in THRESHOLD_SCHEDULE, must be like 06:30", str)
+		return
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThresholdScheduleAt(t *testing.T) {
+	s, err := parseThresholdSchedule("06:00-10:00=0.3,22:00-02:00=0.4", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time string
+		want float32
+	}{
+		{"05:59", 0.5},
+		{"06:00", 0.3},
+		{"09:59", 0.3},
+		{"10:00", 0.5},
+		{"12:00", 0.5},
+		{"21:59", 0.5},
+		// the second window crosses midnight.
+		{"22:00", 0.4},
+		{"23:59", 0.4},
+		{"00:00", 0.4},
+		{"01:59", 0.4},
+		{"02:00", 0.5},
+	}
+	for _, test := range tests {
+		clock, _ := time.Parse("15:04", test.time)
+		now := time.Date(2020, 6, 1, clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+		if got := s.at(now); got != test.want {
+			t.Errorf("threshold at %s is %v, want %v", test.time, got, test.want)
+		}
+	}
+}
+
+func TestThresholdScheduleFirstWindowWins(t *testing.T) {
+	s, err := parseThresholdSchedule("08:00-12:00=0.2,10:00-14:00=0.7", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.at(time.Date(2020, 6, 1, 11, 0, 0, 0, time.UTC)); got != 0.2 {
+		t.Errorf("threshold where the windows overlap is %v, want 0.2 from the first", got)
+	}
+}
+
+func TestThresholdScheduleNil(t *testing.T) {
+	var s *thresholdSchedule
+	if got := s.at(time.Now()); got != defaultPublishThreshold {
+		t.Errorf("threshold of a nil schedule is %v, want %v", got, defaultPublishThreshold)
+	}
+}
+
+func TestParseThresholdScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"06:00=0.3",
+		"06:00-10:00",
+		"6-10=0.3",
+		"06:00-25:00=0.3",
+		"06:00-10:00=1.5",
+		"06:00-10:00=x",
+	} {
+		if _, err := parseThresholdSchedule(spec, 0.5); err == nil {
+			t.Errorf("parsed THRESHOLD_SCHEDULE %q, want an error", spec)
+		}
+	}
+}
@@ -41,7 +41,7 @@ func main() {
 		fmt.Println("found", len(stations.Freqs), "stations")
 		for _, station := range stations.Freqs {
 			fmt.Println("starting freq", station)
-			audio, err := rtlsdr.GetAudio("localhost", int(station))
+			audio, err := rtlsdr.GetAudio("localhost", station)
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
+)
+
+// usbDevice is an RTL-SDR dongle that captures 8 bit IQ samples at usbSampleRate, the I and Q of each sample
+// interleaved, offset by 127.5.
+type usbDevice interface {
+	// tune sets the frequency in Hz at the center of the samples, and drops the samples from before it.
+	tune(freq int64) error
+	// read fills buf with samples, its length is a multiple of 512.
+	read(buf []byte) error
+	Close() error
+}
+
+// usbSampleRate is the rate that the dongle captures at, 4 times the rate that the FM of a station is
+// demodulated at, which is in turn 16 times usbAudioSampleRate.
+const usbSampleRate = 1024000
+
+// usbAudioSampleRate is the rate of the audio that the FM is demodulated to.
+const usbAudioSampleRate = usbSampleRate / 64
+
+// usbTuneOffset is how far above a station the dongle is tuned, so that the spike that its mixer leaves at the
+// center isn't in the station. A quarter of the sample rate makes mixing the station down a rotation.
+const usbTuneOffset = usbSampleRate / 4
+
+// usbReadSize is how many bytes of samples are read at once, 128 milliseconds of them.
+const usbReadSize = 262144
+
+// usbSettleReads is how many reads are dropped after tuning, while the tuner settles.
+const usbSettleReads = 2
+
+// usbFMBand is the FM channels that GetFreqs scans unless it is given another band, its squelch isn't used.
+var usbFMBand = rtlsdr.ScanRange{Start: 87900000, Stop: 107900000, Step: 200000}
+
+// usbScanThresholdDB is how much stronger than the median channel a channel must be for GetFreqs to count it as a station.
+const usbScanThresholdDB = 10
+
+// usbSDR is the SDR that captures from an RTL-SDR dongle attached to this device, instead of from the sdr
+// service, and demodulates the FM itself. It can only tune to one station at a time.
+type usbSDR struct {
+	// Mode is how the audio is demodulated, "" is wfm.
+	Mode rtlsdr.Mode
+	// Scan is the band that GetFreqs scans, nil is usbFMBand. Its squelch isn't used, as the power of the
+	// channels is only compared to each other.
+	Scan   *rtlsdr.ScanRange
+	mu     sync.Mutex
+	device usbDevice
+	buf    []byte
+	// noiseDB is the power of the median channel of the last scan, which GetSNR measures stations over.
+	noiseDB    float64
+	noiseKnown bool
+}
+
+// newUSBSDR opens dongle number index, 0 for the first one. It fails unless the service was built with
+// -tags rtlsdr, which links librtlsdr.
+func newUSBSDR(index int) (*usbSDR, error) {
+	device, err := openUSBDevice(index)
+	if err != nil {
+		return nil, err
+	}
+	return &usbSDR{device: device, buf: make([]byte, usbReadSize)}, nil
+}
+
+// tune tunes to the station at freq and drops the samples that the tuner captures while it settles.
+func (s *usbSDR) tune(ctx context.Context, freq int64) error {
+	return s.tuneCenter(ctx, freq+usbTuneOffset)
+}
+
+// tuneCenter tunes the dongle to center, without the offset of tune, and drops the samples that the tuner
+// captures while it settles.
+func (s *usbSDR) tuneCenter(ctx context.Context, center int64) error {
+	err := s.device.tune(center)
+	if err != nil {
+		return fmt.Errorf("can't tune the dongle to %d Hz: %v", center, err)
+	}
+	for i := 0; i < usbSettleReads; i++ {
+		err = s.read(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *usbSDR) read(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := s.device.read(s.buf)
+	if err != nil {
+		return fmt.Errorf("can't read from the dongle: %v", err)
+	}
+	return nil
+}
+
+// GetFreqs measures the power of each channel of Scan, and returns those that are usbScanThresholdDB stronger than
+// the median channel, which is mostly noise as most channels are empty.
+func (s *usbSDR) GetFreqs(ctx context.Context) (freqs rtlsdr.Freqs, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scan := usbFMBand
+	if s.Scan != nil {
+		scan = *s.Scan
+	}
+	channels := scan.Channels()
+	var powers []float64
+	for _, freq := range channels {
+		err = s.tune(ctx, freq)
+		if err == nil {
+			err = s.read(ctx)
+		}
+		if err != nil {
+			return
+		}
+		powers = append(powers, channelPowerDB(s.buf))
+	}
+	sorted := append([]float64(nil), powers...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	s.noiseDB, s.noiseKnown = median, true
+	freqs.Origin = "usb"
+	for i, freq := range channels {
+		logDebug("channel power", field("freq", freq), field("dB", powers[i]-median))
+		if powers[i]-median >= usbScanThresholdDB {
+			freqs.Freqs = append(freqs.Freqs, freq)
+		}
+	}
+	return
+}
+
+// GetSNR measures the power of the station at freq over that of the median channel of the last scan, which is
+// mostly noise. It fails until the band has been scanned.
+func (s *usbSDR) GetSNR(ctx context.Context, freq int64) (power rtlsdr.SignalPower, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.noiseKnown {
+		return power, fmt.Errorf("the noise isn't known until the band has been scanned")
+	}
+	err = s.tune(ctx, freq)
+	if err == nil {
+		err = s.read(ctx)
+	}
+	if err != nil {
+		return
+	}
+	power.Origin = "usb"
+	power.Freq = freq
+	power.PowerDB = float32(channelPowerDB(s.buf))
+	power.NoiseDB = float32(s.noiseDB)
+	power.SNR = power.PowerDB - power.NoiseDB
+	return
+}
+
+// GetAudio captures a chunk of audio from the station at freq, into a buffer from audioBuffers.
+func (s *usbSDR) GetAudio(ctx context.Context, freq int64) (audio []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.tune(ctx, freq)
+	if err != nil {
+		return
+	}
+	audio = getAudioBuffer()
+	demod := newDemodulator(s.Mode)
+	size := expectedAudioBytes(captureSeconds)
+	for len(audio) < size {
+		err = s.read(ctx)
+		if err != nil {
+			releaseAudioBuffer(audio)
+			return nil, err
+		}
+		audio = demod.demodulate(s.buf, audio)
+	}
+	return audio[:size], nil
+}
+
+// GetIQ captures the IQ samples centered on freq as the dongle captures them, which is always at usbSampleRate
+// with the gain automatic.
+func (s *usbSDR) GetIQ(ctx context.Context, freq int64, opts rtlsdr.IQOptions) (iq []byte, err error) {
+	if opts.SampleRate != usbSampleRate || opts.Gain != 0 {
+		return nil, fmt.Errorf("the dongle captures at %d samples a second with the gain automatic, not %d with %v dB", usbSampleRate, opts.SampleRate, opts.Gain)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.tuneCenter(ctx, freq)
+	if err != nil {
+		return
+	}
+	size := opts.Samples() * 2
+	iq = make([]byte, 0, size+usbReadSize)
+	for len(iq) < size {
+		err = s.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		iq = append(iq, s.buf...)
+	}
+	return iq[:size], nil
+}
+
+func (s *usbSDR) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.device.Close()
+}
+
+// channelPowerDB is the power in dB of the channel that iq was tuned to, after filtering out its neighbours.
+func channelPowerDB(iq []byte) float64 {
+	stage := newChannelFilter()
+	var sum float64
+	var n int
+	stage.filter(iq, func(i, q float32) {
+		sum += float64(i*i + q*q)
+		n++
+	})
+	if sum == 0 || n == 0 {
+		return minPowerDBFS
+	}
+	return 10 * math.Log10(sum/float64(n))
+}
+
+// lowpass returns the taps of a windowed sinc low pass filter that passes up to cutoff of the sample rate,
+// scaled so that it doesn't change the level of what it passes.
+func lowpass(taps int, cutoff float64) []float32 {
+	h := make([]float32, taps)
+	var sum float64
+	for i := range h {
+		x := float64(i - (taps-1)/2)
+		v := 2 * cutoff
+		if x != 0 {
+			v = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// hamming window.
+		v *= 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(taps-1))
+		h[i] = float32(v)
+		sum += v
+	}
+	for i := range h {
+		h[i] /= float32(sum)
+	}
+	return h
+}
+
+// decimator is a low pass filter that keeps one of every Factor of its samples, holding the samples of the
+// last call that the next needs.
+type decimator struct {
+	Taps    []float32
+	Factor  int
+	history []float32
+	// phase is where the next sample that is kept starts, in the history and samples of the next call.
+	phase int
+}
+
+func newDecimator(taps []float32, factor int) *decimator {
+	return &decimator{Taps: taps, Factor: factor, history: make([]float32, len(taps)-1)}
+}
+
+// filter filters in and appends the samples that are kept to out.
+func (d *decimator) filter(in []float32, out []float32) []float32 {
+	x := append(d.history, in...)
+	n := len(d.Taps)
+	for i := d.phase; i+n <= len(x); i += d.Factor {
+		var sum float32
+		for j, tap := range d.Taps {
+			sum += tap * x[i+j]
+		}
+		out = append(out, sum)
+		d.phase = i + d.Factor
+	}
+	d.phase -= len(x) - (n - 1)
+	d.history = append(d.history[:0], x[len(x)-(n-1):]...)
+	return out
+}
+
+// channelFilter mixes the station down from usbTuneOffset below the center of the samples, and filters it
+// out of them at a quarter of the sample rate.
+type channelFilter struct {
+	i, q *decimator
+	// n counts the samples, for the rotation that mixes them.
+	n      int
+	ii, qq []float32
+	oi, oq []float32
+}
+
+func newChannelFilter() *channelFilter {
+	// FM stations are 200 kHz apart, and take up most of that.
+	taps := lowpass(65, 120000.0/usbSampleRate)
+	return &channelFilter{i: newDecimator(taps, 4), q: newDecimator(taps, 4)}
+}
+
+// filter calls sample with the I and Q of each sample of the station in iq.
+func (c *channelFilter) filter(iq []byte, sample func(i, q float32)) {
+	c.ii, c.qq = c.ii[:0], c.qq[:0]
+	for k := 0; k+1 < len(iq); k += 2 {
+		i := (float32(iq[k]) - 127.5) / 127.5
+		q := (float32(iq[k+1]) - 127.5) / 127.5
+		// multiply by e^(j*pi*n/2), which moves the station up by a quarter of the sample rate, to 0 Hz.
+		switch c.n % 4 {
+		case 1:
+			i, q = -q, i
+		case 2:
+			i, q = -i, -q
+		case 3:
+			i, q = q, -i
+		}
+		c.n++
+		c.ii = append(c.ii, i)
+		c.qq = append(c.qq, q)
+	}
+	c.oi = c.i.filter(c.ii, c.oi[:0])
+	c.oq = c.q.filter(c.qq, c.oq[:0])
+	for k := range c.oi {
+		sample(c.oi[k], c.oq[k])
+	}
+}
+
+// fmDeemphasis is the time constant of the de-emphasis of FM broadcasts in the Americas, as rtl_fm -E deemp.
+const fmDeemphasis = 75e-6
+
+// fmAudioScale scales the deviation of the FM in Hz to samples, at the level of rtl_fm -s 170k, so the
+// model hears the same levels as from the sdr service.
+const fmAudioScale = 32768.0 / 170000
+
+// fmDemodulator turns the IQ samples of a station into 16 bit little endian mono audio at
+// usbAudioSampleRate, as rtl_fm does for the sdr service.
+type fmDemodulator struct {
+	channel *channelFilter
+	// lastI and lastQ are the sample before, whose phase the next one is compared to.
+	lastI, lastQ float32
+	deemphasis   float32
+	deemphAlpha  float32
+	// stage1 and stage2 decimate the audio down to usbAudioSampleRate, and filter out the 19 kHz pilot and
+	// the stereo and RDS above it.
+	stage1, stage2 *decimator
+	baseband       []float32
+	mid, audio     []float32
+}
+
+func newFMDemodulator() *fmDemodulator {
+	demodRate := float64(usbSampleRate / 4)
+	return &fmDemodulator{
+		channel:     newChannelFilter(),
+		deemphAlpha: float32(1 - math.Exp(-1/(demodRate*fmDeemphasis))),
+		stage1:      newDecimator(lowpass(31, 16000/demodRate), 4),
+		stage2:      newDecimator(lowpass(127, 7000/(demodRate/4)), 4),
+	}
+}
+
+// demodulate demodulates iq and appends the audio to out.
+func (d *fmDemodulator) demodulate(iq []byte, out []byte) []byte {
+	demodRate := float64(usbSampleRate / 4)
+	d.baseband = d.baseband[:0]
+	d.channel.filter(iq, func(i, q float32) {
+		// the phase of the sample times the conjugate of the one before is how far the phase turned.
+		re := i*d.lastI + q*d.lastQ
+		im := q*d.lastI - i*d.lastQ
+		d.lastI, d.lastQ = i, q
+		deviation := float32(math.Atan2(float64(im), float64(re)) * demodRate / (2 * math.Pi))
+		d.deemphasis += d.deemphAlpha * (deviation - d.deemphasis)
+		d.baseband = append(d.baseband, d.deemphasis)
+	})
+	d.mid = d.stage1.filter(d.baseband, d.mid[:0])
+	d.audio = d.stage2.filter(d.mid, d.audio[:0])
+	for _, v := range d.audio {
+		out = appendSample(out, float64(v)*fmAudioScale)
+	}
+	return out
+}
+
+// appendSample appends v to out as a 16 bit little endian sample, clipped to its range.
+func appendSample(out []byte, v float64) []byte {
+	sample := math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(v)))
+	out = append(out, 0, 0)
+	binary.LittleEndian.PutUint16(out[len(out)-2:], uint16(int16(sample)))
+	return out
+}
+
+// demodulator turns the IQ samples of a station into 16 bit little endian mono audio at usbAudioSampleRate,
+// appending it to out.
+type demodulator interface {
+	demodulate(iq []byte, out []byte) []byte
+}
+
+// newDemodulator returns the demodulator of mode.
+func newDemodulator(mode rtlsdr.Mode) demodulator {
+	switch mode {
+	case rtlsdr.ModeNFM, rtlsdr.ModeAM:
+		return newNarrowDemodulator(mode)
+	}
+	return newFMDemodulator()
+}
+
+// nfmAudioScale scales the deviation of narrow FM in Hz to samples, at the level of rtl_fm -M fm -s 16k.
+const nfmAudioScale = 32768.0 / usbAudioSampleRate
+
+// amAudioScale is the level of audio that modulates the carrier fully, a quarter below full scale.
+const amAudioScale = 24576
+
+// amCarrierTime is the time constant in seconds of the level of the carrier that AM is measured against,
+// long enough not to follow the audio, short enough to follow fading.
+const amCarrierTime = 0.5
+
+// narrowDemodulator demodulates narrow FM or AM, whose channels are much narrower than those of broadcast FM.
+// It filters the channel down to usbAudioSampleRate, and demodulates that.
+type narrowDemodulator struct {
+	am      bool
+	channel *channelFilter
+	// i1 and q1, then i2 and q2, decimate the I and Q of the channel down to usbAudioSampleRate, passing
+	// 6 kHz either side of the carrier.
+	i1, q1, i2, q2 *decimator
+	lastI, lastQ   float32
+	// carrier is the level of the AM carrier, which the audio is the change of.
+	carrier      float64
+	carrierAlpha float64
+	ii, qq       []float32
+	mi, mq       []float32
+	oi, oq       []float32
+}
+
+func newNarrowDemodulator(mode rtlsdr.Mode) *narrowDemodulator {
+	channelRate := float64(usbSampleRate / 4)
+	midRate := channelRate / 4
+	stage1 := lowpass(31, 20000/channelRate)
+	stage2 := lowpass(63, 6000/midRate)
+	return &narrowDemodulator{
+		am:           mode == rtlsdr.ModeAM,
+		channel:      newChannelFilter(),
+		i1:           newDecimator(stage1, 4),
+		q1:           newDecimator(stage1, 4),
+		i2:           newDecimator(stage2, 4),
+		q2:           newDecimator(stage2, 4),
+		carrierAlpha: 1 - math.Exp(-1/(usbAudioSampleRate*amCarrierTime)),
+	}
+}
+
+// demodulate demodulates iq and appends the audio to out.
+func (d *narrowDemodulator) demodulate(iq []byte, out []byte) []byte {
+	d.ii, d.qq = d.ii[:0], d.qq[:0]
+	d.channel.filter(iq, func(i, q float32) {
+		d.ii = append(d.ii, i)
+		d.qq = append(d.qq, q)
+	})
+	d.mi = d.i1.filter(d.ii, d.mi[:0])
+	d.mq = d.q1.filter(d.qq, d.mq[:0])
+	d.oi = d.i2.filter(d.mi, d.oi[:0])
+	d.oq = d.q2.filter(d.mq, d.oq[:0])
+	for k := range d.oi {
+		i, q := d.oi[k], d.oq[k]
+		if d.am {
+			// the audio is how far the envelope is from the carrier, relative to it, so that it doesn't
+			// matter how strong the station is.
+			envelope := math.Hypot(float64(i), float64(q))
+			if d.carrier == 0 {
+				d.carrier = envelope
+			}
+			d.carrier += d.carrierAlpha * (envelope - d.carrier)
+			v := 0.0
+			if d.carrier > 0 {
+				v = (envelope/d.carrier - 1) * amAudioScale
+			}
+			out = appendSample(out, v)
+			continue
+		}
+		re := i*d.lastI + q*d.lastQ
+		im := q*d.lastI - i*d.lastQ
+		d.lastI, d.lastQ = i, q
+		deviation := math.Atan2(float64(im), float64(re)) * usbAudioSampleRate / (2 * math.Pi)
+		out = appendSample(out, deviation*nfmAudioScale)
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+//go:build rtlsdr
+// +build rtlsdr
+
+package main
+
+// #cgo LDFLAGS: -lrtlsdr
+// #include <stdlib.h>
+// #include <rtl-sdr.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// librtlsdrDevice is a dongle opened with librtlsdr.
+type librtlsdrDevice struct {
+	dev *C.rtlsdr_dev_t
+}
+
+// openUSBDevice opens dongle number index with librtlsdr, at usbSampleRate and with the gain of the tuner automatic.
+func openUSBDevice(index int) (usbDevice, error) {
+	count := int(C.rtlsdr_get_device_count())
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("no RTL-SDR dongle number %d, found %d of them", index, count)
+	}
+	d := &librtlsdrDevice{}
+	if r := C.rtlsdr_open(&d.dev, C.uint32_t(index)); r < 0 {
+		return nil, fmt.Errorf("can't open RTL-SDR dongle number %d, is the sdr service or its kernel driver using it? error %d", index, int(r))
+	}
+	if r := C.rtlsdr_set_sample_rate(d.dev, usbSampleRate); r < 0 {
+		d.Close()
+		return nil, fmt.Errorf("can't set the sample rate of the dongle to %d: error %d", usbSampleRate, int(r))
+	}
+	if r := C.rtlsdr_set_tuner_gain_mode(d.dev, 0); r < 0 {
+		d.Close()
+		return nil, fmt.Errorf("can't make the gain of the dongle automatic: error %d", int(r))
+	}
+	logInfo("opened RTL-SDR dongle", field("index", index), field("name", C.GoString(C.rtlsdr_get_device_name(C.uint32_t(index)))))
+	return d, nil
+}
+
+func (d *librtlsdrDevice) tune(freq int64) error {
+	if r := C.rtlsdr_set_center_freq(d.dev, C.uint32_t(freq)); r < 0 {
+		return fmt.Errorf("error %d", int(r))
+	}
+	if r := C.rtlsdr_reset_buffer(d.dev); r < 0 {
+		return fmt.Errorf("can't reset the buffer: error %d", int(r))
+	}
+	return nil
+}
+
+func (d *librtlsdrDevice) read(buf []byte) error {
+	var n C.int
+	if r := C.rtlsdr_read_sync(d.dev, unsafe.Pointer(&buf[0]), C.int(len(buf)), &n); r < 0 {
+		return fmt.Errorf("error %d", int(r))
+	}
+	if int(n) != len(buf) {
+		return fmt.Errorf("short read of %d of %d bytes", int(n), len(buf))
+	}
+	return nil
+}
+
+func (d *librtlsdrDevice) Close() error {
+	if r := C.rtlsdr_close(d.dev); r < 0 {
+		return fmt.Errorf("can't close the dongle: error %d", int(r))
+	}
+	return nil
+}
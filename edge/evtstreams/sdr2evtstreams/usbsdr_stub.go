@@ -0,0 +1,11 @@
+//go:build !rtlsdr
+// +build !rtlsdr
+
+package main
+
+import "errors"
+
+// openUSBDevice always fails, as the service was built without librtlsdr.
+func openUSBDevice(index int) (usbDevice, error) {
+	return nil, errors.New("SDR_BACKEND=usb needs the service to be built with -tags rtlsdr, which links librtlsdr")
+}
@@ -0,0 +1,43 @@
+package main
+
+// audioWindow is a part of a capture that is scored on its own, from byte Start up to End, Offset seconds into it.
+type audioWindow struct {
+	Offset     float32
+	Start, End int
+	Score      audioScore
+}
+
+// slidingWindows scores a capture that is longer than the model takes as overlapping windows of Seconds each,
+// one starting every HopSeconds, so that a short stretch of speech in a capture of mostly music still scores
+// high in the windows around it. The last window always ends at the end of the capture.
+type slidingWindows struct {
+	Seconds    float64
+	HopSeconds float64
+}
+
+// split returns the windows of audio, or nil if w is nil. Audio no longer than a window is a single window.
+func (w *slidingWindows) split(audio []byte) (windows []audioWindow) {
+	if w == nil {
+		return nil
+	}
+	size, hop := expectedAudioBytes(w.Seconds), expectedAudioBytes(w.HopSeconds)
+	if len(audio) <= size || hop <= 0 {
+		return []audioWindow{{Start: 0, End: len(audio)}}
+	}
+	start := 0
+	for ; start+size < len(audio); start += hop {
+		windows = append(windows, w.window(start, size))
+	}
+	// the windows never run past the end, so the last one is moved back to end there.
+	return append(windows, w.window(len(audio)-size, size))
+}
+
+func (w *slidingWindows) window(start, size int) audioWindow {
+	frame := audioBytesPerSample * audioChannels
+	start -= start % frame
+	return audioWindow{
+		Offset: float32(start/frame) / float32(audioSampleRate),
+		Start:  start,
+		End:    start + size,
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlidingWindowsSplit(t *testing.T) {
+	w := &slidingWindows{Seconds: 1, HopSeconds: 0.5}
+	second := expectedAudioBytes(1)
+	tests := []struct {
+		name  string
+		audio []byte
+		want  []audioWindow
+	}{
+		{"shorter than a window", make([]byte, second/2), []audioWindow{{Start: 0, End: second / 2}}},
+		{"exactly a window", make([]byte, second), []audioWindow{{Start: 0, End: second}}},
+		{"a whole number of hops", make([]byte, 2*second), []audioWindow{
+			{Offset: 0, Start: 0, End: second},
+			{Offset: 0.5, Start: second / 2, End: second * 3 / 2},
+			{Offset: 1, Start: second, End: 2 * second},
+		}},
+		// the last window is moved back to end at the end of the audio.
+		{"between hops", make([]byte, second*9/4), []audioWindow{
+			{Offset: 0, Start: 0, End: second},
+			{Offset: 0.5, Start: second / 2, End: second * 3 / 2},
+			{Offset: 1, Start: second, End: 2 * second},
+			{Offset: 1.25, Start: second * 5 / 4, End: second * 9 / 4},
+		}},
+	}
+	for _, test := range tests {
+		if got := w.split(test.audio); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: split into %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSlidingWindowsSplitWholeSamples(t *testing.T) {
+	w := &slidingWindows{Seconds: 1, HopSeconds: 0.5}
+	// an odd number of bytes would put the last window in the middle of a sample.
+	audio := make([]byte, expectedAudioBytes(1.5)+1)
+	for _, window := range w.split(audio) {
+		if window.Start%audioBytesPerSample != 0 {
+			t.Errorf("window starts at byte %d, in the middle of a sample", window.Start)
+		}
+		if window.End > len(audio) {
+			t.Errorf("window ends at byte %d, past the end of %d bytes", window.End, len(audio))
+		}
+	}
+}
+
+func TestNilSlidingWindows(t *testing.T) {
+	var w *slidingWindows
+	if windows := w.split(make([]byte, expectedAudioBytes(10))); windows != nil {
+		t.Errorf("nil windows split into %+v, want nil", windows)
+	}
+}
@@ -2,29 +2,50 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/open-horizon/examples/edge/services/sdr/bbcfake"
+	"github.com/open-horizon/examples/edge/services/sdr/rds"
 	rtlsdr "github.com/open-horizon/examples/edge/services/sdr/rtlsdrclientlib"
 )
 
-func captureAudio(freq int) (audio []byte, err error) {
-	cmd := exec.Command("rtl_fm", "-M", "fm", "-s", "170k", "-o", "4", "-A", "fast", "-r", "16k", "-l", "0", "-E", "deemp", "-f", strconv.Itoa(freq))
+// rtlFM is the rtl_fm command that captures the 16 kHz 16 bit mono audio of the station at freq, demodulated in mode.
+// Narrow FM and AM are sampled at 16 kHz to begin with, which is about as wide as their channels.
+func rtlFM(freq int, mode rtlsdr.Mode) *exec.Cmd {
+	args := []string{"-M", "fm", "-s", "170k", "-o", "4", "-A", "fast", "-r", "16k", "-l", "0", "-E", "deemp"}
+	switch mode {
+	case rtlsdr.ModeNFM:
+		args = []string{"-M", "fm", "-s", "16k", "-A", "fast", "-l", "0"}
+	case rtlsdr.ModeAM:
+		args = []string{"-M", "am", "-s", "16k", "-A", "fast", "-l", "0"}
+	}
+	cmd := exec.Command("rtl_fm", append(args, "-f", strconv.Itoa(freq))...)
+	cmd.Env = append(cmd.Env, "RTLSDR_RPC_IS_ENABLED=1", "RTLSDR_RPC_SERV_ADDR=localhost")
+	return cmd
+}
+
+// audioBytesPerSecond is how many bytes of the audio of rtlFM last a second.
+const audioBytesPerSecond = 16000 * 2
+
+func captureAudio(freq int, mode rtlsdr.Mode) (audio []byte, err error) {
+	cmd := rtlFM(freq, mode)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	cmd.Env = append(cmd.Env, "RTLSDR_RPC_IS_ENABLED=1", "RTLSDR_RPC_SERV_ADDR=localhost")
 	err = cmd.Start()
 	if err != nil {
 		panic(err)
@@ -49,6 +70,47 @@ func captureAudio(freq int) (audio []byte, err error) {
 	return
 }
 
+// rdsSeconds is how long captureRDS listens to a station for, RDS sends the 8 characters of a station name in
+// 4 groups of 88 milliseconds each, and repeats them several times a second.
+const rdsSeconds = 10
+
+// captureRDS captures the FM multiplex signal of the station at freq, instead of its audio, and decodes its RDS.
+func captureRDS(freq int) (info rtlsdr.StationInfo, err error) {
+	cmd := exec.Command("rtl_fm", "-M", "fm", "-s", "171k", "-A", "std", "-l", "0", "-F", "9", "-f", strconv.Itoa(freq))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(cmd.Env, "RTLSDR_RPC_IS_ENABLED=1", "RTLSDR_RPC_SERV_ADDR=localhost")
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	time.Sleep(rdsSeconds * time.Second)
+	err = cmd.Process.Kill()
+	if err != nil {
+		err = errors.New(string(stderr.Bytes()))
+		return
+	}
+	raw := stdout.Bytes()
+	mpx := make([]int16, len(raw)/2)
+	for i := range mpx {
+		mpx[i] = int16(binary.LittleEndian.Uint16(raw[i*2:]))
+	}
+	if len(mpx) < rds.SampleRate {
+		err = errors.New("for some reason, the multiplex signal is too short")
+		return
+	}
+	info.Origin = "sdr_hardware"
+	info.Freq = int64(freq)
+	station, ok := rds.Decode(mpx)
+	if ok {
+		info.PI = fmt.Sprintf("%04X", station.PI)
+		info.PS = station.PS
+		info.CallSign = station.CallSign
+	}
+	return
+}
+
 const ROWS int = 18
 const COLS int = 411
 
@@ -63,14 +125,23 @@ func stringListToFloat(stringList []string) (floatList []float32) {
 	return
 }
 
-func capturePower() (power rtlsdr.PowerDist, err error) {
-	start := 70000000
-	end := 110000000
+// powerLow and powerHigh are the band that /power covers, in bins of powerBin Hz.
+const (
+	powerLow  = 70000000
+	powerHigh = 110000000
+	powerBin  = 10000
+)
+
+// powerSeconds is how long the power of a scan for stations is averaged over.
+const powerSeconds = 10
+
+// capturePower captures the power from start to end Hz, in bins of bin Hz, averaged over seconds.
+func capturePower(start, end, bin int64, seconds int) (power rtlsdr.PowerDist, err error) {
 	power.Origin = "sdr_hardware"
 	power.Low = float32(start)
 	power.High = float32(end)
-	// rtl_power -e 10 -c 20% -f 70000000:110000000:10000
-	cmd := exec.Command("rtl_power", "-e", "10", "-c", "20%", "-f", strconv.Itoa(start)+":"+strconv.Itoa(end)+":10000")
+	// rtl_power -i 10 -e 10 -c 20% -f 70000000:110000000:10000
+	cmd := exec.Command("rtl_power", "-i", strconv.Itoa(seconds), "-e", strconv.Itoa(seconds), "-c", "20%", "-f", strconv.FormatInt(start, 10)+":"+strconv.FormatInt(end, 10)+":"+strconv.FormatInt(bin, 10))
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
@@ -85,13 +156,15 @@ func capturePower() (power rtlsdr.PowerDist, err error) {
 	if err != nil {
 		return
 	}
-	if len(recordList) != ROWS {
-		err = errors.New("expected " + strconv.Itoa(ROWS) + " rows, got " + strconv.Itoa(len(recordList)) + " rows")
+	// each row is a hop of rtl_power over part of the band, which all have as many bins.
+	if len(recordList) == 0 || len(recordList[0]) <= 6 {
+		err = errors.New("rtl_power captured no power")
 		return
 	}
+	cols := len(recordList[0][6:])
 	for _, row := range recordList {
-		if len(row[6:]) != COLS {
-			err = errors.New("expected " + strconv.Itoa(COLS) + " elems, got " + strconv.Itoa(len(row[6:])) + " elems")
+		if len(row[6:]) != cols {
+			err = errors.New("expected " + strconv.Itoa(cols) + " elems, got " + strconv.Itoa(len(row[6:])) + " elems")
 			return
 		}
 		power.Dbm = append(power.Dbm, stringListToFloat(row[6:])...)
@@ -106,13 +179,18 @@ func makeAudioHandler(fake *bbcfake.FakeRadio) func(w http.ResponseWriter, r *ht
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		mode, err := rtlsdr.ParseMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		var audio []byte
 		if freq == 0 {
 			audio = fake.GetNextChunk()
 			time.Sleep(30 * time.Second)
 		} else {
 			if rtlRpcdIsAlive {
-				audio, err = captureAudio(freq)
+				audio, err = captureAudio(freq, mode)
 			} else {
 				err = errors.New("freq != 0 but rtl_rpcd is dead")
 			}
@@ -126,16 +204,218 @@ func makeAudioHandler(fake *bbcfake.FakeRadio) func(w http.ResponseWriter, r *ht
 	}
 }
 
+// maxStreamSeconds is the longest that /stream sends audio for.
+const maxStreamSeconds = 300
+
+// streamAudio sends the audio of the station at freq to w as rtl_fm captures it, size bytes of it, and stops
+// early if done is closed, as when the client goes away. Nothing of the audio is held on to, so the memory it
+// takes doesn't grow with size.
+func streamAudio(w io.Writer, freq int, mode rtlsdr.Mode, size int, done <-chan struct{}) error {
+	return streamCmd(w, rtlFM(freq, mode), size, audioBytesPerSecond/10, done)
+}
+
+// streamCmd sends size bytes of the output of cmd to w as it comes, in writes of at most frame bytes, and
+// stops early if done is closed.
+func streamCmd(w io.Writer, cmd *exec.Cmd, size, frame int, done <-chan struct{}) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	go func() {
+		<-done
+		cmd.Process.Kill()
+	}()
+	buf := make([]byte, frame)
+	for sent := 0; sent < size; {
+		if len(buf) > size-sent {
+			buf = buf[:size-sent]
+		}
+		n, err := stdout.Read(buf)
+		if n > 0 {
+			_, writeErr := w.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			sent += n
+		}
+		if err != nil {
+			return fmt.Errorf("%s stopped after %d of %d bytes: %v %s", cmd.Args[0], sent, size, err, stderr.Bytes())
+		}
+	}
+	return nil
+}
+
+// streamFake sends size bytes of the fake station to w as fast as a real station would play them.
+func streamFake(w io.Writer, fake *bbcfake.FakeRadio, size int, done <-chan struct{}) error {
+	frame := audioBytesPerSecond / 10
+	var chunk []byte
+	for sent := 0; sent < size; {
+		if len(chunk) == 0 {
+			chunk = fake.GetNextChunk()
+		}
+		n := frame
+		if n > size-sent {
+			n = size - sent
+		}
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		select {
+		case <-done:
+			return errors.New("the client went away")
+		case <-time.After(100 * time.Millisecond):
+		}
+		_, err := w.Write(chunk[:n])
+		if err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		chunk = chunk[n:]
+		sent += n
+	}
+	return nil
+}
+
+// makeStreamHandler serves /stream/<freq>?seconds=<seconds>, which sends the same audio as /audio/<freq> as it
+// is captured, instead of all of it at the end. seconds is 30 if not set.
+func makeStreamHandler(fake *bbcfake.FakeRadio) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		freq, err := strconv.Atoi(r.URL.Path[8:])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mode, err := rtlsdr.ParseMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		seconds := 30.0
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			seconds, err = strconv.ParseFloat(s, 64)
+			if err != nil || seconds <= 0 || seconds > maxStreamSeconds {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if freq != 0 && !rtlRpcdIsAlive {
+			fmt.Println("freq != 0 but rtl_rpcd is dead")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// whole samples of 2 bytes.
+		size := int(math.Round(seconds*audioBytesPerSecond/2)) * 2
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		done := r.Context().Done()
+		if freq == 0 {
+			err = streamFake(w, fake, size, done)
+		} else {
+			err = streamAudio(w, freq, mode, size, done)
+		}
+		// the status was already sent, the client sees that the stream is short.
+		if err != nil {
+			fmt.Println("stream of", freq, "failed:", err)
+		}
+	}
+}
+
+// rtlSDR is the rtl_sdr command that captures the raw IQ samples centered on freq with opts.
+func rtlSDR(freq int, opts rtlsdr.IQOptions) *exec.Cmd {
+	cmd := exec.Command("rtl_sdr", "-f", strconv.Itoa(freq), "-s", strconv.Itoa(opts.SampleRate),
+		"-g", strconv.FormatFloat(float64(opts.Gain), 'f', -1, 32), "-n", strconv.Itoa(opts.Samples()), "-")
+	cmd.Env = append(cmd.Env, "RTLSDR_RPC_IS_ENABLED=1", "RTLSDR_RPC_SERV_ADDR=localhost")
+	return cmd
+}
+
+// iqHandler serves /iq/<freq>?rate=<rate>&gain=<gain>&seconds=<seconds>, which streams the raw IQ samples centered
+// on freq as rtl_sdr captures them, 2 bytes a sample.
+func iqHandler(w http.ResponseWriter, r *http.Request) {
+	freq, err := strconv.Atoi(r.URL.Path[4:])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	opts, err := rtlsdr.ParseIQOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if freq == 0 {
+		http.Error(w, "the fake station has no IQ samples", http.StatusNotFound)
+		return
+	}
+	if !rtlRpcdIsAlive {
+		fmt.Println("freq != 0 but rtl_rpcd is dead")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size := opts.Samples() * 2
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	// a tenth of a second at a time.
+	frame := opts.SampleRate / 10 * 2
+	err = streamCmd(w, rtlSDR(freq, opts), size, frame, r.Context().Done())
+	// the status was already sent, the client sees that the samples are short.
+	if err != nil {
+		fmt.Println("IQ capture of", freq, "failed:", err)
+	}
+}
+
+func rdsHandler(w http.ResponseWriter, r *http.Request) {
+	freq, err := strconv.Atoi(r.URL.Path[5:])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var info rtlsdr.StationInfo
+	if freq == 0 {
+		// the fake station has no RDS.
+		info = rtlsdr.StationInfo{Origin: "fake"}
+	} else if rtlRpcdIsAlive {
+		info, err = captureRDS(freq)
+	} else {
+		err = errors.New("freq != 0 but rtl_rpcd is dead")
+	}
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jsonBytes, err := json.Marshal(info)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonBytes)
+}
+
 func powerHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("/power is deprecated! Please use /freqs")
-	power, err := capturePower()
+	power, err := capturePower(powerLow, powerHigh, powerBin, powerSeconds)
 	if (err != nil) && !(os.Getenv("MOCK_IF_YOU_MUST") == "false") {
 		fmt.Println("using mock power data:", err.Error())
 		err = nil
 		power = rtlsdr.PowerDist{
 			Origin: "mock_file",
-			Low:    float32(70000000),
-			High:   float32(110000000),
+			Low:    float32(powerLow),
+			High:   float32(powerHigh),
 			Dbm:    make([]float32, ROWS*COLS),
 		}
 	}
@@ -153,20 +433,122 @@ func powerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonBytes)
 }
 
+// snrChannels is how many channels either side of a station measureSNR measures the noise in, and snrSeconds
+// how long it averages the power over.
+const (
+	snrChannels = 5
+	snrSeconds  = 1
+)
+
+// maxSNRWidth is the widest channel that /snr measures.
+const maxSNRWidth = 1000000
+
+// measureSNR measures the power of the station at freq in a channel width Hz wide, and takes the median power of
+// the snrChannels channels either side of it, less the ones next to it, as the noise.
+func measureSNR(freq, width int64) (power rtlsdr.SignalPower, err error) {
+	bin := width / 10
+	if bin < 1 {
+		bin = 1
+	}
+	data, err := capturePower(freq-snrChannels*width, freq+snrChannels*width, bin, snrSeconds)
+	if err != nil {
+		return
+	}
+	var signal float64
+	var signalBins int
+	var noise []float64
+	for i, dbm := range data.Dbm {
+		if math.IsNaN(float64(dbm)) {
+			continue
+		}
+		binFreq := float64(data.Low) + float64(data.High-data.Low)*(float64(i)+0.5)/float64(len(data.Dbm))
+		offset := math.Abs(binFreq - float64(freq))
+		if offset <= float64(width)/2 {
+			signal += math.Pow(10, float64(dbm)/10)
+			signalBins++
+		} else if offset > float64(width)*1.5 {
+			noise = append(noise, float64(dbm))
+		}
+	}
+	if signalBins == 0 || len(noise) == 0 {
+		err = errors.New("rtl_power captured too little power to measure the SNR")
+		return
+	}
+	sort.Float64s(noise)
+	power.Origin = "sdr_hardware"
+	power.Freq = freq
+	power.PowerDB = float32(10 * math.Log10(signal/float64(signalBins)))
+	power.NoiseDB = float32(noise[len(noise)/2])
+	power.SNR = power.PowerDB - power.NoiseDB
+	return
+}
+
+// snrHandler serves /snr/<freq>?width=<width>, the power of the station at freq in a channel width Hz wide over
+// the noise around it. width is that of an FM broadcast channel if it isn't set.
+func snrHandler(w http.ResponseWriter, r *http.Request) {
+	freq, err := strconv.ParseInt(r.URL.Path[5:], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	width := rtlsdr.ModeWFM.Bandwidth()
+	if v := r.URL.Query().Get("width"); v != "" {
+		width, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || width <= 0 || width > maxSNRWidth {
+			http.Error(w, fmt.Sprintf("bad width %q, it must be from 1 to %d Hz", v, maxSNRWidth), http.StatusBadRequest)
+			return
+		}
+	}
+	var power rtlsdr.SignalPower
+	if freq == 0 {
+		// the fake station is as clear as a strong broadcast station.
+		power = rtlsdr.SignalPower{Origin: "fake", NoiseDB: -30, SNR: 30}
+	} else if rtlRpcdIsAlive {
+		power, err = measureSNR(freq, width)
+	} else {
+		err = errors.New("freq != 0 but rtl_rpcd is dead")
+	}
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jsonBytes, err := json.Marshal(power)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonBytes)
+}
+
 func FreqToIndex(freq float32, data rtlsdr.PowerDist) int {
 	percentPos := (freq - data.Low) / (data.High - data.Low)
 	index := int(float32(len(data.Dbm)) * percentPos)
 	return index
 }
 
-func getCeilingSignals(celling float32) (freqs []float32, origin string) {
+// getCeilingSignals returns the channels of scan that are over its squelch. The FM band and others within
+// powerLow and powerHigh are found in the power of /power, others in a capture of their own with bins of
+// a quarter of their step, or 10 kHz if that is smaller.
+func getCeilingSignals(scan rtlsdr.ScanRange) (freqs []int64, origin string) {
 	fmt.Println("begin capture power")
-	data, err := capturePower()
+	start, end, bin := int64(powerLow), int64(powerHigh), int64(powerBin)
+	if scan.Start-scan.Step < powerLow || scan.Stop+scan.Step > powerHigh {
+		start, end = scan.Start-scan.Step, scan.Stop+scan.Step
+		if bin > scan.Step/4 {
+			bin = scan.Step / 4
+		}
+		if bin < 1 {
+			bin = 1
+		}
+	}
+	data, err := capturePower(start, end, bin, powerSeconds)
 	if err != nil {
 		fmt.Println(err.Error())
 		fmt.Println("sending fake freq")
 		origin = "fake"
-		freqs = []float32{0.0}
+		freqs = []int64{0}
 		return
 	}
 	for i := range data.Dbm {
@@ -175,18 +557,28 @@ func getCeilingSignals(celling float32) (freqs []float32, origin string) {
 		}
 	}
 
-	for i := float32(85900000); i < data.High; i += 200000 {
-		dbm := data.Dbm[FreqToIndex(i, data)]
-		if dbm > celling {
-			freqs = append(freqs, i)
+	for _, freq := range scan.Channels() {
+		if float32(freq) >= data.High {
+			break
+		}
+		dbm := data.Dbm[FreqToIndex(float32(freq), data)]
+		if dbm > scan.Squelch {
+			freqs = append(freqs, freq)
 		}
 	}
 	origin = "sdr_hardware"
 	return
 }
 
+// freqsHandler scans the FM band for stations, or the band of the start, stop, step and squelch of its query.
 func freqsHandler(w http.ResponseWriter, r *http.Request) {
-	freqs, origin := getCeilingSignals(-8)
+	scan, err := rtlsdr.ParseScanRange(r.URL.Query())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	freqs, origin := getCeilingSignals(scan)
 	jsonBytes, err := json.Marshal(rtlsdr.Freqs{Origin: origin, Freqs: freqs})
 	if err != nil {
 		fmt.Println(err)
@@ -219,6 +611,10 @@ func main() {
 		fmt.Println("Requests for audio will now be fulfilled using fake data.")
 	})
 	http.HandleFunc("/audio/", makeAudioHandler(&fake))
+	http.HandleFunc("/stream/", makeStreamHandler(&fake))
+	http.HandleFunc("/iq/", iqHandler)
+	http.HandleFunc("/rds/", rdsHandler)
+	http.HandleFunc("/snr/", snrHandler)
 	http.HandleFunc("/power", powerHandler)
 	http.HandleFunc("/freqs", freqsHandler)
 	log.Fatal(http.ListenAndServe(":8080", nil))
@@ -0,0 +1,284 @@
+// Package rds decodes the names that FM stations send with RDS, or RBDS as it is called in North America,
+// from the multiplex signal of an FM demodulator, like that of rtl_fm -M fm -s 171k.
+package rds
+
+import (
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+// SampleRate is the sample rate of the multiplex signal that Decode takes, 3 times the 57 kHz RDS subcarrier.
+const SampleRate = 171000
+
+const (
+	// decimation brings the subcarrier down to a baseband at 7125 Hz, samplesPerBit samples to each of the
+	// 1187.5 bits a second.
+	decimation    = 24
+	samplesPerBit = 6
+	// firTaps is the length of the low pass filter that keeps the 2.4 kHz either side of the subcarrier.
+	firTaps = 241
+	// timingWindow is how many bits the timing of the bits is picked for at once, so that it follows the clock
+	// of the station drifting against that of the receiver.
+	timingWindow = 64
+	// maxBadBlocks is how many blocks in a row may fail their check before the blocks are synced again.
+	maxBadBlocks = 8
+)
+
+// Station is what the RDS of a station says about it.
+type Station struct {
+	// PI is the program identification code, unique to each station in an area.
+	PI uint16
+	// PS is the program service name that radios display, like "WXYZ FM", empty if none was received in full.
+	PS string
+	// CallSign is the call sign that RBDS codes in the PI of North American stations, like WXYZ, or empty.
+	CallSign string
+	// Groups is how many groups were received without errors.
+	Groups int
+}
+
+// Decode decodes the RDS of mpx, 16 bit samples at SampleRate. ok is false if no PI was received twice.
+func Decode(mpx []int16) (station Station, ok bool) {
+	var d decoder
+	d.decodeBits(differentialBits(baseband(mpx)))
+	return d.station()
+}
+
+// baseband mixes the 57 kHz subcarrier of mpx down to 0 Hz, filters it and decimates it.
+// As the subcarrier is a third of SampleRate, the mixer repeats every 3 samples.
+func baseband(mpx []int16) (samples []complex128) {
+	var taps [firTaps]complex128
+	for k := range taps {
+		// a windowed sinc with its cutoff at 2.4 kHz.
+		t := float64(k - firTaps/2)
+		h := 2 * 2400.0 / SampleRate
+		if t != 0 {
+			h = math.Sin(2*math.Pi*2400*t/SampleRate) / (math.Pi * t)
+		}
+		h *= 0.54 - 0.46*math.Cos(2*math.Pi*float64(k)/(firTaps-1))
+		taps[k] = complex(h, 0) * cmplx.Exp(complex(0, -2*math.Pi*float64(k%3)/3))
+	}
+	for n := 0; n+firTaps <= len(mpx); n += decimation {
+		var sum complex128
+		for k, tap := range taps {
+			sum += complex(float64(mpx[n+k]), 0) * tap
+		}
+		samples = append(samples, sum)
+	}
+	return
+}
+
+// differentialBits turns the baseband into the bits of the data. Each bit is sent as a biphase symbol, a
+// half bit one way then a half bit the other, whose polarity only flips for a 1. Comparing each symbol with the
+// one before it gets the bits without having to recover the phase of the subcarrier.
+func differentialBits(samples []complex128) (bits []byte) {
+	symbol := func(i int) complex128 {
+		var sum complex128
+		for j := 0; j < samplesPerBit; j++ {
+			if j < samplesPerBit/2 {
+				sum += samples[i+j]
+			} else {
+				sum -= samples[i+j]
+			}
+		}
+		return sum
+	}
+	var last complex128
+	for start := 0; start+(timingWindow+1)*samplesPerBit <= len(samples); start += timingWindow * samplesPerBit {
+		// the timing is the offset whose symbols have the most energy.
+		best, bestEnergy := 0, -1.0
+		for offset := 0; offset < samplesPerBit; offset++ {
+			energy := 0.0
+			for i := 0; i < timingWindow; i++ {
+				s := symbol(start + offset + i*samplesPerBit)
+				energy += real(s)*real(s) + imag(s)*imag(s)
+			}
+			if energy > bestEnergy {
+				best, bestEnergy = offset, energy
+			}
+		}
+		for i := 0; i < timingWindow; i++ {
+			s := symbol(start + best + i*samplesPerBit)
+			if real(s*cmplx.Conj(last)) < 0 {
+				bits = append(bits, 1)
+			} else {
+				bits = append(bits, 0)
+			}
+			last = s
+		}
+	}
+	return
+}
+
+// The offset words that are added to the checkwords of blocks A, B, C, C' and D of each group.
+var offsetWords = [...]uint16{0x0fc, 0x198, 0x168, 0x350, 0x1b4}
+
+const (
+	blockA = iota
+	blockB
+	blockC
+	blockCPrime
+	blockD
+	noBlock
+)
+
+// checkword is the remainder of data times x^10 divided by the generator x^10+x^8+x^7+x^5+x^4+x^3+1.
+func checkword(data uint16) uint16 {
+	reg := uint32(data) << 10
+	for i := 25; i >= 10; i-- {
+		if reg&(1<<uint(i)) != 0 {
+			reg ^= 0x5b9 << uint(i-10)
+		}
+	}
+	return uint16(reg & 0x3ff)
+}
+
+// blockKind is which block the 26 bits of block are, by their offset word, noBlock if its check fails.
+func blockKind(block uint32) int {
+	offset := uint16(block&0x3ff) ^ checkword(uint16(block>>10))
+	for kind, word := range offsetWords {
+		if offset == word {
+			return kind
+		}
+	}
+	return noBlock
+}
+
+// position is where kind comes in a group, C' takes the place of C in the groups of version B.
+func position(kind int) int {
+	if kind >= blockCPrime {
+		return kind - 1
+	}
+	return kind
+}
+
+// decoder puts the bits together into blocks and groups, and keeps what the groups say.
+type decoder struct {
+	pis map[uint16]int
+	// ps is the program service name, sent 2 characters at a time. seen counts how often each pair was
+	// received the same in a row, as it only counts once it was received twice.
+	ps     [8]byte
+	seen   [4]int
+	groups int
+}
+
+func (d *decoder) decodeBits(bits []byte) {
+	var reg uint32
+	synced := false
+	// found is the bit that each block found while not synced ended on, and its position in a group.
+	type found struct{ bit, position int }
+	var candidates []found
+	// while synced, next is the position of the next block in its group, and group holds the blocks so far.
+	next, badBlocks, inBlock := 0, 0, 0
+	var group [4]uint16
+	valid := 0
+	for i, bit := range bits {
+		reg = (reg<<1 | uint32(bit)) & (1<<26 - 1)
+		if i < 25 {
+			continue
+		}
+		if !synced {
+			kind := blockKind(reg)
+			if kind == noBlock {
+				continue
+			}
+			p := position(kind)
+			// synced once two blocks are whole blocks apart and in the order of a group.
+			for _, c := range candidates {
+				if n := i - c.bit; n%26 == 0 && n <= 26*8 && (c.position+n/26)%4 == p {
+					synced = true
+				}
+			}
+			if !synced {
+				candidates = append(candidates, found{i, p})
+				if len(candidates) > 10 {
+					candidates = candidates[1:]
+				}
+				continue
+			}
+			candidates = nil
+			next, badBlocks, inBlock, valid = p, 0, 0, 0
+		} else if inBlock++; inBlock < 26 {
+			continue
+		}
+		inBlock = 0
+		kind := blockKind(reg)
+		if next == 0 {
+			valid = 0
+		}
+		if kind != noBlock && position(kind) == next {
+			group[next] = uint16(reg >> 10)
+			valid |= 1 << uint(next)
+			badBlocks = 0
+		} else if badBlocks++; badBlocks > maxBadBlocks {
+			synced = false
+			continue
+		}
+		if next == 3 && valid == 0xf {
+			d.handleGroup(group)
+		}
+		next = (next + 1) % 4
+	}
+}
+
+// handleGroup keeps the PI of every group and the program service name of the groups of type 0.
+func (d *decoder) handleGroup(group [4]uint16) {
+	d.groups++
+	if d.pis == nil {
+		d.pis = map[uint16]int{}
+	}
+	d.pis[group[0]]++
+	if group[1]>>12 != 0 {
+		return
+	}
+	segment := group[1] & 3
+	chars := [2]byte{byte(group[3] >> 8), byte(group[3])}
+	for i, c := range chars {
+		// the RDS character set is ASCII for what can be printed.
+		if c < 0x20 || c > 0x7e {
+			chars[i] = '?'
+		}
+	}
+	if d.ps[segment*2] == chars[0] && d.ps[segment*2+1] == chars[1] {
+		d.seen[segment]++
+	} else {
+		d.ps[segment*2], d.ps[segment*2+1] = chars[0], chars[1]
+		d.seen[segment] = 1
+	}
+}
+
+func (d *decoder) station() (station Station, ok bool) {
+	station.Groups = d.groups
+	for pi, n := range d.pis {
+		if n >= 2 && n > d.pis[station.PI] {
+			station.PI, ok = pi, true
+		}
+	}
+	if !ok {
+		return
+	}
+	station.CallSign = CallSign(station.PI)
+	for _, n := range d.seen {
+		if n < 2 {
+			return
+		}
+	}
+	station.PS = strings.TrimSpace(string(d.ps[:]))
+	return
+}
+
+// CallSign is the 4 letter call sign that RBDS codes in pi, K or W followed by 3 letters, or empty if pi
+// doesn't code one, as for stations outside North America and those with 3 letter call signs.
+func CallSign(pi uint16) string {
+	var prefix byte
+	n := int(pi)
+	switch {
+	case n >= 0x1000 && n <= 0x54a7:
+		prefix, n = 'K', n-0x1000
+	case n >= 0x54a8 && n <= 0x994f:
+		prefix, n = 'W', n-0x54a8
+	default:
+		return ""
+	}
+	return string([]byte{prefix, byte('A' + n/676), byte('A' + n/26%26), byte('A' + n%26)})
+}
@@ -1,18 +1,35 @@
 package rtlsdr
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// GetAudio fetches a 30 second chunk of raw audio.
-func GetAudio(hostname string, freq int) (audio []byte, err error) {
-	resp, err := http.Get("http://" + hostname + ":8080/audio/" + strconv.Itoa(freq))
+// DefaultPort is the port of the sdr service, used when the hostname passed to the functions here has none.
+const DefaultPort = "8080"
+
+// baseURL is the URL of the sdr service at hostname, a host name or IP address with an optional port.
+func baseURL(hostname string) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return "http://" + hostname
+	}
+	return "http://" + net.JoinHostPort(strings.Trim(hostname, "[]"), DefaultPort)
+}
+
+// GetAudio fetches a 30 second chunk of raw audio from the station at freq Hz.
+func GetAudio(hostname string, freq int64) (audio []byte, err error) {
+	resp, err := http.Get(baseURL(hostname) + "/audio/" + strconv.FormatInt(freq, 10))
 	if err != nil {
 		panic(err)
 	}
@@ -28,6 +45,209 @@ func GetAudio(hostname string, freq int) (audio []byte, err error) {
 	return
 }
 
+// GetAudioInto is like GetAudio, but appends the audio to buf[:0] so that buffers can be reused,
+// and returns any error instead of panicking.
+func GetAudioInto(hostname string, freq int64, buf []byte) (audio []byte, err error) {
+	return GetAudioIntoContext(context.Background(), hostname, freq, buf)
+}
+
+// Mode is how the audio of a station is demodulated.
+type Mode string
+
+const (
+	// ModeWFM is the wide FM of broadcast stations, with the de-emphasis of the Americas.
+	ModeWFM Mode = "wfm"
+	// ModeNFM is the narrow FM of two-way radio and NOAA weather radio, in channels of 12.5 or 25 kHz.
+	ModeNFM Mode = "nfm"
+	// ModeAM is the AM of airband, in channels of 8.33 or 25 kHz.
+	ModeAM Mode = "am"
+)
+
+// ParseMode returns the Mode named name, wfm if it is empty.
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case "":
+		return ModeWFM, nil
+	case ModeWFM, ModeNFM, ModeAM:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown demodulation mode %q, must be wfm, nfm or am", name)
+}
+
+// query is the query that asks the sdr service for audio demodulated in mode, none for wfm, so that sdr services
+// from before the modes are asked the same as before.
+func (mode Mode) query() string {
+	if mode == "" || mode == ModeWFM {
+		return ""
+	}
+	return "mode=" + url.QueryEscape(string(mode))
+}
+
+// Bandwidth is how wide in Hz the channel of a station in mode is, around its frequency.
+func (mode Mode) Bandwidth() int64 {
+	switch mode {
+	case ModeNFM:
+		return 12500
+	case ModeAM:
+		return 8330
+	}
+	return 200000
+}
+
+// GetAudioIntoContext is like GetAudioInto, but gives up once ctx is done, as when its deadline passes.
+func GetAudioIntoContext(ctx context.Context, hostname string, freq int64, buf []byte) (audio []byte, err error) {
+	return GetAudioIntoModeContext(ctx, hostname, freq, ModeWFM, buf)
+}
+
+// GetAudioIntoModeContext is like GetAudioIntoContext, but demodulates the audio in mode. sdr services from before
+// the modes demodulate it as wide FM whatever mode is.
+func GetAudioIntoModeContext(ctx context.Context, hostname string, freq int64, mode Mode, buf []byte) (audio []byte, err error) {
+	path := "/audio/" + strconv.FormatInt(freq, 10)
+	if q := mode.query(); q != "" {
+		path += "?" + q
+	}
+	resp, err := get(ctx, hostname, path)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	audio, err = readInto(resp.Body, buf)
+	if err == nil && len(audio) < 100 {
+		err = errors.New("audio is too short")
+	}
+	return
+}
+
+// readInto appends all of r to buf[:0], which only grows if r is longer than buf.
+func readInto(r io.Reader, buf []byte) (data []byte, err error) {
+	data = buf[:0]
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		var n int
+		n, err = r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// StreamAudio streams seconds of raw audio from the station at freq Hz as the sdr service captures it, so that
+// it can be read as it arrives instead of all of it at the end. Closing it stops the capture, as does ctx
+// being done. The stream is seconds of audio long, 32000 bytes a second, unless the capture fails part way.
+func StreamAudio(ctx context.Context, hostname string, freq int64, seconds float64) (audio io.ReadCloser, err error) {
+	return StreamAudioMode(ctx, hostname, freq, seconds, ModeWFM)
+}
+
+// StreamAudioMode is like StreamAudio, but demodulates the audio in mode.
+func StreamAudioMode(ctx context.Context, hostname string, freq int64, seconds float64, mode Mode) (audio io.ReadCloser, err error) {
+	path := "/stream/" + strconv.FormatInt(freq, 10) + "?seconds=" + strconv.FormatFloat(seconds, 'f', -1, 64)
+	if q := mode.query(); q != "" {
+		path += "&" + q
+	}
+	resp, err := get(ctx, hostname, path)
+	if err != nil {
+		return
+	}
+	return resp.Body, nil
+}
+
+// IQOptions are how the raw IQ samples of a station are captured.
+type IQOptions struct {
+	// SampleRate is how many samples are captured a second, which the dongle can do from 225001 to 300000,
+	// and from 900001 to 3200000.
+	SampleRate int
+	// Gain is the gain of the tuner in dB, 0 is automatic.
+	Gain float32
+	// Seconds is how long the capture lasts.
+	Seconds float64
+}
+
+// DefaultIQ is what the sdr service captures unless it is asked otherwise, a second of 240 kHz around the
+// station, as wide as an FM broadcast channel, with the gain automatic.
+var DefaultIQ = IQOptions{SampleRate: 240000, Seconds: 1}
+
+// MaxIQSeconds is the longest that the sdr service captures IQ samples for.
+const MaxIQSeconds = 10
+
+// Check returns an error if the dongle can't capture with opts.
+func (opts IQOptions) Check() error {
+	if !(opts.SampleRate > 225000 && opts.SampleRate <= 300000) && !(opts.SampleRate > 900000 && opts.SampleRate <= 3200000) {
+		return fmt.Errorf("the dongle can't capture %d samples a second, it can do from 225001 to 300000 and from 900001 to 3200000", opts.SampleRate)
+	}
+	if opts.Gain < 0 || opts.Gain > 50 {
+		return fmt.Errorf("the gain must be from 0, for automatic, to 50 dB, got %v", opts.Gain)
+	}
+	if opts.Seconds <= 0 || opts.Seconds > MaxIQSeconds {
+		return fmt.Errorf("an IQ capture must last over 0 and at most %d seconds, got %v", MaxIQSeconds, opts.Seconds)
+	}
+	return nil
+}
+
+// Samples is how many samples a capture with opts has.
+func (opts IQOptions) Samples() int {
+	return int(math.Round(opts.Seconds * float64(opts.SampleRate)))
+}
+
+// Query is opts as the query of /iq.
+func (opts IQOptions) Query() url.Values {
+	return url.Values{
+		"rate":    {strconv.Itoa(opts.SampleRate)},
+		"gain":    {strconv.FormatFloat(float64(opts.Gain), 'f', -1, 32)},
+		"seconds": {strconv.FormatFloat(opts.Seconds, 'f', -1, 64)},
+	}
+}
+
+// ParseIQOptions reads IQOptions from a query like that of Query. Those of its fields that aren't in query are those of DefaultIQ.
+func ParseIQOptions(query url.Values) (opts IQOptions, err error) {
+	opts = DefaultIQ
+	if v := query.Get("rate"); v != "" {
+		opts.SampleRate, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("bad rate %q, it must be in whole samples a second", v)
+		}
+	}
+	if v := query.Get("gain"); v != "" {
+		gain, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return opts, fmt.Errorf("bad gain %q, it must be in dB", v)
+		}
+		opts.Gain = float32(gain)
+	}
+	if v := query.Get("seconds"); v != "" {
+		opts.Seconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, fmt.Errorf("bad seconds %q", v)
+		}
+	}
+	return opts, opts.Check()
+}
+
+// GetIQContext captures the raw IQ samples centered on freq Hz with opts, and appends them to buf[:0] like
+// GetAudioInto. Each sample is an unsigned byte of I then one of Q, offset by 127.5, as the dongle captures them.
+// It gives up once ctx is done.
+func GetIQContext(ctx context.Context, hostname string, freq int64, opts IQOptions, buf []byte) (iq []byte, err error) {
+	err = opts.Check()
+	if err != nil {
+		return
+	}
+	resp, err := get(ctx, hostname, "/iq/"+strconv.FormatInt(freq, 10)+"?"+opts.Query().Encode())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	iq, err = readInto(resp.Body, buf)
+	if err == nil && len(iq) != opts.Samples()*2 {
+		err = fmt.Errorf("got %d bytes of IQ samples, expected %d", len(iq), opts.Samples()*2)
+	}
+	return
+}
+
 // FreqToIndex converts a frequency to a list index.
 func FreqToIndex(freq float32, data PowerDist) int {
 	percentPos := (freq - data.Low) / (data.High - data.Low)
@@ -35,26 +255,125 @@ func FreqToIndex(freq float32, data PowerDist) int {
 	return index
 }
 
-// GetCeilingSignals fetches the signal power distribution and samples it down to a list of frequencies at which there (probably) exist strong FM signals.
-func GetCeilingSignals(hostname string, celling float32) (stationFreqs []float32, origin string, err error) {
-	data, err := getPower(hostname)
+// ScanRange is the band that a scan for stations covers: the channels from Start to Stop Hz, Step Hz apart,
+// which are stations if their power is over Squelch dB.
+type ScanRange struct {
+	Start   int64
+	Stop    int64
+	Step    int64
+	Squelch float32
+}
+
+// FMBand is the FM broadcast band, which the sdr service scans unless it is asked for another.
+var FMBand = ScanRange{Start: 85900000, Stop: 109900000, Step: 200000, Squelch: -8}
+
+// Check returns an error if r isn't a band that can be scanned.
+func (r ScanRange) Check() error {
+	if r.Start <= 0 || r.Step <= 0 {
+		return fmt.Errorf("the start and step of a scan must be over 0, got %d and %d Hz", r.Start, r.Step)
+	}
+	if r.Stop < r.Start {
+		return fmt.Errorf("the scan stops at %d Hz, before it starts at %d Hz", r.Stop, r.Start)
+	}
+	return nil
+}
+
+// Channels returns the frequencies of the channels in r, from Start up to and including Stop.
+func (r ScanRange) Channels() (freqs []int64) {
+	for freq := r.Start; freq <= r.Stop; freq += r.Step {
+		freqs = append(freqs, freq)
+	}
+	return
+}
+
+// Query is r as the query of /freqs.
+func (r ScanRange) Query() url.Values {
+	return url.Values{
+		"start":   {strconv.FormatInt(r.Start, 10)},
+		"stop":    {strconv.FormatInt(r.Stop, 10)},
+		"step":    {strconv.FormatInt(r.Step, 10)},
+		"squelch": {strconv.FormatFloat(float64(r.Squelch), 'f', -1, 32)},
+	}
+}
+
+// ParseScanRange reads a ScanRange from a query like that of Query. Those of its fields that aren't in query are those of FMBand.
+func ParseScanRange(query url.Values) (r ScanRange, err error) {
+	r = FMBand
+	for _, param := range []struct {
+		Name  string
+		Value *int64
+	}{{"start", &r.Start}, {"stop", &r.Stop}, {"step", &r.Step}} {
+		if v := query.Get(param.Name); v != "" {
+			*param.Value, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return r, fmt.Errorf("bad %s %q, it must be in whole Hz", param.Name, v)
+			}
+		}
+	}
+	if v := query.Get("squelch"); v != "" {
+		squelch, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return r, fmt.Errorf("bad squelch %q, it must be in dB", v)
+		}
+		r.Squelch = float32(squelch)
+	}
+	return r, r.Check()
+}
+
+// GetCeilingSignals fetches the signal power distribution and samples it down to a list of frequencies in Hz at which there (probably) exist strong FM signals.
+func GetCeilingSignals(hostname string, celling float32) (stationFreqs []int64, origin string, err error) {
+	return GetCeilingSignalsContext(context.Background(), hostname, celling)
+}
+
+// GetCeilingSignalsContext is like GetCeilingSignals, but gives up once ctx is done, as when its deadline passes.
+func GetCeilingSignalsContext(ctx context.Context, hostname string, celling float32) (stationFreqs []int64, origin string, err error) {
+	scan := FMBand
+	scan.Squelch = celling
+	return GetCeilingSignalsRangeContext(ctx, hostname, scan)
+}
+
+// GetCeilingSignalsRangeContext is like GetCeilingSignalsContext, but samples the channels of scan instead of
+// those of the FM band. The power distribution of the sdr service only covers 70 to 110 MHz.
+func GetCeilingSignalsRangeContext(ctx context.Context, hostname string, scan ScanRange) (stationFreqs []int64, origin string, err error) {
+	data, err := getPower(ctx, hostname)
 	if err != nil {
 		return
 	}
-	for i := float32(85900000); i < data.High; i += 200000 {
-		dbm := data.Dbm[FreqToIndex(i, data)]
-		if dbm > celling {
-			stationFreqs = append(stationFreqs, i)
+	for _, freq := range scan.Channels() {
+		if float32(freq) < data.Low || float32(freq) >= data.High {
+			continue
+		}
+		dbm := data.Dbm[FreqToIndex(float32(freq), data)]
+		if dbm > scan.Squelch {
+			stationFreqs = append(stationFreqs, freq)
 		}
 	}
 	origin = data.Origin
 	return
 }
 
-// Freqs stores a list of frequencies of stations
+// Freqs stores a list of frequencies of stations in Hz.
 type Freqs struct {
-	Origin string    `json:"origin"`
-	Freqs  []float32 `json:"freqs"`
+	Origin string  `json:"origin"`
+	Freqs  []int64 `json:"freqs"`
+}
+
+// UnmarshalJSON also reads the frequencies of sdr services from before they were whole Hz, which sent them as
+// float32 and so could send them like 8.97e+07.
+func (freqs *Freqs) UnmarshalJSON(data []byte) error {
+	var f struct {
+		Origin string    `json:"origin"`
+		Freqs  []float64 `json:"freqs"`
+	}
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return err
+	}
+	freqs.Origin, freqs.Freqs = f.Origin, nil
+	for _, freq := range f.Freqs {
+		freqs.Freqs = append(freqs.Freqs, int64(math.Round(freq)))
+	}
+	return nil
 }
 
 // PowerDist is the distribution of power of frequency.
@@ -65,12 +384,38 @@ type PowerDist struct {
 	Dbm    []float32 `json:"dbm"`
 }
 
+// StationInfo is what the RDS of a station says about it. PI, PS and CallSign are empty if it has no RDS that decodes.
+type StationInfo struct {
+	Origin string `json:"origin"`
+	Freq   int64  `json:"freq"`
+	// PI is the program identification code in hex, unique to each station in an area.
+	PI string `json:"pi,omitempty"`
+	// PS is the program service name that radios display, like "WXYZ FM".
+	PS string `json:"ps,omitempty"`
+	// CallSign is the call sign that RBDS codes in the PI of North American stations, like WXYZ.
+	CallSign string `json:"callSign,omitempty"`
+}
+
+// GetStationInfo listens to the RDS of the station at freq for 10 seconds, and returns what it says.
+// The sdr service can't capture audio while it does.
+func GetStationInfo(hostname string, freq int64) (info StationInfo, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Second)
+	defer cancel()
+	return GetStationInfoContext(ctx, hostname, freq)
+}
+
+// GetStationInfoContext is like GetStationInfo, but gives up once ctx is done, as when its deadline passes.
+func GetStationInfoContext(ctx context.Context, hostname string, freq int64) (info StationInfo, err error) {
+	err = getJSON(ctx, hostname, "/rds/"+strconv.FormatInt(freq, 10), &info)
+	return
+}
+
 func GetFreqs(hostname string) (freqs Freqs, err error) {
 	timeout := time.Duration(40 * time.Second)
 	client := http.Client{
 		Timeout: timeout,
 	}
-	resp, err := client.Get("http://" + hostname + ":8080/freqs")
+	resp, err := client.Get(baseURL(hostname) + "/freqs")
 	if err != nil {
 		panic(err)
 	}
@@ -88,20 +433,98 @@ func GetFreqs(hostname string) (freqs Freqs, err error) {
 	return
 }
 
-func getPower(hostname string) (power PowerDist, err error) {
-	resp, err := http.Get("http://" + hostname + ":8080/power")
+// GetFreqsContext is like GetFreqs, but gives up once ctx is done, as when its deadline passes, instead of after
+// 40 seconds, and returns any error instead of panicking.
+func GetFreqsContext(ctx context.Context, hostname string) (freqs Freqs, err error) {
+	err = getJSON(ctx, hostname, "/freqs", &freqs)
+	return
+}
+
+// GetFreqsRangeContext is like GetFreqsContext, but scans the channels of scan instead of the FM band.
+// sdr services from before they could scan other bands scan the FM band whatever scan is.
+func GetFreqsRangeContext(ctx context.Context, hostname string, scan ScanRange) (freqs Freqs, err error) {
+	err = scan.Check()
 	if err != nil {
-		panic(err)
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		err = errors.New("bad resp")
+	err = getJSON(ctx, hostname, "/freqs?"+scan.Query().Encode(), &freqs)
+	return
+}
+
+// GetPower fetches the distribution of power from 70 to 110 MHz that the sdr service captures.
+func GetPower(hostname string) (power PowerDist, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Second)
+	defer cancel()
+	return GetPowerContext(ctx, hostname)
+}
+
+// GetPowerContext is like GetPower, but gives up once ctx is done, as when its deadline passes.
+func GetPowerContext(ctx context.Context, hostname string) (power PowerDist, err error) {
+	return getPower(ctx, hostname)
+}
+
+func getPower(ctx context.Context, hostname string) (power PowerDist, err error) {
+	err = getJSON(ctx, hostname, "/power", &power)
+	return
+}
+
+// SignalPower is how strong a station is over the noise around it.
+type SignalPower struct {
+	Origin string `json:"origin"`
+	Freq   int64  `json:"freq"`
+	// PowerDB is the power in the channel of the station, and NoiseDB the median power around it, in dB.
+	PowerDB float32 `json:"powerDB"`
+	NoiseDB float32 `json:"noiseDB"`
+	// SNR is the signal to noise ratio of the station in dB, PowerDB less NoiseDB.
+	SNR float32 `json:"snr"`
+}
+
+// GetSNR measures the power of the station at freq Hz in a channel width Hz wide, and of the noise around it,
+// which takes the sdr service about a second. A width of 0 is the width of an FM broadcast channel.
+func GetSNR(hostname string, freq, width int64) (power SignalPower, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Second)
+	defer cancel()
+	return GetSNRContext(ctx, hostname, freq, width)
+}
+
+// GetSNRContext is like GetSNR, but gives up once ctx is done, as when its deadline passes.
+func GetSNRContext(ctx context.Context, hostname string, freq, width int64) (power SignalPower, err error) {
+	path := "/snr/" + strconv.FormatInt(freq, 10)
+	if width > 0 {
+		path += "?width=" + strconv.FormatInt(width, 10)
+	}
+	err = getJSON(ctx, hostname, path, &power)
+	return
+}
+
+// get GETs path from the sdr service at hostname, and gives up once ctx is done. The caller closes the body
+// of resp, which is only returned if its status is OK.
+func get(ctx context.Context, hostname, path string) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL(hostname)+path, nil)
+	if err != nil {
 		return
 	}
-	jsonByte, err := ioutil.ReadAll(resp.Body)
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(jsonByte, &power)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("bad resp: " + resp.Status)
+	}
 	return
 }
+
+// getJSON GETs path from the sdr service at hostname like get, and decodes its JSON into v.
+func getJSON(ctx context.Context, hostname, path string, v interface{}) error {
+	resp, err := get(ctx, hostname, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	jsonByte, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonByte, v)
+}